@@ -4,6 +4,7 @@
 import requests
 
 url = "http://gerrit-observatory.internal.wandoujia.com/observers"
+token = "xxx"
 
 def main():
     data = {
@@ -17,7 +18,8 @@ def main():
       "comment": "构建 docker 镜像"
     }
     
-    ret = requests.post(url, json=data)
+    headers = {"Authorization": "Bearer %s" % token}
+    ret = requests.post(url, json=data, headers=headers)
     print ret.status_code
 
 
@@ -0,0 +1,578 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gerrit-observatory/log"
+)
+
+// EnvPrefix prefixes the environment variables overriding settings, the
+// variable of gerrit.host is OBSERVATORY_GERRIT_HOST
+const EnvPrefix = "OBSERVATORY_"
+
+// Config holds every setting of the observatory, the config tag is the key
+// of a setting in the file and the name of its flag. Settings tagged
+// reload:"restart" are only applied on start, secret ones are never reported
+type Config struct {
+	GerritHost string `config:"gerrit.host" help:"hostname of the gerrit server"`
+	GerritPort int    `config:"gerrit.port" help:"ssh port of the gerrit server"`
+	GerritUser string `config:"gerrit.user" help:"ssh user streaming the gerrit events"`
+	PrivateKey string `config:"gerrit.private_key" help:"path of the ssh private key of gerrit.user"`
+
+	RedisHost      string `config:"redis.host" reload:"restart" help:"redis host"`
+	RedisPort      int    `config:"redis.port" reload:"restart" help:"redis port"`
+	RedisDB        int    `config:"redis.db" reload:"restart" help:"redis database"`
+	RedisKeyPrefix string `config:"redis.key_prefix" reload:"restart" help:"prefix of every redis key, to share a database"`
+
+	StorageBackend string `config:"storage.backend" reload:"restart" help:"where subscribes, tokens, queues and the event history are stored: redis, file or memory"`
+	StoragePath    string `config:"storage.path" reload:"restart" help:"database of the file storage backend, a JSON snapshot of an older release found there is converted"`
+	StorageMigrate bool   `config:"storage.migrate_on_start" reload:"restart" help:"upgrade what older releases stored on start, otherwise refuse to start until migrated"`
+
+	GitOpsProject string `config:"gitops.project" reload:"restart" help:"gerrit project holding the subscribes manifest, gitops is disabled when empty"`
+	GitOpsBranch  string `config:"gitops.branch" reload:"restart" help:"branch the manifest is applied from"`
+	GitOpsPath    string `config:"gitops.path" reload:"restart" help:"path of the manifest in gitops.project"`
+	GitOpsOwner   string `config:"gitops.owner" reload:"restart" help:"owner of the manifest entries not naming one, each owner needs a token mapped to a gerrit user"`
+	GitOpsOwners  string `config:"gitops.owners" reload:"restart" help:"comma separated owners the manifest entries may name besides gitops.owner, entries naming others are rejected"`
+	GitOpsPrune   bool   `config:"gitops.prune" reload:"restart" help:"archive the subscribes of the declared owners missing from the manifest"`
+	GitOpsLabel   string `config:"gitops.label" reload:"restart" help:"label voted on the changes of the manifest, no vote when empty"`
+
+	HTTPListen string `config:"http.listen" reload:"restart" help:"address the API listens on"`
+	AdminToken string `config:"admin.token" secret:"true" help:"bootstrap admin token, none when empty"`
+	AdminOwner string `config:"admin.owner" help:"owner of the bootstrap admin token"`
+
+	HistoryRetentionHours int `config:"history.retention_hours" help:"hours events are kept in history"`
+	HistoryMaxEvents      int `config:"history.max_events" help:"events kept in history at most"`
+
+	PostTimeout               int `config:"delivery.timeout" help:"seconds a hook has to answer"`
+	DeliveryAttempts          int `config:"delivery.attempts" help:"attempts to deliver an event to a hook"`
+	DeliveryRetryInterval     int `config:"delivery.retry_interval" help:"seconds between delivery attempts, growing linearly"`
+	DeliveryLogRetentionHours int `config:"delivery.log_retention_hours" help:"hours delivery attempts are logged"`
+	DeliveryLogMaxEntries     int `config:"delivery.log_max_entries" help:"delivery attempts logged per subscribe at most"`
+	DeliveryQueueSize         int `config:"delivery.queue_size" help:"events an observer may have pending"`
+	DisableAfterFailures      int `config:"delivery.disable_after_failures" help:"consecutive failed deliveries pausing a subscribe, never when 0"`
+	DisableAfterHours         int `config:"delivery.disable_after_hours" help:"hours of failed deliveries pausing a subscribe, never when 0"`
+	DeliveryConcurrency       int `config:"delivery.concurrency" help:"events an observer delivers at once unless its subscribe says otherwise"`
+	DeliveryMaxConnections    int `config:"delivery.max_connections" help:"POSTs to hooks in flight across the observers"`
+
+	Overflow               string `config:"overflow.policy" help:"what happens to the events a full observer queue can not take: block, spill, drop_oldest, drop_newest or coalesce"`
+	OverflowBlockTimeoutMs int    `config:"overflow.block_timeout_ms" help:"milliseconds the block policy waits for room before dropping the event"`
+
+	BreakerFailures    int    `config:"breaker.failures" help:"failed delivery attempts in a row opening the circuit breaker of an observer, never when 0"`
+	BreakerOpenSeconds int    `config:"breaker.open_seconds" help:"seconds a circuit breaker stays open before the hook is probed"`
+	BreakerMode        string `config:"breaker.mode" help:"what happens to the events matched while a breaker is open: fail or queue"`
+
+	NotifyWebhookURL string `config:"notify.webhook_url" help:"url the notices to the owners of disabled or expired subscribes are POSTed to, they are only logged when empty"`
+
+	ShutdownTimeout int `config:"shutdown.timeout" help:"seconds given to pending deliveries on shutdown before they are persisted"`
+
+	TracingEndpoint    string `config:"tracing.endpoint" help:"OTLP/HTTP traces endpoint, such as http://127.0.0.1:4318/v1/traces, tracing is disabled when empty"`
+	TracingServiceName string `config:"tracing.service_name" help:"service name of the exported spans"`
+
+	LogLevel  string `config:"log.level" help:"one of debug, info, warning and error"`
+	LogJSON   bool   `config:"log.json" help:"write log lines as JSON objects"`
+	LogRedact bool   `config:"log.redact" help:"mask emails in log lines"`
+}
+
+// Default returns the settings used when nothing overrides them
+func Default() *Config {
+	return &Config{
+		GerritPort: 29418,
+		GerritUser: "autodeploy",
+		PrivateKey: "./.id_rsa",
+
+		RedisHost: "127.0.0.1",
+		RedisPort: 6379,
+
+		StorageBackend: "redis",
+		StoragePath:    "observatory.db",
+		StorageMigrate: true,
+
+		GitOpsBranch: "master",
+		GitOpsPath:   "observatory.yaml",
+		GitOpsOwner:  "gitops",
+		GitOpsLabel:  "Verified",
+
+		HTTPListen: ":8080",
+		AdminOwner: "admin",
+
+		HistoryRetentionHours: 72,
+		HistoryMaxEvents:      100000,
+
+		PostTimeout:               60,
+		DeliveryAttempts:          3,
+		DeliveryRetryInterval:     5,
+		DeliveryLogRetentionHours: 168,
+		DeliveryLogMaxEntries:     1000,
+		DeliveryQueueSize:         100,
+		DeliveryConcurrency:       1,
+		DeliveryMaxConnections:    64,
+
+		Overflow:               "drop_newest",
+		OverflowBlockTimeoutMs: 500,
+
+		BreakerFailures:    5,
+		BreakerOpenSeconds: 60,
+		BreakerMode:        "fail",
+
+		ShutdownTimeout: 30,
+
+		TracingServiceName: "gerrit-observatory",
+
+		LogLevel:  "info",
+		LogRedact: true,
+	}
+}
+
+// Error reports one invalid setting along with where it was read from
+type Error struct {
+	Key     string
+	Source  string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Source == "" {
+		return fmt.Sprintf("%s: %s", e.Key, e.Message)
+	}
+	return fmt.Sprintf("%s: %s (from %s)", e.Key, e.Message, e.Source)
+}
+
+// Errors is the validation report of a configuration
+type Errors []*Error
+
+func (errs Errors) Error() string {
+	lines := make([]string, 0, len(errs)+1)
+	lines = append(lines, fmt.Sprintf("invalid configuration, %d error(s):", len(errs)))
+	for _, err := range errs {
+		lines = append(lines, "  "+err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (errs *Errors) add(key string, source string, format string, v ...interface{}) {
+	*errs = append(*errs, &Error{Key: key, Source: source, Message: fmt.Sprintf(format, v...)})
+}
+
+// Load builds the configuration from the defaults, the file given by the
+// -config flag, the environment and the other flags, each overriding the
+// previous ones. Every problem found is returned at once as Errors,
+// flag.ErrHelp is returned when usage was requested
+func Load(args []string, environ []string) (*Config, error) {
+	return load(args, environ, (*Config).Validate)
+}
+
+// LoadStorage is Load for the commands working on the store alone, only the
+// settings of the storage are validated
+func LoadStorage(args []string, environ []string) (*Config, error) {
+	return load(args, environ, (*Config).ValidateStorage)
+}
+
+func load(args []string, environ []string, validate func(*Config) error) (*Config, error) {
+	config := Default()
+	fields := settings(config)
+
+	fs := flag.NewFlagSet("gerrit-observatory", flag.ContinueOnError)
+	path := fs.String("config", "", "path of a TOML config file")
+	for _, f := range fields {
+		if f.value.Kind() == reflect.Bool {
+			fs.Bool(f.key, f.value.Bool(), f.help)
+		} else {
+			fs.String(f.key, fmt.Sprint(f.value.Interface()), f.help)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, Errors{{Key: "args", Message: fmt.Sprintf("unexpected arguments %q", fs.Args())}}
+	}
+
+	var errs Errors
+	if *path != "" {
+		loadFile(*path, fields, &errs)
+	}
+	loadEnv(environ, fields, &errs)
+	fs.Visit(func(fl *flag.Flag) {
+		if f, ok := fields[fl.Name]; ok {
+			if err := setString(f.value, fl.Value.String()); err != nil {
+				errs.add(f.key, "flag -"+fl.Name, "%v", err)
+			}
+		}
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	if err := validate(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// List splits the comma separated value of a setting, blank items are
+// skipped
+func List(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Validate checks every setting, reporting all the invalid ones
+func (config *Config) Validate() error {
+	var errs Errors
+
+	if config.GerritHost == "" {
+		errs.add("gerrit.host", "", "is required")
+	}
+	checkPort(&errs, "gerrit.port", config.GerritPort)
+	if config.GerritUser == "" {
+		errs.add("gerrit.user", "", "is required")
+	}
+	if config.PrivateKey == "" {
+		errs.add("gerrit.private_key", "", "is required")
+	} else if _, err := os.Stat(config.PrivateKey); err != nil {
+		errs.add("gerrit.private_key", "", "is not readable: %v", err)
+	}
+
+	config.validateStorage(&errs)
+
+	if config.GitOpsProject != "" {
+		if strings.ContainsAny(config.GitOpsProject, "'\n") {
+			errs.add("gitops.project", "", "must not contain quotes or newlines")
+		}
+		required := []struct{ key, value string }{
+			{"gitops.branch", config.GitOpsBranch},
+			{"gitops.path", config.GitOpsPath},
+			{"gitops.owner", config.GitOpsOwner},
+		}
+		for _, r := range required {
+			if r.value == "" {
+				errs.add(r.key, "", "is required along with gitops.project")
+			}
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(config.HTTPListen); err != nil {
+		errs.add("http.listen", "", "is not a host:port address: %v", err)
+	}
+	if config.AdminToken != "" && config.AdminOwner == "" {
+		errs.add("admin.owner", "", "is required along with admin.token")
+	}
+
+	checkPositive(&errs, "delivery.timeout", config.PostTimeout)
+	checkPositive(&errs, "delivery.attempts", config.DeliveryAttempts)
+	if config.DeliveryRetryInterval < 0 {
+		errs.add("delivery.retry_interval", "", "must not be negative")
+	}
+	checkPositive(&errs, "delivery.queue_size", config.DeliveryQueueSize)
+	checkPositive(&errs, "delivery.concurrency", config.DeliveryConcurrency)
+	checkPositive(&errs, "delivery.max_connections", config.DeliveryMaxConnections)
+	switch config.Overflow {
+	case "block", "spill", "drop_oldest", "drop_newest", "coalesce":
+	default:
+		errs.add("overflow.policy", "", "must be block, spill, drop_oldest, drop_newest or coalesce")
+	}
+	checkPositive(&errs, "overflow.block_timeout_ms", config.OverflowBlockTimeoutMs)
+	if config.DisableAfterFailures < 0 {
+		errs.add("delivery.disable_after_failures", "", "must not be negative")
+	}
+	if config.DisableAfterHours < 0 {
+		errs.add("delivery.disable_after_hours", "", "must not be negative")
+	}
+	if config.BreakerFailures < 0 {
+		errs.add("breaker.failures", "", "must not be negative")
+	}
+	checkPositive(&errs, "breaker.open_seconds", config.BreakerOpenSeconds)
+	if config.BreakerMode != "fail" && config.BreakerMode != "queue" {
+		errs.add("breaker.mode", "", "must be fail or queue")
+	}
+	if config.NotifyWebhookURL != "" {
+		u, err := url.Parse(config.NotifyWebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add("notify.webhook_url", "", "must be an http or https URL")
+		}
+	}
+	checkPositive(&errs, "shutdown.timeout", config.ShutdownTimeout)
+
+	if config.TracingEndpoint != "" {
+		u, err := url.Parse(config.TracingEndpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add("tracing.endpoint", "", "must be an http or https URL")
+		}
+	}
+	if _, err := log.ParseLevel(config.LogLevel); err != nil {
+		errs.add("log.level", "", "%v", err)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ValidateStorage checks the settings the store is opened with: redis,
+// storage, the event history and the delivery log
+func (config *Config) ValidateStorage() error {
+	var errs Errors
+	config.validateStorage(&errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (config *Config) validateStorage(errs *Errors) {
+	if config.RedisHost == "" {
+		errs.add("redis.host", "", "is required")
+	}
+	checkPort(errs, "redis.port", config.RedisPort)
+	if config.RedisDB < 0 {
+		errs.add("redis.db", "", "must not be negative")
+	}
+	if strings.ContainsAny(config.RedisKeyPrefix, " *?[]") {
+		errs.add("redis.key_prefix", "", "must not contain spaces or glob characters")
+	}
+	switch config.StorageBackend {
+	case "redis", "memory":
+	case "file":
+		if config.StoragePath == "" {
+			errs.add("storage.path", "", "is required by the file backend")
+		}
+	default:
+		errs.add("storage.backend", "", "must be one of redis, file or memory")
+	}
+	checkPositive(errs, "history.retention_hours", config.HistoryRetentionHours)
+	checkPositive(errs, "history.max_events", config.HistoryMaxEvents)
+	checkPositive(errs, "delivery.log_retention_hours", config.DeliveryLogRetentionHours)
+	checkPositive(errs, "delivery.log_max_entries", config.DeliveryLogMaxEntries)
+}
+
+func checkPort(errs *Errors, key string, port int) {
+	if port < 1 || port > 65535 {
+		errs.add(key, "", "must be between 1 and 65535, got %d", port)
+	}
+}
+
+func checkPositive(errs *Errors, key string, n int) {
+	if n <= 0 {
+		errs.add(key, "", "must be positive, got %d", n)
+	}
+}
+
+// Change is a setting differing between two configurations
+type Change struct {
+	Key             string `json:"key"`
+	Old             string `json:"old"`
+	New             string `json:"new"`
+	RestartRequired bool   `json:"restart_required"`
+}
+
+// Diff lists the settings changed from old to new, sorted by key
+func Diff(old *Config, new *Config) []*Change {
+	oldFields, newFields := settings(old), settings(new)
+	changes := make([]*Change, 0)
+	for _, f := range sortedSettings(newFields) {
+		o := oldFields[f.key]
+		if reflect.DeepEqual(o.value.Interface(), f.value.Interface()) {
+			continue
+		}
+		change := &Change{
+			Key:             f.key,
+			Old:             fmt.Sprint(o.value.Interface()),
+			New:             fmt.Sprint(f.value.Interface()),
+			RestartRequired: f.restart,
+		}
+		if f.secret {
+			change.Old, change.New = "<secret>", "<secret>"
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// Live returns a copy of new where the settings requiring a restart keep
+// their value in old, that is the configuration in effect after a reload
+func Live(old *Config, new *Config) *Config {
+	live := *new
+	oldFields := settings(old)
+	for key, f := range settings(&live) {
+		if f.restart {
+			f.value.Set(oldFields[key].value)
+		}
+	}
+	return &live
+}
+
+// setting is one settable field of a Config
+type setting struct {
+	key     string
+	help    string
+	restart bool
+	secret  bool
+	value   reflect.Value
+}
+
+func settings(config *Config) map[string]*setting {
+	fields := make(map[string]*setting)
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("config")
+		if key == "" {
+			continue
+		}
+		tag := t.Field(i).Tag
+		fields[key] = &setting{
+			key:     key,
+			help:    tag.Get("help"),
+			restart: tag.Get("reload") == "restart",
+			secret:  tag.Get("secret") == "true",
+			value:   v.Field(i),
+		}
+	}
+	return fields
+}
+
+// envName returns the environment variable overriding key
+func envName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+func loadEnv(environ []string, fields map[string]*setting, errs *Errors) {
+	env := make(map[string]string, len(environ))
+	for _, kv := range environ {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	for _, f := range sortedSettings(fields) {
+		name := envName(f.key)
+		raw, ok := env[name]
+		if !ok {
+			continue
+		}
+		if err := setString(f.value, raw); err != nil {
+			errs.add(f.key, "env "+name, "%v", err)
+		}
+	}
+}
+
+func loadFile(path string, fields map[string]*setting, errs *Errors) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		errs.add("config", "flag -config", "%v", err)
+		return
+	}
+	values, parseErrs := parseTOML(path, string(raw))
+	*errs = append(*errs, parseErrs...)
+	for _, v := range values {
+		f, ok := fields[v.key]
+		if !ok {
+			errs.add(v.key, v.source, "unknown setting")
+			continue
+		}
+		if err := setValue(f.value, v.value); err != nil {
+			errs.add(v.key, v.source, "%v", err)
+		}
+	}
+}
+
+// setString sets a field from the text of an environment variable or flag
+func setString(field reflect.Value, raw string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", raw)
+		}
+		field.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("expected a boolean, got %q", raw)
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Kind())
+	}
+	return nil
+}
+
+// setValue sets a field from a typed value of the config file
+func setValue(field reflect.Value, value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		if field.Kind() != reflect.String {
+			return fmt.Errorf("expected %s, got string %q", kindName(field.Kind()), v)
+		}
+		field.SetString(v)
+	case int64:
+		if field.Kind() != reflect.Int {
+			return fmt.Errorf("expected %s, got integer %d", kindName(field.Kind()), v)
+		}
+		field.SetInt(v)
+	case bool:
+		if field.Kind() != reflect.Bool {
+			return fmt.Errorf("expected %s, got boolean %t", kindName(field.Kind()), v)
+		}
+		field.SetBool(v)
+	default:
+		return fmt.Errorf("unsupported value %v", value)
+	}
+	return nil
+}
+
+func kindName(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Int:
+		return "an integer"
+	case reflect.Bool:
+		return "a boolean"
+	}
+	return "a string"
+}
+
+func sortedSettings(fields map[string]*setting) []*setting {
+	sorted := make([]*setting, 0, len(fields))
+	for _, f := range fields {
+		sorted = append(sorted, f)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].key < sorted[j].key })
+	return sorted
+}
+
+// ReloadReport tells what a reload changed
+type ReloadReport struct {
+	Changes []*Change `json:"changes"`
+	// Applied are the changed settings in effect, RestartRequired those
+	// waiting for the next start
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+// NewReloadReport sorts changes into a report
+func NewReloadReport(changes []*Change) *ReloadReport {
+	report := &ReloadReport{Changes: changes, Applied: []string{}, RestartRequired: []string{}}
+	for _, change := range changes {
+		if change.RestartRequired {
+			report.RestartRequired = append(report.RestartRequired, change.Key)
+		} else {
+			report.Applied = append(report.Applied, change.Key)
+		}
+	}
+	return report
+}
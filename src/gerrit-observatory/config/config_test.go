@@ -0,0 +1,171 @@
+package config
+
+import (
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, dir string, name string, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "observatory-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := writeFile(t, dir, "id_rsa", "key")
+	path := writeFile(t, dir, "observatory.toml",
+		`[gerrit]
+host = "review.example.com" # inline comment
+port = 29419
+private_key = '`+key+`'
+
+[delivery]
+attempts = 5
+
+[log]
+json = true
+`)
+
+	config, err := Load([]string{"-config", path, "-delivery.attempts", "7", "-log.redact=false"},
+		[]string{"OBSERVATORY_GERRIT_PORT=2222", "OBSERVATORY_DELIVERY_ATTEMPTS=6", "OBSERVATORY_REDIS_DB=4", "PATH=/bin"})
+	assert.Nil(t, err)
+	assert.Equal(t, "review.example.com", config.GerritHost)
+	// the environment overrides the file, the flags override both
+	assert.Equal(t, 2222, config.GerritPort)
+	assert.Equal(t, 7, config.DeliveryAttempts)
+	assert.Equal(t, 4, config.RedisDB)
+	assert.Equal(t, key, config.PrivateKey)
+	assert.True(t, config.LogJSON)
+	assert.False(t, config.LogRedact)
+	// untouched settings keep their defaults
+	assert.Equal(t, ":8080", config.HTTPListen)
+	assert.Equal(t, "autodeploy", config.GerritUser)
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "observatory-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeFile(t, dir, "observatory.toml", `[gerrit]
+port = "29418"
+timeout = 3
+host
+`)
+
+	_, err = Load([]string{"-config", path, "-redis.port", "x"}, []string{"OBSERVATORY_LOG_JSON=maybe"})
+	errs, ok := err.(Errors)
+	assert.True(t, ok)
+	assert.Equal(t, []string{
+		`config: expected key = value, got "host" (from ` + path + `:4)`,
+		`gerrit.port: expected an integer, got string "29418" (from ` + path + `:2)`,
+		`gerrit.timeout: unknown setting (from ` + path + `:3)`,
+		`log.json: expected a boolean, got "maybe" (from env OBSERVATORY_LOG_JSON)`,
+		`redis.port: expected an integer, got "x" (from flag -redis.port)`,
+	}, messages(errs))
+
+	_, err = Load([]string{"-h"}, nil)
+	assert.Equal(t, flag.ErrHelp, err)
+}
+
+func TestLoadStorage(t *testing.T) {
+	// the gerrit settings are not needed to work on the store
+	args := []string{"-storage.backend", "file", "-gerrit.private_key", "/nonexistent/id_rsa"}
+	_, err := Load(args, nil)
+	assert.NotNil(t, err)
+	config, err := LoadStorage(args, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "file", config.StorageBackend)
+
+	_, err = LoadStorage([]string{"-storage.backend", "disk", "-history.max_events", "0"}, nil)
+	errs, ok := err.(Errors)
+	assert.True(t, ok)
+	keys := make([]string, 0, len(errs))
+	for _, err := range errs {
+		keys = append(keys, err.Key)
+	}
+	assert.Equal(t, []string{"storage.backend", "history.max_events"}, keys)
+}
+
+func TestValidate(t *testing.T) {
+	config := Default()
+	config.PrivateKey = "/nonexistent/id_rsa"
+	config.RedisPort = 0
+	config.HTTPListen = "8080"
+	config.DeliveryAttempts = 0
+	config.TracingEndpoint = "localhost:4318"
+	config.LogLevel = "loud"
+
+	errs, ok := config.Validate().(Errors)
+	assert.True(t, ok)
+	keys := make([]string, 0, len(errs))
+	for _, err := range errs {
+		keys = append(keys, err.Key)
+	}
+	assert.Equal(t, []string{"gerrit.host", "gerrit.private_key", "redis.port", "http.listen", "delivery.attempts", "tracing.endpoint", "log.level"}, keys)
+	assert.Contains(t, errs.Error(), "invalid configuration, 7 error(s):\n  gerrit.host: is required\n")
+}
+
+func TestDiffLive(t *testing.T) {
+	old := Default()
+	new := Default()
+	new.RedisPort = 6380
+	new.LogLevel = "debug"
+	new.AdminToken = "s3cret"
+
+	changes := Diff(old, new)
+	assert.Equal(t, []*Change{
+		{Key: "admin.token", Old: "<secret>", New: "<secret>"},
+		{Key: "log.level", Old: "info", New: "debug"},
+		{Key: "redis.port", Old: "6379", New: "6380", RestartRequired: true},
+	}, changes)
+	report := NewReloadReport(changes)
+	assert.Equal(t, []string{"admin.token", "log.level"}, report.Applied)
+	assert.Equal(t, []string{"redis.port"}, report.RestartRequired)
+
+	live := Live(old, new)
+	assert.Equal(t, 6379, live.RedisPort)
+	assert.Equal(t, "debug", live.LogLevel)
+	assert.Equal(t, 6380, new.RedisPort)
+	assert.Empty(t, Diff(old, old))
+}
+
+func TestParseTOML(t *testing.T) {
+	values, errs := parseTOML("test.toml", `a = 'it''s'
+[t]
+b = "x # y" # z
+c = 1_000
+c = 2
+d = -3
+e = [1]
+`)
+	assert.Equal(t, 3, len(errs))
+	assert.Equal(t, "a", errs[0].Key)
+	assert.Equal(t, "t.c", errs[1].Key)
+	assert.Equal(t, "is set twice", errs[1].Message)
+	assert.Equal(t, "t.e", errs[2].Key)
+	assert.Equal(t, 3, len(values))
+	assert.Equal(t, "x # y", values[0].value)
+	assert.Equal(t, int64(1000), values[1].value)
+	assert.Equal(t, int64(-3), values[2].value)
+}
+
+func messages(errs Errors) []string {
+	lines := make([]string, 0, len(errs))
+	for _, err := range errs {
+		lines = append(lines, err.Error())
+	}
+	return lines
+}
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// fileValue is a value read from the config file
+type fileValue struct {
+	key    string
+	source string
+	value  interface{}
+}
+
+// parseTOML reads the subset of TOML settings need: tables, comments and
+// key value pairs of strings, integers and booleans. Keys are returned
+// prefixed by their table, as in gerrit.host
+func parseTOML(name string, content string) ([]*fileValue, Errors) {
+	var (
+		values []*fileValue
+		errs   Errors
+		table  string
+		seen   = make(map[string]bool)
+	)
+	for i, line := range strings.Split(content, "\n") {
+		source := fmt.Sprintf("%s:%d", name, i+1)
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				errs.add("config", source, "invalid table header %q", line)
+				continue
+			}
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq <= 0 {
+			errs.add("config", source, "expected key = value, got %q", line)
+			continue
+		}
+		key := strings.TrimSpace(line[:eq])
+		if table != "" {
+			key = table + "." + key
+		}
+		value, err := parseTOMLValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			errs.add(key, source, "%v", err)
+			continue
+		}
+		if seen[key] {
+			errs.add(key, source, "is set twice")
+			continue
+		}
+		seen[key] = true
+		values = append(values, &fileValue{key: key, source: source, value: value})
+	}
+	return values, errs
+}
+
+func parseTOMLValue(raw string) (interface{}, error) {
+	switch {
+	case raw == "true":
+		return true, nil
+	case raw == "false":
+		return false, nil
+	case strings.HasPrefix(raw, `"`):
+		s, err := strconv.Unquote(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s", raw)
+		}
+		return s, nil
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") || strings.Contains(raw[1:len(raw)-1], "'") {
+			return nil, fmt.Errorf("invalid string %s", raw)
+		}
+		return raw[1 : len(raw)-1], nil
+	}
+	n, err := strconv.ParseInt(strings.Replace(raw, "_", "", -1), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported value %s, expected a string, an integer or a boolean", raw)
+	}
+	return n, nil
+}
+
+// stripComment drops a # comment that is not inside a string
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0 && c == '\\' && quote == '"':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
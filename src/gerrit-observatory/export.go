@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"gerrit-observatory/manifest"
+)
+
+var apiClient = &http.Client{Timeout: 60 * time.Second}
+
+// apiFlags are the flags of the commands talking to a running observatory,
+// so that its observers follow the changes
+type apiFlags struct {
+	url   *string
+	token *string
+}
+
+func newAPIFlags(fs *flag.FlagSet) *apiFlags {
+	defaultURL := os.Getenv("OBSERVATORY_URL")
+	if defaultURL == "" {
+		defaultURL = "http://127.0.0.1:8080"
+	}
+	return &apiFlags{
+		url:   fs.String("url", defaultURL, "address of the observatory API, or $OBSERVATORY_URL"),
+		token: fs.String("token", os.Getenv("OBSERVATORY_TOKEN"), "bearer token, or $OBSERVATORY_TOKEN"),
+	}
+}
+
+func (f *apiFlags) do(method string, path string, query url.Values, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, *f.url+path+"?"+query.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+*f.token)
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s replied %d: %s", method, path, resp.StatusCode, bytes.TrimSpace(raw))
+	}
+	return raw, nil
+}
+
+// runExport is the export command, it writes the manifest of the
+// subscribes the token can access. It returns the exit code
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	api := newAPIFlags(fs)
+	format := fs.String("format", manifest.FormatYAML, "manifest format, yaml or json")
+	output := fs.String("o", "-", "file the manifest is written to, - for stdout")
+	if err := fs.Parse(args); err != nil {
+		return exitCode(err)
+	}
+
+	raw, err := api.do("GET", "/observers/export", url.Values{"format": {*format}}, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *output == "-" {
+		os.Stdout.Write(raw)
+		return 0
+	}
+	if err = ioutil.WriteFile(*output, raw, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// runImport is the import command, it prints the plan of a manifest and
+// applies it when -apply is given. It returns the exit code
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	api := newAPIFlags(fs)
+	file := fs.String("f", "", "manifest to import, in yaml or json, - for stdin")
+	apply := fs.Bool("apply", false, "apply the plan, only print it otherwise")
+	prune := fs.Bool("prune", false, "archive the subscribes missing from the manifest")
+	if err := fs.Parse(args); err != nil {
+		return exitCode(err)
+	}
+	if *file == "" {
+		fmt.Fprintln(os.Stderr, "import: -f is required")
+		fs.Usage()
+		return 2
+	}
+
+	var raw []byte
+	var err error
+	if *file == "-" {
+		raw, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		raw, err = ioutil.ReadFile(*file)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if _, err = manifest.Decode(raw); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *file, err)
+		return 1
+	}
+
+	query := url.Values{"prune": {strconv.FormatBool(*prune)}, "dry_run": {"true"}}
+	for _, dryRun := range []bool{true, false} {
+		query.Set("dry_run", strconv.FormatBool(dryRun))
+		reply, err := api.do("POST", "/observers/import", query, bytes.NewReader(raw))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		var result struct {
+			Plan manifest.Plan `json:"plan"`
+		}
+		if err = json.Unmarshal(reply, &result); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if dryRun {
+			fmt.Print(result.Plan.String())
+			if !*apply || len(result.Plan.Changes) == 0 {
+				if len(result.Plan.Changes) > 0 {
+					fmt.Println("nothing was changed, run again with -apply to import")
+				}
+				return 0
+			}
+			continue
+		}
+		fmt.Printf("applied %d change(s)\n", len(result.Plan.Changes))
+	}
+	return 0
+}
+
+// exitCode maps a flag parsing error to an exit code
+func exitCode(err error) int {
+	if err == flag.ErrHelp {
+		return 0
+	}
+	return 2
+}
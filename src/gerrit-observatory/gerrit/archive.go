@@ -0,0 +1,171 @@
+package gerrit
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var (
+	uploadArchiveCommand = "git-upload-archive '%s'"
+	reviewCommand        = "gerrit review --project '%s' --json %s"
+
+	// ErrFileNotFound is returned by ReadFile when the revision has no such file
+	ErrFileNotFound = errors.New("file not found")
+)
+
+// Review is the vote and message posted on a patch set, labels map a
+// label name such as Verified to its score
+type Review struct {
+	Message string         `json:"message,omitempty"`
+	Labels  map[string]int `json:"labels,omitempty"`
+}
+
+// Review posts review on revision, a commit of project
+func (c *Client) Review(project string, revision string, review *Review) error {
+	if err := checkQuotable(project); err != nil {
+		return err
+	}
+	if !revisionPattern.MatchString(revision) {
+		return fmt.Errorf("invalid revision %q", revision)
+	}
+	raw, err := json.Marshal(review)
+	if err != nil {
+		return err
+	}
+	_, err = c.run(fmt.Sprintf(reviewCommand, project, revision), bytes.NewReader(raw))
+	return err
+}
+
+// ReadFile returns the content of file at revision of project, revision is
+// a branch, a ref or a commit. The file is fetched as a tar archive with
+// git-upload-archive, which gerrit serves when download.archive lists tar
+func (c *Client) ReadFile(project string, revision string, file string) ([]byte, error) {
+	if err := checkQuotable(project); err != nil {
+		return nil, err
+	}
+	file = path.Clean(strings.TrimPrefix(file, "/"))
+	client, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var stdin bytes.Buffer
+	for _, arg := range []string{"--format=tar", revision, file} {
+		writePacket(&stdin, "argument "+arg+"\n")
+	}
+	stdin.WriteString("0000")
+	session.Stdin = &stdin
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	command := fmt.Sprintf(uploadArchiveCommand, project)
+	if err = session.Start(command); err != nil {
+		return nil, err
+	}
+
+	archive, err := readArchive(stdout)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s:%s: %v", command, revision, file, err)
+	}
+	return extractFile(archive, file)
+}
+
+// readArchive reads the reply of git-upload-archive, an ACK then the
+// archive multiplexed on side band 1, band 3 carrying errors
+func readArchive(r io.Reader) ([]byte, error) {
+	status, err := readPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	if msg := strings.TrimSpace(string(status)); msg != "ACK" {
+		return nil, errors.New(strings.TrimPrefix(msg, "NACK "))
+	}
+	if flush, err := readPacket(r); err != nil || flush != nil {
+		return nil, fmt.Errorf("expected a flush after ACK, err: %v", err)
+	}
+
+	var archive bytes.Buffer
+	for {
+		packet, err := readPacket(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(packet) == 0 {
+			return archive.Bytes(), nil
+		}
+		switch packet[0] {
+		case 1:
+			archive.Write(packet[1:])
+		case 3:
+			return nil, errors.New(strings.TrimSpace(string(packet[1:])))
+		}
+	}
+}
+
+// extractFile returns the content of file in a tar archive
+func extractFile(archive []byte, file string) ([]byte, error) {
+	reader := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil, ErrFileNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		if path.Clean(header.Name) == file && header.Typeflag != tar.TypeDir {
+			return ioutil.ReadAll(reader)
+		}
+	}
+}
+
+// writePacket writes data as a pkt-line, prefixed by its length in hex
+func writePacket(w io.Writer, data string) {
+	fmt.Fprintf(w, "%04x%s", len(data)+4, data)
+}
+
+// readPacket reads a pkt-line, a flush packet is returned as nil
+func readPacket(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n, err := strconv.ParseUint(string(size[:]), 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pkt-line length %q", size)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	if n < 4 {
+		return nil, fmt.Errorf("invalid pkt-line length %d", n)
+	}
+	packet := make([]byte, n-4)
+	_, err = io.ReadFull(r, packet)
+	return packet, err
+}
+
+// checkQuotable rejects project names that can not be single quoted in a
+// gerrit command line
+func checkQuotable(project string) error {
+	if project == "" || strings.ContainsAny(project, "'\n") {
+		return fmt.Errorf("invalid project %q", project)
+	}
+	return nil
+}
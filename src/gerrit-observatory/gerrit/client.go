@@ -0,0 +1,102 @@
+package gerrit
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var (
+	lsProjectsCommand = "gerrit ls-projects --type ALL"
+	suexecCommand     = "suexec --as %s -- %s"
+	gerritUserPattern = regexp.MustCompile(`^[A-Za-z0-9._@-]+$`)
+	revisionPattern   = regexp.MustCompile(`^[0-9a-f]{40}$`)
+)
+
+// Client runs one-off gerrit commands over ssh
+type Client struct {
+	sync.Mutex
+	config *ssh.ClientConfig
+	addr   string
+}
+
+// NewClient Client initialize
+func NewClient(port int, user string, hostname string, privateKey string) (client *Client, err error) {
+	creds, err := LoadCredentials(port, user, hostname, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	client = &Client{}
+	client.Configure(creds)
+	return
+}
+
+// Configure sets the server and credentials used by the next commands
+func (c *Client) Configure(creds *Credentials) {
+	c.Lock()
+	defer c.Unlock()
+	c.config = creds.config
+	c.addr = creds.addr
+}
+
+// Run executes command and returns its stdout
+func (c *Client) Run(command string) ([]byte, error) {
+	return c.run(command, nil)
+}
+
+// run executes command with stdin as its input, nil for none
+func (c *Client) run(command string, stdin io.Reader) ([]byte, error) {
+	client, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stdin = stdin
+	session.Stderr = &stderr
+	out, err := session.Output(command)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func (c *Client) dial() (*ssh.Client, error) {
+	c.Lock()
+	config, addr := c.config, c.addr
+	c.Unlock()
+	return ssh.Dial("tcp", addr, config)
+}
+
+// VisibleProjects lists the projects gerritUser is allowed to read, the
+// command is run through suexec so the ssh user needs the "Run As" capability
+func (c *Client) VisibleProjects(gerritUser string) ([]string, error) {
+	if !gerritUserPattern.MatchString(gerritUser) {
+		return nil, fmt.Errorf("invalid gerrit user %q", gerritUser)
+	}
+	out, err := c.Run(fmt.Sprintf(suexecCommand, gerritUser, lsProjectsCommand))
+	if err != nil {
+		return nil, err
+	}
+
+	projects := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if project := strings.TrimSpace(scanner.Text()); project != "" {
+			projects = append(projects, project)
+		}
+	}
+	return projects, scanner.Err()
+}
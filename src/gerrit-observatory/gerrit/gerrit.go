@@ -2,126 +2,385 @@ package gerrit
 
 import (
 	"bufio"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"golang.org/x/crypto/ssh"
 	"io"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"sync"
 	"time"
+
+	"gerrit-observatory/log"
+	"gerrit-observatory/metrics"
+	"gerrit-observatory/trace"
 )
 
 var (
-	gerritCommand = "gerrit stream-events"
+	gerritCommand     = "gerrit stream-events"
+	reconnectInterval = 2 * time.Second
 )
 
-type retriableError error
+// Event is one gerrit event read from stream-events
+type Event struct {
+	ID         string                 `json:"id"`
+	Source     string                 `json:"source"`
+	ReceivedAt time.Time              `json:"received_at"`
+	Data       map[string]interface{} `json:"data"`
+	// Trace is the span the event was decoded in, the spans of its dispatch
+	// and delivery are its children
+	Trace trace.SpanContext `json:"-"`
+}
+
+// NewEvent wraps data into an Event with a fresh id
+func NewEvent(data map[string]interface{}) *Event {
+	return &Event{
+		ID:         newEventID(),
+		ReceivedAt: time.Now(),
+		Data:       data,
+	}
+}
+
+// Type returns the gerrit event type
+func (e *Event) Type() string {
+	t, _ := e.Data["type"].(string)
+	return t
+}
+
+// CreatedOn returns the eventCreatedOn time set by gerrit, or a zero time
+// for versions not reporting it
+func (e *Event) CreatedOn() time.Time {
+	switch createdOn := e.Data["eventCreatedOn"].(type) {
+	case json.Number:
+		if sec, err := createdOn.Int64(); err == nil {
+			return time.Unix(sec, 0)
+		}
+	case float64:
+		return time.Unix(int64(createdOn), 0)
+	}
+	return time.Time{}
+}
+
+// Project returns the name of the project the event belongs to
+func (e *Event) Project() string {
+	for _, key := range []string{"change", "refUpdate"} {
+		if attr, ok := e.Data[key].(map[string]interface{}); ok {
+			if project, ok := attr["project"].(string); ok {
+				return project
+			}
+		}
+	}
+	if project, ok := e.Data["project"].(string); ok {
+		return project
+	}
+	if project, ok := e.Data["projectName"].(string); ok {
+		return project
+	}
+	return ""
+}
+
+func newEventID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(buf)
+}
 
 // EventStream struct
 type EventStream struct {
-	Channel chan map[string]interface{}
+	sync.Mutex
+	Channel chan *Event
 	config  *ssh.ClientConfig
 	addr    string
+	source  string
 	deamon  bool
+	// client is the connection being streamed, reconfigured tells Run to
+	// reconnect after Configure closed it
+	client       *ssh.Client
+	reconfigured bool
+	// stop is closed by Stop, stopped once Run returned
+	stop    chan struct{}
+	stopped chan struct{}
+
+	connectedSince time.Time
+	lastEventTime  time.Time
+	reconnects     int
+	lastError      string
+}
+
+// StreamStatus reports the connection of a stream to its gerrit server
+type StreamStatus struct {
+	Source         string     `json:"source"`
+	Connected      bool       `json:"connected"`
+	ConnectedSince *time.Time `json:"connected_since,omitempty"`
+	LastEventTime  *time.Time `json:"last_event_time,omitempty"`
+	Reconnects     int        `json:"reconnects"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+// Status reports the connection state of es
+func (es *EventStream) Status() StreamStatus {
+	es.Lock()
+	defer es.Unlock()
+
+	status := StreamStatus{
+		Source:     es.source,
+		Connected:  !es.connectedSince.IsZero(),
+		Reconnects: es.reconnects,
+		LastError:  es.lastError,
+	}
+	if status.Connected {
+		since := es.connectedSince
+		status.ConnectedSince = &since
+	}
+	if !es.lastEventTime.IsZero() {
+		last := es.lastEventTime
+		status.LastEventTime = &last
+	}
+	return status
 }
 
 // NewEventStream EventStream initialize
 func NewEventStream(port int, user string, hostname string, privateKey string) (eventStream *EventStream, err error) {
-	signer, err := makeSigner(privateKey)
+	creds, err := LoadCredentials(port, user, hostname, privateKey)
 	if err != nil {
-		return
+		return nil, err
+	}
+	eventStream = &EventStream{
+		Channel: make(chan *Event, 100),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
 	}
+	eventStream.Configure(creds)
+	return
+}
 
-	sshConfig := &ssh.ClientConfig{
-		User: user,
-		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+// Configure sets the server and credentials of es, a running stream is
+// reconnected with them, the events already read stay queued in es.Channel
+func (es *EventStream) Configure(creds *Credentials) {
+	es.Lock()
+	es.config = creds.config
+	es.addr = creds.addr
+	es.source = creds.source
+	client := es.client
+	if client != nil {
+		es.reconfigured = true
 	}
-	sshConfig.SetDefaults()
+	es.Unlock()
 
-	eventStream = &EventStream{
-		addr:    fmt.Sprintf("%s:%d", hostname, port),
-		Channel: make(chan map[string]interface{}, 100),
-		config:  sshConfig,
+	if client != nil {
+		log.Logger.With(log.Fields{log.FieldSource: creds.source}).Infof("event stream reconfigured, reconnecting")
+		client.Close()
 	}
-	return
 }
 
 // SetDeamon recover es.Run if loop exit
 func (es *EventStream) SetDeamon() {
+	es.Lock()
+	defer es.Unlock()
 	es.deamon = true
 }
 
-// Run eventStream loop
+// Stop closes the ssh session and waits for Run to return, es.Channel is
+// closed once every event read is queued
+func (es *EventStream) Stop() {
+	close(es.stop)
+	<-es.stopped
+	close(es.Channel)
+	log.Logger.Infof("event stream stopped")
+}
+
+// Run eventStream loop, it returns when the connection is lost unless
+// SetDeamon was called, in which case it reconnects forever, until Stop
 func (es *EventStream) Run() {
-	defer func() {
-		if e := recover(); e != nil {
-			fmt.Printf("panic in EventStream: %s \n", e)
-			if _, ok := e.(retriableError); ok && es.deamon {
-				// log here
-				time.Sleep(time.Second * 2)
-				go es.Run()
+	defer close(es.stopped)
+	for {
+		err := es.stream()
+		select {
+		case <-es.stop:
+			return
+		default:
+		}
+
+		es.Lock()
+		if err != nil {
+			es.lastError = err.Error()
+		}
+		retry := es.deamon || es.reconfigured
+		reconfigured := es.reconfigured
+		es.reconfigured = false
+		source := es.source
+		es.Unlock()
+
+		logger := log.Logger.With(log.Fields{log.FieldSource: source})
+		if !retry {
+			logger.Errorf("event stream stopped, err: %v", err)
+			return
+		}
+		if !reconfigured {
+			logger.Warningf("event stream stopped, reconnecting in %s, err: %v", reconnectInterval, err)
+			select {
+			case <-time.After(reconnectInterval):
+			case <-es.stop:
+				return
 			}
 		}
-	}()
+		metrics.StreamReconnects.Inc(source)
+		es.Lock()
+		es.reconnects++
+		es.Unlock()
+	}
+}
+
+// stream runs gerrit stream-events over one connection until it ends
+func (es *EventStream) stream() error {
+	es.Lock()
+	config, addr, source := es.config, es.addr, es.source
+	es.Unlock()
 
-	client, err := ssh.Dial("tcp", es.addr, es.config)
+	client, err := ssh.Dial("tcp", addr, config)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer client.Close()
-	go es.createSession(client)
 
-	err = client.Conn.Wait()
-	if err != nil {
-		panic(err)
+	es.Lock()
+	if es.config != config {
+		// reconfigured while dialing
+		es.reconfigured = true
+		es.Unlock()
+		return fmt.Errorf("configuration changed")
 	}
-}
-
-func (es *EventStream) createSession(client *ssh.Client) {
-	for {
-		session, err := client.NewSession()
-		if err != nil {
-			panic(err)
-		}
-		defer session.Close()
-		session.Stdout = nil
-		session.Stderr = nil
-		stdout, err := session.StdoutPipe()
-		if err != nil {
-			panic(err)
+	es.client = client
+	es.Unlock()
+	defer func() {
+		es.Lock()
+		if es.client == client {
+			es.client = nil
 		}
-		stderr, err := session.StderrPipe()
-		if err != nil {
-			panic(err)
+		es.connectedSince = time.Time{}
+		es.Unlock()
+	}()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		return err
+	}
+	go es.stderrParser(stderr, source)
+	if err = session.Start(gerritCommand); err != nil {
+		return err
+	}
+	streamed := make(chan struct{})
+	defer close(streamed)
+	go func() {
+		select {
+		case <-es.stop:
+			session.Signal(ssh.SIGTERM)
+			session.Close()
+			client.Close()
+		case <-streamed:
 		}
-		go es.stdoutParser(stdout)
-		go es.stderrParser(stderr)
-		session.Start(gerritCommand)
-		session.Wait()
+	}()
+	log.Logger.With(log.Fields{log.FieldSource: source}).Infof("event stream connected to %s", addr)
+	es.Lock()
+	es.connectedSince = time.Now()
+	es.Unlock()
+
+	parseErr := es.stdoutParser(stdout, source)
+	waitErr := session.Wait()
+	if parseErr != nil && parseErr != io.EOF {
+		return parseErr
+	}
+	if waitErr != nil {
+		return waitErr
 	}
+	return fmt.Errorf("%s exited", gerritCommand)
 }
 
-func (es *EventStream) stdoutParser(stdout io.Reader) {
-	var raw = make(map[string]interface{})
+// stdoutParser queues the events read from stdout until it is closed
+func (es *EventStream) stdoutParser(stdout io.Reader, source string) error {
 	decoder := json.NewDecoder(stdout)
 	decoder.UseNumber()
 	for {
+		var raw = make(map[string]interface{})
 		err := decoder.Decode(&raw)
 		if err != nil {
-			// log here
-			fmt.Printf("%s\n", err)
-			return
+			return err
 		}
-		es.Channel <- raw
+		event := NewEvent(raw)
+		event.Source = source
+		es.Lock()
+		es.lastEventTime = event.ReceivedAt
+		es.Unlock()
+		span := trace.StartSpanAt(trace.SpanContext{}, "gerrit.decode", trace.KindConsumer, event.ReceivedAt)
+		span.SetAttribute("event.id", event.ID)
+		span.SetAttribute("event.type", event.Type())
+		span.SetAttribute("event.source", event.Source)
+		span.SetAttribute("event.project", event.Project())
+		event.Trace = span.Context()
+		metrics.EventsReceived.Inc(event.Type(), event.Source)
+		if createdOn := event.CreatedOn(); !createdOn.IsZero() {
+			metrics.StreamLag.Set(event.ReceivedAt.Sub(createdOn).Seconds(), event.Source)
+		}
+		log.Logger.With(log.Fields{log.FieldEventID: event.ID, log.FieldSource: event.Source}).Debugf("event %s received", event.Type())
+		es.Channel <- event
+		span.End()
 	}
 }
 
-func (es *EventStream) stderrParser(stderr io.Reader) {
+func (es *EventStream) stderrParser(stderr io.Reader, source string) {
+	logger := log.Logger.With(log.Fields{log.FieldSource: source})
 	scanner := bufio.NewScanner(stderr)
 	for scanner.Scan() {
-		//log here
-		fmt.Printf("stderr: %s \n", scanner.Text())
+		logger.Warningf("gerrit stderr: %s", scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Errorf("gerrit stderr not read, err: %v", err)
+	}
+}
+
+// Credentials are the server and ssh credentials of a gerrit, read once so
+// a client and an event stream are configured alike
+type Credentials struct {
+	addr   string
+	source string
+	config *ssh.ClientConfig
+}
+
+// LoadCredentials reads privateKey, the key of user on the gerrit server at
+// hostname:port
+func LoadCredentials(port int, user string, hostname string, privateKey string) (*Credentials, error) {
+	sshConfig, err := newSSHConfig(user, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Credentials{addr: fmt.Sprintf("%s:%d", hostname, port), source: hostname, config: sshConfig}, nil
+}
+
+func newSSHConfig(user string, privateKey string) (*ssh.ClientConfig, error) {
+	signer, err := makeSigner(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	sshConfig := &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
 	}
+	sshConfig.SetDefaults()
+	return sshConfig, nil
 }
 
 func makeSigner(keyname string) (signer ssh.Signer, err error) {
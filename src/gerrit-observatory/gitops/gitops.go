@@ -0,0 +1,286 @@
+package gitops
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"gerrit-observatory/gerrit"
+	"gerrit-observatory/log"
+	"gerrit-observatory/manifest"
+	"gerrit-observatory/metrics"
+	"gerrit-observatory/redis"
+	"gerrit-observatory/store"
+)
+
+const zeroRevision = "0000000000000000000000000000000000000000"
+
+// Source reads the manifest from gerrit, reviews its changes and lists the
+// projects the owners can read, it is the gerrit.Client of the observatory
+type Source interface {
+	ReadFile(project string, revision string, file string) ([]byte, error)
+	Review(project string, revision string, review *gerrit.Review) error
+	VisibleProjects(gerritUser string) ([]string, error)
+}
+
+// Settings locate the manifest in gerrit, entries without an owner belong
+// to Owner. Entries may only name Owner or one of Owners, pushing to the
+// manifest grants no more. Label is voted on the changes of the manifest,
+// none when empty.
+// The subscribes created for an owner are bounded by the gerrit user its
+// tokens map it to, an owner without one can not be given new subscribes
+type Settings struct {
+	Project string
+	Branch  string
+	Path    string
+	Owner   string
+	Owners  []string
+	Prune   bool
+	Label   string
+}
+
+// Reconciler keeps the subscribes in line with the manifest of a branch:
+// the subscribes are reconciled when the branch is updated, and the patch
+// sets modifying the manifest are reviewed with the plan or the problems
+type Reconciler struct {
+	settings  Settings
+	ref       string
+	source    Source
+	observers manifest.Observers
+}
+
+// NewReconciler returns the reconciler of the manifest settings locate
+func NewReconciler(settings Settings, source Source, observers manifest.Observers) *Reconciler {
+	return &Reconciler{
+		settings:  settings,
+		ref:       "refs/heads/" + strings.TrimPrefix(settings.Branch, "refs/heads/"),
+		source:    source,
+		observers: observers,
+	}
+}
+
+// Run reconciles the subscribes with the tip of the branch, catching up on
+// the updates missed while stopped, then handles events until closed
+func (r *Reconciler) Run(events <-chan *gerrit.Event) {
+	if _, err := r.Reconcile(r.ref); err != nil {
+		r.logger().Errorf("subscribes not reconciled on start, err: %v", err)
+	}
+	for msg := range events {
+		r.Handle(msg)
+	}
+}
+
+// Handle reconciles the subscribes on a ref-updated event of the branch and
+// reviews the patch sets created on it
+func (r *Reconciler) Handle(msg *gerrit.Event) {
+	switch msg.Type() {
+	case "ref-updated":
+		refName, newRev := field(msg.Data, "refUpdate", "refName"), field(msg.Data, "refUpdate", "newRev")
+		if msg.Project() != r.settings.Project || newRev == zeroRevision ||
+			refName != r.ref && "refs/heads/"+refName != r.ref {
+			return
+		}
+		if _, err := r.Reconcile(newRev); err != nil {
+			r.logger().With(log.Fields{"revision": newRev}).Errorf("subscribes not reconciled, err: %v", err)
+		}
+	case "patchset-created":
+		if msg.Project() != r.settings.Project || "refs/heads/"+field(msg.Data, "change", "branch") != r.ref {
+			return
+		}
+		revision := field(msg.Data, "patchSet", "revision")
+		if err := r.Review(revision, field(msg.Data, "patchSet", "ref"), parent(msg.Data)); err != nil {
+			r.logger().With(log.Fields{"revision": revision}).Errorf("patch set not reviewed, err: %v", err)
+		}
+	}
+}
+
+// Reconcile applies the manifest at revision of the branch. An invalid
+// manifest changes nothing, its problems are returned as an error
+func (r *Reconciler) Reconcile(revision string) (*manifest.Plan, error) {
+	logger := r.logger().With(log.Fields{"revision": revision})
+	raw, err := r.source.ReadFile(r.settings.Project, revision, r.settings.Path)
+	if err != nil {
+		metrics.GitOpsReconciles.Inc("failed")
+		return nil, err
+	}
+	plan, problems, err := r.plan(raw)
+	if err != nil {
+		metrics.GitOpsReconciles.Inc("failed")
+		return nil, err
+	}
+	if len(problems) > 0 {
+		metrics.GitOpsReconciles.Inc("invalid")
+		return nil, fmt.Errorf("invalid manifest %s, %s", r.settings.Path, strings.Join(problems, "; "))
+	}
+	applied, err := manifest.Apply(plan, r.observers, r.visibility)
+	if err != nil {
+		metrics.GitOpsReconciles.Inc("failed")
+		return nil, fmt.Errorf("%d of %d changes applied, %v", applied, len(plan.Changes), err)
+	}
+	metrics.GitOpsReconciles.Inc("applied")
+	if applied > 0 {
+		logger.Infof("subscribes reconciled, %d change(s), %d unchanged", applied, plan.Unchanged)
+	} else {
+		logger.Debugf("subscribes already reconciled")
+	}
+	return plan, nil
+}
+
+// Review votes on the patch set revision, fetched from ref, when it changes
+// the manifest of parent. The plan merging it would apply is reported,
+// or the problems of the manifest
+func (r *Reconciler) Review(revision string, ref string, parent string) error {
+	raw, err := r.source.ReadFile(r.settings.Project, ref, r.settings.Path)
+	if err != nil && err != gerrit.ErrFileNotFound {
+		return err
+	}
+	if parent != "" {
+		old, errOld := r.source.ReadFile(r.settings.Project, parent, r.settings.Path)
+		if errOld != nil && errOld != gerrit.ErrFileNotFound {
+			return errOld
+		}
+		if err == errOld && bytes.Equal(raw, old) {
+			return nil
+		}
+	}
+
+	var problems []string
+	var plan *manifest.Plan
+	if err == gerrit.ErrFileNotFound {
+		problems = []string{"the manifest is deleted, the subscribes would no longer follow the branch"}
+	} else if plan, problems, err = r.plan(raw); err != nil {
+		return err
+	}
+
+	review := &gerrit.Review{}
+	score := 1
+	if len(problems) > 0 {
+		score = -1
+		review.Message = fmt.Sprintf("%s is invalid:\n\n* %s\n", r.settings.Path, strings.Join(problems, "\n* "))
+	} else {
+		review.Message = fmt.Sprintf("%s is valid, once merged:\n\n%s", r.settings.Path, plan)
+	}
+	if r.settings.Label != "" {
+		review.Labels = map[string]int{r.settings.Label: score}
+	}
+	r.logger().With(log.Fields{"revision": revision}).Infof("patch set reviewed with %d, %d problem(s)", score, len(problems))
+	return r.source.Review(r.settings.Project, revision, review)
+}
+
+// plan decodes and validates raw, then plans its import against the
+// subscribes of the owners it declares. Entries naming an owner out of the
+// settings are problems, the subscribes of that owner are left alone
+func (r *Reconciler) plan(raw []byte) (*manifest.Plan, []string, error) {
+	m, err := manifest.Decode(raw)
+	if err != nil {
+		return nil, []string{err.Error()}, nil
+	}
+	allowed := map[string]bool{r.settings.Owner: true}
+	for _, owner := range r.settings.Owners {
+		allowed[owner] = true
+	}
+	var problems []string
+	owners := map[string]bool{r.settings.Owner: true}
+	for i, e := range m.Observers {
+		if e.Owner == "" {
+			continue
+		}
+		if !allowed[e.Owner] {
+			problems = append(problems, fmt.Sprintf("observers[%d].owner: %s is not an owner of the manifest", i, e.Owner))
+			continue
+		}
+		owners[e.Owner] = true
+	}
+	subscribes, err := store.Subscriptions.List()
+	if err != nil {
+		return nil, nil, err
+	}
+	current := make([]*redis.Subscribe, 0, len(subscribes))
+	for _, sub := range subscribes {
+		if owners[sub.Owner] {
+			current = append(current, sub)
+		}
+	}
+
+	errs := m.Validate()
+	plan, planErrs := manifest.MakePlan(current, m, r.settings.Owner, r.settings.Prune)
+	for _, e := range append(errs, planErrs...) {
+		problems = append(problems, e.Error())
+	}
+	users, err := gerritUsers()
+	if err != nil {
+		return nil, nil, err
+	}
+	unmapped := make(map[string]bool)
+	for _, change := range plan.Changes {
+		if _, ok := users[change.Owner]; !ok && allowed[change.Owner] && change.Action == manifest.ActionCreate && !unmapped[change.Owner] {
+			unmapped[change.Owner] = true
+			problems = append(problems, fmt.Sprintf("owner %s has no token mapped to a gerrit user, its subscribes can not be bounded", change.Owner))
+		}
+	}
+	return plan, problems, nil
+}
+
+// visibility resolves the gerrit user of owner and the projects it can
+// read, reconciled subscribes are never created unbounded
+func (r *Reconciler) visibility(owner string) (string, []string, error) {
+	users, err := gerritUsers()
+	if err != nil {
+		return "", nil, err
+	}
+	gerritUser, ok := users[owner]
+	if !ok {
+		return "", nil, fmt.Errorf("owner %s has no token mapped to a gerrit user", owner)
+	}
+	projects, err := r.source.VisibleProjects(gerritUser)
+	if err != nil {
+		return "", nil, err
+	}
+	return gerritUser, projects, nil
+}
+
+// gerritUsers maps the owners to the gerrit user of their tokens, owners
+// whose tokens map them to none or to several are left out
+func gerritUsers() (map[string]string, error) {
+	tokens, err := store.Subscriptions.GetTokens()
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]string)
+	ambiguous := make(map[string]bool)
+	for _, token := range tokens {
+		if token.GerritUser == "" {
+			continue
+		}
+		if user, ok := users[token.Owner]; ok && user != token.GerritUser {
+			ambiguous[token.Owner] = true
+		}
+		users[token.Owner] = token.GerritUser
+	}
+	for owner := range ambiguous {
+		delete(users, owner)
+	}
+	return users, nil
+}
+
+func (r *Reconciler) logger() *log.Entry {
+	return log.Logger.With(log.Fields{"project": r.settings.Project, "path": r.settings.Path})
+}
+
+// field returns the string attribute name of the object key of data
+func field(data map[string]interface{}, key string, name string) string {
+	attr, _ := data[key].(map[string]interface{})
+	value, _ := attr[name].(string)
+	return value
+}
+
+// parent returns the first parent of the patch set of data
+func parent(data map[string]interface{}) string {
+	patchSet, _ := data["patchSet"].(map[string]interface{})
+	parents, _ := patchSet["parents"].([]interface{})
+	if len(parents) == 0 {
+		return ""
+	}
+	first, _ := parents[0].(string)
+	return first
+}
@@ -0,0 +1,230 @@
+package gitops
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"gerrit-observatory/gerrit"
+	"gerrit-observatory/redis"
+	"gerrit-observatory/store"
+)
+
+const (
+	manifestV1 = `version: 1
+observers:
+  - name: builds
+    filter:
+      type: patchset-created
+    hook_url: http://ci.example.com/hook
+`
+	manifestV2 = `version: 1
+observers:
+  - name: refs
+    owner: release
+    filter:
+      type: ref-updated
+    hook_url: http://release.example.com/hook
+`
+	invalidManifest = `version: 1
+observers:
+  - name: Builds
+    filter:
+      type: patchset-created
+    hook_url: ftp://ci.example.com/hook
+`
+)
+
+type fakeSource struct {
+	files    map[string]string
+	reviews  map[string]*gerrit.Review
+	projects map[string][]string
+}
+
+func (s *fakeSource) ReadFile(project string, revision string, file string) ([]byte, error) {
+	content, ok := s.files[project+":"+revision+":"+file]
+	if !ok {
+		return nil, gerrit.ErrFileNotFound
+	}
+	return []byte(content), nil
+}
+
+func (s *fakeSource) Review(project string, revision string, review *gerrit.Review) error {
+	s.reviews[revision] = review
+	return nil
+}
+
+func (s *fakeSource) VisibleProjects(gerritUser string) ([]string, error) {
+	return s.projects[gerritUser], nil
+}
+
+type fakeObservers map[int]bool
+
+func (o fakeObservers) AddObserver(sub *redis.Subscribe) error {
+	o[sub.ID] = true
+	return nil
+}
+
+func (o fakeObservers) UpdateObserver(sub *redis.Subscribe) error {
+	o[sub.ID] = true
+	return nil
+}
+
+func (o fakeObservers) DetachObserver(id int) {
+	delete(o, id)
+}
+
+func setup() (*Reconciler, *fakeSource, fakeObservers) {
+	store.Subscriptions = store.NewMemoryStore()
+	store.Subscriptions.SaveToken("ci-secret", &redis.Token{Owner: "gitops", GerritUser: "ci-bot"})
+	store.Subscriptions.SaveToken("release-secret", &redis.Token{Owner: "release", GerritUser: "release-bot"})
+	source := &fakeSource{files: map[string]string{}, reviews: map[string]*gerrit.Review{}, projects: map[string][]string{
+		"ci-bot":      {"loki", "orion/crawler"},
+		"release-bot": {"release/tools"},
+	}}
+	observers := fakeObservers{}
+	settings := Settings{Project: "infra/observatory", Branch: "master", Path: "observatory.yaml", Owner: "gitops", Owners: []string{"release"}, Prune: true, Label: "Verified"}
+	return NewReconciler(settings, source, observers), source, observers
+}
+
+func refUpdated(project string, refName string, newRev string) *gerrit.Event {
+	return gerrit.NewEvent(map[string]interface{}{
+		"type":      "ref-updated",
+		"refUpdate": map[string]interface{}{"project": project, "refName": refName, "newRev": newRev},
+	})
+}
+
+func patchSetCreated(branch string, revision string, parent string) *gerrit.Event {
+	return gerrit.NewEvent(map[string]interface{}{
+		"type":   "patchset-created",
+		"change": map[string]interface{}{"project": "infra/observatory", "branch": branch},
+		"patchSet": map[string]interface{}{
+			"revision": revision,
+			"ref":      "refs/changes/01/1/" + revision,
+			"parents":  []interface{}{parent},
+		},
+	})
+}
+
+func TestReconcile(t *testing.T) {
+	r, source, observers := setup()
+	source.files["infra/observatory:aaa:observatory.yaml"] = manifestV1
+	source.files["infra/observatory:bbb:observatory.yaml"] = manifestV2
+
+	r.Handle(refUpdated("infra/observatory", "refs/heads/master", "aaa"))
+	subscribes, err := store.Subscriptions.List()
+	assert.Nil(t, err)
+	assert.Len(t, subscribes, 1)
+	assert.Equal(t, "gitops", subscribes[0].Owner)
+	assert.Equal(t, "builds", subscribes[0].Detail.Name)
+	assert.Equal(t, "ci-bot", subscribes[0].GerritUser)
+	assert.Equal(t, []string{"loki", "orion/crawler"}, subscribes[0].VisibleProjects)
+	assert.Equal(t, fakeObservers{subscribes[0].ID: true}, observers)
+
+	plan, err := r.Reconcile("aaa")
+	assert.Nil(t, err)
+	assert.Empty(t, plan.Changes)
+
+	r.Handle(refUpdated("infra/other", "refs/heads/master", "bbb"))
+	r.Handle(refUpdated("infra/observatory", "refs/heads/stable", "bbb"))
+	r.Handle(refUpdated("infra/observatory", "master", "0000000000000000000000000000000000000000"))
+	subscribes, _ = store.Subscriptions.List()
+	assert.Len(t, subscribes, 1)
+
+	// the subscribes pruned are archived, and restored once declared again
+	r.Handle(refUpdated("infra/observatory", "master", "bbb"))
+	subscribes, _ = store.Subscriptions.List()
+	assert.Len(t, subscribes, 2)
+	assert.Equal(t, redis.StateArchived, subscribes[0].State)
+	assert.Equal(t, "pruned from the manifest", subscribes[0].StateReason)
+	assert.Equal(t, "release", subscribes[1].Owner)
+	assert.Equal(t, []string{"release/tools"}, subscribes[1].VisibleProjects)
+	assert.Equal(t, fakeObservers{subscribes[1].ID: true}, observers)
+	plan, err = r.Reconcile("aaa")
+	assert.Nil(t, err)
+	assert.Equal(t, "restore gitops/builds (id 1)\n0 to create, 0 to update, 1 to restore, 0 to archive, 0 unchanged\n", plan.String())
+	subscribes, _ = store.Subscriptions.List()
+	assert.Equal(t, redis.StateActive, subscribes[0].State)
+	assert.Equal(t, fakeObservers{subscribes[0].ID: true, subscribes[1].ID: true}, observers)
+
+	// a manifest missing from the branch or invalid changes nothing
+	_, err = r.Reconcile("ccc")
+	assert.Equal(t, gerrit.ErrFileNotFound, err)
+	source.files["infra/observatory:ddd:observatory.yaml"] = invalidManifest
+	_, err = r.Reconcile("ddd")
+	assert.Contains(t, err.Error(), "observers[0].hook_url: scheme must be http or https")
+	subscribes, _ = store.Subscriptions.List()
+	assert.Equal(t, redis.StateActive, subscribes[0].State)
+	assert.Equal(t, redis.StateActive, subscribes[1].State)
+}
+
+func TestReconcileUnmappedOwner(t *testing.T) {
+	r, source, observers := setup()
+	r.settings.Owners = append(r.settings.Owners, "nobody")
+	source.files["infra/observatory:aaa:observatory.yaml"] = strings.Replace(manifestV2, "owner: release", "owner: nobody", 1)
+
+	// subscribes are never created without the projects of their owner
+	_, err := r.Reconcile("aaa")
+	assert.Contains(t, err.Error(), "owner nobody has no token mapped to a gerrit user")
+	subscribes, _ := store.Subscriptions.List()
+	assert.Empty(t, subscribes)
+	assert.Empty(t, observers)
+
+	source.files["infra/observatory:refs/changes/01/1/bbb:observatory.yaml"] = source.files["infra/observatory:aaa:observatory.yaml"]
+	r.Handle(patchSetCreated("master", "bbb", ""))
+	assert.Equal(t, map[string]int{"Verified": -1}, source.reviews["bbb"].Labels)
+}
+
+func TestReconcileForeignOwner(t *testing.T) {
+	r, source, observers := setup()
+	store.Subscriptions.SaveToken("payments-secret", &redis.Token{Owner: "payments", GerritUser: "payments-bot"})
+	detail := redis.SubscribeDetail{Name: "charges", Filter: map[string]interface{}{"type": "ref-updated"}, HookURL: "http://payments.example.com/hook"}
+	id, err := store.Subscriptions.Save("payments", detail, "payments-bot", nil)
+	assert.Nil(t, err)
+	source.files["infra/observatory:aaa:observatory.yaml"] = strings.Replace(manifestV2, "owner: release", "owner: payments", 1)
+
+	// pushing to the manifest does not reach the subscribes of other teams
+	_, err = r.Reconcile("aaa")
+	assert.Contains(t, err.Error(), "observers[0].owner: payments is not an owner of the manifest")
+	subscribes, _ := store.Subscriptions.List()
+	assert.Len(t, subscribes, 1)
+	assert.Equal(t, id, subscribes[0].ID)
+	assert.Equal(t, "charges", subscribes[0].Detail.Name)
+	assert.Empty(t, observers)
+
+	source.files["infra/observatory:refs/changes/01/1/bbb:observatory.yaml"] = source.files["infra/observatory:aaa:observatory.yaml"]
+	r.Handle(patchSetCreated("master", "bbb", ""))
+	assert.Equal(t, map[string]int{"Verified": -1}, source.reviews["bbb"].Labels)
+	assert.Equal(t, "observatory.yaml is invalid:\n\n* observers[0].owner: payments is not an owner of the manifest\n", source.reviews["bbb"].Message)
+}
+
+func TestReview(t *testing.T) {
+	r, source, _ := setup()
+	source.files["infra/observatory:aaa:observatory.yaml"] = manifestV1
+	source.files["infra/observatory:refs/changes/01/1/bbb:observatory.yaml"] = manifestV1
+	source.files["infra/observatory:refs/changes/01/1/ccc:observatory.yaml"] = manifestV2
+	source.files["infra/observatory:refs/changes/01/1/ddd:observatory.yaml"] = invalidManifest
+
+	// the patch set does not touch the manifest
+	r.Handle(patchSetCreated("master", "bbb", "aaa"))
+	assert.Empty(t, source.reviews)
+	r.Handle(patchSetCreated("stable", "ccc", "aaa"))
+	assert.Empty(t, source.reviews)
+
+	r.Handle(patchSetCreated("master", "ccc", "aaa"))
+	assert.Equal(t, map[string]int{"Verified": 1}, source.reviews["ccc"].Labels)
+	assert.Equal(t, "observatory.yaml is valid, once merged:\n\ncreate release/refs\n1 to create, 0 to update, 0 to restore, 0 to archive, 0 unchanged\n", source.reviews["ccc"].Message)
+
+	r.Handle(patchSetCreated("master", "ddd", "aaa"))
+	assert.Equal(t, map[string]int{"Verified": -1}, source.reviews["ddd"].Labels)
+	assert.Equal(t, "observatory.yaml is invalid:\n\n"+
+		"* observers[0].hook_url: scheme must be http or https\n"+
+		"* observers[0].name: must be lowercase letters, digits, dots, dashes or underscores, at most 64\n", source.reviews["ddd"].Message)
+
+	r.Handle(patchSetCreated("master", "eee", "aaa"))
+	assert.Equal(t, map[string]int{"Verified": -1}, source.reviews["eee"].Labels)
+
+	subscribes, _ := store.Subscriptions.List()
+	assert.Empty(t, subscribes)
+}
@@ -0,0 +1,104 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"gerrit-observatory/redis"
+	"gerrit-observatory/store"
+)
+
+type callerKey struct{}
+
+// authenticate rejects requests without a valid bearer token and stores the
+// token of the caller in the request context
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		token, err := store.Subscriptions.Authenticate(strings.TrimSpace(raw))
+		if err == redis.ErrTokenNotFound {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gerrit-observatory"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized", "a valid bearer token is required")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal", err.Error())
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, token)))
+	})
+}
+
+// requireAdmin wraps handlers reserved to admin tokens
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !caller(r).Admin {
+			writeError(w, http.StatusForbidden, "forbidden", "admin token required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func caller(r *http.Request) *redis.Token {
+	return r.Context().Value(callerKey{}).(*redis.Token)
+}
+
+// canAccess tells whether the caller may operate on sub
+func canAccess(r *http.Request, sub *redis.Subscribe) bool {
+	token := caller(r)
+	return token.Admin || token.Owner == sub.Owner
+}
+
+// tokenCreated is the only response that ever carries a token in clear
+type tokenCreated struct {
+	*redis.Token
+	Secret string `json:"token"`
+}
+
+func TokensPostHandler(w http.ResponseWriter, r *http.Request) {
+	var req redis.Token
+
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+	if req.Owner == "" {
+		writeValidationError(w, []FieldError{{Field: "owner", Message: "is required"}})
+		return
+	}
+	raw, err := store.GenerateToken(store.Subscriptions, &req)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	w.Header().Set("Location", "/tokens/"+req.ID)
+	writeJSON(w, http.StatusCreated, tokenCreated{Token: &req, Secret: raw})
+}
+
+func TokensGetHandler(w http.ResponseWriter, r *http.Request) {
+	tokens, err := store.Subscriptions.GetTokens()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+func TokenDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	deleted, err := store.Subscriptions.DeleteToken(mux.Vars(r)["tokenId"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	if !deleted {
+		writeError(w, http.StatusNotFound, "not_found", redis.ErrTokenNotFound.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,64 @@
+package http
+
+import (
+	"net/http"
+
+	"gerrit-observatory/log"
+	"gerrit-observatory/observer"
+	"gerrit-observatory/store"
+)
+
+// redriveRequest lists the dropped events to redrive, every dropped event
+// when empty
+type redriveRequest struct {
+	EventIDs []string `json:"event_ids"`
+}
+
+// redriveResult lists the events handed back to the observer and those
+// that were not dropped or are no longer in the history
+type redriveResult struct {
+	Redriven []string `json:"redriven"`
+	Missing  []string `json:"missing"`
+}
+
+// ObserverDropsHandler lists the events a subscribe dropped, newest first
+func ObserverDropsHandler(w http.ResponseWriter, r *http.Request) {
+	observerId, ok := observerIDVar(w, r)
+	if !ok {
+		return
+	}
+	if _, ok = ownedSubscribe(w, r, observerId); !ok {
+		return
+	}
+	drops, err := store.Subscriptions.GetDrops(observerId)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, drops)
+}
+
+// ObserverRedriveHandler hands dropped events back to the observer of a
+// subscribe, they are handled after its queued events
+func ObserverRedriveHandler(w http.ResponseWriter, r *http.Request) {
+	var req redriveRequest
+
+	observerId, ok := observerIDVar(w, r)
+	if !ok || !decodeOptionalBody(w, r, &req) {
+		return
+	}
+	if _, ok = ownedSubscribe(w, r, observerId); !ok {
+		return
+	}
+	redriven, missing, err := observerContr.Redrive(observerId, req.EventIDs)
+	if err == observer.ErrNotObserved {
+		writeError(w, http.StatusConflict, "not_observed", "subscribe is archived, resume it first")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	log.Logger.With(log.Fields{log.FieldObserverID: observerId}).Infof("%d dropped events redriven by %s", len(redriven), caller(r).Owner)
+	writeJSON(w, http.StatusOK, redriveResult{Redriven: redriven, Missing: missing})
+}
@@ -0,0 +1,70 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"gerrit-observatory/observer"
+)
+
+var (
+	// evaluatePageSize is the number of history events read at once, the
+	// whole window is evaluated
+	evaluatePageSize = 1000
+	evaluateLimit    = 100
+)
+
+// evaluateRequest asks which events of the last Since a filter would have
+// matched, Since is a duration such as "24h" and defaults to the retention
+type evaluateRequest struct {
+	Filter map[string]interface{} `json:"filter"`
+	Since  string                 `json:"since"`
+	Limit  int                    `json:"limit"`
+}
+
+func FiltersEvaluateHandler(w http.ResponseWriter, r *http.Request) {
+	var req evaluateRequest
+
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+	var fields []FieldError
+	if req.Filter == nil {
+		fields = append(fields, FieldError{Field: "filter", Message: "is required"})
+	}
+	for _, e := range observer.ValidateFilter(req.Filter) {
+		fields = append(fields, FieldError{Field: e.Path, Message: e.Err.Error()})
+	}
+	var since time.Time
+	if req.Since != "" {
+		window, err := time.ParseDuration(req.Since)
+		if err != nil || window <= 0 {
+			fields = append(fields, FieldError{Field: "since", Message: "must be a positive duration such as 24h"})
+		}
+		since = time.Now().Add(-window)
+	}
+	if req.Limit < 0 {
+		fields = append(fields, FieldError{Field: "limit", Message: "must not be negative"})
+	}
+	if len(fields) > 0 {
+		writeFieldErrors(w, "invalid_filter", "filter evaluation request is invalid", fields)
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = evaluateLimit
+	}
+
+	_, projects, ok := visibleProjects(w, r, nil)
+	if !ok {
+		return
+	}
+	evaluation, err := observer.EvaluateFilter(req.Filter, projects, since, evaluatePageSize, req.Limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, evaluation)
+}
@@ -1,23 +1,106 @@
 package http
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"strconv"
-	"encoding/json"
+	"sync"
+	"time"
+
 	"github.com/gorilla/mux"
 
+	"gerrit-observatory/gerrit"
+	"gerrit-observatory/log"
+	"gerrit-observatory/manifest"
+	"gerrit-observatory/metrics"
+	"gerrit-observatory/observer"
 	"gerrit-observatory/redis"
+	"gerrit-observatory/store"
+)
+
+var (
+	observerContr *observer.ObserverContr
+	reloader      Reloader
+
+	serverLock sync.Mutex
+	server     *http.Server
 )
 
-func Router() {
+// Router serves the API on addr until the server fails, it returns nil
+// once stopped by Shutdown. The status page reports streams and version
+func Router(contr *observer.ObserverContr, lister ProjectLister, r Reloader, streams []StreamMonitor, version string, addr string) error {
+	observerContr = contr
+	projectLister = lister
+	reloader = r
+	streamMonitors = streams
+	buildVersion = version
+
+	serverLock.Lock()
+	server = &http.Server{Addr: addr, Handler: newHandler()}
+	serverLock.Unlock()
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting connections and waits for the requests in
+// progress until ctx is done
+func Shutdown(ctx context.Context) error {
+	serverLock.Lock()
+	defer serverLock.Unlock()
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}
+
+// newHandler serves the metrics and probes to anyone and the API to token
+// holders
+func newHandler() http.Handler {
+	r := mux.NewRouter()
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
+	r.HandleFunc("/healthz", HealthzHandler).Methods("GET")
+	r.HandleFunc("/readyz", ReadyzHandler).Methods("GET")
+	r.PathPrefix("/").Handler(authenticate(newRouter()))
+	return r
+}
+
+func newRouter() *mux.Router {
 	r := mux.NewRouter()
 
+	r.HandleFunc("/tokens", requireAdmin(TokensPostHandler)).Methods("POST")
+	r.HandleFunc("/tokens", requireAdmin(TokensGetHandler)).Methods("GET")
+	r.HandleFunc("/tokens/{tokenId}", requireAdmin(TokenDeleteHandler)).Methods("DELETE")
+
+	r.HandleFunc("/logging", requireAdmin(LoggingGetHandler)).Methods("GET")
+	r.HandleFunc("/logging", requireAdmin(LoggingPutHandler)).Methods("PUT")
+	r.HandleFunc("/reload", requireAdmin(ReloadHandler)).Methods("POST")
+	r.HandleFunc("/status", StatusHandler).Methods("GET")
+
 	r.HandleFunc("/observers", ObserversPostHandler).Methods("POST")
 	r.HandleFunc("/observers", ObserversGetHandler).Methods("GET")
+	r.HandleFunc("/observers/export", ObserversExportHandler).Methods("GET")
+	r.HandleFunc("/observers/import", ObserversImportHandler).Methods("POST")
 	r.HandleFunc("/observers/{observerId}", ObserverGetHandler).Methods("GET")
+	r.HandleFunc("/observers/{observerId}", ObserverPutHandler).Methods("PUT")
+	r.HandleFunc("/observers/{observerId}", ObserverPatchHandler).Methods("PATCH")
 	r.HandleFunc("/observers/{observerId}", ObserverDeleteHandler).Methods("DELETE")
+	r.HandleFunc("/observers/{observerId}/pause", ObserverPauseHandler).Methods("POST")
+	r.HandleFunc("/observers/{observerId}/resume", ObserverResumeHandler).Methods("POST")
+	r.HandleFunc("/observers/{observerId}/archive", ObserverArchiveHandler).Methods("POST")
+	r.HandleFunc("/observers/{observerId}/test", ObserverTestHandler).Methods("POST")
+	r.HandleFunc("/observers/{observerId}/deliveries", ObserverDeliveriesHandler).Methods("GET")
+	r.HandleFunc("/observers/{observerId}/stats", ObserverStatsHandler).Methods("GET")
+	r.HandleFunc("/observers/{observerId}/drops", ObserverDropsHandler).Methods("GET")
+	r.HandleFunc("/observers/{observerId}/redrive", ObserverRedriveHandler).Methods("POST")
 
-	http.ListenAndServe(":8080", r)
+	r.HandleFunc("/filters/evaluate", FiltersEvaluateHandler).Methods("POST")
+	r.HandleFunc("/reports/unmatched", UnmatchedReportHandler).Methods("GET")
+	return r
 }
 
 func ObserversPostHandler(w http.ResponseWriter, r *http.Request) {
@@ -25,60 +108,471 @@ func ObserversPostHandler(w http.ResponseWriter, r *http.Request) {
 
 	defer r.Body.Close()
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		w.WriteHeader(500)
-		w.Write([]byte(err.Error()))
+		writeError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+	if fields := validateDetail(&req); len(fields) > 0 {
+		writeValidationError(w, fields)
+		return
+	}
+	if !nameAvailable(w, caller(r).Owner, req.Name, 0) {
+		return
+	}
+	gerritUser, projects, ok := visibleProjects(w, r, nil)
+	if !ok {
 		return
 	}
-	req.Save()
-	return
+	id, err := store.Subscriptions.Save(caller(r).Owner, req, gerritUser, projects)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	subscribe, err := store.Subscriptions.Get(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	if err = observerContr.AddObserver(subscribe); err != nil {
+		log.Logger.With(log.Fields{log.FieldObserverID: id}).Warningf("subscribe saved but not observed, err: %v", err)
+	}
+	w.Header().Set("Location", fmt.Sprintf("/observers/%d", id))
+	writeJSON(w, http.StatusCreated, subscribe)
 }
 
+// ObserversGetHandler lists the subscribes of the caller in the states of
+// the state parameter, the active and paused ones by default
 func ObserversGetHandler(w http.ResponseWriter, r *http.Request) {
-	subscribes, err := redis.GetSubscribes()
+	states, fields := parseStates(r)
+	if len(fields) > 0 {
+		writeFieldErrors(w, "invalid_query", "invalid query parameters", fields)
+		return
+	}
+	subscribes, err := store.Subscriptions.List()
 	if err != nil {
-		w.WriteHeader(500)
-		w.Write([]byte(err.Error()))
+		writeError(w, http.StatusInternalServerError, "internal", err.Error())
 		return
 	}
-	b, _ := json.Marshal(subscribes)
-	w.Write(b)
-	return
+	owned := make([]*redis.Subscribe, 0, len(subscribes))
+	for _, subscribe := range subscribes {
+		if canAccess(r, subscribe) && states[subscribe.State] {
+			owned = append(owned, subscribe)
+		}
+	}
+	writeJSON(w, http.StatusOK, owned)
 }
 
 func ObserverGetHandler(w http.ResponseWriter, r *http.Request) {
-	observerId, err := strconv.Atoi(mux.Vars(r)["observerId"])
-	if err != nil {
-		w.WriteHeader(500)
-		w.Write([]byte(err.Error()))
+	observerId, ok := observerIDVar(w, r)
+	if !ok {
+		return
+	}
+
+	subscribe, ok := ownedSubscribe(w, r, observerId)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, subscribe)
+}
+
+func ObserverPutHandler(w http.ResponseWriter, r *http.Request) {
+	var req redis.SubscribeDetail
+
+	observerId, ok := observerIDVar(w, r)
+	if !ok {
+		return
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", err.Error())
 		return
 	}
+	subscribe, ok := ownedSubscribe(w, r, observerId)
+	if !ok {
+		return
+	}
+	updateSubscribe(w, r, subscribe, req)
+}
 
-	subscribe, err := redis.GetSubscribe(observerId)
+// subscribePatch holds the fields of a PATCH request, absent fields are left
+// untouched while present ones replace the stored value as a whole. A null
+// expires_at removes the expiry and a null debounce the debounce
+type subscribePatch struct {
+	Name        *string                 `json:"name"`
+	Filter      *map[string]interface{} `json:"filter"`
+	HookURL     *string                 `json:"hook_url"`
+	Comment     *string                 `json:"comment"`
+	ExpiresAt   json.RawMessage         `json:"expires_at"`
+	Concurrency *int                    `json:"concurrency"`
+	Overflow    *string                 `json:"overflow"`
+	Debounce    json.RawMessage         `json:"debounce"`
+}
+
+func ObserverPatchHandler(w http.ResponseWriter, r *http.Request) {
+	var req subscribePatch
+
+	observerId, ok := observerIDVar(w, r)
+	if !ok {
+		return
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+	subscribe, ok := ownedSubscribe(w, r, observerId)
+	if !ok {
+		return
+	}
+	detail := subscribe.Detail
+	if req.Name != nil {
+		detail.Name = *req.Name
+	}
+	if req.Filter != nil {
+		detail.Filter = *req.Filter
+	}
+	if req.HookURL != nil {
+		detail.HookURL = *req.HookURL
+	}
+	if req.Comment != nil {
+		detail.Comment = *req.Comment
+	}
+	if req.Concurrency != nil {
+		detail.Concurrency = *req.Concurrency
+	}
+	if req.Overflow != nil {
+		detail.Overflow = *req.Overflow
+	}
+	if req.ExpiresAt != nil {
+		detail.ExpiresAt = nil
+		if err := json.Unmarshal(req.ExpiresAt, &detail.ExpiresAt); err != nil {
+			writeValidationError(w, []FieldError{{Field: "expires_at", Message: "must be an RFC 3339 time or null"}})
+			return
+		}
+	}
+	if req.Debounce != nil {
+		detail.Debounce = nil
+		if err := json.Unmarshal(req.Debounce, &detail.Debounce); err != nil {
+			writeValidationError(w, []FieldError{{Field: "debounce", Message: "must be an object or null"}})
+			return
+		}
+	}
+	updateSubscribe(w, r, subscribe, detail)
+}
+
+func updateSubscribe(w http.ResponseWriter, r *http.Request, subscribe *redis.Subscribe, detail redis.SubscribeDetail) {
+	id := subscribe.ID
+	if subscribe.State == redis.StateArchived {
+		writeError(w, http.StatusConflict, "archived", "subscribe is archived, resume it first")
+		return
+	}
+	if fields := validateDetail(&detail); len(fields) > 0 {
+		writeValidationError(w, fields)
+		return
+	}
+	if !nameAvailable(w, subscribe.Owner, detail.Name, id) {
+		return
+	}
+	gerritUser, projects, ok := visibleProjects(w, r, subscribe)
+	if !ok {
+		return
+	}
+	_, err := store.Subscriptions.Update(id, detail)
+	if err == nil {
+		err = store.Subscriptions.SetVisibleProjects(id, gerritUser, projects)
+	}
+	if err == nil {
+		subscribe, err = store.Subscriptions.Get(id)
+	}
 	if err != nil {
-		w.WriteHeader(500)
-		w.Write([]byte(err.Error()))
+		writeStoreError(w, err)
 		return
 	}
-	b, _ := json.Marshal(subscribe)
-	w.Write(b)
-	return
+	if subscribe.Observed() {
+		if err = observerContr.UpdateObserver(subscribe); err != nil {
+			err = observerContr.AddObserver(subscribe)
+		}
+		if err != nil {
+			log.Logger.With(log.Fields{log.FieldObserverID: id}).Warningf("subscribe updated but not observed, err: %v", err)
+		}
+	}
+	writeJSON(w, http.StatusOK, subscribe)
 }
 
+// ObserverDeleteHandler purges a subscribe with its statistics and delivery
+// log, archiving keeps them
 func ObserverDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	observerId, err := strconv.Atoi(mux.Vars(r)["observerId"])
+	observerId, ok := observerIDVar(w, r)
+	if !ok {
+		return
+	}
+	if _, ok = ownedSubscribe(w, r, observerId); !ok {
+		return
+	}
+
+	deleted, err := store.Subscriptions.Delete(observerId)
 	if err != nil {
-		w.WriteHeader(500)
-		w.Write([]byte(err.Error()))
+		writeError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	if !deleted {
+		writeStoreError(w, redis.ErrSubscribeNotFound)
+		return
+	}
+	observerContr.DetachObserver(observerId)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// testRequest holds a sample event to test a subscribe with, the newest
+// matching recent event is used when Event is absent
+type testRequest struct {
+	Event   map[string]interface{} `json:"event"`
+	Deliver bool                   `json:"deliver"`
+}
+
+func ObserverTestHandler(w http.ResponseWriter, r *http.Request) {
+	var req testRequest
+
+	observerId, ok := observerIDVar(w, r)
+	if !ok {
+		return
+	}
+	defer r.Body.Close()
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&req); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+	subscribe, ok := ownedSubscribe(w, r, observerId)
+	if !ok {
+		return
+	}
+	var event *gerrit.Event
+	if req.Event != nil {
+		event = gerrit.NewEvent(req.Event)
+	}
+	result, err := observerContr.TestObserver(subscribe, event, req.Deliver)
+	if err == observer.ErrNoRecentEvent {
+		writeError(w, http.StatusNotFound, "no_recent_event", err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func ObserverStatsHandler(w http.ResponseWriter, r *http.Request) {
+	observerId, ok := observerIDVar(w, r)
+	if !ok {
+		return
+	}
+	subscribe, ok := ownedSubscribe(w, r, observerId)
+	if !ok {
+		return
+	}
+	backlog, err := store.Subscriptions.BacklogLength(observerId)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	subscribe.Stats.Backlog = int64(backlog)
+	spilled, err := store.Subscriptions.SpilledLength(observerId)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	subscribe.Stats.Spilled = int64(spilled)
+	writeJSON(w, http.StatusOK, subscribe.Stats)
+}
+
+var (
+	deliveriesLimit    = 50
+	deliveriesMaxLimit = 500
+)
+
+// deliveriesPage is a page of the delivery log of an observer
+type deliveriesPage struct {
+	Total      int               `json:"total"`
+	Offset     int               `json:"offset"`
+	Limit      int               `json:"limit"`
+	Deliveries []*redis.Delivery `json:"deliveries"`
+}
+
+func ObserverDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	observerId, ok := observerIDVar(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	q := redis.DeliveryQuery{
+		EventID: query.Get("event_id"),
+		Outcome: query.Get("outcome"),
+		Limit:   deliveriesLimit,
+	}
+	var fields []FieldError
+	if q.Outcome != "" && q.Outcome != "success" && q.Outcome != "failure" {
+		fields = append(fields, FieldError{Field: "outcome", Message: "must be success or failure"})
+	}
+	if since := query.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			fields = append(fields, FieldError{Field: "since", Message: "must be an RFC 3339 time"})
+		}
+		q.Since = t
+	}
+	if offset := query.Get("offset"); offset != "" {
+		n, err := strconv.Atoi(offset)
+		if err != nil || n < 0 {
+			fields = append(fields, FieldError{Field: "offset", Message: "must be a non negative integer"})
+		}
+		q.Offset = n
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 || n > deliveriesMaxLimit {
+			fields = append(fields, FieldError{Field: "limit", Message: fmt.Sprintf("must be between 1 and %d", deliveriesMaxLimit)})
+		}
+		q.Limit = n
+	}
+	if len(fields) > 0 {
+		writeFieldErrors(w, "invalid_query", "invalid query parameters", fields)
+		return
+	}
+	if _, ok = ownedSubscribe(w, r, observerId); !ok {
 		return
 	}
 
-	subscribe, err := redis.DeleteSubscribe(observerId)
+	deliveries, total, err := store.Subscriptions.GetDeliveries(observerId, q)
 	if err != nil {
-		w.WriteHeader(500)
-		w.Write([]byte(err.Error()))
+		writeError(w, http.StatusInternalServerError, "internal", err.Error())
 		return
 	}
-	b, _ := json.Marshal(subscribe)
+	writeJSON(w, http.StatusOK, deliveriesPage{Total: total, Offset: q.Offset, Limit: q.Limit, Deliveries: deliveries})
+}
+
+// FieldError points at the request field that failed validation
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ErrorBody is the envelope of every error response
+type ErrorBody struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+func validateDetail(detail *redis.SubscribeDetail) []FieldError {
+	var fields []FieldError
+
+	if detail.Name != "" && !manifest.ValidName(detail.Name) {
+		fields = append(fields, FieldError{Field: "name", Message: "must be lowercase letters, digits, dots, dashes or underscores, at most 64"})
+	}
+	if detail.Filter == nil {
+		fields = append(fields, FieldError{Field: "filter", Message: "is required"})
+	}
+	for _, e := range observer.ValidateFilter(detail.Filter) {
+		fields = append(fields, FieldError{Field: e.Path, Message: e.Err.Error()})
+	}
+	if problem := manifest.HookURLProblem(detail.HookURL); problem != "" {
+		fields = append(fields, FieldError{Field: "hook_url", Message: problem})
+	}
+	if detail.ExpiresAt != nil && !detail.ExpiresAt.After(time.Now()) {
+		fields = append(fields, FieldError{Field: "expires_at", Message: "must be in the future"})
+	}
+	if detail.Concurrency < 0 || detail.Concurrency > observer.MaxConcurrency {
+		fields = append(fields, FieldError{Field: "concurrency", Message: fmt.Sprintf("must be between 0 and %d", observer.MaxConcurrency)})
+	}
+	if !observer.ValidOverflow(detail.Overflow) {
+		fields = append(fields, FieldError{Field: "overflow", Message: "must be block, spill, drop_oldest, drop_newest or coalesce"})
+	}
+	if field, problem := observer.DebounceProblem(detail.Debounce); problem != "" {
+		fields = append(fields, FieldError{Field: field, Message: problem})
+	}
+	return fields
+}
+
+// nameAvailable tells whether no other subscribe of owner than id is named
+// name, the conflict is reported otherwise
+func nameAvailable(w http.ResponseWriter, owner string, name string, id int) bool {
+	if name == "" {
+		return true
+	}
+	subscribes, err := store.Subscriptions.List()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal", err.Error())
+		return false
+	}
+	for _, sub := range subscribes {
+		if sub.Owner == owner && sub.Detail.Name == name && sub.ID != id {
+			writeValidationError(w, []FieldError{{Field: "name", Message: fmt.Sprintf("is already used by observer %d", sub.ID)}})
+			return false
+		}
+	}
+	return true
+}
+
+func observerIDVar(w http.ResponseWriter, r *http.Request) (int, bool) {
+	observerId, err := strconv.Atoi(mux.Vars(r)["observerId"])
+	if err != nil || observerId <= 0 {
+		writeError(w, http.StatusBadRequest, "invalid_id", fmt.Sprintf("invalid observer id %q", mux.Vars(r)["observerId"]))
+		return 0, false
+	}
+	return observerId, true
+}
+
+// ownedSubscribe loads the subscribe of id, subscribes of other owners are
+// reported as not found unless the caller is an admin
+func ownedSubscribe(w http.ResponseWriter, r *http.Request, id int) (*redis.Subscribe, bool) {
+	subscribe, err := store.Subscriptions.Get(id)
+	if err == nil && !canAccess(r, subscribe) {
+		err = redis.ErrSubscribeNotFound
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return nil, false
+	}
+	return subscribe, true
+}
+
+func writeStoreError(w http.ResponseWriter, err error) {
+	if err == redis.ErrSubscribeNotFound {
+		writeError(w, http.StatusNotFound, "not_found", err.Error())
+		return
+	}
+	writeError(w, http.StatusInternalServerError, "internal", err.Error())
+}
+
+func writeValidationError(w http.ResponseWriter, fields []FieldError) {
+	writeFieldErrors(w, "invalid_subscribe", "subscribe validation failed", fields)
+}
+
+func writeFieldErrors(w http.ResponseWriter, code string, message string, fields []FieldError) {
+	writeJSON(w, http.StatusBadRequest, ErrorBody{Error: ErrorDetail{
+		Code:    code,
+		Message: message,
+		Fields:  fields,
+	}})
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeJSON(w, status, ErrorBody{Error: ErrorDetail{Code: code, Message: message}})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		b, _ = json.Marshal(ErrorBody{Error: ErrorDetail{Code: "internal", Message: err.Error()}})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	w.Write(b)
-	return
 }
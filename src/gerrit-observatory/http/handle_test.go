@@ -0,0 +1,592 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+
+	"gerrit-observatory/config"
+	"gerrit-observatory/gerrit"
+	"gerrit-observatory/log"
+	"gerrit-observatory/observer"
+	"gerrit-observatory/redis"
+	"gerrit-observatory/store"
+)
+
+var (
+	DetailRaw = `{
+	  "filter": {
+		"type": "patchset-created",
+		"change": {
+		  "branch": "release-*",
+		  "project": "loki"
+		}
+	  },
+	  "hook_url": "http://loki.wandoulabs.com/webhook?from_gerrit",
+	  "comment": "用途说明"
+	}`
+)
+
+type fakeLister map[string][]string
+
+func (l fakeLister) VisibleProjects(gerritUser string) ([]string, error) {
+	projects, ok := l[gerritUser]
+	if !ok {
+		return nil, fmt.Errorf("suexec: no such user %s", gerritUser)
+	}
+	return projects, nil
+}
+
+type fakeReloader struct {
+	report *config.ReloadReport
+	err    error
+}
+
+func (r *fakeReloader) Reload() (*config.ReloadReport, error) {
+	return r.report, r.err
+}
+
+type HandleTestSuite struct {
+	suite.Suite
+	incoming   chan *gerrit.Event
+	router     http.Handler
+	adminToken string
+	lokiToken  string
+	crawlToken string
+}
+
+func (suite *HandleTestSuite) SetupSuite() {
+	projectLister = fakeLister{
+		"zengyaopeng": {"loki"},
+		"tanyi":       {"orion/crawler"},
+	}
+}
+
+func (suite *HandleTestSuite) SetupTest() {
+	store.Subscriptions = store.NewMemoryStore()
+	suite.incoming = make(chan *gerrit.Event)
+	observerContr = observer.NewObserverContr(suite.incoming, 1)
+	go observerContr.Start()
+	suite.router = newHandler()
+	suite.adminToken = "admin-secret"
+	err := store.Subscriptions.SaveToken(suite.adminToken, &redis.Token{Owner: "ops", Admin: true})
+	assert.Nil(suite.T(), err)
+	suite.lokiToken, err = store.GenerateToken(store.Subscriptions, &redis.Token{Owner: "loki", GerritUser: "zengyaopeng"})
+	assert.Nil(suite.T(), err)
+	suite.crawlToken, err = store.GenerateToken(store.Subscriptions, &redis.Token{Owner: "crawler", GerritUser: "tanyi"})
+	assert.Nil(suite.T(), err)
+}
+
+// TearDownTest stops the observers the test added before the next one
+// replaces the store
+func (suite *HandleTestSuite) TearDownTest() {
+	close(suite.incoming)
+	observerContr.Shutdown(5 * time.Second)
+}
+
+func (suite *HandleTestSuite) do(method string, path string, token string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	return w
+}
+
+func (suite *HandleTestSuite) create(token string) *redis.Subscribe {
+	w := suite.do("POST", "/observers", token, DetailRaw)
+	assert.Equal(suite.T(), http.StatusCreated, w.Code)
+	var subscribe redis.Subscribe
+	assert.Nil(suite.T(), json.Unmarshal(w.Body.Bytes(), &subscribe))
+	return &subscribe
+}
+
+func (suite *HandleTestSuite) TestCreate() {
+	w := suite.do("POST", "/observers", suite.lokiToken, DetailRaw)
+	assert.Equal(suite.T(), http.StatusCreated, w.Code)
+	var subscribe redis.Subscribe
+	assert.Nil(suite.T(), json.Unmarshal(w.Body.Bytes(), &subscribe))
+	assert.NotEqual(suite.T(), subscribe.ID, 0)
+	assert.Equal(suite.T(), subscribe.Owner, "loki")
+	assert.Equal(suite.T(), subscribe.GerritUser, "zengyaopeng")
+	assert.Equal(suite.T(), subscribe.VisibleProjects, []string{"loki"})
+	assert.Equal(suite.T(), w.Header().Get("Location"), "/observers/"+strconv.Itoa(subscribe.ID))
+
+	subscribe = *suite.create(suite.adminToken)
+	assert.Nil(suite.T(), subscribe.VisibleProjects)
+}
+
+func (suite *HandleTestSuite) TestCreateVisibility() {
+	raw, err := store.GenerateToken(store.Subscriptions, &redis.Token{Owner: "nobody"})
+	assert.Nil(suite.T(), err)
+	w := suite.do("POST", "/observers", raw, DetailRaw)
+	assert.Equal(suite.T(), http.StatusForbidden, w.Code)
+
+	raw, err = store.GenerateToken(store.Subscriptions, &redis.Token{Owner: "ghost", GerritUser: "ghost"})
+	assert.Nil(suite.T(), err)
+	w = suite.do("POST", "/observers", raw, DetailRaw)
+	assert.Equal(suite.T(), http.StatusBadGateway, w.Code)
+}
+
+func (suite *HandleTestSuite) TestCreateValidation() {
+	w := suite.do("POST", "/observers", suite.lokiToken, `{"filter": {"type": "(", "change": {"branch": ["a"]}}, "hook_url": "ftp://x"}`)
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+	var body ErrorBody
+	assert.Nil(suite.T(), json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(suite.T(), body.Error.Code, "invalid_subscribe")
+	assert.Equal(suite.T(), body.Error.Fields, []FieldError{
+		{Field: "filter.change.branch", Message: "list values are not supported"},
+		{Field: "filter.type", Message: "error parsing regexp: missing closing ): `(`"},
+		{Field: "hook_url", Message: "scheme must be http or https"},
+	})
+
+	w = suite.do("POST", "/observers", suite.lokiToken, `{`)
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+}
+
+func (suite *HandleTestSuite) TestUnauthorized() {
+	w := suite.do("GET", "/observers", "", "")
+	assert.Equal(suite.T(), http.StatusUnauthorized, w.Code)
+	w = suite.do("GET", "/observers", "bogus", "")
+	assert.Equal(suite.T(), http.StatusUnauthorized, w.Code)
+	w = suite.do("POST", "/tokens", suite.lokiToken, `{"owner": "loki"}`)
+	assert.Equal(suite.T(), http.StatusForbidden, w.Code)
+}
+
+func (suite *HandleTestSuite) TestOwnership() {
+	subscribe := suite.create(suite.lokiToken)
+	path := "/observers/" + strconv.Itoa(subscribe.ID)
+
+	w := suite.do("GET", path, suite.crawlToken, "")
+	assert.Equal(suite.T(), http.StatusNotFound, w.Code)
+	w = suite.do("DELETE", path, suite.crawlToken, "")
+	assert.Equal(suite.T(), http.StatusNotFound, w.Code)
+
+	var subscribes []*redis.Subscribe
+	w = suite.do("GET", "/observers", suite.crawlToken, "")
+	assert.Nil(suite.T(), json.Unmarshal(w.Body.Bytes(), &subscribes))
+	assert.Len(suite.T(), subscribes, 0)
+	w = suite.do("GET", "/observers", suite.adminToken, "")
+	assert.Nil(suite.T(), json.Unmarshal(w.Body.Bytes(), &subscribes))
+	assert.Len(suite.T(), subscribes, 1)
+
+	w = suite.do("GET", path, suite.adminToken, "")
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+}
+
+func (suite *HandleTestSuite) TestUpdateDelete() {
+	subscribe := suite.create(suite.lokiToken)
+	path := "/observers/" + strconv.Itoa(subscribe.ID)
+
+	w := suite.do("PATCH", path, suite.lokiToken, `{"comment": "patched"}`)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	var updated redis.Subscribe
+	assert.Nil(suite.T(), json.Unmarshal(w.Body.Bytes(), &updated))
+	assert.Equal(suite.T(), updated.Detail.Comment, "patched")
+	assert.Equal(suite.T(), updated.Detail.HookURL, subscribe.Detail.HookURL)
+
+	w = suite.do("PUT", path, suite.lokiToken, `{"filter": {"type": "ref-updated"}}`)
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+
+	w = suite.do("GET", "/observers/abc", suite.lokiToken, "")
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+	w = suite.do("GET", "/observers/9999", suite.lokiToken, "")
+	assert.Equal(suite.T(), http.StatusNotFound, w.Code)
+
+	w = suite.do("DELETE", path, suite.lokiToken, "")
+	assert.Equal(suite.T(), http.StatusNoContent, w.Code)
+	w = suite.do("DELETE", path, suite.lokiToken, "")
+	assert.Equal(suite.T(), http.StatusNotFound, w.Code)
+}
+
+func (suite *HandleTestSuite) TestExportImport() {
+	suite.create(suite.lokiToken)
+	suite.create(suite.crawlToken)
+
+	w := suite.do("GET", "/observers/export?format=yaml", suite.lokiToken, "")
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Equal(suite.T(), "application/yaml", w.Header().Get("Content-Type"))
+	exported := w.Body.String()
+	assert.Contains(suite.T(), exported, "  - name: observer-1\n    owner: loki\n")
+	assert.NotContains(suite.T(), exported, "crawler")
+
+	manifest := exported + `  - name: nightly
+    filter:
+      type: ref-updated
+    hook_url: http://loki.wandoulabs.com/nightly
+`
+	w = suite.do("POST", "/observers/import?dry_run=true&prune=true", suite.lokiToken, manifest)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), `"dry_run":true`)
+	assert.Contains(suite.T(), w.Body.String(), `{"action":"create","name":"nightly","owner":"loki"}`)
+	assert.Contains(suite.T(), w.Body.String(), `{"action":"update","name":"observer-1","owner":"loki","id":1,"fields":["name"]}`)
+	w = suite.do("GET", "/observers/3", suite.adminToken, "")
+	assert.Equal(suite.T(), http.StatusNotFound, w.Code)
+
+	w = suite.do("POST", "/observers/import", suite.lokiToken, manifest)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	w = suite.do("POST", "/observers/import", suite.lokiToken, manifest)
+	assert.Contains(suite.T(), w.Body.String(), `"plan":{"changes":[],"unchanged":2}`)
+	w = suite.do("GET", "/observers/3", suite.lokiToken, "")
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), `"VisibleProjects":["loki"]`)
+
+	// pruned subscribes are archived, not deleted
+	w = suite.do("POST", "/observers/import?prune=true", suite.lokiToken, "version: 1\nobservers: []\n")
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	w = suite.do("GET", "/observers/3", suite.lokiToken, "")
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), `"State":"archived"`)
+	assert.Contains(suite.T(), w.Body.String(), `"StateReason":"pruned from the manifest"`)
+	w = suite.do("GET", "/observers/2", suite.crawlToken, "")
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+
+	w = suite.do("POST", "/observers/import", suite.lokiToken, `{"version": 1, "observers": [{"name": "x", "owner": "crawler", "filter": {}, "hook_url": "ftp://x"}]}`)
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), `"field":"observers[0].owner"`)
+	assert.Contains(suite.T(), w.Body.String(), `"field":"observers[0].hook_url"`)
+}
+
+func (suite *HandleTestSuite) TestLifecycle() {
+	subscribe := suite.create(suite.lokiToken)
+	other := suite.create(suite.lokiToken)
+	path := "/observers/" + strconv.Itoa(subscribe.ID)
+	list := func(query string) []int {
+		w := suite.do("GET", "/observers"+query, suite.lokiToken, "")
+		assert.Equal(suite.T(), http.StatusOK, w.Code)
+		var subscribes []*redis.Subscribe
+		assert.Nil(suite.T(), json.Unmarshal(w.Body.Bytes(), &subscribes))
+		ids := make([]int, 0, len(subscribes))
+		for _, s := range subscribes {
+			ids = append(ids, s.ID)
+		}
+		return ids
+	}
+
+	w := suite.do("POST", path+"/pause", suite.lokiToken, `{"mode": "drop"}`)
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), `"field":"mode"`)
+	w = suite.do("POST", path+"/pause", suite.lokiToken, "")
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), `"State":"paused","PauseMode":"queue"`)
+	assert.Equal(suite.T(), []int{other.ID}, list("?state=active"))
+	assert.Equal(suite.T(), []int{subscribe.ID}, list("?state=paused"))
+
+	w = suite.do("POST", path+"/archive", suite.crawlToken, "")
+	assert.Equal(suite.T(), http.StatusNotFound, w.Code)
+	w = suite.do("POST", path+"/archive", suite.lokiToken, "")
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), `"State":"archived"`)
+	assert.Equal(suite.T(), []int{other.ID}, list(""))
+	assert.Equal(suite.T(), []int{subscribe.ID, other.ID}, list("?state=all"))
+	assert.Equal(suite.T(), []int{subscribe.ID}, list("?state=archived,paused"))
+	w = suite.do("GET", "/observers?state=deleted", suite.lokiToken, "")
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+
+	// archived subscribes are kept as they were until resumed
+	w = suite.do("PATCH", path, suite.lokiToken, `{"comment": "patched"}`)
+	assert.Equal(suite.T(), http.StatusConflict, w.Code)
+	w = suite.do("POST", path+"/pause", suite.lokiToken, "")
+	assert.Equal(suite.T(), http.StatusConflict, w.Code)
+	w = suite.do("GET", path+"/stats", suite.lokiToken, "")
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+
+	w = suite.do("POST", path+"/resume", suite.lokiToken, `{"discard_backlog": true}`)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), `"State":"active"`)
+	assert.Equal(suite.T(), []int{subscribe.ID, other.ID}, list("?state=active"))
+
+	w = suite.do("DELETE", path, suite.lokiToken, "")
+	assert.Equal(suite.T(), http.StatusNoContent, w.Code)
+	assert.Equal(suite.T(), []int{other.ID}, list("?state=all"))
+}
+
+func (suite *HandleTestSuite) TestExpiry() {
+	subscribe := suite.create(suite.lokiToken)
+	path := "/observers/" + strconv.Itoa(subscribe.ID)
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	w := suite.do("PATCH", path, suite.lokiToken, `{"expires_at": "`+past+`"}`)
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), `"field":"expires_at"`)
+	w = suite.do("PATCH", path, suite.lokiToken, `{"expires_at": "tomorrow"}`)
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+	w = suite.do("PATCH", path, suite.lokiToken, `{"expires_at": "`+future+`"}`)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), `"expires_at":"`+future+`"`)
+	w = suite.do("PATCH", path, suite.lokiToken, `{"expires_at": null}`)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.NotContains(suite.T(), w.Body.String(), `expires_at`)
+
+	// an expired subscribe is only resumed along with a later expiry
+	expired := time.Now().Add(-time.Hour)
+	detail := subscribe.Detail
+	detail.ExpiresAt = &expired
+	_, err := store.Subscriptions.Update(subscribe.ID, detail)
+	assert.Nil(suite.T(), err)
+	_, err = store.Subscriptions.SetState(subscribe.ID, redis.StateArchived, "", "expired")
+	assert.Nil(suite.T(), err)
+	w = suite.do("POST", path+"/resume", suite.lokiToken, "")
+	assert.Equal(suite.T(), http.StatusConflict, w.Code)
+	w = suite.do("POST", path+"/resume", suite.lokiToken, `{"expires_at": "`+past+`"}`)
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+	w = suite.do("POST", path+"/resume", suite.lokiToken, `{"expires_at": "`+future+`"}`)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), `"State":"active"`)
+	assert.Contains(suite.T(), w.Body.String(), `"StateReason":"resumed by loki"`)
+	assert.Contains(suite.T(), w.Body.String(), `"expires_at":"`+future+`"`)
+}
+
+func (suite *HandleTestSuite) TestConcurrency() {
+	subscribe := suite.create(suite.lokiToken)
+	path := "/observers/" + strconv.Itoa(subscribe.ID)
+
+	w := suite.do("PATCH", path, suite.lokiToken, `{"concurrency": 33}`)
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), `"field":"concurrency"`)
+	w = suite.do("PATCH", path, suite.lokiToken, `{"concurrency": -1}`)
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+	w = suite.do("PATCH", path, suite.lokiToken, `{"concurrency": 4}`)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), `"concurrency":4`)
+	w = suite.do("PATCH", path, suite.lokiToken, `{"concurrency": 0}`)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.NotContains(suite.T(), w.Body.String(), `concurrency`)
+}
+
+func (suite *HandleTestSuite) TestDebounce() {
+	subscribe := suite.create(suite.lokiToken)
+	path := "/observers/" + strconv.Itoa(subscribe.ID)
+
+	w := suite.do("PATCH", path, suite.lokiToken, `{"debounce": {"key": "owner", "window_seconds": 30}}`)
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), `"field":"debounce.key"`)
+	w = suite.do("PATCH", path, suite.lokiToken, `{"debounce": {"key": "change", "window_seconds": 0}}`)
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), `"field":"debounce.window_seconds"`)
+	w = suite.do("PATCH", path, suite.lokiToken, `{"debounce": "change"}`)
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+	w = suite.do("PATCH", path, suite.lokiToken, `{"debounce": {"key": "topic", "window_seconds": 30, "batch": true}}`)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), `"debounce":{"key":"topic","window_seconds":30,"batch":true}`)
+	w = suite.do("PATCH", path, suite.lokiToken, `{"debounce": null}`)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.NotContains(suite.T(), w.Body.String(), `"debounce":`)
+}
+
+func (suite *HandleTestSuite) TestDrops() {
+	subscribe := suite.create(suite.lokiToken)
+	path := "/observers/" + strconv.Itoa(subscribe.ID)
+
+	w := suite.do("PATCH", path, suite.lokiToken, `{"overflow": "wait"}`)
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), `"field":"overflow"`)
+	w = suite.do("PATCH", path, suite.lokiToken, `{"overflow": "spill"}`)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), `"overflow":"spill"`)
+
+	drop := &redis.Drop{EventID: "0123456789abcdef", EventType: "patchset-created", Reason: observer.DropQueueFull, Time: time.Now()}
+	assert.Nil(suite.T(), store.Subscriptions.LogDrop(subscribe.ID, drop))
+	w = suite.do("GET", path+"/drops", suite.crawlToken, "")
+	assert.Equal(suite.T(), http.StatusNotFound, w.Code)
+	w = suite.do("GET", path+"/drops", suite.lokiToken, "")
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	var drops []*redis.Drop
+	assert.Nil(suite.T(), json.Unmarshal(w.Body.Bytes(), &drops))
+	if assert.Len(suite.T(), drops, 1) {
+		assert.Equal(suite.T(), drop.EventID, drops[0].EventID)
+		assert.Equal(suite.T(), observer.DropQueueFull, drops[0].Reason)
+	}
+
+	// the events of an archived subscribe are not redriven
+	w = suite.do("POST", path+"/archive", suite.lokiToken, "")
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	w = suite.do("POST", path+"/redrive", suite.lokiToken, `{"event_ids": ["0123456789abcdef"]}`)
+	assert.Equal(suite.T(), http.StatusConflict, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), "not_observed")
+}
+
+func (suite *HandleTestSuite) TestUnmatchedReport() {
+	subscribe := suite.create(suite.lokiToken)
+	suite.create(suite.crawlToken)
+	report := func(token string, query string) []int {
+		w := suite.do("GET", "/reports/unmatched"+query, token, "")
+		assert.Equal(suite.T(), http.StatusOK, w.Code)
+		var report unmatchedReport
+		assert.Nil(suite.T(), json.Unmarshal(w.Body.Bytes(), &report))
+		ids := make([]int, 0, len(report.Subscribes))
+		for _, entry := range report.Subscribes {
+			ids = append(ids, entry.ID)
+		}
+		return ids
+	}
+
+	// subscribes younger than the period are given time to match
+	assert.Empty(suite.T(), report(suite.lokiToken, ""))
+	assert.Equal(suite.T(), []int{subscribe.ID}, report(suite.lokiToken, "?period=1ns"))
+	assert.Len(suite.T(), report(suite.adminToken, "?period=1ns"), 2)
+	w := suite.do("GET", "/reports/unmatched?period=-1h", suite.lokiToken, "")
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+
+	created, err := time.Parse(time.UnixDate, subscribe.CreatedTime)
+	assert.Nil(suite.T(), err)
+	sub := &redis.Subscribe{CreatedTime: subscribe.CreatedTime}
+	sub.Stats.LastMatchTime = created.Add(time.Hour).Format(time.UnixDate)
+	assert.False(suite.T(), unmatchedSince(sub, created.Add(time.Minute)))
+	assert.True(suite.T(), unmatchedSince(sub, created.Add(2*time.Hour)))
+}
+
+func (suite *HandleTestSuite) TestStatus() {
+	subscribe := suite.create(suite.lokiToken)
+	w := suite.do("GET", "/status", suite.lokiToken, "")
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	var status struct {
+		Breakers    []observer.BreakerStatus `json:"breakers"`
+		Connections connections              `json:"connections"`
+	}
+	assert.Nil(suite.T(), json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Contains(suite.T(), status.Breakers, observer.BreakerStatus{Observer: subscribe.ID, State: observer.BreakerClosed})
+	assert.Equal(suite.T(), connections{InFlight: 0, Limit: 64}, status.Connections)
+}
+
+func (suite *HandleTestSuite) TestObserverTest() {
+	subscribe := suite.create(suite.lokiToken)
+	path := "/observers/" + strconv.Itoa(subscribe.ID) + "/test"
+
+	w := suite.do("POST", path, suite.lokiToken, "")
+	assert.Equal(suite.T(), http.StatusNotFound, w.Code)
+
+	w = suite.do("POST", path, suite.lokiToken, `{"event": {"type": "patchset-created", "change": {"branch": "master", "project": "loki"}}}`)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	var result observer.TestResult
+	assert.Nil(suite.T(), json.Unmarshal(w.Body.Bytes(), &result))
+	assert.True(suite.T(), result.Visible)
+	assert.False(suite.T(), result.Matched)
+	assert.Equal(suite.T(), "filter.change.branch", result.Mismatch.Path)
+
+	w = suite.do("POST", path, suite.crawlToken, "")
+	assert.Equal(suite.T(), http.StatusNotFound, w.Code)
+}
+
+func (suite *HandleTestSuite) TestFiltersEvaluate() {
+	for _, data := range []map[string]interface{}{
+		{"type": "patchset-created", "change": map[string]interface{}{"project": "loki", "branch": "release-1"}},
+		{"type": "patchset-created", "change": map[string]interface{}{"project": "orion/crawler", "branch": "release-1"}},
+		{"type": "ref-updated", "refUpdate": map[string]interface{}{"project": "loki"}},
+	} {
+		assert.Nil(suite.T(), store.Subscriptions.RecordEvent(gerrit.NewEvent(data)))
+	}
+
+	w := suite.do("POST", "/filters/evaluate", suite.lokiToken, `{"filter": {"change": {"branch": "release-.*"}}, "since": "1h"}`)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	var evaluation observer.Evaluation
+	assert.Nil(suite.T(), json.Unmarshal(w.Body.Bytes(), &evaluation))
+	assert.Equal(suite.T(), 2, evaluation.Scanned)
+	assert.Equal(suite.T(), 1, evaluation.Total)
+	assert.Equal(suite.T(), map[string]int{"loki": 1}, evaluation.ByProject)
+
+	w = suite.do("POST", "/filters/evaluate", suite.adminToken, `{"filter": {"type": "patchset-created"}}`)
+	assert.Nil(suite.T(), json.Unmarshal(w.Body.Bytes(), &evaluation))
+	assert.Equal(suite.T(), 2, evaluation.Total)
+
+	// the history is read a page at a time, every page is evaluated
+	defer func(pageSize int) { evaluatePageSize = pageSize }(evaluatePageSize)
+	evaluatePageSize = 2
+	for i := 0; i < 3; i++ {
+		assert.Nil(suite.T(), store.Subscriptions.RecordEvent(gerrit.NewEvent(map[string]interface{}{"type": "change-merged", "project": "loki"})))
+	}
+	w = suite.do("POST", "/filters/evaluate", suite.adminToken, `{"filter": {"type": "change-merged"}, "limit": 1}`)
+	assert.Nil(suite.T(), json.Unmarshal(w.Body.Bytes(), &evaluation))
+	assert.Equal(suite.T(), 6, evaluation.Scanned)
+	assert.Equal(suite.T(), 3, evaluation.Total)
+	assert.Len(suite.T(), evaluation.Events, 1)
+
+	w = suite.do("POST", "/filters/evaluate", suite.lokiToken, `{"filter": {"type": "("}, "since": "yesterday"}`)
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+}
+
+func (suite *HandleTestSuite) TestObserverDeliveries() {
+	subscribe := suite.create(suite.lokiToken)
+	path := "/observers/" + strconv.Itoa(subscribe.ID) + "/deliveries"
+	assert.Nil(suite.T(), store.Subscriptions.LogDelivery(subscribe.ID, &redis.Delivery{EventID: "e1", Attempt: 1, Error: "timeout", Time: time.Now()}))
+	assert.Nil(suite.T(), store.Subscriptions.LogDelivery(subscribe.ID, &redis.Delivery{EventID: "e2", Attempt: 1, StatusCode: 200, Time: time.Now()}))
+
+	w := suite.do("GET", path+"?outcome=failure", suite.lokiToken, "")
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	var page deliveriesPage
+	assert.Nil(suite.T(), json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Equal(suite.T(), 1, page.Total)
+	assert.Equal(suite.T(), "e1", page.Deliveries[0].EventID)
+
+	w = suite.do("GET", path+"?limit=0&outcome=maybe", suite.lokiToken, "")
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+	var body ErrorBody
+	assert.Nil(suite.T(), json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Len(suite.T(), body.Error.Fields, 2)
+
+	w = suite.do("GET", path, suite.crawlToken, "")
+	assert.Equal(suite.T(), http.StatusNotFound, w.Code)
+}
+
+func (suite *HandleTestSuite) TestMetrics() {
+	w := suite.do("GET", "/metrics", "", "")
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), "# TYPE gerrit_observatory_events_received_total counter")
+	assert.Contains(suite.T(), w.Body.String(), `gerrit_observatory_queue_depth{queue="incoming"} 0`)
+}
+
+func (suite *HandleTestSuite) TestLogging() {
+	w := suite.do("GET", "/logging", suite.lokiToken, "")
+	assert.Equal(suite.T(), http.StatusForbidden, w.Code)
+
+	w = suite.do("PUT", "/logging", suite.adminToken, `{"level": "verbose"}`)
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), `"field":"level"`)
+
+	defer log.Logger.SetLevel(log.Logger.Level())
+	w = suite.do("PUT", "/logging", suite.adminToken, `{"level": "debug", "json": true}`)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.JSONEq(suite.T(), `{"level": "debug", "json": true, "redact": true}`, w.Body.String())
+	assert.Equal(suite.T(), log.LevelDebug, log.Logger.Level())
+
+	w = suite.do("PUT", "/logging", suite.adminToken, `{"json": false}`)
+	assert.JSONEq(suite.T(), `{"level": "debug", "json": false, "redact": true}`, w.Body.String())
+}
+
+func (suite *HandleTestSuite) TestReload() {
+	fake := &fakeReloader{report: config.NewReloadReport([]*config.Change{
+		{Key: "log.level", Old: "info", New: "debug"},
+		{Key: "http.listen", Old: ":8080", New: ":9090", RestartRequired: true},
+	})}
+	reloader = fake
+
+	w := suite.do("POST", "/reload", suite.lokiToken, "")
+	assert.Equal(suite.T(), http.StatusForbidden, w.Code)
+
+	w = suite.do("POST", "/reload", suite.adminToken, "")
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	var report config.ReloadReport
+	assert.Nil(suite.T(), json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(suite.T(), []string{"log.level"}, report.Applied)
+	assert.Equal(suite.T(), []string{"http.listen"}, report.RestartRequired)
+
+	fake.report, fake.err = nil, config.Errors{{Key: "redis.port", Source: "env OBSERVATORY_REDIS_PORT", Message: `expected an integer, got "x"`}}
+	w = suite.do("POST", "/reload", suite.adminToken, "")
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), `"code":"invalid_config"`)
+	assert.Contains(suite.T(), w.Body.String(), `"field":"redis.port"`)
+}
+
+func TestHandleTestSuite(t *testing.T) {
+	suite.Run(t, new(HandleTestSuite))
+}
@@ -0,0 +1,177 @@
+package http
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"gerrit-observatory/log"
+	"gerrit-observatory/redis"
+	"gerrit-observatory/store"
+)
+
+// listedStates are the states listed unless the state parameter says
+// otherwise, archived subscribes are only listed on demand
+var listedStates = []string{redis.StateActive, redis.StatePaused}
+
+// pauseRequest chooses what a paused subscribe does with the events it
+// matches, they are queued by default
+type pauseRequest struct {
+	Mode string `json:"mode"`
+}
+
+// resumeRequest tells whether the events queued while paused are delivered,
+// the default, or discarded. ExpiresAt extends an expired subscribe
+type resumeRequest struct {
+	DiscardBacklog bool       `json:"discard_backlog"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+}
+
+// parseStates reads the state parameter, a comma separated list of states
+// or all
+func parseStates(r *http.Request) (map[string]bool, []FieldError) {
+	raw := r.URL.Query().Get("state")
+	names := listedStates
+	if raw == "all" {
+		names = []string{redis.StateActive, redis.StatePaused, redis.StateArchived}
+	} else if raw != "" {
+		names = strings.Split(raw, ",")
+	}
+	states := make(map[string]bool, len(names))
+	for _, name := range names {
+		switch name {
+		case redis.StateActive, redis.StatePaused, redis.StateArchived:
+			states[name] = true
+		default:
+			return nil, []FieldError{{Field: "state", Message: "must be all or a comma separated list of active, paused and archived"}}
+		}
+	}
+	return states, nil
+}
+
+// decodeOptionalBody decodes the JSON body of r into v, an empty body keeps
+// the defaults of v
+func decodeOptionalBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return false
+	}
+	return true
+}
+
+// ObserverPauseHandler stops delivering the events of a subscribe while it
+// keeps matching them, they are queued in its backlog or skipped
+func ObserverPauseHandler(w http.ResponseWriter, r *http.Request) {
+	req := pauseRequest{Mode: redis.PauseQueue}
+
+	observerId, ok := observerIDVar(w, r)
+	if !ok || !decodeOptionalBody(w, r, &req) {
+		return
+	}
+	if req.Mode != redis.PauseQueue && req.Mode != redis.PauseSkip {
+		writeValidationError(w, []FieldError{{Field: "mode", Message: "must be queue or skip"}})
+		return
+	}
+	subscribe, ok := ownedSubscribe(w, r, observerId)
+	if !ok {
+		return
+	}
+	if subscribe.State == redis.StateArchived {
+		writeError(w, http.StatusConflict, "archived", "subscribe is archived, resume it first")
+		return
+	}
+	subscribe, err := store.Subscriptions.SetState(observerId, redis.StatePaused, req.Mode, "paused by "+caller(r).Owner)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err = observerContr.UpdateObserver(subscribe); err != nil {
+		err = observerContr.AddObserver(subscribe)
+	}
+	if err != nil {
+		log.Logger.With(log.Fields{log.FieldObserverID: observerId}).Warningf("subscribe paused but not observed, err: %v", err)
+	}
+	log.Logger.With(log.Fields{log.FieldObserverID: observerId}).Infof("subscribe paused by %s, deliveries %s", caller(r).Owner, pausedVerb(req.Mode))
+	writeJSON(w, http.StatusOK, subscribe)
+}
+
+// ObserverResumeHandler delivers again the events of a paused or archived
+// subscribe, its backlog first unless discard_backlog is set. An expired
+// subscribe is only resumed along with a later expires_at
+func ObserverResumeHandler(w http.ResponseWriter, r *http.Request) {
+	var req resumeRequest
+
+	observerId, ok := observerIDVar(w, r)
+	if !ok || !decodeOptionalBody(w, r, &req) {
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		writeValidationError(w, []FieldError{{Field: "expires_at", Message: "must be in the future"}})
+		return
+	}
+	subscribe, ok := ownedSubscribe(w, r, observerId)
+	if !ok {
+		return
+	}
+	if subscribe.State == redis.StateActive && req.ExpiresAt == nil {
+		writeJSON(w, http.StatusOK, subscribe)
+		return
+	}
+	if req.ExpiresAt != nil {
+		detail := subscribe.Detail
+		detail.ExpiresAt = req.ExpiresAt
+		if _, err := store.Subscriptions.Update(observerId, detail); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+	} else if subscribe.Expired(time.Now()) {
+		writeError(w, http.StatusConflict, "expired", "subscribe expired, resume it with a later expires_at")
+		return
+	}
+	subscribe, err := store.Subscriptions.SetState(observerId, redis.StateActive, "", "resumed by "+caller(r).Owner)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	logger := log.Logger.With(log.Fields{log.FieldObserverID: observerId})
+	if err = observerContr.ResumeObserver(subscribe, req.DiscardBacklog); err != nil {
+		logger.Warningf("subscribe resumed but not observed, err: %v", err)
+	}
+	logger.Infof("subscribe resumed by %s", caller(r).Owner)
+	writeJSON(w, http.StatusOK, subscribe)
+}
+
+// ObserverArchiveHandler stops observing a subscribe but keeps it, with its
+// statistics and delivery log, until it is resumed or purged with DELETE
+func ObserverArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	observerId, ok := observerIDVar(w, r)
+	if !ok {
+		return
+	}
+	subscribe, ok := ownedSubscribe(w, r, observerId)
+	if !ok {
+		return
+	}
+	if subscribe.State == redis.StateArchived {
+		writeJSON(w, http.StatusOK, subscribe)
+		return
+	}
+	subscribe, err := store.Subscriptions.SetState(observerId, redis.StateArchived, "", "archived by "+caller(r).Owner)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	observerContr.DetachObserver(observerId)
+	log.Logger.With(log.Fields{log.FieldObserverID: observerId}).Infof("subscribe archived by %s", caller(r).Owner)
+	writeJSON(w, http.StatusOK, subscribe)
+}
+
+func pausedVerb(mode string) string {
+	if mode == redis.PauseSkip {
+		return "skipped"
+	}
+	return "queued"
+}
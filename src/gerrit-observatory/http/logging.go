@@ -0,0 +1,60 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"gerrit-observatory/log"
+)
+
+// loggingSettings are the runtime settings of the logger
+type loggingSettings struct {
+	Level  string `json:"level"`
+	JSON   bool   `json:"json"`
+	Redact bool   `json:"redact"`
+}
+
+// loggingPatch changes the settings it carries, leaving the others alone
+type loggingPatch struct {
+	Level  *string `json:"level"`
+	JSON   *bool   `json:"json"`
+	Redact *bool   `json:"redact"`
+}
+
+func currentLogging() *loggingSettings {
+	return &loggingSettings{
+		Level:  log.Logger.Level().String(),
+		JSON:   log.Logger.JSON(),
+		Redact: log.Logger.Redact(),
+	}
+}
+
+func LoggingGetHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentLogging())
+}
+
+func LoggingPutHandler(w http.ResponseWriter, r *http.Request) {
+	var req loggingPatch
+
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+	if req.Level != nil {
+		level, err := log.ParseLevel(*req.Level)
+		if err != nil {
+			writeFieldErrors(w, "invalid_logging", "logging settings are invalid", []FieldError{{Field: "level", Message: err.Error()}})
+			return
+		}
+		log.Logger.SetLevel(level)
+	}
+	if req.JSON != nil {
+		log.Logger.SetJSON(*req.JSON)
+	}
+	if req.Redact != nil {
+		log.Logger.SetRedact(*req.Redact)
+	}
+	log.Logger.Infof("logging settings changed by %s", caller(r).Owner)
+	writeJSON(w, http.StatusOK, currentLogging())
+}
@@ -0,0 +1,142 @@
+package http
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"gerrit-observatory/log"
+	"gerrit-observatory/manifest"
+	"gerrit-observatory/redis"
+	"gerrit-observatory/store"
+)
+
+var maxManifestSize int64 = 4 << 20
+
+// importResult is the plan of an import, applied unless DryRun is set
+type importResult struct {
+	DryRun bool           `json:"dry_run"`
+	Plan   *manifest.Plan `json:"plan"`
+}
+
+// accessibleSubscribes lists the subscribes the caller may operate on
+func accessibleSubscribes(r *http.Request) ([]*redis.Subscribe, error) {
+	subscribes, err := store.Subscriptions.List()
+	if err != nil {
+		return nil, err
+	}
+	owned := make([]*redis.Subscribe, 0, len(subscribes))
+	for _, subscribe := range subscribes {
+		if canAccess(r, subscribe) {
+			owned = append(owned, subscribe)
+		}
+	}
+	return owned, nil
+}
+
+// ObserversExportHandler writes the subscribes of the caller as a manifest,
+// in JSON unless format=yaml is asked for
+func ObserversExportHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = manifest.FormatJSON
+	}
+	subscribes, err := accessibleSubscribes(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	raw, err := manifest.Encode(manifest.Export(subscribes), format)
+	if err != nil {
+		writeFieldErrors(w, "invalid_query", "invalid query parameters", []FieldError{{Field: "format", Message: err.Error()}})
+		return
+	}
+	w.Header().Set("Content-Type", "application/"+format)
+	w.WriteHeader(http.StatusOK)
+	w.Write(raw)
+}
+
+// ObserversImportHandler applies a manifest, in JSON or YAML, to the
+// subscribes of the caller. With dry_run=true only the plan is returned,
+// with prune=true the subscribes missing from the manifest are archived
+func ObserversImportHandler(w http.ResponseWriter, r *http.Request) {
+	dryRun, errDryRun := parseBoolParam(r, "dry_run")
+	prune, errPrune := parseBoolParam(r, "prune")
+	var fields []FieldError
+	if errDryRun != nil {
+		fields = append(fields, FieldError{Field: "dry_run", Message: errDryRun.Error()})
+	}
+	if errPrune != nil {
+		fields = append(fields, FieldError{Field: "prune", Message: errPrune.Error()})
+	}
+	if len(fields) > 0 {
+		writeFieldErrors(w, "invalid_query", "invalid query parameters", fields)
+		return
+	}
+
+	defer r.Body.Close()
+	raw, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxManifestSize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+	m, err := manifest.Decode(raw)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_manifest", err.Error())
+		return
+	}
+
+	token := caller(r)
+	for i, e := range m.Observers {
+		if !token.Admin && e.Owner != "" && e.Owner != token.Owner {
+			fields = append(fields, FieldError{Field: fmt.Sprintf("observers[%d].owner", i), Message: "must be " + token.Owner})
+		}
+	}
+	errs := m.Validate()
+	current, err := accessibleSubscribes(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	plan, planErrs := manifest.MakePlan(current, m, token.Owner, prune)
+	for _, e := range append(errs, planErrs...) {
+		fields = append(fields, FieldError{Field: fmt.Sprintf("observers[%d].%s", e.Index, e.Field), Message: e.Message})
+	}
+	if len(fields) > 0 {
+		writeFieldErrors(w, "invalid_manifest", "manifest validation failed", fields)
+		return
+	}
+	if dryRun {
+		writeJSON(w, http.StatusOK, &importResult{DryRun: true, Plan: plan})
+		return
+	}
+
+	gerritUser, projects := "", []string(nil)
+	for _, change := range plan.Changes {
+		if change.Action == manifest.ActionCreate {
+			var ok bool
+			if gerritUser, projects, ok = visibleProjects(w, r, nil); !ok {
+				return
+			}
+			break
+		}
+	}
+	visibility := func(string) (string, []string, error) { return gerritUser, projects, nil }
+	if applied, err := manifest.Apply(plan, observerContr, visibility); err != nil {
+		writeError(w, http.StatusInternalServerError, "import_failed",
+			fmt.Sprintf("%d of %d changes applied, %v", applied, len(plan.Changes), err))
+		return
+	}
+	log.Logger.Infof("manifest imported by %s, %d change(s), %d unchanged", token.Owner, len(plan.Changes), plan.Unchanged)
+	writeJSON(w, http.StatusOK, &importResult{Plan: plan})
+}
+
+// parseBoolParam reads an optional boolean query parameter
+func parseBoolParam(r *http.Request, name string) (bool, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(raw)
+}
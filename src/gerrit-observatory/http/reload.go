@@ -0,0 +1,31 @@
+package http
+
+import (
+	"net/http"
+
+	"gerrit-observatory/config"
+	"gerrit-observatory/log"
+)
+
+// Reloader applies the configuration again while running
+type Reloader interface {
+	Reload() (*config.ReloadReport, error)
+}
+
+func ReloadHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := reloader.Reload()
+	if errs, ok := err.(config.Errors); ok {
+		fields := make([]FieldError, 0, len(errs))
+		for _, e := range errs {
+			fields = append(fields, FieldError{Field: e.Key, Message: e.Error()})
+		}
+		writeFieldErrors(w, "invalid_config", "configuration is invalid, nothing was applied", fields)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "reload_failed", err.Error())
+		return
+	}
+	log.Logger.Infof("configuration reloaded by %s", caller(r).Owner)
+	writeJSON(w, http.StatusOK, report)
+}
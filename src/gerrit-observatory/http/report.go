@@ -0,0 +1,84 @@
+package http
+
+import (
+	"net/http"
+	"time"
+
+	"gerrit-observatory/redis"
+	"gerrit-observatory/store"
+)
+
+// defaultUnmatchedPeriod is the period of the unmatched report unless the
+// period parameter says otherwise
+const defaultUnmatchedPeriod = 7 * 24 * time.Hour
+
+// unmatchedEntry is a subscribe of the unmatched report, LastMatchTime is
+// empty when it never matched an event
+type unmatchedEntry struct {
+	ID            int    `json:"id"`
+	Name          string `json:"name,omitempty"`
+	Owner         string `json:"owner"`
+	HookURL       string `json:"hook_url"`
+	State         string `json:"state"`
+	CreatedTime   string `json:"created_time"`
+	LastMatchTime string `json:"last_match_time"`
+}
+
+// unmatchedReport lists the observed subscribes older than the period that
+// matched no event during it
+type unmatchedReport struct {
+	Period     string            `json:"period"`
+	Since      time.Time         `json:"since"`
+	Subscribes []*unmatchedEntry `json:"subscribes"`
+}
+
+// UnmatchedReportHandler reports the subscribes of the caller, every one
+// for an admin, which matched nothing during the period parameter, a
+// duration such as 72h defaulting to 7 days
+func UnmatchedReportHandler(w http.ResponseWriter, r *http.Request) {
+	period := defaultUnmatchedPeriod
+	if raw := r.URL.Query().Get("period"); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil || parsed <= 0 {
+			writeFieldErrors(w, "invalid_query", "invalid query parameters", []FieldError{{Field: "period", Message: "must be a positive duration such as 72h"}})
+			return
+		}
+		period = parsed
+	}
+	subscribes, err := store.Subscriptions.List()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	since := time.Now().Add(-period)
+	report := &unmatchedReport{Period: period.String(), Since: since, Subscribes: make([]*unmatchedEntry, 0)}
+	for _, sub := range subscribes {
+		if !canAccess(r, sub) || !sub.Observed() || !unmatchedSince(sub, since) {
+			continue
+		}
+		report.Subscribes = append(report.Subscribes, &unmatchedEntry{
+			ID:            sub.ID,
+			Name:          sub.Detail.Name,
+			Owner:         sub.Owner,
+			HookURL:       sub.Detail.HookURL,
+			State:         sub.State,
+			CreatedTime:   sub.CreatedTime,
+			LastMatchTime: sub.Stats.LastMatchTime,
+		})
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// unmatchedSince tells whether sub existed at since and matched no event
+// after it, those created later had less than the period to match
+func unmatchedSince(sub *redis.Subscribe, since time.Time) bool {
+	created, err := time.Parse(time.UnixDate, sub.CreatedTime)
+	if err != nil || created.After(since) {
+		return false
+	}
+	if sub.Stats.LastMatchTime == "" {
+		return true
+	}
+	matched, err := time.Parse(time.UnixDate, sub.Stats.LastMatchTime)
+	return err == nil && matched.Before(since)
+}
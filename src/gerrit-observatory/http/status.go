@@ -0,0 +1,136 @@
+package http
+
+import (
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+
+	"gerrit-observatory/gerrit"
+	"gerrit-observatory/observer"
+	"gerrit-observatory/store"
+)
+
+var (
+	streamMonitors []StreamMonitor
+	buildVersion   = "dev"
+	startedAt      = time.Now()
+)
+
+// StreamMonitor reports the connection of an event stream, one per gerrit
+// source
+type StreamMonitor interface {
+	Status() gerrit.StreamStatus
+}
+
+// check is the outcome of one readiness check
+type check struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type readiness struct {
+	Ready  bool     `json:"ready"`
+	Checks []*check `json:"checks"`
+}
+
+// queueDepth is the number of events waiting in a queue
+type queueDepth struct {
+	Queue string `json:"queue"`
+	Depth int    `json:"depth"`
+}
+
+type status struct {
+	Version         string                   `json:"version"`
+	GoVersion       string                   `json:"go_version"`
+	StartedAt       time.Time                `json:"started_at"`
+	UptimeSeconds   int64                    `json:"uptime_seconds"`
+	Ready           bool                     `json:"ready"`
+	Checks          []*check                 `json:"checks"`
+	Sources         []gerrit.StreamStatus    `json:"sources"`
+	ActiveObservers int                      `json:"active_observers"`
+	Queues          []queueDepth             `json:"queues"`
+	Breakers        []observer.BreakerStatus `json:"breakers"`
+	Connections     connections              `json:"connections"`
+}
+
+// connections are the POSTs to hooks in flight and their limit
+type connections struct {
+	InFlight int `json:"in_flight"`
+	Limit    int `json:"limit"`
+}
+
+// HealthzHandler answers as long as the process serves requests
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// ReadyzHandler answers 503 with the failing checks until the subscription
+// store is reachable and at least one event stream is connected
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	ready := checkReadiness()
+	code := http.StatusOK
+	if !ready.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, ready)
+}
+
+func StatusHandler(w http.ResponseWriter, r *http.Request) {
+	ready := checkReadiness()
+	incoming, observers := observerContr.QueueDepths()
+	inFlight, limit := observerContr.Connections()
+
+	ids := make([]int, 0, len(observers))
+	for id := range observers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	queues := make([]queueDepth, 0, len(ids)+1)
+	queues = append(queues, queueDepth{Queue: "incoming", Depth: incoming})
+	for _, id := range ids {
+		queues = append(queues, queueDepth{Queue: "observer:" + strconv.Itoa(id), Depth: observers[id]})
+	}
+
+	writeJSON(w, http.StatusOK, &status{
+		Version:         buildVersion,
+		GoVersion:       runtime.Version(),
+		StartedAt:       startedAt,
+		UptimeSeconds:   int64(time.Since(startedAt).Seconds()),
+		Ready:           ready.Ready,
+		Checks:          ready.Checks,
+		Sources:         streamStatuses(),
+		ActiveObservers: len(observers),
+		Queues:          queues,
+		Breakers:        observerContr.BreakerStatuses(),
+		Connections:     connections{inFlight, limit},
+	})
+}
+
+func checkReadiness() *readiness {
+	storeCheck := &check{Name: "store", OK: true}
+	if err := store.Subscriptions.Ping(); err != nil {
+		storeCheck.OK, storeCheck.Error = false, err.Error()
+	}
+	streamCheck := &check{Name: "stream", Error: "no event stream is connected"}
+	for _, s := range streamStatuses() {
+		if s.Connected {
+			streamCheck.OK, streamCheck.Error = true, ""
+			break
+		}
+	}
+	return &readiness{
+		Ready:  storeCheck.OK && streamCheck.OK,
+		Checks: []*check{storeCheck, streamCheck},
+	}
+}
+
+func streamStatuses() []gerrit.StreamStatus {
+	statuses := make([]gerrit.StreamStatus, 0, len(streamMonitors))
+	for _, monitor := range streamMonitors {
+		statuses = append(statuses, monitor.Status())
+	}
+	return statuses
+}
@@ -0,0 +1,44 @@
+package http
+
+import (
+	"net/http"
+
+	"gerrit-observatory/redis"
+)
+
+// ProjectLister resolves the projects a gerrit user is allowed to read
+type ProjectLister interface {
+	VisibleProjects(gerritUser string) ([]string, error)
+}
+
+var (
+	projectLister ProjectLister
+)
+
+// visibleProjects resolves the gerrit user bounding sub and the projects it
+// can read. sub is nil for a subscribe being created, admins without a mapped
+// user get an unrestricted subscribe
+func visibleProjects(w http.ResponseWriter, r *http.Request, sub *redis.Subscribe) (string, []string, bool) {
+	token := caller(r)
+	gerritUser := ""
+	if sub != nil {
+		gerritUser = sub.GerritUser
+	}
+	if gerritUser == "" {
+		gerritUser = token.GerritUser
+	}
+	if gerritUser == "" {
+		if token.Admin {
+			return "", nil, true
+		}
+		writeError(w, http.StatusForbidden, "forbidden", "token is not mapped to a gerrit user")
+		return "", nil, false
+	}
+
+	projects, err := projectLister.VisibleProjects(gerritUser)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "gerrit_unavailable", err.Error())
+		return "", nil, false
+	}
+	return gerritUser, projects, true
+}
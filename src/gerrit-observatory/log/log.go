@@ -1,9 +1,263 @@
 package log
 
 import (
-	"github.com/ngaut/logging"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// correlation fields shared by every package logging about events
+const (
+	FieldEventID    = "event_id"
+	FieldObserverID = "observer_id"
+	FieldSource     = "source"
 )
 
 var (
-	Logger = logging.New()
+	Logger = New(os.Stderr)
+
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	redacted     = "[redacted]"
+)
+
+// Level is the severity of a log line
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
 )
+
+var levelNames = []string{"debug", "info", "warning", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", l)
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses the name of a level, "warn" is accepted for warning
+func ParseLevel(name string) (Level, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "warn" {
+		return LevelWarning, nil
+	}
+	for i, levelName := range levelNames {
+		if levelName == name {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q, expected one of %s", name, strings.Join(levelNames, ", "))
+}
+
+// Fields are the key value pairs attached to a log line
+type Fields map[string]interface{}
+
+// StructuredLogger writes leveled log lines with fields, as text or as JSON
+// objects, its settings may be changed while it is in use
+type StructuredLogger struct {
+	sync.Mutex
+	out    io.Writer
+	level  int32
+	json   int32
+	redact int32
+}
+
+// New returns a logger writing text lines at info level to out, emails are
+// redacted
+func New(out io.Writer) *StructuredLogger {
+	return &StructuredLogger{out: out, level: int32(LevelInfo), redact: 1}
+}
+
+// SetOutput sets the destination of the log lines
+func (l *StructuredLogger) SetOutput(out io.Writer) {
+	l.Lock()
+	defer l.Unlock()
+	l.out = out
+}
+
+// SetLevel drops the lines below level
+func (l *StructuredLogger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+// Level returns the lowest level written
+func (l *StructuredLogger) Level() Level {
+	return Level(atomic.LoadInt32(&l.level))
+}
+
+// SetJSON switches between JSON objects and text lines
+func (l *StructuredLogger) SetJSON(enabled bool) {
+	atomic.StoreInt32(&l.json, boolToInt32(enabled))
+}
+
+// JSON tells whether lines are written as JSON objects
+func (l *StructuredLogger) JSON() bool {
+	return atomic.LoadInt32(&l.json) == 1
+}
+
+// SetRedact controls whether emails are masked in messages and fields
+func (l *StructuredLogger) SetRedact(enabled bool) {
+	atomic.StoreInt32(&l.redact, boolToInt32(enabled))
+}
+
+// Redact tells whether emails are masked
+func (l *StructuredLogger) Redact() bool {
+	return atomic.LoadInt32(&l.redact) == 1
+}
+
+// With returns an entry logging fields along with every line
+func (l *StructuredLogger) With(fields Fields) *Entry {
+	return &Entry{logger: l, fields: fields}
+}
+
+func (l *StructuredLogger) Debugf(format string, v ...interface{}) {
+	l.output(LevelDebug, nil, format, v...)
+}
+
+func (l *StructuredLogger) Infof(format string, v ...interface{}) {
+	l.output(LevelInfo, nil, format, v...)
+}
+
+func (l *StructuredLogger) Warningf(format string, v ...interface{}) {
+	l.output(LevelWarning, nil, format, v...)
+}
+
+func (l *StructuredLogger) Errorf(format string, v ...interface{}) {
+	l.output(LevelError, nil, format, v...)
+}
+
+// output must be called straight from a logging method so the caller is
+// reported right
+func (l *StructuredLogger) output(level Level, fields Fields, format string, v ...interface{}) {
+	if level < l.Level() {
+		return
+	}
+	now := time.Now()
+	msg := fmt.Sprintf(format, v...)
+	caller := "???"
+	if _, file, line, ok := runtime.Caller(2); ok {
+		caller = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+	if l.Redact() {
+		msg = redactString(msg)
+		fields = redactFields(fields)
+	}
+
+	var buf bytes.Buffer
+	if l.JSON() {
+		line := make(map[string]interface{}, len(fields)+4)
+		for key, value := range fields {
+			line[key] = value
+		}
+		line["time"] = now.Format(time.RFC3339Nano)
+		line["level"] = level.String()
+		line["caller"] = caller
+		line["msg"] = msg
+		if err := json.NewEncoder(&buf).Encode(line); err != nil {
+			buf.Reset()
+			fmt.Fprintf(&buf, `{"level":"error","msg":%q}`+"\n", "log line not encoded: "+err.Error())
+		}
+	} else {
+		fmt.Fprintf(&buf, "%s %s: [%s] %s", now.Format("2006/01/02 15:04:05"), caller, level, msg)
+		for _, key := range sortedKeys(fields) {
+			fmt.Fprintf(&buf, " %s=%s", key, formatValue(fields[key]))
+		}
+		buf.WriteByte('\n')
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	l.out.Write(buf.Bytes())
+}
+
+// Entry is a logger bound to fields, typically the event, observer and
+// source a line is about
+type Entry struct {
+	logger *StructuredLogger
+	fields Fields
+}
+
+// With returns an entry logging the fields of e and fields, the latter
+// taking precedence
+func (e *Entry) With(fields Fields) *Entry {
+	merged := make(Fields, len(e.fields)+len(fields))
+	for key, value := range e.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return &Entry{logger: e.logger, fields: merged}
+}
+
+func (e *Entry) Debugf(format string, v ...interface{}) {
+	e.logger.output(LevelDebug, e.fields, format, v...)
+}
+
+func (e *Entry) Infof(format string, v ...interface{}) {
+	e.logger.output(LevelInfo, e.fields, format, v...)
+}
+
+func (e *Entry) Warningf(format string, v ...interface{}) {
+	e.logger.output(LevelWarning, e.fields, format, v...)
+}
+
+func (e *Entry) Errorf(format string, v ...interface{}) {
+	e.logger.output(LevelError, e.fields, format, v...)
+}
+
+func redactString(s string) string {
+	return emailPattern.ReplaceAllString(s, redacted)
+}
+
+func redactFields(fields Fields) Fields {
+	if len(fields) == 0 {
+		return fields
+	}
+	masked := make(Fields, len(fields))
+	for key, value := range fields {
+		if s, ok := value.(string); ok {
+			value = redactString(s)
+		}
+		masked[key] = value
+	}
+	return masked
+}
+
+func formatValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+func sortedKeys(fields Fields) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,59 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestText(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf)
+
+	logger.Debugf("hidden")
+	assert.Equal(t, "", buf.String())
+
+	logger.With(Fields{FieldEventID: "abc", FieldObserverID: 3}).Warningf("hook of %s failed", "jane.doe@example.com")
+	line := buf.String()
+	assert.Contains(t, line, "log_test.go:")
+	assert.Contains(t, line, "[warning] hook of [redacted] failed event_id=abc observer_id=3\n")
+
+	buf.Reset()
+	logger.SetLevel(LevelDebug)
+	logger.SetRedact(false)
+	logger.With(Fields{"owner": "jane.doe@example.com", "comment": "two words"}).Debugf("shown")
+	assert.True(t, strings.HasSuffix(buf.String(), `[debug] shown comment="two words" owner=jane.doe@example.com`+"\n"))
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf)
+	logger.SetJSON(true)
+
+	entry := logger.With(Fields{FieldEventID: "abc", FieldSource: "review.example.com"})
+	entry.With(Fields{FieldObserverID: 7, "account": "bob@example.com"}).Errorf("not delivered")
+
+	var line map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "error", line["level"])
+	assert.Equal(t, "not delivered", line["msg"])
+	assert.Equal(t, "abc", line[FieldEventID])
+	assert.Equal(t, float64(7), line[FieldObserverID])
+	assert.Equal(t, "review.example.com", line[FieldSource])
+	assert.Equal(t, "[redacted]", line["account"])
+	assert.NotEmpty(t, line["time"])
+	assert.Contains(t, line["caller"], "log_test.go:")
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("WARN")
+	assert.Nil(t, err)
+	assert.Equal(t, LevelWarning, level)
+	level, err = ParseLevel("debug")
+	assert.Nil(t, err)
+	assert.Equal(t, "debug", level.String())
+	_, err = ParseLevel("verbose")
+	assert.NotNil(t, err)
+}
@@ -1,67 +1,183 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"gerrit-observatory/config"
 	"gerrit-observatory/gerrit"
-	"gerrit-observatory/observer"
-	"gerrit-observatory/redis"
+	"gerrit-observatory/gitops"
 	"gerrit-observatory/http"
+	"gerrit-observatory/log"
+	"gerrit-observatory/notify"
+	"gerrit-observatory/observer"
+	"gerrit-observatory/store"
+	"gerrit-observatory/trace"
 )
 
-var (
-	GerritPort  = 29418
-	GerritUser  = "autodeploy"
-	GerritHost  = "xxx"
-	PrivateKey  = "./.id_rsa"
-	RedisHost   = "127.0.0.1"
-	RedisPort   = 6379
-	RedisDB     = 0
-	PostTimeout = 60
-)
+// Version is set at build time by the Makefile
+var Version = "dev"
 
-// Config global config
-type Config struct {
-	GerritPort  int
-	GerritUser  string
-	GerritHost  string
-	PrivateKey  string
-	RedisHost   string
-	RedisPort   int
-	RedisDB     int
-	PostTimeout int
-}
+// expiryInterval is how often subscribes are checked for expiry
+const expiryInterval = time.Minute
 
 func main() {
-	config := &Config{
-		GerritPort:  GerritPort,
-		GerritUser:  GerritUser,
-		GerritHost:  GerritHost,
-		PrivateKey:  PrivateKey,
-		RedisHost:   RedisHost,
-		RedisPort:   RedisPort,
-		RedisDB:     RedisDB,
-		PostTimeout: PostTimeout,
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			os.Exit(runMigrate(os.Args[2:]))
+		case "export":
+			os.Exit(runExport(os.Args[2:]))
+		case "import":
+			os.Exit(runImport(os.Args[2:]))
+		}
 	}
 
-	redis.InitRedis(config.RedisHost, config.RedisPort, config.RedisDB)
-	defer redis.DestroyRedis()
+	conf, err := config.Load(os.Args[1:], os.Environ())
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
-	eventStream, err := gerrit.NewEventStream(config.GerritPort, config.GerritUser, config.GerritHost, config.PrivateKey)
+	applyLogging(conf)
+	if err := run(conf); err != nil {
+		log.Logger.Errorf("%v", err)
+		os.Exit(1)
+	}
+}
+
+// run starts the observatory and returns once it is shut down. Errors are
+// returned rather than exiting so the store is closed, and its pending
+// writes kept, whatever stops the observatory
+func run(conf *config.Config) error {
+	trace.Init(conf.TracingEndpoint, conf.TracingServiceName)
+	defer trace.Shutdown()
+
+	subscriptions, err := openStore(conf)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("subscription store not opened, err: %v", err)
 	}
-	observerContr := observer.NewObserverContr(eventStream.Channel, config.PostTimeout)
-	subscribes, err := redis.GetSubscribes()
+	defer closeStore(conf, subscriptions)
+	if err = migrateOnStart(conf, subscriptions); err != nil {
+		return err
+	}
+	store.Subscriptions = subscriptions
+
+	if conf.AdminToken != "" {
+		if err := saveAdminToken(conf); err != nil {
+			return fmt.Errorf("admin token not saved, err: %v", err)
+		}
+	}
+
+	eventStream, err := gerrit.NewEventStream(conf.GerritPort, conf.GerritUser, conf.GerritHost, conf.PrivateKey)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("event stream not created, err: %v", err)
+	}
+	gerritClient, err := gerrit.NewClient(conf.GerritPort, conf.GerritUser, conf.GerritHost, conf.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("gerrit client not created, err: %v", err)
+	}
+	observerContr := observer.NewObserverContr(eventStream.Channel, conf.PostTimeout)
+	observerContr.MaxAttempts = conf.DeliveryAttempts
+	observerContr.RetryInterval = time.Duration(conf.DeliveryRetryInterval) * time.Second
+	observerContr.QueueSize = conf.DeliveryQueueSize
+	observerContr.Concurrency = conf.DeliveryConcurrency
+	observerContr.SetMaxConnections(conf.DeliveryMaxConnections)
+	observerContr.SetOverflowPolicy(conf.Overflow, time.Duration(conf.OverflowBlockTimeoutMs)*time.Millisecond)
+	observerContr.SetDisablePolicy(conf.DisableAfterFailures, time.Duration(conf.DisableAfterHours)*time.Hour)
+	observerContr.SetBreakerPolicy(conf.BreakerFailures, time.Duration(conf.BreakerOpenSeconds)*time.Second, conf.BreakerMode)
+	notify.Init(conf.NotifyWebhookURL)
+	subscribes, err := store.Subscriptions.List()
+	if err != nil {
+		return fmt.Errorf("subscribes not loaded, err: %v", err)
 	}
 	for _, obs := range subscribes {
+		if !obs.Observed() {
+			continue
+		}
 		err = observerContr.AddObserver(obs)
 		if err != nil {
-			panic(err)
+			log.Logger.With(log.Fields{log.FieldObserverID: obs.ID}).Errorf("subscribe not observed, err: %v", err)
 		}
 	}
+	if conf.GitOpsProject != "" {
+		events := make(observer.EventChan, conf.DeliveryQueueSize)
+		observerContr.Tap(events)
+		go gitops.NewReconciler(gitops.Settings{
+			Project: conf.GitOpsProject,
+			Branch:  conf.GitOpsBranch,
+			Path:    conf.GitOpsPath,
+			Owner:   conf.GitOpsOwner,
+			Owners:  config.List(conf.GitOpsOwners),
+			Prune:   conf.GitOpsPrune,
+			Label:   conf.GitOpsLabel,
+		}, gerritClient, observerContr).Run(events)
+	}
 	go observerContr.Start()
+	go observerContr.WatchExpiry(expiryInterval)
+	eventStream.SetDeamon()
 	go eventStream.Run()
 
-	http.Router()
+	reloader := newReloader(os.Args[1:], conf, eventStream, gerritClient, observerContr)
+	go reloadOnHangup(reloader)
+	stopped := make(chan struct{})
+	go shutdownOnTerm(reloader, eventStream, observerContr, stopped)
+
+	log.Logger.Infof("version %s listening on %s", Version, conf.HTTPListen)
+	if err := http.Router(observerContr, gerritClient, reloader, []http.StreamMonitor{eventStream}, Version, conf.HTTPListen); err != nil {
+		// the deliveries in progress are saved before the store is closed
+		eventStream.Stop()
+		observerContr.Shutdown(time.Duration(reloader.Current().ShutdownTimeout) * time.Second)
+		return fmt.Errorf("http server stopped, err: %v", err)
+	}
+	<-stopped
+	log.Logger.Infof("shut down")
+	return nil
+}
+
+// shutdownOnTerm stops the observatory on SIGTERM or SIGINT: no more events
+// are read, the pending deliveries are given shutdown.timeout to complete
+// and the API finishes the requests in progress. A second signal kills it
+func shutdownOnTerm(r *reloader, stream *gerrit.EventStream, contr *observer.ObserverContr, stopped chan struct{}) {
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-term
+	signal.Stop(term)
+
+	timeout := time.Duration(r.Current().ShutdownTimeout) * time.Second
+	deadline := time.Now().Add(timeout)
+	log.Logger.Infof("%s received, shutting down within %s", sig, timeout)
+
+	stream.Stop()
+	contr.Shutdown(timeout)
+
+	// the API gets what is left of the deadline, and at least a second
+	if deadline.Sub(time.Now()) < time.Second {
+		deadline = time.Now().Add(time.Second)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := http.Shutdown(ctx); err != nil {
+		log.Logger.Warningf("http server not shut down gracefully, err: %v", err)
+	}
+	close(stopped)
+}
+
+// reloadOnHangup reloads the configuration on every SIGHUP
+func reloadOnHangup(r *reloader) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if _, err := r.Reload(); err != nil {
+			log.Logger.Errorf("configuration not reloaded, err: %v", err)
+		}
+	}
 }
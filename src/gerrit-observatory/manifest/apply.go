@@ -0,0 +1,149 @@
+package manifest
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"gerrit-observatory/log"
+	"gerrit-observatory/observer"
+	"gerrit-observatory/redis"
+	"gerrit-observatory/store"
+)
+
+// Observers runs the observers of the subscribes, it is the
+// observer.ObserverContr of the observatory
+type Observers interface {
+	AddObserver(sub *redis.Subscribe) error
+	UpdateObserver(sub *redis.Subscribe) error
+	DetachObserver(id int)
+}
+
+// HookURLProblem tells what is wrong with a hook url, it is empty for a
+// valid one
+func HookURLProblem(raw string) string {
+	hookURL, err := url.Parse(raw)
+	switch {
+	case raw == "":
+		return "is required"
+	case err != nil:
+		return err.Error()
+	case hookURL.Scheme != "http" && hookURL.Scheme != "https":
+		return "scheme must be http or https"
+	case hookURL.Host == "":
+		return "host is required"
+	}
+	return ""
+}
+
+// Validate checks the filter, hook url and expiry of every entry of m as
+// the API does, names are checked by MakePlan
+func (m *Manifest) Validate() []*EntryError {
+	var errs []*EntryError
+	now := time.Now()
+	for i, e := range m.Observers {
+		if e.Filter == nil {
+			errs = append(errs, &EntryError{i, "filter", "is required"})
+		}
+		for _, err := range observer.ValidateFilter(e.Filter) {
+			errs = append(errs, &EntryError{i, err.Path, err.Err.Error()})
+		}
+		if problem := HookURLProblem(e.HookURL); problem != "" {
+			errs = append(errs, &EntryError{i, "hook_url", problem})
+		}
+		if e.ExpiresAt != nil && !e.ExpiresAt.After(now) {
+			errs = append(errs, &EntryError{i, "expires_at", "must be in the future"})
+		}
+		if e.Concurrency < 0 || e.Concurrency > observer.MaxConcurrency {
+			errs = append(errs, &EntryError{i, "concurrency", fmt.Sprintf("must be between 0 and %d", observer.MaxConcurrency)})
+		}
+		if !observer.ValidOverflow(e.Overflow) {
+			errs = append(errs, &EntryError{i, "overflow", "must be block, spill, drop_oldest, drop_newest or coalesce"})
+		}
+		if field, problem := observer.DebounceProblem(e.Debounce); problem != "" {
+			errs = append(errs, &EntryError{i, field, problem})
+		}
+	}
+	return errs
+}
+
+// Visibility returns the gerrit user bounding the subscribes created for
+// owner and the projects it can read, an empty user lifts the restriction
+type Visibility func(owner string) (string, []string, error)
+
+// visibleTo is the visibility resolved for an owner
+type visibleTo struct {
+	gerritUser string
+	projects   []string
+}
+
+// Apply stores the changes of plan in order and updates their observers.
+// Created subscribes are bounded as visibility resolves for their owner,
+// once per owner. It returns the number of changes applied
+func Apply(plan *Plan, observers Observers, visibility Visibility) (int, error) {
+	resolved := make(map[string]*visibleTo)
+	for i, change := range plan.Changes {
+		if err := applyChange(change, observers, visibility, resolved); err != nil {
+			return i, fmt.Errorf("%s %s/%s failed: %v", change.Action, change.Owner, change.Name, err)
+		}
+	}
+	return len(plan.Changes), nil
+}
+
+func applyChange(change *Change, observers Observers, visibility Visibility, resolved map[string]*visibleTo) error {
+	logger := log.Logger.With(log.Fields{log.FieldObserverID: change.ID})
+	switch change.Action {
+	case ActionCreate:
+		visible, ok := resolved[change.Owner]
+		if !ok {
+			gerritUser, projects, err := visibility(change.Owner)
+			if err != nil {
+				return err
+			}
+			visible = &visibleTo{gerritUser, projects}
+			resolved[change.Owner] = visible
+		}
+		id, err := store.Subscriptions.Save(change.Owner, change.Entry.Detail(), visible.gerritUser, visible.projects)
+		if err != nil {
+			return err
+		}
+		change.ID = id
+		subscribe, err := store.Subscriptions.Get(id)
+		if err != nil {
+			return err
+		}
+		if err = observers.AddObserver(subscribe); err != nil {
+			logger.With(log.Fields{log.FieldObserverID: id}).Warningf("subscribe imported but not observed, err: %v", err)
+		}
+	case ActionUpdate:
+		subscribe, err := store.Subscriptions.Update(change.ID, change.Entry.Detail())
+		if err != nil {
+			return err
+		}
+		if subscribe.Observed() {
+			if err = observers.UpdateObserver(subscribe); err != nil {
+				err = observers.AddObserver(subscribe)
+			}
+			if err != nil {
+				logger.Warningf("subscribe imported but not observed, err: %v", err)
+			}
+		}
+	case ActionRestore:
+		if _, err := store.Subscriptions.Update(change.ID, change.Entry.Detail()); err != nil {
+			return err
+		}
+		subscribe, err := store.Subscriptions.SetState(change.ID, redis.StateActive, "", "restored by the manifest")
+		if err != nil {
+			return err
+		}
+		if err = observers.AddObserver(subscribe); err != nil {
+			logger.Warningf("subscribe restored but not observed, err: %v", err)
+		}
+	case ActionArchive:
+		if _, err := store.Subscriptions.SetState(change.ID, redis.StateArchived, "", "pruned from the manifest"); err != nil {
+			return err
+		}
+		observers.DetachObserver(change.ID)
+	}
+	return nil
+}
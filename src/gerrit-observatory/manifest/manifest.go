@@ -0,0 +1,320 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gerrit-observatory/redis"
+)
+
+// Version of the manifest format
+const Version = 1
+
+// formats a manifest is read and written in
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+)
+
+var namePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+// Manifest declares the subscribes of a deployment, as kept in git
+type Manifest struct {
+	Version   int      `json:"version"`
+	Observers []*Entry `json:"observers"`
+}
+
+// Entry declares a subscribe identified by its owner and name. The owner
+// defaults to the one importing the manifest
+type Entry struct {
+	Name        string                 `json:"name"`
+	Owner       string                 `json:"owner,omitempty"`
+	Filter      map[string]interface{} `json:"filter"`
+	HookURL     string                 `json:"hook_url"`
+	Comment     string                 `json:"comment,omitempty"`
+	ExpiresAt   *time.Time             `json:"expires_at,omitempty"`
+	Concurrency int                    `json:"concurrency,omitempty"`
+	Overflow    string                 `json:"overflow,omitempty"`
+	Debounce    *redis.Debounce        `json:"debounce,omitempty"`
+}
+
+// Detail returns the subscribe detail e declares
+func (e *Entry) Detail() redis.SubscribeDetail {
+	return redis.SubscribeDetail{Name: e.Name, Filter: e.Filter, HookURL: e.HookURL, Comment: e.Comment, ExpiresAt: e.ExpiresAt,
+		Concurrency: e.Concurrency, Overflow: e.Overflow, Debounce: e.Debounce}
+}
+
+// ValidName tells whether name can identify a subscribe
+func ValidName(name string) bool {
+	return namePattern.MatchString(name)
+}
+
+// Name returns the name sub is exported under, subscribes created without a
+// name are given one derived from their id which they adopt on import
+func Name(sub *redis.Subscribe) string {
+	if sub.Detail.Name != "" {
+		return sub.Detail.Name
+	}
+	return fmt.Sprintf("observer-%d", sub.ID)
+}
+
+// Export declares subscribes, ordered by owner and name
+func Export(subscribes []*redis.Subscribe) *Manifest {
+	m := &Manifest{Version: Version, Observers: make([]*Entry, 0, len(subscribes))}
+	for _, sub := range subscribes {
+		m.Observers = append(m.Observers, &Entry{
+			Name:        Name(sub),
+			Owner:       sub.Owner,
+			Filter:      sub.Detail.Filter,
+			HookURL:     sub.Detail.HookURL,
+			Comment:     sub.Detail.Comment,
+			ExpiresAt:   sub.Detail.ExpiresAt,
+			Concurrency: sub.Detail.Concurrency,
+			Overflow:    sub.Detail.Overflow,
+			Debounce:    sub.Detail.Debounce,
+		})
+	}
+	sort.Slice(m.Observers, func(i, j int) bool {
+		a, b := m.Observers[i], m.Observers[j]
+		return a.Owner < b.Owner || a.Owner == b.Owner && a.Name < b.Name
+	})
+	return m
+}
+
+// Encode writes m in format
+func Encode(m *Manifest, format string) ([]byte, error) {
+	switch format {
+	case FormatJSON:
+		raw, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(raw, '\n'), nil
+	case FormatYAML:
+		observers := make([]interface{}, 0, len(m.Observers))
+		for _, e := range m.Observers {
+			entry := orderedMap{{"name", e.Name}}
+			if e.Owner != "" {
+				entry = append(entry, keyValue{"owner", e.Owner})
+			}
+			entry = append(entry, keyValue{"filter", e.Filter}, keyValue{"hook_url", e.HookURL})
+			if e.Comment != "" {
+				entry = append(entry, keyValue{"comment", e.Comment})
+			}
+			if e.ExpiresAt != nil {
+				entry = append(entry, keyValue{"expires_at", e.ExpiresAt.Format(time.RFC3339)})
+			}
+			if e.Concurrency != 0 {
+				entry = append(entry, keyValue{"concurrency", float64(e.Concurrency)})
+			}
+			if e.Overflow != "" {
+				entry = append(entry, keyValue{"overflow", e.Overflow})
+			}
+			if d := e.Debounce; d != nil {
+				debounce := orderedMap{{"key", d.Key}, {"window_seconds", float64(d.Window)}}
+				if d.Batch {
+					debounce = append(debounce, keyValue{"batch", true})
+				}
+				entry = append(entry, keyValue{"debounce", debounce})
+			}
+			observers = append(observers, entry)
+		}
+		return encodeYAML(orderedMap{{"version", float64(m.Version)}, {"observers", observers}}), nil
+	}
+	return nil, fmt.Errorf("unknown manifest format %q, expected json or yaml", format)
+}
+
+// Decode reads a manifest in JSON or YAML, a document starting with { is
+// read as JSON. Unknown fields are rejected so typos do not go unnoticed
+func Decode(raw []byte) (*Manifest, error) {
+	trimmed := bytes.TrimSpace(raw)
+	if !bytes.HasPrefix(trimmed, []byte("{")) {
+		doc, err := decodeYAML(raw)
+		if err != nil {
+			return nil, err
+		}
+		if trimmed, err = json.Marshal(doc); err != nil {
+			return nil, err
+		}
+	}
+	var m Manifest
+	decoder := json.NewDecoder(bytes.NewReader(trimmed))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&m); err != nil {
+		return nil, err
+	}
+	if m.Version != Version {
+		return nil, fmt.Errorf("unsupported manifest version %d, expected %d", m.Version, Version)
+	}
+	return &m, nil
+}
+
+// Action is what importing an entry does to the stored subscribes
+type Action string
+
+const (
+	ActionCreate  Action = "create"
+	ActionUpdate  Action = "update"
+	ActionRestore Action = "restore"
+	ActionArchive Action = "archive"
+)
+
+// Change is one step of a plan. ID is zero for a creation, Fields lists
+// what an update or a restore changes
+type Change struct {
+	Action Action   `json:"action"`
+	Name   string   `json:"name"`
+	Owner  string   `json:"owner"`
+	ID     int      `json:"id,omitempty"`
+	Fields []string `json:"fields,omitempty"`
+	Entry  *Entry   `json:"-"`
+}
+
+// Plan is what importing a manifest does, unchanged subscribes are only
+// counted
+type Plan struct {
+	Changes   []*Change `json:"changes"`
+	Unchanged int       `json:"unchanged"`
+}
+
+func (p *Plan) String() string {
+	var buf bytes.Buffer
+	counts := make(map[Action]int)
+	for _, c := range p.Changes {
+		counts[c.Action]++
+		fmt.Fprintf(&buf, "%s %s/%s", c.Action, c.Owner, c.Name)
+		if c.ID != 0 {
+			fmt.Fprintf(&buf, " (id %d)", c.ID)
+		}
+		if len(c.Fields) > 0 {
+			fmt.Fprintf(&buf, ": %s", strings.Join(c.Fields, ", "))
+		}
+		buf.WriteByte('\n')
+	}
+	fmt.Fprintf(&buf, "%d to create, %d to update, %d to restore, %d to archive, %d unchanged\n",
+		counts[ActionCreate], counts[ActionUpdate], counts[ActionRestore], counts[ActionArchive], p.Unchanged)
+	return buf.String()
+}
+
+// EntryError reports an invalid entry of a manifest
+type EntryError struct {
+	Index   int
+	Field   string
+	Message string
+}
+
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("observers[%d].%s: %s", e.Index, e.Field, e.Message)
+}
+
+// MakePlan compares the entries of m with the current subscribes, those
+// owned by the importer or every subscribe for an admin. Entries without an
+// owner belong to owner. Archived subscribes m declares are restored, the
+// current subscribes missing from m are archived when prune is set, never
+// deleted
+func MakePlan(current []*redis.Subscribe, m *Manifest, owner string, prune bool) (*Plan, []*EntryError) {
+	var errs []*EntryError
+	byKey := make(map[string]*redis.Subscribe, len(current))
+	for _, sub := range current {
+		byKey[sub.Owner+"/"+Name(sub)] = sub
+	}
+
+	plan := &Plan{Changes: make([]*Change, 0)}
+	declared := make(map[string]bool, len(m.Observers))
+	for i, e := range m.Observers {
+		if e.Owner == "" {
+			e.Owner = owner
+		}
+		if !ValidName(e.Name) {
+			errs = append(errs, &EntryError{i, "name", "must be lowercase letters, digits, dots, dashes or underscores, at most 64"})
+			continue
+		}
+		key := e.Owner + "/" + e.Name
+		if declared[key] {
+			errs = append(errs, &EntryError{i, "name", fmt.Sprintf("%s is declared twice", key)})
+			continue
+		}
+		declared[key] = true
+
+		sub, ok := byKey[key]
+		if !ok {
+			plan.Changes = append(plan.Changes, &Change{Action: ActionCreate, Name: e.Name, Owner: e.Owner, Entry: e})
+			continue
+		}
+		fields := diff(sub, e)
+		if sub.State == redis.StateArchived {
+			plan.Changes = append(plan.Changes, &Change{Action: ActionRestore, Name: e.Name, Owner: e.Owner, ID: sub.ID, Fields: fields, Entry: e})
+			continue
+		}
+		if len(fields) == 0 {
+			plan.Unchanged++
+			continue
+		}
+		plan.Changes = append(plan.Changes, &Change{Action: ActionUpdate, Name: e.Name, Owner: e.Owner, ID: sub.ID, Fields: fields, Entry: e})
+	}
+	if prune {
+		for _, sub := range current {
+			if sub.State != redis.StateArchived && !declared[sub.Owner+"/"+Name(sub)] {
+				plan.Changes = append(plan.Changes, &Change{Action: ActionArchive, Name: Name(sub), Owner: sub.Owner, ID: sub.ID})
+			}
+		}
+	}
+	return plan, errs
+}
+
+// diff lists the fields of sub that importing e changes
+func diff(sub *redis.Subscribe, e *Entry) []string {
+	var fields []string
+	if sub.Detail.Name != e.Name {
+		fields = append(fields, "name")
+	}
+	if !sameJSON(sub.Detail.Filter, e.Filter) {
+		fields = append(fields, "filter")
+	}
+	if sub.Detail.HookURL != e.HookURL {
+		fields = append(fields, "hook_url")
+	}
+	if sub.Detail.Comment != e.Comment {
+		fields = append(fields, "comment")
+	}
+	if !sameTime(sub.Detail.ExpiresAt, e.ExpiresAt) {
+		fields = append(fields, "expires_at")
+	}
+	if sub.Detail.Concurrency != e.Concurrency {
+		fields = append(fields, "concurrency")
+	}
+	if sub.Detail.Overflow != e.Overflow {
+		fields = append(fields, "overflow")
+	}
+	if !sameJSON(sub.Detail.Debounce, e.Debounce) {
+		fields = append(fields, "debounce")
+	}
+	return fields
+}
+
+// sameTime compares optional times by instant
+func sameTime(a *time.Time, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// sameJSON compares values the way they are stored, as JSON
+func sameJSON(a interface{}, b interface{}) bool {
+	var x, y interface{}
+	rawA, errA := json.Marshal(a)
+	rawB, errB := json.Marshal(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	json.Unmarshal(rawA, &x)
+	json.Unmarshal(rawB, &y)
+	return reflect.DeepEqual(x, y)
+}
@@ -0,0 +1,156 @@
+package manifest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"gerrit-observatory/redis"
+)
+
+func testSubscribes() []*redis.Subscribe {
+	expiresAt := time.Date(2030, 1, 31, 12, 0, 0, 0, time.UTC)
+	return []*redis.Subscribe{
+		{ID: 1, Owner: "loki", Detail: redis.SubscribeDetail{
+			Name:        "release-builds",
+			Filter:      map[string]interface{}{"type": "patchset-created", "change": map[string]interface{}{"project": "loki"}},
+			HookURL:     "http://loki.example.com/hook",
+			Comment:     "用途说明: builds",
+			ExpiresAt:   &expiresAt,
+			Concurrency: 4,
+			Overflow:    "spill",
+			Debounce:    &redis.Debounce{Key: "change", Window: 30, Batch: true},
+		}},
+		{ID: 2, Owner: "loki", Detail: redis.SubscribeDetail{
+			Filter:  map[string]interface{}{"type": "ref-updated"},
+			HookURL: "http://loki.example.com/refs",
+		}},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	m := Export(testSubscribes())
+	assert.Equal(t, "observer-2", m.Observers[0].Name)
+	assert.Equal(t, "release-builds", m.Observers[1].Name)
+
+	for _, format := range []string{FormatJSON, FormatYAML} {
+		raw, err := Encode(m, format)
+		assert.Nil(t, err)
+		decoded, err := Decode(raw)
+		assert.Nil(t, err, format)
+		assert.Equal(t, m, decoded, format)
+	}
+
+	_, err := Encode(m, "toml")
+	assert.NotNil(t, err)
+}
+
+func TestRoundTripEmpty(t *testing.T) {
+	for _, filter := range []map[string]interface{}{
+		{},
+		{"type": "change-merged", "change": map[string]interface{}{}},
+		{"type": "comment-added", "approvals": []interface{}{}},
+	} {
+		m := Export([]*redis.Subscribe{{ID: 1, Owner: "loki", Detail: redis.SubscribeDetail{
+			Filter:  filter,
+			HookURL: "http://loki.example.com/hook",
+		}}})
+		raw, err := Encode(m, FormatYAML)
+		assert.Nil(t, err)
+		decoded, err := Decode(raw)
+		assert.Nil(t, err, string(raw))
+		assert.Equal(t, m, decoded, string(raw))
+	}
+
+	m := Export(nil)
+	raw, err := Encode(m, FormatYAML)
+	assert.Nil(t, err)
+	assert.Equal(t, "version: 1\nobservers: []\n", string(raw))
+	decoded, err := Decode(raw)
+	assert.Nil(t, err)
+	assert.Equal(t, m, decoded)
+}
+
+func TestDecodeYAML(t *testing.T) {
+	m, err := Decode([]byte(`# observers of loki
+version: 1
+observers:
+- name: release-builds
+  filter:
+    type: patchset-created
+    change: {project: loki, branch: "release-*"}
+    approvals: [Verified, 'Code-Review']
+  hook_url: http://loki.example.com/hook?from=gerrit # trailing comment
+`))
+	assert.Nil(t, err)
+	assert.Len(t, m.Observers, 1)
+	assert.Equal(t, "http://loki.example.com/hook?from=gerrit", m.Observers[0].HookURL)
+	assert.Equal(t, map[string]interface{}{
+		"type":      "patchset-created",
+		"change":    map[string]interface{}{"project": "loki", "branch": "release-*"},
+		"approvals": []interface{}{"Verified", "Code-Review"},
+	}, m.Observers[0].Filter)
+
+	_, err = Decode([]byte("version: 2\nobservers: []\n"))
+	assert.EqualError(t, err, "unsupported manifest version 2, expected 1")
+	_, err = Decode([]byte("version: 1\nobservers:\n- name: a\n  hook: http://x\n"))
+	assert.NotNil(t, err)
+	_, err = Decode([]byte("version: 1\nobservers: &anchor []\n"))
+	assert.NotNil(t, err)
+}
+
+func TestMakePlan(t *testing.T) {
+	current := testSubscribes()
+	m := Export(current)
+	m.Observers[0].Owner = ""
+
+	plan, errs := MakePlan(current, m, "loki", false)
+	assert.Empty(t, errs)
+	assert.Equal(t, 1, plan.Unchanged)
+	assert.Len(t, plan.Changes, 1)
+	assert.Equal(t, &Change{Action: ActionUpdate, Name: "observer-2", Owner: "loki", ID: 2, Fields: []string{"name"}, Entry: m.Observers[0]}, plan.Changes[0])
+
+	m.Observers[1].HookURL = "http://loki.example.com/other"
+	m.Observers[1].ExpiresAt = nil
+	m.Observers[1].Concurrency = 0
+	m.Observers[1].Debounce = &redis.Debounce{Key: "change", Window: 60}
+	m.Observers[0] = &Entry{Name: "refs", Filter: map[string]interface{}{"type": "ref-updated"}, HookURL: "http://loki.example.com/refs"}
+	plan, errs = MakePlan(current, m, "loki", true)
+	assert.Empty(t, errs)
+	assert.Equal(t, "create loki/refs\n"+
+		"update loki/release-builds (id 1): hook_url, expires_at, concurrency, debounce\n"+
+		"archive loki/observer-2 (id 2)\n"+
+		"1 to create, 1 to update, 0 to restore, 1 to archive, 0 unchanged\n", plan.String())
+
+	// archived subscribes are restored once declared again, never pruned
+	current[1].State = redis.StateArchived
+	plan, errs = MakePlan(current, m, "loki", true)
+	assert.Empty(t, errs)
+	assert.Len(t, plan.Changes, 2)
+	restored := Export(current[1:])
+	plan, errs = MakePlan(current, restored, "loki", true)
+	assert.Empty(t, errs)
+	assert.Equal(t, "restore loki/observer-2 (id 2): name\n"+
+		"archive loki/release-builds (id 1)\n"+
+		"0 to create, 0 to update, 1 to restore, 1 to archive, 0 unchanged\n", plan.String())
+
+	m.Observers = append(m.Observers, &Entry{Name: "refs"}, &Entry{Name: "Bad Name"})
+	_, errs = MakePlan(current, m, "loki", true)
+	assert.Len(t, errs, 2)
+	assert.Equal(t, "observers[2].name: loki/refs is declared twice", errs[0].Error())
+	assert.Equal(t, 3, errs[1].Index)
+}
+
+func TestValidate(t *testing.T) {
+	m := Export(testSubscribes())
+	assert.Empty(t, m.Validate())
+
+	past := time.Now().Add(-time.Minute)
+	m.Observers[1].ExpiresAt = &past
+	m.Observers[0].HookURL = "ftp://loki.example.com/refs"
+	errs := m.Validate()
+	assert.Len(t, errs, 2)
+	assert.Equal(t, "observers[0].hook_url: scheme must be http or https", errs[0].Error())
+	assert.Equal(t, "observers[1].expires_at: must be in the future", errs[1].Error())
+}
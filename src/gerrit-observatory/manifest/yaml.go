@@ -0,0 +1,519 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The YAML support covers what manifests need: block mappings and
+// sequences, flow collections, plain, single and double quoted scalars and
+// comments. Anchors, tags, multi-line scalars and multiple documents are
+// rejected or read as plain text
+
+// orderedMap is a mapping encoded with its keys in order
+type orderedMap []keyValue
+
+type keyValue struct {
+	key   string
+	value interface{}
+}
+
+// encodeYAML writes v, made of orderedMap, map[string]interface{},
+// []interface{}, strings, numbers, booleans and nil, as a YAML document
+func encodeYAML(v interface{}) []byte {
+	var buf bytes.Buffer
+	writeYAML(&buf, v, 0)
+	return buf.Bytes()
+}
+
+func writeYAML(buf *bytes.Buffer, v interface{}, indent int) {
+	pad := strings.Repeat(" ", indent)
+	if !isBlock(v) {
+		buf.WriteString(pad + yamlScalar(v) + "\n")
+		return
+	}
+	switch value := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		m := make(orderedMap, 0, len(keys))
+		for _, key := range keys {
+			m = append(m, keyValue{key, value[key]})
+		}
+		writeYAML(buf, m, indent)
+	case orderedMap:
+		for _, kv := range value {
+			buf.WriteString(pad + yamlScalar(kv.key) + ":")
+			writeNested(buf, kv.value, indent+2)
+		}
+	case []interface{}:
+		for _, item := range value {
+			buf.WriteString(pad + "-")
+			if isBlock(item) {
+				// the first line of the item goes after the dash
+				var itemBuf bytes.Buffer
+				writeYAML(&itemBuf, item, indent+2)
+				buf.WriteString(" " + strings.TrimPrefix(itemBuf.String(), pad+"  "))
+				continue
+			}
+			writeNested(buf, item, indent+2)
+		}
+	}
+}
+
+// writeNested writes v after a key or a dash
+func writeNested(buf *bytes.Buffer, v interface{}, indent int) {
+	if isBlock(v) {
+		buf.WriteString("\n")
+		writeYAML(buf, v, indent)
+		return
+	}
+	buf.WriteString(" ")
+	writeYAML(buf, v, 0)
+}
+
+// isBlock tells whether v is written as an indented block, empty
+// collections are written in flow style
+func isBlock(v interface{}) bool {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		return len(value) > 0
+	case orderedMap:
+		return len(value) > 0
+	case []interface{}:
+		return len(value) > 0
+	}
+	return false
+}
+
+func yamlScalar(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}, orderedMap:
+		return "{}"
+	case []interface{}:
+		return "[]"
+	case string:
+		if needsQuotes(value) {
+			var buf bytes.Buffer
+			encoder := json.NewEncoder(&buf)
+			encoder.SetEscapeHTML(false)
+			encoder.Encode(value)
+			return strings.TrimSpace(buf.String())
+		}
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// needsQuotes tells whether s would not read back as the same plain string
+func needsQuotes(s string) bool {
+	if s == "" || strings.TrimSpace(s) != s {
+		return true
+	}
+	if _, ok := resolvePlain(s).(string); !ok {
+		return true
+	}
+	if strings.ContainsAny(s[:1], "-?:,[]{}#&*!|>'\"%@`") {
+		return true
+	}
+	for _, r := range s {
+		if r < ' ' || r == 0x7f {
+			return true
+		}
+	}
+	return strings.Contains(s, ": ") || strings.Contains(s, " #") || strings.HasSuffix(s, ":")
+}
+
+// yamlLine is a significant line of a document
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// decodeYAML reads a document into map[string]interface{}, []interface{},
+// strings, float64, booleans and nil, like encoding/json does
+func decodeYAML(raw []byte) (interface{}, error) {
+	p := &yamlParser{}
+	for i, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimRight(stripYAMLComment(line), " \t\r")
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || trimmed == "---" && p.pos == 0 && len(p.lines) == 0 {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed in indentation", i+1)
+		}
+		if trimmed == "---" || trimmed == "..." {
+			return nil, fmt.Errorf("line %d: a single document is expected", i+1)
+		}
+		p.lines = append(p.lines, yamlLine{number: i + 1, indent: len(line) - len(trimmed), text: trimmed})
+	}
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+	v, err := p.parseBlock(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		return nil, fmt.Errorf("line %d: unexpected indentation", line.number)
+	}
+	return v, nil
+}
+
+// parseBlock reads the mapping or sequence whose lines are at indent
+func (p *yamlParser) parseBlock(indent int) (interface{}, error) {
+	line := p.lines[p.pos]
+	if line.indent != indent {
+		return nil, fmt.Errorf("line %d: unexpected indentation", line.number)
+	}
+	if isSequenceItem(line.text) {
+		return p.parseSequence(indent)
+	}
+	if _, _, ok := splitKey(line.text); ok {
+		return p.parseMapping(indent)
+	}
+	p.pos++
+	return parseFlow(line.text, line.number)
+}
+
+func (p *yamlParser) parseSequence(indent int) (interface{}, error) {
+	items := make([]interface{}, 0)
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		// a mapping key may follow a sequence nested at its indentation
+		if line.indent < indent || line.indent == indent && !isSequenceItem(line.text) {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: expected a sequence item", line.number)
+		}
+		rest := strings.TrimLeft(line.text[1:], " ")
+		if rest == "" {
+			p.pos++
+			item, err := p.parseNested(indent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			continue
+		}
+		// the item starts on the line of the dash, as if it were indented
+		// by the dash and the spaces after it
+		itemIndent := indent + len(line.text) - len(rest)
+		p.lines[p.pos] = yamlLine{number: line.number, indent: itemIndent, text: rest}
+		item, err := p.parseBlock(itemIndent)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (p *yamlParser) parseMapping(indent int) (interface{}, error) {
+	m := make(map[string]interface{})
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", line.number)
+		}
+		key, rest, ok := splitKey(line.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value, got %q", line.number, line.text)
+		}
+		if _, dup := m[key]; dup {
+			return nil, fmt.Errorf("line %d: key %q is set twice", line.number, key)
+		}
+		p.pos++
+		if rest != "" {
+			value, err := parseFlow(rest, line.number)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = value
+			continue
+		}
+		// a sequence may be nested at the indentation of its key
+		if p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isSequenceItem(p.lines[p.pos].text) {
+			value, err := p.parseSequence(indent)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = value
+			continue
+		}
+		value, err := p.parseNested(indent)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = value
+	}
+	return m, nil
+}
+
+// parseNested reads the block more indented than parent, null when absent
+func (p *yamlParser) parseNested(parent int) (interface{}, error) {
+	if p.pos >= len(p.lines) || p.lines[p.pos].indent <= parent {
+		return nil, nil
+	}
+	return p.parseBlock(p.lines[p.pos].indent)
+}
+
+func isSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitKey splits "key: value" outside of quotes and flow collections
+func splitKey(text string) (string, string, bool) {
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		return "", "", false
+	}
+	end, err := scanScalarEnd(text, 0, ":")
+	if err != nil || end >= len(text) || text[end] != ':' {
+		return "", "", false
+	}
+	if end+1 < len(text) && text[end+1] != ' ' {
+		return "", "", false
+	}
+	rawKey := strings.TrimSpace(text[:end])
+	key, err := parseScalar(rawKey)
+	if err != nil || rawKey == "" {
+		return "", "", false
+	}
+	return fmt.Sprint(key), strings.TrimSpace(text[end+1:]), true
+}
+
+// parseFlow reads a scalar or a flow collection filling the rest of a line
+func parseFlow(text string, number int) (interface{}, error) {
+	f := &flowParser{text: text}
+	v, err := f.parseValue("")
+	if err == nil {
+		f.skipSpaces()
+		if f.pos < len(f.text) {
+			err = fmt.Errorf("unexpected %q", f.text[f.pos:])
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %v", number, err)
+	}
+	return v, nil
+}
+
+type flowParser struct {
+	text string
+	pos  int
+}
+
+func (f *flowParser) skipSpaces() {
+	for f.pos < len(f.text) && f.text[f.pos] == ' ' {
+		f.pos++
+	}
+}
+
+// parseValue reads a value ending before one of the terminators, which
+// are only significant inside flow collections
+func (f *flowParser) parseValue(terminators string) (interface{}, error) {
+	f.skipSpaces()
+	if f.pos >= len(f.text) {
+		return nil, nil
+	}
+	switch f.text[f.pos] {
+	case '[':
+		f.pos++
+		items := make([]interface{}, 0)
+		for {
+			f.skipSpaces()
+			if f.pos < len(f.text) && f.text[f.pos] == ']' {
+				f.pos++
+				return items, nil
+			}
+			item, err := f.parseValue(",]")
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			if err = f.separator(']'); err != nil {
+				return nil, err
+			}
+			if f.text[f.pos-1] == ']' {
+				return items, nil
+			}
+		}
+	case '{':
+		f.pos++
+		m := make(map[string]interface{})
+		for {
+			f.skipSpaces()
+			if f.pos < len(f.text) && f.text[f.pos] == '}' {
+				f.pos++
+				return m, nil
+			}
+			key, err := f.parseValue(":,}")
+			if err != nil {
+				return nil, err
+			}
+			f.skipSpaces()
+			if f.pos >= len(f.text) || f.text[f.pos] != ':' {
+				return nil, fmt.Errorf("expected : in flow mapping")
+			}
+			f.pos++
+			value, err := f.parseValue(",}")
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprint(key)] = value
+			if err = f.separator('}'); err != nil {
+				return nil, err
+			}
+			if f.text[f.pos-1] == '}' {
+				return m, nil
+			}
+		}
+	}
+	end, err := scanScalarEnd(f.text, f.pos, terminators)
+	if err != nil {
+		return nil, err
+	}
+	raw := strings.TrimSpace(f.text[f.pos:end])
+	f.pos = end
+	return parseScalar(raw)
+}
+
+// separator consumes a comma or the closing character of a collection
+func (f *flowParser) separator(closing byte) error {
+	f.skipSpaces()
+	if f.pos >= len(f.text) {
+		return fmt.Errorf("unterminated flow collection")
+	}
+	if c := f.text[f.pos]; c == ',' || c == closing {
+		f.pos++
+		return nil
+	}
+	return fmt.Errorf("expected , or %c", closing)
+}
+
+// scanScalarEnd returns the index where the scalar starting at start ends,
+// at one of the terminators outside of quotes or at the end of text. A
+// colon only ends a scalar when followed by a space or the end of text
+func scanScalarEnd(text string, start int, terminators string) (int, error) {
+	i := start
+	for i < len(text) && text[i] == ' ' {
+		i++
+	}
+	if i < len(text) && (text[i] == '"' || text[i] == '\'') {
+		quote := text[i]
+		for i++; i < len(text); i++ {
+			if quote == '"' && text[i] == '\\' {
+				i++
+				continue
+			}
+			if text[i] == quote {
+				if quote == '\'' && i+1 < len(text) && text[i+1] == '\'' {
+					i++
+					continue
+				}
+				return i + 1, nil
+			}
+		}
+		return 0, fmt.Errorf("unterminated quoted string")
+	}
+	for ; i < len(text); i++ {
+		c := text[i]
+		if !strings.ContainsRune(terminators, rune(c)) {
+			continue
+		}
+		if c == ':' && i+1 < len(text) && text[i+1] != ' ' && !strings.ContainsRune(terminators, rune(text[i+1])) {
+			continue
+		}
+		return i, nil
+	}
+	return i, nil
+}
+
+func parseScalar(raw string) (interface{}, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	switch raw[0] {
+	case '"':
+		var s string
+		if err := json.Unmarshal([]byte(raw), &s); err != nil {
+			return nil, fmt.Errorf("invalid double quoted string %s", raw)
+		}
+		return s, nil
+	case '\'':
+		if len(raw) < 2 || raw[len(raw)-1] != '\'' {
+			return nil, fmt.Errorf("invalid single quoted string %s", raw)
+		}
+		return strings.Replace(raw[1:len(raw)-1], "''", "'", -1), nil
+	case '&', '*', '!', '|', '>':
+		return nil, fmt.Errorf("anchors, aliases, tags and block scalars are not supported: %s", raw)
+	}
+	return resolvePlain(raw), nil
+}
+
+// resolvePlain resolves the plain scalars of the YAML core schema
+func resolvePlain(raw string) interface{} {
+	switch raw {
+	case "null", "Null", "NULL", "~":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+	if n, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return float64(n)
+	}
+	// hexadecimal floats, infinities and NaN are left as strings
+	if f, err := strconv.ParseFloat(raw, 64); err == nil && strings.ContainsAny(raw, "0123456789") && !strings.ContainsAny(raw, "xXpPnN_") {
+		return f
+	}
+	return raw
+}
+
+// stripYAMLComment drops a comment starting with # at the beginning of the
+// line or after a space, outside of quotes
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if quote == '"' && c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || strings.ContainsRune(" :[{,-", rune(line[i-1])) {
+				quote = c
+			}
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
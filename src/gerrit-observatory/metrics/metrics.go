@@ -0,0 +1,261 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// DefBuckets are the default histogram buckets, in seconds
+	DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+	registry = &Registry{}
+)
+
+type collector interface {
+	write(w io.Writer)
+}
+
+// Registry holds metrics and renders them in the Prometheus text format
+type Registry struct {
+	sync.Mutex
+	collectors []collector
+	hooks      []func()
+}
+
+func (r *Registry) register(c collector) {
+	r.Lock()
+	defer r.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// OnCollect registers hook to run before every collection, it is meant to
+// refresh gauges mirroring some state such as queue lengths
+func OnCollect(hook func()) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.hooks = append(registry.hooks, hook)
+}
+
+// WriteTo renders every registered metric
+func WriteTo(w io.Writer) {
+	registry.Lock()
+	hooks := append([]func(){}, registry.hooks...)
+	collectors := append([]collector{}, registry.collectors...)
+	registry.Unlock()
+
+	for _, hook := range hooks {
+		hook()
+	}
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// Handler serves the registered metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		WriteTo(&buf)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(buf.Bytes())
+	})
+}
+
+// series is the set of label values of a metric vector
+type series struct {
+	labelValues []string
+	value       float64
+	buckets     []uint64
+	count       uint64
+}
+
+type vec struct {
+	sync.Mutex
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64
+	series     map[string]*series
+}
+
+func newVec(kind string, name string, help string, labelNames []string) *vec {
+	return &vec{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		series:     make(map[string]*series),
+	}
+}
+
+// get must be called with v locked
+func (v *vec) get(labelValues []string) *series {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		if v.buckets != nil {
+			s.buckets = make([]uint64, len(v.buckets))
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+// Reset drops every series of the vector
+func (v *vec) Reset() {
+	v.Lock()
+	defer v.Unlock()
+	v.series = make(map[string]*series)
+}
+
+func (v *vec) write(w io.Writer) {
+	v.Lock()
+	defer v.Unlock()
+
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, escape(v.help, false))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.kind)
+	for _, key := range keys {
+		s := v.series[key]
+		if v.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, v.labels(s, "", ""), formatFloat(s.value))
+			continue
+		}
+		for i, upper := range v.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labels(s, "le", formatFloat(upper)), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labels(s, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, v.labels(s, "", ""), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, v.labels(s, "", ""), s.count)
+	}
+}
+
+func (v *vec) labels(s *series, extraName string, extraValue string) string {
+	pairs := make([]string, 0, len(v.labelNames)+1)
+	for i, name := range v.labelNames {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escape(s.labelValues[i], true)))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	*vec
+}
+
+// NewCounterVec registers a counter
+func NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{newVec("counter", name, help, labelNames)}
+	registry.register(c)
+	return c
+}
+
+// Add increases the counter of labelValues by delta, delta must not be negative
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	c.Lock()
+	defer c.Unlock()
+	c.get(labelValues).value += delta
+}
+
+// Inc increases the counter of labelValues by one
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// GaugeVec is a gauge partitioned by labels
+type GaugeVec struct {
+	*vec
+}
+
+// NewGaugeVec registers a gauge
+func NewGaugeVec(name string, help string, labelNames ...string) *GaugeVec {
+	g := &GaugeVec{newVec("gauge", name, help, labelNames)}
+	registry.register(g)
+	return g
+}
+
+// Set sets the gauge of labelValues to value
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.Lock()
+	defer g.Unlock()
+	g.get(labelValues).value = value
+}
+
+// Add adds delta to the gauge of labelValues
+func (g *GaugeVec) Add(delta float64, labelValues ...string) {
+	g.Lock()
+	defer g.Unlock()
+	g.get(labelValues).value += delta
+}
+
+// HistogramVec samples observations into buckets, partitioned by labels
+type HistogramVec struct {
+	*vec
+}
+
+// NewHistogramVec registers a histogram, buckets must be sorted
+func NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	h := &HistogramVec{newVec("histogram", name, help, labelNames)}
+	h.buckets = buckets
+	registry.register(h)
+	return h
+}
+
+// Observe adds value to the histogram of labelValues
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.Lock()
+	defer h.Unlock()
+	s := h.get(labelValues)
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func escape(s string, quote bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quote {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
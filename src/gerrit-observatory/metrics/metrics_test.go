@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrite(t *testing.T) {
+	counter := &CounterVec{newVec("counter", "test_events_total", "Events.", []string{"type"})}
+	counter.Inc("patchset-created")
+	counter.Add(2, `ref"updated`)
+	var buf bytes.Buffer
+	counter.write(&buf)
+	assert.Equal(t, `# HELP test_events_total Events.
+# TYPE test_events_total counter
+test_events_total{type="patchset-created"} 1
+test_events_total{type="ref\"updated"} 2
+`, buf.String())
+
+	histogram := &HistogramVec{newVec("histogram", "test_duration_seconds", "Duration.", nil)}
+	histogram.buckets = []float64{0.1, 1}
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	histogram.Observe(5)
+	buf.Reset()
+	histogram.write(&buf)
+	assert.Equal(t, `# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1"} 1
+test_duration_seconds_bucket{le="1"} 2
+test_duration_seconds_bucket{le="+Inf"} 3
+test_duration_seconds_sum 5.55
+test_duration_seconds_count 3
+`, buf.String())
+
+	gauge := &GaugeVec{newVec("gauge", "test_depth", "Depth.", []string{"queue"})}
+	gauge.Set(3, "incoming")
+	gauge.Add(-1, "incoming")
+	gauge.Reset()
+	gauge.Set(1, "observer:1")
+	buf.Reset()
+	gauge.write(&buf)
+	assert.Contains(t, buf.String(), `test_depth{queue="observer:1"} 1`)
+	assert.NotContains(t, buf.String(), "incoming")
+}
@@ -0,0 +1,42 @@
+package metrics
+
+var (
+	EventsReceived = NewCounterVec("gerrit_observatory_events_received_total",
+		"Events read from the gerrit event stream.", "type", "source")
+	StreamReconnects = NewCounterVec("gerrit_observatory_stream_reconnects_total",
+		"Reconnections of the gerrit event stream.", "source")
+	StreamLag = NewGaugeVec("gerrit_observatory_stream_lag_seconds",
+		"Delay between eventCreatedOn and the reception of the last event.", "source")
+
+	ObserverMatched = NewCounterVec("gerrit_observatory_observer_matched_total",
+		"Events matching the filter of an observer.", "observer")
+	ObserverDelivered = NewCounterVec("gerrit_observatory_observer_delivered_total",
+		"Events accepted by the hook of an observer.", "observer")
+	ObserverFailed = NewCounterVec("gerrit_observatory_observer_failed_total",
+		"Events the hook of an observer did not accept after every attempt.", "observer")
+	DeliveryDuration = NewHistogramVec("gerrit_observatory_delivery_duration_seconds",
+		"Duration of the POST of an event to a hook.", DefBuckets, "observer")
+	EventsDropped = NewCounterVec("gerrit_observatory_events_dropped_total",
+		"Events an observer dropped, mostly because its queue was full.", "observer", "reason")
+	EventsDebounced = NewCounterVec("gerrit_observatory_events_debounced_total",
+		"Matched events an observer did not deliver on their own, a later one of their debounce key stood for them.", "observer")
+	QueueDepth = NewGaugeVec("gerrit_observatory_queue_depth",
+		"Events waiting in a queue, the incoming queue or the one of an observer.", "queue")
+	DeliveriesInFlight = NewGaugeVec("gerrit_observatory_deliveries_in_flight",
+		"POSTs to hooks in flight across the observers.")
+	BreakerState = NewGaugeVec("gerrit_observatory_breaker_state",
+		"State of the circuit breaker of an observer, 0 closed, 1 half open and 2 open.", "observer")
+	BreakerTransitions = NewCounterVec("gerrit_observatory_breaker_transitions_total",
+		"Changes of state of the circuit breaker of an observer.", "observer", "state")
+	BreakerRejected = NewCounterVec("gerrit_observatory_breaker_rejected_total",
+		"Events kept from the hook of an observer by its open circuit breaker.", "observer")
+
+	Notifications = NewCounterVec("gerrit_observatory_notifications_total",
+		"Notices posted to the owners of subscribes the observatory disabled or expired.", "event", "result")
+
+	GitOpsReconciles = NewCounterVec("gerrit_observatory_gitops_reconciles_total",
+		"Reconciliations of the subscribes with the manifest of the config repository.", "result")
+
+	RedisErrors = NewCounterVec("gerrit_observatory_redis_errors_total",
+		"Failed redis commands.", "command")
+)
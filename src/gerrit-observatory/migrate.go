@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"gerrit-observatory/config"
+	"gerrit-observatory/log"
+	"gerrit-observatory/redis"
+	"gerrit-observatory/store"
+)
+
+// openStore opens the configured subscription store, connecting to redis
+// only for the redis backend
+func openStore(conf *config.Config) (store.SubscriptionStore, error) {
+	if conf.StorageBackend == store.BackendRedis {
+		redis.SetKeyPrefix(conf.RedisKeyPrefix)
+		redis.InitRedis(conf.RedisHost, conf.RedisPort, conf.RedisDB)
+	}
+	redis.InitHistory(time.Duration(conf.HistoryRetentionHours)*time.Hour, conf.HistoryMaxEvents)
+	redis.InitDeliveryLog(time.Duration(conf.DeliveryLogRetentionHours)*time.Hour, conf.DeliveryLogMaxEntries)
+	return store.Open(conf.StorageBackend, conf.StoragePath)
+}
+
+// closeStore closes s and the redis connections openStore made for it
+func closeStore(conf *config.Config, s store.SubscriptionStore) {
+	if err := s.Close(); err != nil {
+		log.Logger.Errorf("subscription store not closed, err: %v", err)
+	}
+	if conf.StorageBackend == store.BackendRedis {
+		redis.DestroyRedis()
+	}
+}
+
+// migrateOnStart upgrades the store, or only checks it is up to date when
+// storage.migrate_on_start is off
+func migrateOnStart(conf *config.Config, s store.SubscriptionStore) error {
+	report, err := s.Migrate(!conf.StorageMigrate)
+	if err != nil {
+		return fmt.Errorf("store not migrated, err: %v", err)
+	}
+	if report.UpToDate() {
+		return nil
+	}
+	if report.DryRun {
+		return fmt.Errorf("store schema version %d is older than %d, run %s migrate", report.From, report.To, os.Args[0])
+	}
+	for _, step := range report.Steps {
+		log.Logger.Infof("store migrated to version %d, %s: %d change(s)", step.Version, step.Description, len(step.Changes))
+	}
+	return nil
+}
+
+// runMigrate is the migrate command, it prints the migrations the store
+// needs and applies them when -apply is given. The other arguments are
+// the usual configuration flags, only the storage settings are required.
+// It returns the exit code
+func runMigrate(args []string) int {
+	apply := false
+	flags := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg == "-apply" || arg == "--apply" {
+			apply = true
+			continue
+		}
+		flags = append(flags, arg)
+	}
+	conf, err := config.LoadStorage(flags, os.Environ())
+	if err == flag.ErrHelp {
+		fmt.Fprintf(os.Stderr, "usage: %s migrate [-apply] [flags], the dry run report is printed unless -apply is given\n", os.Args[0])
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	s, err := openStore(conf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "subscription store not opened, err: %v\n", err)
+		return 1
+	}
+	defer closeStore(conf, s)
+
+	report, err := s.Migrate(true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dry run failed, err: %v\n", err)
+		return 1
+	}
+	fmt.Print(report)
+	if report.UpToDate() {
+		return 0
+	}
+	if !apply {
+		fmt.Println("nothing was changed, run again with -apply to migrate")
+		return 0
+	}
+	report, err = s.Migrate(false)
+	if report != nil {
+		fmt.Print(report)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migration failed, err: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,110 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"gerrit-observatory/log"
+	"gerrit-observatory/metrics"
+	"gerrit-observatory/redis"
+)
+
+// events a notice reports
+const (
+	EventDisabled = "subscribe.disabled"
+	EventExpired  = "subscribe.expired"
+)
+
+var (
+	mu         sync.Mutex
+	webhookURL string
+	client     = &http.Client{Timeout: 10 * time.Second}
+	// pending lets tests wait for the notices being posted
+	pending sync.WaitGroup
+)
+
+// Notice tells the owner of a subscribe that the observatory changed its
+// state without being asked to
+type Notice struct {
+	Event       string    `json:"event"`
+	SubscribeID int       `json:"subscribe_id"`
+	Name        string    `json:"name,omitempty"`
+	Owner       string    `json:"owner"`
+	HookURL     string    `json:"hook_url"`
+	State       string    `json:"state"`
+	Reason      string    `json:"reason"`
+	Time        time.Time `json:"time"`
+}
+
+// Init sets the url notices are POSTed to, they are only logged when it is
+// empty
+func Init(url string) {
+	mu.Lock()
+	defer mu.Unlock()
+	webhookURL = url
+}
+
+// Send logs a notice of event for the owner of sub, and POSTs it to the
+// notification webhook in the background
+func Send(event string, sub *redis.Subscribe) {
+	n := &Notice{
+		Event:       event,
+		SubscribeID: sub.ID,
+		Name:        sub.Detail.Name,
+		Owner:       sub.Owner,
+		HookURL:     sub.Detail.HookURL,
+		State:       sub.State,
+		Reason:      sub.StateReason,
+		Time:        time.Now(),
+	}
+	logger := log.Logger.With(log.Fields{log.FieldObserverID: sub.ID})
+	logger.Warningf("notifying %s: %s, %s", n.Owner, event, n.Reason)
+
+	mu.Lock()
+	url := webhookURL
+	mu.Unlock()
+	if url == "" {
+		return
+	}
+	pending.Add(1)
+	go func() {
+		defer pending.Done()
+		result := "sent"
+		if err := post(url, n); err != nil {
+			result = "failed"
+			logger.Errorf("notice %s not sent, err: %v", event, err)
+		}
+		metrics.Notifications.Inc(event, result)
+	}()
+}
+
+// Wait returns once the notices sent so far are posted
+func Wait() {
+	pending.Wait()
+}
+
+func post(url string, n *Notice) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "Gerrit_Observatory")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package notify
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gerrit-observatory/redis"
+)
+
+func TestSend(t *testing.T) {
+	notices := make(chan *Notice, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n Notice
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&n))
+		notices <- &n
+	}))
+	defer server.Close()
+
+	expiresAt := time.Now()
+	sub := &redis.Subscribe{
+		ID:          7,
+		Owner:       "loki",
+		Detail:      redis.SubscribeDetail{Name: "nightly", HookURL: "http://loki/hook", ExpiresAt: &expiresAt},
+		State:       redis.StateArchived,
+		StateReason: "expired at " + expiresAt.Format(time.RFC3339),
+	}
+	Send(EventExpired, sub)
+
+	Init(server.URL)
+	defer Init("")
+	Send(EventExpired, sub)
+	Wait()
+	n := <-notices
+	assert.Equal(t, EventExpired, n.Event)
+	assert.Equal(t, 7, n.SubscribeID)
+	assert.Equal(t, "nightly", n.Name)
+	assert.Equal(t, "loki", n.Owner)
+	assert.Equal(t, redis.StateArchived, n.State)
+	assert.Equal(t, sub.StateReason, n.Reason)
+	assert.Len(t, notices, 0)
+
+	Init("http://127.0.0.1:1/")
+	Send(EventDisabled, sub)
+	Wait()
+}
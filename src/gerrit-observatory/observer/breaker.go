@@ -0,0 +1,293 @@
+package observer
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"gerrit-observatory/gerrit"
+	"gerrit-observatory/log"
+	"gerrit-observatory/metrics"
+	"gerrit-observatory/redis"
+	"gerrit-observatory/store"
+	"gerrit-observatory/trace"
+)
+
+// states of a circuit breaker
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// what an observer does with the events it matches while its breaker is
+// open: fail counts them as failed without POSTing them, queue keeps them
+// in the backlog until a probe closes the breaker
+const (
+	BreakerFail  = "fail"
+	BreakerQueue = "queue"
+)
+
+// breakerPolicy holds the breaker settings of a controller, the breakers
+// never open when failures is zero
+type breakerPolicy struct {
+	failures int
+	cooldown time.Duration
+	mode     string
+}
+
+// breaker stops the POSTs to a hook which failed a number of attempts in a
+// row. Once open for the cooldown it lets a single probe through, which
+// closes it again when accepted and opens it anew otherwise
+type breaker struct {
+	sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	rejected int64
+	// probing is set while the probe of a half open breaker is in flight,
+	// the attempts of the other lanes are rejected until it is recorded
+	probing bool
+}
+
+// BreakerStatus reports the breaker of an observer, Rejected counts the
+// events it kept from the hook
+type BreakerStatus struct {
+	Observer            int        `json:"observer"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	Rejected            int64      `json:"rejected"`
+}
+
+func newBreaker() *breaker {
+	return &breaker{state: BreakerClosed}
+}
+
+// allow tells whether an attempt may be made at now, an open breaker turns
+// half open, letting the attempt through as its probe, once the cooldown
+// elapsed. Only that attempt is let through until its outcome is recorded
+func (b *breaker) allow(now time.Time, policy breakerPolicy) (allowed bool, changed bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.state == BreakerClosed {
+		return true, false
+	}
+	if policy.failures <= 0 {
+		b.state, b.failures, b.probing = BreakerClosed, 0, false
+		return true, true
+	}
+	if b.state == BreakerHalfOpen {
+		if b.probing {
+			b.rejected++
+			return false, false
+		}
+		b.probing = true
+		return true, false
+	}
+	if now.Sub(b.openedAt) < policy.cooldown {
+		b.rejected++
+		return false, false
+	}
+	b.state, b.probing = BreakerHalfOpen, true
+	return true, true
+}
+
+// record counts the outcome of an attempt made at now, it tells whether the
+// breaker changed state
+func (b *breaker) record(succeeded bool, now time.Time, policy breakerPolicy) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	b.probing = false
+	if succeeded {
+		b.failures = 0
+		if b.state == BreakerClosed {
+			return false
+		}
+		b.state = BreakerClosed
+		return true
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.state == BreakerClosed && policy.failures > 0 && b.failures >= policy.failures {
+		b.state, b.openedAt = BreakerOpen, now
+		return true
+	}
+	return false
+}
+
+// probeIn returns how long is left at now before an open breaker may be
+// probed
+func (b *breaker) probeIn(now time.Time, policy breakerPolicy) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.state != BreakerOpen {
+		return 0
+	}
+	if wait := b.openedAt.Add(policy.cooldown).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+func (b *breaker) status(id int) BreakerStatus {
+	b.Lock()
+	defer b.Unlock()
+
+	status := BreakerStatus{Observer: id, State: b.state, ConsecutiveFailures: b.failures, Rejected: b.rejected}
+	if b.state != BreakerClosed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	return status
+}
+
+// SetBreakerPolicy opens the breaker of an observer after failures failed
+// attempts in a row, for cooldown before it is probed. Mode is BreakerFail
+// or BreakerQueue, failures zero disables the breakers
+func (contr *ObserverContr) SetBreakerPolicy(failures int, cooldown time.Duration, mode string) {
+	contr.Lock()
+	defer contr.Unlock()
+	contr.BreakerFailures = failures
+	contr.BreakerCooldown = cooldown
+	contr.BreakerMode = mode
+}
+
+func (contr *ObserverContr) breakerPolicy() breakerPolicy {
+	contr.Lock()
+	defer contr.Unlock()
+	return breakerPolicy{failures: contr.BreakerFailures, cooldown: contr.BreakerCooldown, mode: contr.BreakerMode}
+}
+
+// BreakerStatuses reports the breakers of the running observers, ordered by
+// subscribe id
+func (contr *ObserverContr) BreakerStatuses() []BreakerStatus {
+	contr.Lock()
+	defer contr.Unlock()
+
+	statuses := make([]BreakerStatus, 0, len(contr.ObserverMap))
+	for id, element := range contr.ObserverMap {
+		statuses = append(statuses, element.Value.(*Observer).breaker.status(id))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Observer < statuses[j].Observer })
+	return statuses
+}
+
+// collectBreakers refreshes the breaker state gauge, 0 for closed, 1 for
+// half open and 2 for open
+func (contr *ObserverContr) collectBreakers() {
+	metrics.BreakerState.Reset()
+	for _, status := range contr.BreakerStatuses() {
+		value := 0.0
+		switch status.State {
+		case BreakerHalfOpen:
+			value = 1
+		case BreakerOpen:
+			value = 2
+		}
+		metrics.BreakerState.Set(value, strconv.Itoa(status.Observer))
+	}
+}
+
+// allowAttempt asks the breaker of obs whether the hook may be POSTed to
+func (obs *Observer) allowAttempt(msg *gerrit.Event) bool {
+	allowed, changed := obs.breaker.allow(time.Now(), obs.contr.breakerPolicy())
+	if changed {
+		obs.breakerChanged(msg)
+	}
+	return allowed
+}
+
+// recordAttempt feeds the outcome of an attempt to the breaker of obs, it
+// tells whether the breaker is now open
+func (obs *Observer) recordAttempt(msg *gerrit.Event, succeeded bool) bool {
+	if obs.breaker.record(succeeded, time.Now(), obs.contr.breakerPolicy()) {
+		obs.breakerChanged(msg)
+	}
+	return obs.breaker.status(obs.subscribe.ID).State == BreakerOpen
+}
+
+func (obs *Observer) breakerChanged(msg *gerrit.Event) {
+	status := obs.breaker.status(obs.subscribe.ID)
+	metrics.BreakerTransitions.Inc(strconv.Itoa(obs.subscribe.ID), status.State)
+	logger := obs.logger(msg)
+	switch status.State {
+	case BreakerOpen:
+		logger.Warningf("circuit breaker open after %d failed attempts", status.ConsecutiveFailures)
+	case BreakerHalfOpen:
+		logger.Infof("circuit breaker half open, probing the hook")
+	default:
+		logger.Infof("circuit breaker closed")
+	}
+}
+
+// queuesWhileOpen tells whether the breaker of obs is open, not yet due
+// for a probe, and keeps the events in the backlog meanwhile. A failed
+// event is then queued rather than failed
+func (obs *Observer) queuesWhileOpen() bool {
+	policy := obs.contr.breakerPolicy()
+	return policy.mode == BreakerQueue && obs.breaker.probeIn(time.Now(), policy) > 0
+}
+
+// reject handles msg, matched while the breaker of obs is open, failing it
+// or keeping it in the backlog until the breaker is probed
+func (obs *Observer) reject(msg *gerrit.Event, delta redis.StatsDelta, span *trace.Span) redis.StatsDelta {
+	label := strconv.Itoa(obs.subscribe.ID)
+	metrics.BreakerRejected.Inc(label)
+	span.SetAttribute("breaker", BreakerOpen)
+	if obs.contr.breakerPolicy().mode != BreakerQueue {
+		delta.Failed = 1
+		metrics.ObserverFailed.Inc(label)
+		span.SetError("circuit breaker open")
+		return delta
+	}
+	if err := store.Subscriptions.SaveBacklog(obs.subscribe.ID, msg); err != nil {
+		obs.logger(msg).Errorf("event not kept in backlog, err: %v", err)
+		obs.logDrop(msg, DropBacklog)
+		delta.Dropped = 1
+		return delta
+	}
+	obs.armProbe()
+	return delta
+}
+
+// armProbe schedules the delivery of the backlog once the open breaker of
+// obs may be probed
+func (obs *Observer) armProbe() {
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+
+	if obs.probeArmed {
+		return
+	}
+	obs.probeArmed = true
+	time.AfterFunc(obs.breaker.probeIn(time.Now(), obs.contr.breakerPolicy()), func() {
+		select {
+		case obs.probeDue <- struct{}{}:
+		default:
+		}
+	})
+}
+
+// probePending tells whether events queued by the breaker of obs wait for
+// a probe, the new events then queue behind them
+func (obs *Observer) probePending() bool {
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	return obs.probeArmed
+}
+
+// runProbe delivers the backlog queued while the breaker of obs was open,
+// its first event probes the hook. The lanes are idle by then, so the
+// events they queued are part of it
+func (obs *Observer) runProbe() {
+	obs.inflight.Wait()
+	obs.mu.Lock()
+	obs.probeArmed = false
+	obs.mu.Unlock()
+	log.Logger.With(log.Fields{log.FieldObserverID: obs.subscribe.ID}).Debugf("delivering the events queued by the circuit breaker")
+	obs.replayBacklog()
+}
@@ -0,0 +1,213 @@
+package observer
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gerrit-observatory/gerrit"
+	"gerrit-observatory/metrics"
+	"gerrit-observatory/redis"
+	"gerrit-observatory/trace"
+)
+
+// debounce keys, what the matched events held back together share
+const (
+	// DebounceChange holds back the events of a change
+	DebounceChange = "change"
+	// DebounceTopic holds back the events of the changes of a topic
+	DebounceTopic = "topic"
+	// DebounceBranch holds back the events of the changes and ref updates
+	// of a branch of a project
+	DebounceBranch = "branch"
+	// DebounceProject holds back the events of a project
+	DebounceProject = "project"
+)
+
+// MaxDebounceWindow bounds the debounce window of a subscribe, in seconds
+const MaxDebounceWindow = 3600
+
+// batchField lists, in the event delivered for a batch, the data of every
+// event it stands for, oldest first
+const batchField = "batch"
+
+// debounceWindow holds the matched events of a debounce key from the first
+// one until the window closes, delta is what was counted of them so far
+type debounceWindow struct {
+	events []*gerrit.Event
+	delta  redis.StatsDelta
+	opened time.Time
+	closes time.Time
+}
+
+// DebounceProblem returns the field of d that is not valid and why, or
+// empty strings when d is valid. A nil d does not debounce
+func DebounceProblem(d *redis.Debounce) (field string, problem string) {
+	if d == nil {
+		return "", ""
+	}
+	switch d.Key {
+	case DebounceChange, DebounceTopic, DebounceBranch, DebounceProject:
+	default:
+		return "debounce.key", "must be change, topic, branch or project"
+	}
+	if d.Window < 1 || d.Window > MaxDebounceWindow {
+		return "debounce.window_seconds", fmt.Sprintf("must be between 1 and %d", MaxDebounceWindow)
+	}
+	return "", ""
+}
+
+// debounceKey returns what msg is held back with, events lacking it, such
+// as those of a change without a topic, are not held back
+func debounceKey(msg *gerrit.Event, key string) (string, bool) {
+	change, _ := msg.Data["change"].(map[string]interface{})
+	switch key {
+	case DebounceChange:
+		if change != nil {
+			return orderingKey(msg), true
+		}
+	case DebounceTopic:
+		if topic, _ := change["topic"].(string); topic != "" {
+			return "topic:" + topic, true
+		}
+	case DebounceBranch:
+		if branch, _ := change["branch"].(string); branch != "" {
+			return fmt.Sprintf("branch:%s:%s", msg.Project(), branch), true
+		}
+		if ref, ok := msg.Data["refUpdate"].(map[string]interface{}); ok {
+			if refName, _ := ref["refName"].(string); strings.HasPrefix(refName, "refs/heads/") {
+				return fmt.Sprintf("branch:%s:%s", msg.Project(), strings.TrimPrefix(refName, "refs/heads/")), true
+			}
+		}
+	case DebounceProject:
+		if project := msg.Project(); project != "" {
+			return "project:" + project, true
+		}
+	}
+	return "", false
+}
+
+// debounce holds the matched msg back when the subscribe of obs debounces
+// its key, the window of the key opens with its first event. Unless a batch
+// is delivered, msg supersedes the event held before it. It tells whether
+// msg was held back, its span is then ended
+func (obs *Observer) debounce(msg *gerrit.Event, delta redis.StatsDelta, span *trace.Span) bool {
+	settings := obs.subscribe.Detail.Debounce
+	if settings == nil {
+		return false
+	}
+	key, ok := debounceKey(msg, settings.Key)
+	if !ok {
+		return false
+	}
+	span.SetAttribute("debounce.key", key)
+	span.End()
+
+	w, ok := obs.debounced[key]
+	if !ok {
+		window := time.Duration(settings.Window) * time.Second
+		now := time.Now()
+		w = &debounceWindow{opened: now, closes: now.Add(window)}
+		obs.debounced[key] = w
+		time.AfterFunc(window, func() {
+			select {
+			case obs.debounceDue <- struct{}{}:
+			default:
+			}
+		})
+	}
+	if !settings.Batch && len(w.events) > 0 {
+		superseded := w.delta
+		superseded.Debounced = 1
+		metrics.EventsDebounced.Inc(strconv.Itoa(obs.subscribe.ID))
+		obs.logger(w.events[0]).Debugf("event superseded within the debounce window of %s", key)
+		obs.record(w.events[0], superseded)
+		w.events, w.delta = w.events[:0], redis.StatsDelta{}
+	}
+	w.events = append(w.events, msg)
+	w.delta.Seen += delta.Seen
+	w.delta.Matched += delta.Matched
+	return true
+}
+
+// flushDebounced delivers the events held back by obs whose window closed
+// at now, or those of every window when all is set, oldest window first
+func (obs *Observer) flushDebounced(now time.Time, all bool) {
+	closed := make([]*debounceWindow, 0, len(obs.debounced))
+	keys := make(map[*debounceWindow]string, len(obs.debounced))
+	for key, w := range obs.debounced {
+		if all || !now.Before(w.closes) {
+			closed = append(closed, w)
+			keys[w] = key
+			delete(obs.debounced, key)
+		}
+	}
+	sort.Slice(closed, func(i, j int) bool { return closed[i].opened.Before(closed[j].opened) })
+	for _, w := range closed {
+		obs.release(keys[w], w)
+	}
+}
+
+// release delivers the events w held back for key, the latest of them or a
+// batch of them all
+func (obs *Observer) release(key string, w *debounceWindow) {
+	msg := w.events[len(w.events)-1]
+	delta := w.delta
+	span := trace.StartSpan(msg.Trace, "observer.debounce", trace.KindInternal)
+	span.SetAttribute("event.id", msg.ID)
+	span.SetAttribute("observer.id", obs.subscribe.ID)
+	span.SetAttribute("debounce.key", key)
+	span.SetAttribute("debounce.events", len(w.events))
+	if obs.isDisabled() {
+		span.SetAttribute("paused", redis.PauseSkip)
+		delta.Skipped = int64(len(w.events))
+		span.End()
+		obs.record(msg, delta)
+		return
+	}
+	if len(w.events) > 1 {
+		msg = batchEvent(w.events)
+		delta.Debounced = int64(len(w.events) - 1)
+		metrics.EventsDebounced.Add(float64(delta.Debounced), strconv.Itoa(obs.subscribe.ID))
+	}
+	obs.send(msg, delta, span)
+}
+
+// batchEvent returns the latest of events along with the data of them all,
+// those of the batches among events are listed in their place. It keeps
+// the id of the latest event so the delivery can be traced back to it
+func batchEvent(events []*gerrit.Event) *gerrit.Event {
+	latest := events[len(events)-1]
+	batch := make([]interface{}, 0, len(events))
+	for _, e := range events {
+		if inner, ok := e.Data[batchField].([]interface{}); ok {
+			batch = append(batch, inner...)
+			continue
+		}
+		batch = append(batch, e.Data)
+	}
+	data := make(map[string]interface{}, len(latest.Data)+1)
+	for k, v := range latest.Data {
+		data[k] = v
+	}
+	data[batchField] = batch
+	return &gerrit.Event{ID: latest.ID, Source: latest.Source, ReceivedAt: latest.ReceivedAt, Data: data, Trace: latest.Trace}
+}
+
+// persistDebounced persists the events held back by obs, the superseded
+// ones are already counted
+func (obs *Observer) persistDebounced() {
+	windows := make([]*debounceWindow, 0, len(obs.debounced))
+	for key, w := range obs.debounced {
+		windows = append(windows, w)
+		delete(obs.debounced, key)
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].opened.Before(windows[j].opened) })
+	var events []*gerrit.Event
+	for _, w := range windows {
+		events = append(events, w.events...)
+	}
+	obs.persist(events...)
+}
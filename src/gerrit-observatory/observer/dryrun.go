@@ -0,0 +1,117 @@
+package observer
+
+import (
+	"errors"
+	"time"
+
+	"gerrit-observatory/gerrit"
+	"gerrit-observatory/redis"
+	"gerrit-observatory/store"
+)
+
+var (
+	testScanEvents = 1000
+
+	// ErrNoRecentEvent is returned when no recent event can be used to test a subscribe
+	ErrNoRecentEvent = errors.New("no recent event matches the subscribe")
+)
+
+// TestResult reports how a subscribe handles one event
+type TestResult struct {
+	Event    *gerrit.Event   `json:"event"`
+	Visible  bool            `json:"visible"`
+	Matched  bool            `json:"matched"`
+	Mismatch *Mismatch       `json:"mismatch,omitempty"`
+	Delivery *DeliveryResult `json:"delivery,omitempty"`
+}
+
+// TestObserver evaluates sub against msg without touching the running
+// observers. A nil msg picks the newest event of the history sub would
+// receive, the event is POSTed to the hook when deliver is set and its
+// project is visible
+func (contr *ObserverContr) TestObserver(sub *redis.Subscribe, msg *gerrit.Event, deliver bool) (*TestResult, error) {
+	obs, err := NewObserver(sub, nil, contr)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		events, err := store.Subscriptions.GetEvents(time.Time{}, testScanEvents)
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range events {
+			if obs.canSee(event) && explainCompare(obs.subscribeFilter, event.Data, "filter") == nil {
+				msg = event
+				break
+			}
+		}
+		if msg == nil {
+			return nil, ErrNoRecentEvent
+		}
+	}
+
+	result := &TestResult{
+		Event:    msg,
+		Visible:  obs.canSee(msg),
+		Mismatch: explainCompare(obs.subscribeFilter, msg.Data, "filter"),
+	}
+	result.Matched = result.Mismatch == nil
+	if deliver && result.Visible {
+		result.Delivery = obs.deliver(msg, msg.Trace, 1)
+	}
+	return result, nil
+}
+
+// Evaluation summarises the events of the history a filter matches
+type Evaluation struct {
+	Since     time.Time       `json:"since"`
+	Scanned   int             `json:"scanned"`
+	Total     int             `json:"total"`
+	Events    []*gerrit.Event `json:"events"`
+	ByType    map[string]int  `json:"by_type"`
+	ByProject map[string]int  `json:"by_project"`
+}
+
+// EvaluateFilter matches filter against every event of the history received
+// since since, read pageSize at a time, and returns limit of those matched.
+// Only events of visibleProjects are considered unless it is nil
+func EvaluateFilter(filter map[string]interface{}, visibleProjects []string, since time.Time, pageSize int, limit int) (*Evaluation, error) {
+	compiled := make(map[string]interface{})
+	if err := mustCompileFilter(filter, compiled); err != nil {
+		return nil, err
+	}
+	if oldest := time.Now().Add(-redis.HistoryRetention()); since.Before(oldest) {
+		since = oldest
+	}
+	visible := visibleSet(visibleProjects)
+	evaluation := &Evaluation{
+		Since:     since,
+		Events:    make([]*gerrit.Event, 0),
+		ByType:    make(map[string]int),
+		ByProject: make(map[string]int),
+	}
+	until := time.Now()
+	for offset, more := 0, true; more; offset += pageSize {
+		var events []*gerrit.Event
+		var err error
+		if events, more, err = store.Subscriptions.GetEventsPage(since, until, offset, pageSize); err != nil {
+			return nil, err
+		}
+		for _, event := range events {
+			if !isVisible(visible, event) {
+				continue
+			}
+			evaluation.Scanned++
+			if explainCompare(compiled, event.Data, "filter") != nil {
+				continue
+			}
+			evaluation.Total++
+			evaluation.ByType[event.Type()]++
+			evaluation.ByProject[event.Project()]++
+			if len(evaluation.Events) < limit {
+				evaluation.Events = append(evaluation.Events, event)
+			}
+		}
+	}
+	return evaluation, nil
+}
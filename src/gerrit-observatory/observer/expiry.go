@@ -0,0 +1,122 @@
+package observer
+
+import (
+	"fmt"
+	"time"
+
+	"gerrit-observatory/log"
+	"gerrit-observatory/notify"
+	"gerrit-observatory/redis"
+	"gerrit-observatory/store"
+)
+
+// SetDisablePolicy pauses the subscribes whose deliveries failed failures
+// times in a row, or kept failing for failing, zero disables either bound
+func (contr *ObserverContr) SetDisablePolicy(failures int, failing time.Duration) {
+	contr.Lock()
+	defer contr.Unlock()
+	contr.DisableAfterFailures = failures
+	contr.DisableAfterFailing = failing
+}
+
+func (contr *ObserverContr) disablePolicy() (int, time.Duration) {
+	contr.Lock()
+	defer contr.Unlock()
+	return contr.DisableAfterFailures, contr.DisableAfterFailing
+}
+
+// disableReason tells why the disable policy of contr pauses a subscribe
+// with stats at now, it is empty while the subscribe is given more time
+func (contr *ObserverContr) disableReason(stats *redis.SubscribeStats, now time.Time) string {
+	failures, failing := contr.disablePolicy()
+	if failures > 0 && stats.ConsecutiveFailures >= int64(failures) {
+		return fmt.Sprintf("disabled after %d consecutive failed deliveries", stats.ConsecutiveFailures)
+	}
+	if failing > 0 && stats.FailingFor(now) >= failing {
+		return fmt.Sprintf("disabled after failing deliveries since %s", stats.FailingSince)
+	}
+	return ""
+}
+
+// afterFailure applies the disable policy once a delivery of obs failed,
+// the lanes of obs do so one at a time
+func (obs *Observer) afterFailure() {
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	if !obs.disabled {
+		obs.disabled = obs.checkFailing()
+	}
+}
+
+func (obs *Observer) isDisabled() bool {
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	return obs.disabled
+}
+
+// checkFailing pauses the subscribe of obs, skipping its deliveries, once
+// the disable policy gives up on its hook. It tells whether it did so
+func (obs *Observer) checkFailing() bool {
+	id := obs.subscribe.ID
+	logger := log.Logger.With(log.Fields{log.FieldObserverID: id})
+	stats, err := store.Subscriptions.GetStats(id)
+	if err != nil {
+		logger.Warningf("disable policy not checked, err: %v", err)
+		return false
+	}
+	reason := obs.contr.disableReason(stats, time.Now())
+	if reason == "" {
+		return false
+	}
+	sub, err := store.Subscriptions.SetState(id, redis.StatePaused, redis.PauseSkip, reason)
+	if err != nil {
+		logger.Errorf("subscribe not disabled, err: %v", err)
+		return false
+	}
+	if err = obs.contr.UpdateObserver(sub); err != nil {
+		logger.Warningf("subscribe disabled but not observed, err: %v", err)
+	}
+	notify.Send(notify.EventDisabled, sub)
+	return true
+}
+
+// WatchExpiry archives the subscribes reaching their expiry time, checking
+// every interval until the incoming queue is closed
+func (contr *ObserverContr) WatchExpiry(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		contr.ExpireSubscribes(time.Now())
+		select {
+		case <-ticker.C:
+		case <-contr.stopped:
+			return
+		}
+	}
+}
+
+// ExpireSubscribes archives the subscribes expired at now, stops their
+// observers and notifies their owners. It returns the ids archived
+func (contr *ObserverContr) ExpireSubscribes(now time.Time) []int {
+	subscribes, err := store.Subscriptions.List()
+	if err != nil {
+		log.Logger.Errorf("expired subscribes not listed, err: %v", err)
+		return nil
+	}
+	expired := make([]int, 0)
+	for _, sub := range subscribes {
+		if !sub.Observed() || !sub.Expired(now) {
+			continue
+		}
+		reason := fmt.Sprintf("expired at %s", sub.Detail.ExpiresAt.Format(time.RFC3339))
+		archived, err := store.Subscriptions.SetState(sub.ID, redis.StateArchived, "", reason)
+		if err != nil {
+			log.Logger.With(log.Fields{log.FieldObserverID: sub.ID}).Errorf("expired subscribe not archived, err: %v", err)
+			continue
+		}
+		contr.DetachObserver(sub.ID)
+		notify.Send(notify.EventExpired, archived)
+		expired = append(expired, sub.ID)
+	}
+	return expired
+}
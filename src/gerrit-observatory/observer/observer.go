@@ -3,18 +3,29 @@ package observer
 import (
 	"bytes"
 	"container/list"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"gerrit-observatory/gerrit"
 	"gerrit-observatory/log"
+	"gerrit-observatory/metrics"
 	"gerrit-observatory/redis"
+	"gerrit-observatory/store"
+	"gerrit-observatory/trace"
 )
 
-type EventChan chan map[string]interface{}
+type EventChan chan *gerrit.Event
 
 type ObserverContr struct {
 	*sync.Mutex
@@ -22,24 +33,145 @@ type ObserverContr struct {
 	observers     *list.List
 	ObserverMap   map[int]*list.Element
 	Timeout       int
+	// MaxAttempts bounds the POSTs of one event, retries wait RetryInterval
+	// times the number of attempts already made
+	MaxAttempts   int
+	RetryInterval time.Duration
+	// QueueSize is the number of events an observer may have pending
+	QueueSize int
+	// Concurrency is the number of deliveries an observer makes at once
+	// unless its subscribe sets one, connections bounds them across the
+	// observers
+	Concurrency int
+	connections *limiter
+	// Overflow is the overflow policy of the observers whose subscribe has
+	// none, BlockTimeout bounds the wait of the block policy
+	Overflow     string
+	BlockTimeout time.Duration
+	// DisableAfterFailures and DisableAfterFailing bound the failed
+	// deliveries of a subscribe before it is paused, zero never pauses
+	DisableAfterFailures int
+	DisableAfterFailing  time.Duration
+	// BreakerFailures failed attempts in a row open the breaker of an
+	// observer for BreakerCooldown, BreakerMode tells what happens to the
+	// events matched meanwhile
+	BreakerFailures int
+	BreakerCooldown time.Duration
+	BreakerMode     string
+	// taps receive every dispatched event along with the observers
+	taps []EventChan
+
+	// stopped is closed once the incoming queue is closed and drained, ctx
+	// is cancelled when a shutdown runs out of time
+	stopped chan struct{}
+	ctx     context.Context
+	abort   context.CancelFunc
+	// running counts the observers started, detached ones included until
+	// their queue is drained
+	running sync.WaitGroup
 }
 
 type Observer struct {
 	http.Client
 	subscribe       *redis.Subscribe
 	subscribeFilter map[string]interface{}
+	visibleProjects map[string]bool
 	eventChan       EventChan
 	contr           *ObserverContr
+	// previous is the observer obs replaced, obs waits for it to drain its
+	// queue so events of a subscribe are still handled in order
+	previous *Observer
+	// discardBacklog drops the events held while paused instead of
+	// delivering them when obs starts
+	discardBacklog bool
+	// mu guards what the lanes of obs share: disabled is set once the
+	// disable policy paused the subscribe of obs, the events left in its
+	// queue are skipped, probeArmed once the breaker queued events, which
+	// are delivered when probeDue fires
+	mu         sync.Mutex
+	disabled   bool
+	probeArmed bool
+	probeDue   chan struct{}
+	// spilling is set while the events go to redis rather than the queue of
+	// obs, spillDue fires once they do. spillMu is never held while taking
+	// another lock
+	spillMu  sync.Mutex
+	spilling bool
+	spillDue chan struct{}
+	// debounced holds the matched events of every debounce key until the
+	// window of the key closes, debounceDue fires once one did. Only the
+	// goroutine of obs touches them
+	debounced   map[string]*debounceWindow
+	debounceDue chan struct{}
+	// breaker is handed over to the observers replacing obs
+	breaker *breaker
+	// sending is held while an event waits for room in the queue of obs,
+	// which is only closed with sending locked. detached is closed first so
+	// the wait gives up
+	sending  sync.RWMutex
+	detached chan struct{}
+	// lanes deliver the matched events when the subscribe makes more than
+	// one delivery at a time, the events of an ordering key always go
+	// through the same lane. inflight counts the events dispatched to the
+	// lanes and not yet handled
+	lanes        []chan *laneItem
+	lanesStarted bool
+	lanesDone    sync.WaitGroup
+	inflight     sync.WaitGroup
+	done         chan struct{}
+}
+
+func NewObserverContr(c chan *gerrit.Event, Timeout int) *ObserverContr {
+	contr := &ObserverContr{
+		Mutex:           &sync.Mutex{},
+		incomingEvent:   c,
+		observers:       list.New(),
+		ObserverMap:     make(map[int]*list.Element),
+		Timeout:         Timeout,
+		MaxAttempts:     3,
+		RetryInterval:   5 * time.Second,
+		QueueSize:       100,
+		Concurrency:     1,
+		connections:     newLimiter(64),
+		Overflow:        OverflowDropNewest,
+		BlockTimeout:    500 * time.Millisecond,
+		BreakerFailures: 5,
+		BreakerCooldown: time.Minute,
+		BreakerMode:     BreakerFail,
+		stopped:         make(chan struct{}),
+	}
+	contr.ctx, contr.abort = context.WithCancel(context.Background())
+	metrics.OnCollect(contr.collectQueueDepth)
+	metrics.OnCollect(contr.collectBreakers)
+	metrics.OnCollect(contr.collectConnections)
+	return contr
+}
+
+// collectQueueDepth refreshes the queue depth gauge with the current length
+// of the incoming queue and of the queue of every observer
+func (contr *ObserverContr) collectQueueDepth() {
+	incoming, observers := contr.QueueDepths()
+
+	metrics.QueueDepth.Reset()
+	metrics.QueueDepth.Set(float64(incoming), "incoming")
+	for id, depth := range observers {
+		metrics.QueueDepth.Set(float64(depth), "observer:"+strconv.Itoa(id))
+	}
 }
 
-func NewObserverContr(c chan map[string]interface{}, Timeout int) *ObserverContr {
-	return &ObserverContr{
-		Mutex:         &sync.Mutex{},
-		incomingEvent: c,
-		observers:     list.New(),
-		ObserverMap:   make(map[int]*list.Element),
-		Timeout:       Timeout,
+// QueueDepths returns the number of events waiting to be dispatched and,
+// by subscribe id, those waiting in the queue and lanes of every running
+// observer
+func (contr *ObserverContr) QueueDepths() (incoming int, observers map[int]int) {
+	contr.Lock()
+	defer contr.Unlock()
+
+	observers = make(map[int]int, len(contr.ObserverMap))
+	for id, element := range contr.ObserverMap {
+		observer := element.Value.(*Observer)
+		observers[id] = len(observer.eventChan) + observer.lanesDepth()
 	}
+	return len(contr.incomingEvent), observers
 }
 
 func NewObserver(sub *redis.Subscribe, ch EventChan, contr *ObserverContr) (obs *Observer, err error) {
@@ -51,28 +183,113 @@ func NewObserver(sub *redis.Subscribe, ch EventChan, contr *ObserverContr) (obs
 		Client:          http.Client{Timeout: time.Duration(contr.Timeout) * time.Second},
 		subscribe:       sub,
 		subscribeFilter: filter,
+		visibleProjects: visibleSet(sub.VisibleProjects),
 		eventChan:       ch,
 		contr:           contr,
+		breaker:         newBreaker(),
+		probeDue:        make(chan struct{}, 1),
+		spillDue:        make(chan struct{}, 1),
+		debounced:       make(map[string]*debounceWindow),
+		debounceDue:     make(chan struct{}, 1),
+		detached:        make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	if n := concurrency(sub, contr.Concurrency); n > 1 {
+		obs.lanes = make([]chan *laneItem, n)
+		for i := range obs.lanes {
+			obs.lanes[i] = make(chan *laneItem, contr.QueueSize)
+		}
 	}
 	return
 }
 
+// Reconfigure changes the delivery settings, observers are replaced when
+// their queue, lanes or http client change, their pending events are still
+// delivered, in order, before the new observers start
+func (contr *ObserverContr) Reconfigure(timeout int, maxAttempts int, retryInterval time.Duration, queueSize int, concurrency int) {
+	contr.Lock()
+	defer contr.Unlock()
+
+	replace := timeout != contr.Timeout || queueSize != contr.QueueSize || concurrency != contr.Concurrency
+	contr.Timeout = timeout
+	contr.MaxAttempts = maxAttempts
+	contr.RetryInterval = retryInterval
+	contr.QueueSize = queueSize
+	contr.Concurrency = concurrency
+	if !replace {
+		return
+	}
+	for id, element := range contr.ObserverMap {
+		old := element.Value.(*Observer)
+		observer, err := NewObserver(old.subscribe, make(EventChan, contr.QueueSize), contr)
+		if err != nil {
+			log.Logger.With(log.Fields{log.FieldObserverID: id}).Errorf("observer not reconfigured, err: %v", err)
+			continue
+		}
+		contr.swap(id, observer)
+	}
+}
+
+// retryPolicy returns the attempts an event is given and the base interval
+// between them
+func (contr *ObserverContr) retryPolicy() (int, time.Duration) {
+	contr.Lock()
+	defer contr.Unlock()
+	return contr.MaxAttempts, contr.RetryInterval
+}
+
 func (contr *ObserverContr) Start() {
+	defer close(contr.stopped)
 	for {
-		msg := <-contr.incomingEvent
+		msg, ok := <-contr.incomingEvent
+		if !ok {
+			log.Logger.Infof("incoming queue closed, no more events are dispatched")
+			return
+		}
 
-		for e := contr.observers.Front(); e != nil; e = e.Next() {
-			observer := e.Value.(*Observer)
+		span := trace.StartSpan(msg.Trace, "observer.dispatch", trace.KindInternal)
+		span.SetAttribute("event.id", msg.ID)
+		logger := eventLogger(msg)
+		if err := store.Subscriptions.RecordEvent(msg); err != nil {
+			logger.Warningf("event not recorded in history, err: %v", err)
+			span.SetAttribute("history.error", err.Error())
+		}
+		dropped := 0
+		contr.Lock()
+		for _, tap := range contr.taps {
 			select {
-			case observer.eventChan <- msg:
-				log.Logger.Infof("event: %v pushed to observer: %v", msg, observer)
+			case tap <- msg:
 			default:
-				log.Logger.Warningf("event: %v NOT pushed to observer: %v", msg, observer)
+				logger.Warningf("event not tapped, tap queue full")
 			}
 		}
+		span.SetAttribute("observers", contr.observers.Len())
+		var blocked []*Observer
+		for e := contr.observers.Front(); e != nil; e = e.Next() {
+			observer := e.Value.(*Observer)
+			n, full := contr.push(observer, msg)
+			dropped += n
+			if full {
+				blocked = append(blocked, observer)
+			}
+		}
+		contr.Unlock()
+		for _, observer := range blocked {
+			dropped += contr.block(observer, msg)
+		}
+		span.SetAttribute("dropped", dropped)
+		span.End()
 	}
 }
 
+// Tap sends every dispatched event to ch as well, events are skipped while
+// ch is full so a slow reader does not hold the observers back
+func (contr *ObserverContr) Tap(ch EventChan) {
+	contr.Lock()
+	defer contr.Unlock()
+	contr.taps = append(contr.taps, ch)
+}
+
 func (contr *ObserverContr) AddObserver(sub *redis.Subscribe) (err error) {
 	contr.Lock()
 	defer contr.Unlock()
@@ -80,126 +297,558 @@ func (contr *ObserverContr) AddObserver(sub *redis.Subscribe) (err error) {
 	if _, ok := contr.ObserverMap[sub.ID]; ok {
 		return fmt.Errorf("subscribe id %d already added", sub.ID)
 	}
-	eventChan := make(EventChan, 100)
+	eventChan := make(EventChan, contr.QueueSize)
 	observer, err := NewObserver(sub, eventChan, contr)
 	if err != nil {
 		return err
 	}
+	observer.followSpilled(nil)
+	contr.running.Add(1)
 	go observer.Start()
 	element := contr.observers.PushFront(observer)
 	contr.ObserverMap[sub.ID] = element
 	return
 }
 
+// RemoveObserver archives the subscribe of id and stops its observer
 func (contr *ObserverContr) RemoveObserver(id int) (err error) {
 	contr.Lock()
 	defer contr.Unlock()
 
-	element, ok := contr.ObserverMap[id]
-	if !ok {
+	if _, ok := contr.ObserverMap[id]; !ok {
 		return fmt.Errorf("subscribe id %d not existed", id)
 	}
-	observer := element.Value.(*Observer)
-	if !observer.subscribe.Valid {
-		return fmt.Errorf("subscribe id %d already removed", id)
+	if _, err = store.Subscriptions.SetState(id, redis.StateArchived, "", "removed"); err != nil {
+		return
+	}
+	contr.detach(id)
+	return
+}
+
+// UpdateObserver replaces the running observer of sub.ID with one built from
+// sub, the filter of sub is compiled before the old observer is stopped
+func (contr *ObserverContr) UpdateObserver(sub *redis.Subscribe) (err error) {
+	contr.Lock()
+	defer contr.Unlock()
+
+	if _, ok := contr.ObserverMap[sub.ID]; !ok {
+		return fmt.Errorf("subscribe id %d not existed", sub.ID)
+	}
+	eventChan := make(EventChan, contr.QueueSize)
+	observer, err := NewObserver(sub, eventChan, contr)
+	if err != nil {
+		return err
+	}
+	contr.swap(sub.ID, observer)
+	return
+}
+
+// swap stops the observer of id once its queue is drained and starts
+// observer in its place, it must be called with contr locked
+func (contr *ObserverContr) swap(id int, observer *Observer) {
+	if element, ok := contr.ObserverMap[id]; ok {
+		observer.previous = element.Value.(*Observer)
+		observer.breaker = observer.previous.breaker
 	}
-	if err = observer.subscribe.Invalid(); err != nil {
+	observer.followSpilled(observer.previous)
+	contr.detach(id)
+	contr.running.Add(1)
+	go observer.Start()
+	element := contr.observers.PushFront(observer)
+	contr.ObserverMap[id] = element
+}
+
+// DetachObserver stops the observer of id without touching its subscribe,
+// it is a no-op if the observer is not running
+func (contr *ObserverContr) DetachObserver(id int) {
+	contr.Lock()
+	defer contr.Unlock()
+
+	contr.detach(id)
+}
+
+// detach must be called with contr locked
+func (contr *ObserverContr) detach(id int) {
+	element, ok := contr.ObserverMap[id]
+	if !ok {
 		return
 	}
+	observer := element.Value.(*Observer)
 	contr.observers.Remove(element)
+	delete(contr.ObserverMap, id)
+	// an event waiting for room gives up before the queue is closed
+	close(observer.detached)
+	observer.sending.Lock()
 	close(observer.eventChan)
-	return
+	observer.sending.Unlock()
 }
 
+// Start handles the events of obs until its queue is closed, the events it
+// held back are then delivered at once, or until a shutdown aborts, in which
+// case the events left are persisted. A new observer first handles the
+// events persisted by the last shutdown
 func (obs *Observer) Start() {
+	defer obs.contr.running.Done()
+	defer close(obs.done)
+	if obs.previous != nil {
+		<-obs.previous.done
+		obs.previous = nil
+	} else {
+		obs.replayPending()
+	}
+	if obs.subscribe.State == redis.StateActive {
+		obs.replayBacklog()
+	}
+	obs.startLanes()
+	defer obs.stopLanes()
 	for {
-		msg, ok := <-obs.eventChan
-		if !ok {
-			// TODO: log here
-			obs.contr.Lock()
-			defer obs.contr.Unlock()
-			delete(obs.contr.ObserverMap, obs.subscribe.ID)
-			break
+		select {
+		case msg, ok := <-obs.eventChan:
+			if !ok {
+				obs.flushDebounced(time.Now(), true)
+				log.Logger.With(log.Fields{log.FieldObserverID: obs.subscribe.ID}).Infof("observer stopped")
+				return
+			}
+			obs.process(msg)
+		case <-obs.probeDue:
+			obs.runProbe()
+		case <-obs.spillDue:
+			if !obs.catchUp() {
+				obs.flushDebounced(time.Now(), true)
+				log.Logger.With(log.Fields{log.FieldObserverID: obs.subscribe.ID}).Infof("observer stopped")
+				return
+			}
+		case <-obs.debounceDue:
+			obs.flushDebounced(time.Now(), false)
+		case <-obs.contr.ctx.Done():
+			// the events in the lanes and those held back are older than
+			// those left in the queue
+			obs.stopLanes()
+			obs.persistDebounced()
+			obs.persistQueue()
+			return
 		}
-		matched, err := msgCompare(obs.subscribeFilter, msg)
-		if err != nil {
-			// TODO: log here
+	}
+}
+
+// process handles msg and records the outcome in the statistics of obs,
+// a matched msg may be held back by the debounce of the subscribe
+func (obs *Observer) process(msg *gerrit.Event) {
+	delta, span, deliver := obs.match(msg)
+	if !deliver {
+		span.End()
+		obs.record(msg, delta)
+		return
+	}
+	if obs.debounce(msg, delta, span) {
+		return
+	}
+	obs.send(msg, delta, span)
+}
+
+// send delivers the matched msg and records the outcome, the delivery is
+// left to a lane once they are started
+func (obs *Observer) send(msg *gerrit.Event, delta redis.StatsDelta, span *trace.Span) {
+	if obs.lanesStarted {
+		obs.dispatch(&laneItem{msg: msg, delta: delta, span: span})
+		return
+	}
+	delta = obs.deliverMatched(msg, delta, span, obs.persist)
+	span.End()
+	obs.record(msg, delta)
+}
+
+// record adds delta to the statistics of obs, a failed delivery is checked
+// against the disable policy
+func (obs *Observer) record(msg *gerrit.Event, delta redis.StatsDelta) {
+	if err := store.Subscriptions.AddStats(obs.subscribe.ID, delta); err != nil {
+		obs.logger(msg).Warningf("stats not updated, err: %v", err)
+	}
+	if delta.Failed > 0 {
+		obs.afterFailure()
+	}
+}
+
+// handle filters and delivers msg, reporting the outcome as statistics
+func (obs *Observer) handle(msg *gerrit.Event) redis.StatsDelta {
+	delta, span, deliver := obs.match(msg)
+	defer span.End()
+	if !deliver {
+		return delta
+	}
+	return obs.deliverMatched(msg, delta, span, obs.persist)
+}
+
+// match filters msg and tells whether it is to be delivered, the events
+// matched while the subscribe is paused are held. The span returned is
+// ended once msg is handled
+func (obs *Observer) match(msg *gerrit.Event) (redis.StatsDelta, *trace.Span, bool) {
+	span := trace.StartSpan(msg.Trace, "observer.handle", trace.KindInternal)
+	span.SetAttribute("event.id", msg.ID)
+	span.SetAttribute("observer.id", obs.subscribe.ID)
+
+	delta := redis.StatsDelta{Seen: 1}
+	if !obs.canSee(msg) {
+		obs.logger(msg).Debugf("event of project %q not visible to observer", msg.Project())
+		span.SetAttribute("visible", false)
+		return delta, span, false
+	}
+	span.SetAttribute("visible", true)
+
+	matchSpan := trace.StartSpan(span.Context(), "observer.match", trace.KindInternal)
+	mismatch := explainCompare(obs.subscribeFilter, msg.Data, "filter")
+	matchSpan.SetAttribute("matched", mismatch == nil)
+	if mismatch != nil {
+		matchSpan.SetAttribute("mismatch.path", mismatch.Path)
+		matchSpan.SetAttribute("mismatch.reason", mismatch.Reason)
+	}
+	matchSpan.End()
+	if mismatch != nil {
+		obs.logger(msg).Debugf("event does not match filter at %s: %s", mismatch.Path, mismatch.Reason)
+		return delta, span, false
+	}
+	delta.Matched = 1
+	metrics.ObserverMatched.Inc(strconv.Itoa(obs.subscribe.ID))
+	if obs.isDisabled() {
+		span.SetAttribute("paused", redis.PauseSkip)
+		delta.Skipped = 1
+		return delta, span, false
+	}
+	if obs.subscribe.State == redis.StatePaused {
+		return obs.hold(msg, delta, span), span, false
+	}
+	return delta, span, true
+}
+
+// deliverMatched delivers msg, which matched the filter of obs, and adds
+// the outcome to delta. An event interrupted by shutdown is handed to
+// requeue and counted once delivered again, one kept from the hook by an
+// open breaker is rejected
+func (obs *Observer) deliverMatched(msg *gerrit.Event, delta redis.StatsDelta, span *trace.Span, requeue func(events ...*gerrit.Event)) redis.StatsDelta {
+	label := strconv.Itoa(obs.subscribe.ID)
+	// events queued by the breaker go first, the new ones wait behind them
+	if obs.probePending() || !obs.allowAttempt(msg) {
+		return obs.reject(msg, delta, span)
+	}
+	delivered, attempts := obs.deliverWithRetry(msg, span.Context())
+	if !delivered && obs.contr.aborted() {
+		requeue(msg)
+		span.SetError("shutdown")
+		return redis.StatsDelta{}
+	}
+	delta.Retried = int64(attempts - 1)
+	span.SetAttribute("attempts", attempts)
+	if !delivered && obs.queuesWhileOpen() {
+		return obs.reject(msg, delta, span)
+	}
+	if delivered {
+		delta.Delivered = 1
+		metrics.ObserverDelivered.Inc(label)
+		span.SetOK()
+	} else {
+		delta.Failed = 1
+		metrics.ObserverFailed.Inc(label)
+		span.SetError("delivery failed")
+	}
+	return delta
+}
+
+// deliverWithRetry POSTs msg until the hook accepts it, the attempts of the
+// controller are exhausted or the breaker opens, every attempt is kept in
+// the delivery log
+func (obs *Observer) deliverWithRetry(msg *gerrit.Event, parent trace.SpanContext) (delivered bool, attempts int) {
+	matchedTime := time.Now()
+	for attempt := 1; ; attempt++ {
+		result := obs.deliver(msg, parent, attempt)
+		metrics.DeliveryDuration.Observe(result.LatencyMs/1000, strconv.Itoa(obs.subscribe.ID))
+		delivery := &redis.Delivery{
+			EventID:      msg.ID,
+			EventType:    msg.Type(),
+			MatchedTime:  matchedTime,
+			Time:         time.Now(),
+			Attempt:      attempt,
+			StatusCode:   result.StatusCode,
+			LatencyMs:    result.LatencyMs,
+			Error:        result.Error,
+			ResponseBody: result.Body,
 		}
-		if !matched {
-			log.Logger.Warningf("event:%v not match filter:%v", msg, obs.subscribeFilter)
-			continue
+		if err := store.Subscriptions.LogDelivery(obs.subscribe.ID, delivery); err != nil {
+			obs.logger(msg).Warningf("delivery attempt %d not logged, err: %v", attempt, err)
 		}
-		bodyBytes, err := json.Marshal(msg)
-		if err != nil {
-			// TODO: log here
+		open := obs.recordAttempt(msg, result.Succeeded())
+		if result.Succeeded() {
+			obs.logger(msg).Infof("event delivered, attempt: %d, status: %d", attempt, result.StatusCode)
+			return true, attempt
 		}
-		req, err := http.NewRequest("POST", obs.subscribe.Detail.HookURL, bytes.NewReader(bodyBytes))
-		req.Header.Set("User-Agent", "Gerrit_Observatory")
-		resp, err := obs.Do(req)
-		if err != nil {
-			log.Logger.Warningf("callbak %v err, err: %v", obs.subscribe.Detail.HookURL, err.Error())
+		obs.logger(msg).Warningf("delivery to %s failed, attempt: %d, err: %v", obs.subscribe.Detail.HookURL, attempt, result.Error)
+		maxAttempts, retryInterval := obs.contr.retryPolicy()
+		if attempt >= maxAttempts || open {
+			return false, attempt
 		}
-		if !(resp.StatusCode >= 200 || resp.StatusCode < 400) {
-			log.Logger.Warningf("callbak %v err, status_code: %v", obs.subscribe.Detail.HookURL, resp.StatusCode)
+		select {
+		case <-time.After(time.Duration(attempt) * retryInterval):
+		case <-obs.contr.ctx.Done():
+			return false, attempt
 		}
-		err = obs.subscribe.Activate()
-		if err != nil {
-			// TODO: log here
+	}
+}
+
+// maxResponseBody bounds the part of a hook response kept for reporting
+const maxResponseBody = 4096
+
+// DeliveryResult reports one POST of an event to a hook
+type DeliveryResult struct {
+	StatusCode int     `json:"status_code"`
+	LatencyMs  float64 `json:"latency_ms"`
+	Body       string  `json:"body"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// Succeeded tells whether the hook accepted the event
+func (r *DeliveryResult) Succeeded() bool {
+	return r.Error == ""
+}
+
+// deliver POSTs the payload of msg to the hook of obs, the request carries
+// a traceparent header continuing the trace of parent
+func (obs *Observer) deliver(msg *gerrit.Event, parent trace.SpanContext, attempt int) (result *DeliveryResult) {
+	span := trace.StartSpan(parent, "hook.post", trace.KindClient)
+	span.SetAttribute("event.id", msg.ID)
+	span.SetAttribute("observer.id", obs.subscribe.ID)
+	span.SetAttribute("http.method", "POST")
+	span.SetAttribute("http.url", obs.subscribe.Detail.HookURL)
+	span.SetAttribute("attempt", attempt)
+	defer func() {
+		span.SetAttribute("http.status_code", result.StatusCode)
+		if result.Succeeded() {
+			span.SetOK()
+		} else {
+			span.SetError(result.Error)
 		}
+		span.End()
+	}()
+
+	result = &DeliveryResult{}
+	bodyBytes, err := json.Marshal(msg.Data)
+	if err != nil {
+		result.Error = err.Error()
+		return result
 	}
+	req, err := http.NewRequest("POST", obs.subscribe.Detail.HookURL, bytes.NewReader(bodyBytes))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	req = req.WithContext(obs.contr.ctx)
+	req.Header.Set("User-Agent", "Gerrit_Observatory")
+	req.Header.Set("Content-Type", "application/json")
+	span.Inject(req.Header)
+
+	release, err := obs.contr.connections.acquire(obs.contr.ctx)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer release()
+	begin := time.Now()
+	resp, err := obs.Do(req)
+	if err != nil {
+		result.LatencyMs = msSince(begin)
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
+	result.LatencyMs = msSince(begin)
+	result.StatusCode = resp.StatusCode
+	result.Body = string(body)
+	if err != nil {
+		result.Error = err.Error()
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		result.Error = fmt.Sprintf("unexpected status code %d", resp.StatusCode)
+	}
+	return result
+}
+
+// eventLogger logs with the correlation fields of msg
+func eventLogger(msg *gerrit.Event) *log.Entry {
+	return log.Logger.With(log.Fields{log.FieldEventID: msg.ID, log.FieldSource: msg.Source})
+}
+
+// logger logs with the correlation fields of msg and obs
+func (obs *Observer) logger(msg *gerrit.Event) *log.Entry {
+	return eventLogger(msg).With(log.Fields{log.FieldObserverID: obs.subscribe.ID})
+}
+
+func msSince(begin time.Time) float64 {
+	return float64(time.Since(begin)) / float64(time.Millisecond)
+}
+
+// canSee tells whether the owner of obs may read the project msg belongs to,
+// events without a project are only delivered to unrestricted observers
+func (obs *Observer) canSee(msg *gerrit.Event) bool {
+	return isVisible(obs.visibleProjects, msg)
+}
+
+// visibleSet indexes projects, a nil projects stands for every project
+func visibleSet(projects []string) map[string]bool {
+	if projects == nil {
+		return nil
+	}
+	visible := make(map[string]bool, len(projects))
+	for _, project := range projects {
+		visible[project] = true
+	}
+	return visible
+}
+
+func isVisible(visible map[string]bool, msg *gerrit.Event) bool {
+	if visible == nil {
+		return true
+	}
+	return visible[msg.Project()]
+}
+
+// FilterError describes an invalid value found at Path of a subscribe filter
+type FilterError struct {
+	Path string
+	Err  error
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Err)
+}
+
+// FilterErrors collects every FilterError found while compiling a filter
+type FilterErrors []*FilterError
+
+func (errs FilterErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, e := range errs {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ValidateFilter reports every invalid value of raw, the result is empty when
+// raw can be compiled
+func ValidateFilter(raw map[string]interface{}) FilterErrors {
+	if err := mustCompileFilter(raw, make(map[string]interface{})); err != nil {
+		return err.(FilterErrors)
+	}
+	return nil
 }
 
 func mustCompileFilter(raw map[string]interface{}, target map[string]interface{}) error {
+	var errs FilterErrors
+	compileFilter(raw, target, "filter", &errs)
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Path < errs[j].Path })
+		return errs
+	}
+	return nil
+}
+
+func compileFilter(raw map[string]interface{}, target map[string]interface{}, path string, errs *FilterErrors) {
 	for filterKey, filterValue := range raw {
+		valuePath := path + "." + filterKey
 		switch filterValue.(type) {
 		case map[string]interface{}:
 			newTarget := make(map[string]interface{})
-			if err := mustCompileFilter(filterValue.(map[string]interface{}), newTarget); err != nil {
-				return err
-			}
+			compileFilter(filterValue.(map[string]interface{}), newTarget, valuePath, errs)
 			target[filterKey] = newTarget
 		case string:
 			re, err := regexp.Compile(filterValue.(string))
 			if err != nil {
-				return err
+				*errs = append(*errs, &FilterError{Path: valuePath, Err: err})
+				continue
 			}
 			target[filterKey] = re
+		case []interface{}:
+			*errs = append(*errs, &FilterError{Path: valuePath, Err: errors.New("list values are not supported")})
 		default:
 			target[filterKey] = filterValue
 		}
 	}
-	return nil
 }
 
 func msgCompare(filter map[string]interface{}, msg map[string]interface{}) (matched bool, err error) {
-	for filterKey, filterValue := range filter {
+	return explainCompare(filter, msg, "filter") == nil, nil
+}
+
+// Mismatch locates the filter value an event failed to match
+type Mismatch struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// explainCompare returns the first filter path msg does not satisfy, or nil
+// when msg matches filter
+func explainCompare(filter map[string]interface{}, msg map[string]interface{}, path string) *Mismatch {
+	keys := make([]string, 0, len(filter))
+	for filterKey := range filter {
+		keys = append(keys, filterKey)
+	}
+	sort.Strings(keys)
+
+	for _, filterKey := range keys {
+		filterValue := filter[filterKey]
+		valuePath := path + "." + filterKey
 		msgValue, ok := msg[filterKey]
 		if !ok {
-			return false, nil
+			return &Mismatch{Path: valuePath, Reason: "missing in event"}
 		}
 		switch filterValue.(type) {
 		case map[string]interface{}:
 			msgValueMap, ok := msgValue.(map[string]interface{})
 			if !ok {
-				return false, nil
+				return &Mismatch{Path: valuePath, Reason: "not an object in event"}
 			}
-			ret, _ := msgCompare(filterValue.(map[string]interface{}), msgValueMap)
-			if !ret {
-				return false, nil
+			if mismatch := explainCompare(filterValue.(map[string]interface{}), msgValueMap, valuePath); mismatch != nil {
+				return mismatch
 			}
 		case *regexp.Regexp:
 			msgValueBytes, ok := msgValue.(string)
 			if !ok {
-				return false, nil
+				return &Mismatch{Path: valuePath, Reason: "not a string in event"}
 			}
 			if !filterValue.(*regexp.Regexp).MatchString(msgValueBytes) {
-				return false, nil
+				return &Mismatch{Path: valuePath, Reason: fmt.Sprintf("%q does not match %q", msgValueBytes, filterValue.(*regexp.Regexp).String())}
 			}
 		default:
-			if filterValue != msgValue {
-				return false, nil
+			if !valueEqual(filterValue, msgValue) {
+				return &Mismatch{Path: valuePath, Reason: fmt.Sprintf("%v does not equal %v", msgValue, filterValue)}
+			}
+		}
+	}
+	return nil
+}
+
+// valueEqual compares scalar filter and event values. Events are decoded with
+// json.Number, numeric filter values are compared to them by value and the
+// others by text
+func valueEqual(filterValue interface{}, msgValue interface{}) bool {
+	switch msgValue.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	case json.Number:
+		number := msgValue.(json.Number)
+		switch filterValue.(type) {
+		case float64:
+			value, err := number.Float64()
+			return err == nil && value == filterValue.(float64)
+		case json.Number:
+			if filterValue.(json.Number) == number {
+				return true
+			}
+			want, err := filterValue.(json.Number).Float64()
+			if err != nil {
+				return false
 			}
+			value, err := number.Float64()
+			return err == nil && value == want
 		}
+		return fmt.Sprint(filterValue) == number.String()
 	}
-	return true, nil
+	return filterValue == msgValue
 }
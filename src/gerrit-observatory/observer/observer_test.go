@@ -1,10 +1,25 @@
 package observer
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"github.com/stretchr/testify/assert"
-	// "github.com/stretchr/testify/suite"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"gerrit-observatory/gerrit"
+	"gerrit-observatory/notify"
+	"gerrit-observatory/redis"
+	"gerrit-observatory/store"
+	"gerrit-observatory/trace"
 )
 
 var (
@@ -104,3 +119,1273 @@ func TestMsgCompare(t *testing.T) {
 	ret, _ = msgCompare(compiledFilter, msg)
 	assert.True(t, ret)
 }
+
+func TestValidateFilter(t *testing.T) {
+	filter := make(map[string]interface{})
+	err := json.Unmarshal([]byte(FilterRaw), &filter)
+	assert.Nil(t, err)
+	assert.Len(t, ValidateFilter(filter), 0)
+
+	filter = map[string]interface{}{
+		"type": "(patchset-created",
+		"change": map[string]interface{}{
+			"branch":  "release-[",
+			"project": "loki",
+		},
+		"approvals": []interface{}{"Code-Review"},
+	}
+	errs := ValidateFilter(filter)
+	assert.Len(t, errs, 3)
+	assert.Equal(t, "filter.approvals", errs[0].Path)
+	assert.Equal(t, "filter.change.branch", errs[1].Path)
+	assert.Equal(t, "filter.type", errs[2].Path)
+	assert.NotNil(t, mustCompileFilter(filter, make(map[string]interface{})))
+}
+
+func TestCanSee(t *testing.T) {
+	refUpdate := make(map[string]interface{})
+	patchSetCreated := make(map[string]interface{})
+	assert.Nil(t, json.Unmarshal([]byte(RefUpdateRaw), &refUpdate))
+	assert.Nil(t, json.Unmarshal([]byte(PatchSetCreatedRaw), &patchSetCreated))
+	refUpdateEvent := gerrit.NewEvent(refUpdate)
+	patchSetCreatedEvent := gerrit.NewEvent(patchSetCreated)
+	assert.Equal(t, "orion/crawler", refUpdateEvent.Project())
+	assert.Equal(t, "loki", patchSetCreatedEvent.Project())
+
+	obs := &Observer{}
+	assert.True(t, obs.canSee(refUpdateEvent))
+	obs.visibleProjects = visibleSet([]string{"loki"})
+	assert.False(t, obs.canSee(refUpdateEvent))
+	assert.True(t, obs.canSee(patchSetCreatedEvent))
+	assert.False(t, obs.canSee(gerrit.NewEvent(map[string]interface{}{"type": "dropped-output"})))
+}
+
+func TestExplainCompare(t *testing.T) {
+	filter := make(map[string]interface{})
+	compiledFilter := make(map[string]interface{})
+	msg := make(map[string]interface{})
+	assert.Nil(t, json.Unmarshal([]byte(FilterRaw), &filter))
+	assert.Nil(t, mustCompileFilter(filter, compiledFilter))
+
+	decoder := json.NewDecoder(strings.NewReader(RefUpdateRaw))
+	decoder.UseNumber()
+	assert.Nil(t, decoder.Decode(&msg))
+	mismatch := explainCompare(compiledFilter, msg, "filter")
+	assert.Equal(t, &Mismatch{Path: "filter.change", Reason: "missing in event"}, mismatch)
+
+	msg = make(map[string]interface{})
+	assert.Nil(t, json.Unmarshal([]byte(PatchSetCreatedRaw), &msg))
+	msg["change"].(map[string]interface{})["branch"] = "master"
+	mismatch = explainCompare(compiledFilter, msg, "filter")
+	assert.Equal(t, "filter.change.branch", mismatch.Path)
+	assert.Equal(t, `"master" does not match "release-.+"`, mismatch.Reason)
+
+	compiledFilter = map[string]interface{}{"patchSet": map[string]interface{}{"sizeInsertions": float64(347)}}
+	decoder = json.NewDecoder(strings.NewReader(PatchSetCreatedRaw))
+	decoder.UseNumber()
+	assert.Nil(t, decoder.Decode(&msg))
+	assert.Nil(t, explainCompare(compiledFilter, msg, "filter"))
+}
+
+func TestValueEqual(t *testing.T) {
+	// filters decoded without UseNumber hold float64, printed in exponent
+	// form from 7 digits on
+	filter := make(map[string]interface{})
+	assert.Nil(t, json.Unmarshal([]byte(`{"change": {"number": 1234567}}`), &filter))
+	msg := make(map[string]interface{})
+	decoder := json.NewDecoder(strings.NewReader(`{"change": {"number": 1234567}}`))
+	decoder.UseNumber()
+	assert.Nil(t, decoder.Decode(&msg))
+	assert.Nil(t, explainCompare(filter, msg, "filter"))
+
+	assert.True(t, valueEqual(float64(1234567), json.Number("1234567")))
+	assert.True(t, valueEqual(json.Number("1234567.0"), json.Number("1234567")))
+	assert.True(t, valueEqual("1234567", json.Number("1234567")))
+	assert.False(t, valueEqual(float64(1234568), json.Number("1234567")))
+	assert.False(t, valueEqual(json.Number("1234568"), json.Number("1234567")))
+	assert.False(t, valueEqual(float64(1234567), "1234567"))
+}
+
+type HistoryTestSuite struct {
+	suite.Suite
+	refUpdate       *gerrit.Event
+	patchSetCreated *gerrit.Event
+}
+
+func TestBreaker(t *testing.T) {
+	policy := breakerPolicy{failures: 2, cooldown: time.Minute, mode: BreakerFail}
+	now := time.Now()
+	b := newBreaker()
+	assert.False(t, b.record(false, now, policy))
+	assert.False(t, b.record(true, now, policy))
+	assert.False(t, b.record(false, now, policy))
+	assert.True(t, b.record(false, now, policy))
+	assert.Equal(t, BreakerOpen, b.status(1).State)
+	assert.Equal(t, time.Minute, b.probeIn(now, policy))
+
+	allowed, changed := b.allow(now.Add(time.Second), policy)
+	assert.False(t, allowed)
+	assert.False(t, changed)
+	allowed, changed = b.allow(now.Add(time.Minute), policy)
+	assert.True(t, allowed)
+	assert.True(t, changed)
+	assert.Equal(t, BreakerHalfOpen, b.status(1).State)
+	// a failed probe opens the breaker anew
+	assert.True(t, b.record(false, now.Add(time.Minute), policy))
+	assert.Equal(t, BreakerOpen, b.status(1).State)
+	allowed, _ = b.allow(now.Add(2*time.Minute), policy)
+	assert.True(t, allowed)
+	assert.True(t, b.record(true, now.Add(2*time.Minute), policy))
+	status := b.status(1)
+	assert.Equal(t, BreakerStatus{Observer: 1, State: BreakerClosed, Rejected: 1}, status)
+
+	// no threshold closes an open breaker
+	b.record(false, now, policy)
+	b.record(false, now, policy)
+	allowed, changed = b.allow(now, breakerPolicy{})
+	assert.True(t, allowed)
+	assert.True(t, changed)
+	assert.Equal(t, BreakerClosed, b.status(1).State)
+}
+
+func TestBreakerSingleProbe(t *testing.T) {
+	policy := breakerPolicy{failures: 1, cooldown: time.Minute, mode: BreakerFail}
+	now := time.Now()
+	b := newBreaker()
+	assert.True(t, b.record(false, now, policy))
+
+	// the lanes of an observer asking at once get a single probe
+	var (
+		wg      sync.WaitGroup
+		allowed int32
+	)
+	for lane := 0; lane < 8; lane++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _ := b.allow(now.Add(time.Minute), policy); ok {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), allowed)
+	assert.Equal(t, BreakerHalfOpen, b.status(1).State)
+	assert.Equal(t, int64(7), b.status(1).Rejected)
+	ok, _ := b.allow(now.Add(2*time.Minute), policy)
+	assert.False(t, ok)
+
+	// a failed probe opens the breaker for another cooldown
+	assert.True(t, b.record(false, now.Add(2*time.Minute), policy))
+	ok, _ = b.allow(now.Add(2*time.Minute), policy)
+	assert.False(t, ok)
+	ok, _ = b.allow(now.Add(3*time.Minute), policy)
+	assert.True(t, ok)
+	ok, _ = b.allow(now.Add(3*time.Minute), policy)
+	assert.False(t, ok)
+
+	// an accepted one lets every lane through
+	assert.True(t, b.record(true, now.Add(3*time.Minute), policy))
+	for lane := 0; lane < 8; lane++ {
+		ok, _ = b.allow(now.Add(3*time.Minute), policy)
+		assert.True(t, ok)
+	}
+}
+
+func TestOrderingKey(t *testing.T) {
+	change := gerrit.NewEvent(map[string]interface{}{
+		"type":   "patchset-created",
+		"change": map[string]interface{}{"project": "loki", "number": "7", "id": "I1"},
+	})
+	assert.Equal(t, "change:loki:7", orderingKey(change))
+	ref := gerrit.NewEvent(map[string]interface{}{
+		"type":      "ref-updated",
+		"refUpdate": map[string]interface{}{"project": "loki", "refName": "refs/heads/master"},
+	})
+	assert.Equal(t, "ref:loki:refs/heads/master", orderingKey(ref))
+	project := gerrit.NewEvent(map[string]interface{}{"type": "project-created", "projectName": "loki"})
+	assert.Equal(t, "project:loki", orderingKey(project))
+}
+
+func TestDebounceKey(t *testing.T) {
+	change := gerrit.NewEvent(map[string]interface{}{
+		"type":   "patchset-created",
+		"change": map[string]interface{}{"project": "loki", "number": "7", "branch": "master", "topic": "docs"},
+	})
+	ref := gerrit.NewEvent(map[string]interface{}{
+		"type":      "ref-updated",
+		"refUpdate": map[string]interface{}{"project": "loki", "refName": "refs/heads/master"},
+	})
+	tag := gerrit.NewEvent(map[string]interface{}{
+		"type":      "ref-updated",
+		"refUpdate": map[string]interface{}{"project": "loki", "refName": "refs/tags/v1"},
+	})
+	for _, c := range []struct {
+		msg *gerrit.Event
+		key string
+		ok  bool
+	}{
+		{change, DebounceChange, true},
+		{change, DebounceTopic, true},
+		{change, DebounceBranch, true},
+		{change, DebounceProject, true},
+		{ref, DebounceChange, false},
+		{ref, DebounceTopic, false},
+		{ref, DebounceBranch, true},
+		{tag, DebounceBranch, false},
+		{tag, DebounceProject, true},
+	} {
+		_, ok := debounceKey(c.msg, c.key)
+		assert.Equal(t, c.ok, ok, "%s of %s", c.key, c.msg.Type())
+	}
+	key, _ := debounceKey(change, DebounceTopic)
+	assert.Equal(t, "topic:docs", key)
+	key, _ = debounceKey(ref, DebounceBranch)
+	other, _ := debounceKey(change, DebounceBranch)
+	assert.Equal(t, "branch:loki:master", key)
+	assert.Equal(t, key, other)
+
+	field, _ := DebounceProblem(&redis.Debounce{Key: "owner", Window: 10})
+	assert.Equal(t, "debounce.key", field)
+	field, _ = DebounceProblem(&redis.Debounce{Key: DebounceChange})
+	assert.Equal(t, "debounce.window_seconds", field)
+	field, _ = DebounceProblem(nil)
+	assert.Equal(t, "", field)
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(1)
+	release, err := l.acquire(context.Background())
+	assert.Nil(t, err)
+	inFlight, limit := l.usage()
+	assert.Equal(t, 1, inFlight)
+	assert.Equal(t, 1, limit)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = l.acquire(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// the slot taken before the resize counts against the new limit
+	l.resize(2)
+	second, err := l.acquire(context.Background())
+	assert.Nil(t, err)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = l.acquire(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// a lower limit holds back the POSTs until enough slots are released
+	l.resize(1)
+	acquired := make(chan func())
+	go func() {
+		third, _ := l.acquire(context.Background())
+		acquired <- third
+	}()
+	release()
+	select {
+	case <-acquired:
+		t.Fatal("slot acquired above the limit")
+	case <-time.After(10 * time.Millisecond):
+	}
+	second()
+	third := <-acquired
+	inFlight, limit = l.usage()
+	assert.Equal(t, 1, inFlight)
+	assert.Equal(t, 1, limit)
+	third()
+	inFlight, _ = l.usage()
+	assert.Equal(t, 0, inFlight)
+}
+
+func TestLimiterResize(t *testing.T) {
+	l := newLimiter(4)
+	held := make([]func(), 0, 4)
+	for i := 0; i < 4; i++ {
+		release, err := l.acquire(context.Background())
+		assert.Nil(t, err)
+		held = append(held, release)
+	}
+	l.resize(2)
+
+	// the POSTs started after the limit was lowered never exceed it, even
+	// while those started before are still in flight
+	var (
+		wg       sync.WaitGroup
+		inFlight int32
+		peak     int32
+	)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				release, err := l.acquire(context.Background())
+				if !assert.Nil(t, err) {
+					return
+				}
+				n := atomic.AddInt32(&inFlight, 1)
+				for {
+					max := atomic.LoadInt32(&peak)
+					if n <= max || atomic.CompareAndSwapInt32(&peak, max, n) {
+						break
+					}
+				}
+				time.Sleep(time.Microsecond)
+				atomic.AddInt32(&inFlight, -1)
+				release()
+			}
+		}()
+	}
+	for _, release := range held {
+		time.Sleep(time.Millisecond)
+		release()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&peak))
+}
+
+func (suite *HistoryTestSuite) SetupTest() {
+	store.Subscriptions = store.NewMemoryStore()
+
+	refUpdate := make(map[string]interface{})
+	patchSetCreated := make(map[string]interface{})
+	assert.Nil(suite.T(), json.Unmarshal([]byte(RefUpdateRaw), &refUpdate))
+	assert.Nil(suite.T(), json.Unmarshal([]byte(PatchSetCreatedRaw), &patchSetCreated))
+	suite.patchSetCreated = gerrit.NewEvent(patchSetCreated)
+	suite.refUpdate = gerrit.NewEvent(refUpdate)
+	suite.patchSetCreated.ReceivedAt = suite.refUpdate.ReceivedAt.Add(-time.Second)
+	assert.Nil(suite.T(), store.Subscriptions.RecordEvent(suite.patchSetCreated))
+	assert.Nil(suite.T(), store.Subscriptions.RecordEvent(suite.refUpdate))
+}
+
+func (suite *HistoryTestSuite) TestTestObserver() {
+	var received map[string]interface{}
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("queued"))
+	}))
+	defer hook.Close()
+
+	filter := make(map[string]interface{})
+	assert.Nil(suite.T(), json.Unmarshal([]byte(FilterRaw), &filter))
+	sub := &redis.Subscribe{ID: 1, Detail: redis.SubscribeDetail{Filter: filter, HookURL: hook.URL}}
+	contr := NewObserverContr(nil, 1)
+
+	result, err := contr.TestObserver(sub, nil, true)
+	assert.Nil(suite.T(), err)
+	assert.True(suite.T(), result.Matched)
+	assert.Equal(suite.T(), suite.patchSetCreated.ID, result.Event.ID)
+	assert.Equal(suite.T(), http.StatusAccepted, result.Delivery.StatusCode)
+	assert.Equal(suite.T(), "queued", result.Delivery.Body)
+	assert.Equal(suite.T(), "patchset-created", received["type"])
+
+	result, err = contr.TestObserver(sub, suite.refUpdate, false)
+	assert.Nil(suite.T(), err)
+	assert.False(suite.T(), result.Matched)
+	assert.Nil(suite.T(), result.Delivery)
+
+	sub.VisibleProjects = []string{"orion/crawler"}
+	_, err = contr.TestObserver(sub, nil, true)
+	assert.Equal(suite.T(), ErrNoRecentEvent, err)
+}
+
+func (suite *HistoryTestSuite) TestEvaluateFilter() {
+	filter := map[string]interface{}{"type": "(patchset-created|ref-updated)"}
+	evaluation, err := EvaluateFilter(filter, nil, time.Time{}, 100, 1)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 2, evaluation.Scanned)
+	assert.Equal(suite.T(), 2, evaluation.Total)
+	assert.Len(suite.T(), evaluation.Events, 1)
+	assert.Equal(suite.T(), suite.refUpdate.ID, evaluation.Events[0].ID)
+	assert.Equal(suite.T(), map[string]int{"patchset-created": 1, "ref-updated": 1}, evaluation.ByType)
+	assert.Equal(suite.T(), map[string]int{"loki": 1, "orion/crawler": 1}, evaluation.ByProject)
+
+	evaluation, err = EvaluateFilter(filter, []string{"loki"}, time.Time{}, 100, 10)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 1, evaluation.Scanned)
+	assert.Equal(suite.T(), suite.patchSetCreated.ID, evaluation.Events[0].ID)
+
+	_, err = EvaluateFilter(map[string]interface{}{"type": "("}, nil, time.Time{}, 100, 10)
+	assert.NotNil(suite.T(), err)
+}
+
+func (suite *HistoryTestSuite) TestDeliverWithRetry() {
+	calls := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer hook.Close()
+
+	detail := redis.SubscribeDetail{Filter: map[string]interface{}{"type": "patchset-created"}, HookURL: hook.URL}
+	id, err := store.Subscriptions.Save("loki", detail, "", nil)
+	assert.Nil(suite.T(), err)
+	sub, err := store.Subscriptions.Get(id)
+	assert.Nil(suite.T(), err)
+	contr := NewObserverContr(nil, 1)
+	contr.RetryInterval = time.Millisecond
+	obs, err := NewObserver(sub, nil, contr)
+	assert.Nil(suite.T(), err)
+
+	delivered, attempts := obs.deliverWithRetry(suite.patchSetCreated, trace.SpanContext{})
+	assert.True(suite.T(), delivered)
+	assert.Equal(suite.T(), 2, attempts)
+	deliveries, total, err := store.Subscriptions.GetDeliveries(id, redis.DeliveryQuery{})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 2, total)
+	assert.Equal(suite.T(), 2, deliveries[0].Attempt)
+	assert.Equal(suite.T(), "ok", deliveries[0].ResponseBody)
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, deliveries[1].StatusCode)
+	assert.Equal(suite.T(), suite.patchSetCreated.ID, deliveries[1].EventID)
+
+	contr.MaxAttempts = 1
+	calls = 0
+	delivered, attempts = obs.deliverWithRetry(suite.refUpdate, trace.SpanContext{})
+	assert.False(suite.T(), delivered)
+	assert.Equal(suite.T(), 1, attempts)
+
+	calls = 0
+	contr.MaxAttempts = 3
+	assert.Equal(suite.T(), redis.StatsDelta{Seen: 1}, obs.handle(suite.refUpdate))
+	assert.Equal(suite.T(), redis.StatsDelta{Seen: 1, Matched: 1, Delivered: 1, Retried: 1}, obs.handle(suite.patchSetCreated))
+	obs.visibleProjects = visibleSet([]string{"orion/crawler"})
+	assert.Equal(suite.T(), redis.StatsDelta{Seen: 1}, obs.handle(suite.patchSetCreated))
+}
+
+func (suite *HistoryTestSuite) TestReconfigure() {
+	var (
+		lock     sync.Mutex
+		received []string
+	)
+	release := make(chan struct{})
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		var data map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&data)
+		lock.Lock()
+		received = append(received, data["seq"].(string))
+		lock.Unlock()
+	}))
+	defer hook.Close()
+
+	detail := redis.SubscribeDetail{Filter: map[string]interface{}{"type": "patchset-created"}, HookURL: hook.URL}
+	id, err := store.Subscriptions.Save("loki", detail, "", nil)
+	assert.Nil(suite.T(), err)
+	sub, err := store.Subscriptions.Get(id)
+	assert.Nil(suite.T(), err)
+
+	incoming := make(chan *gerrit.Event)
+	contr := NewObserverContr(incoming, 1)
+	assert.Nil(suite.T(), contr.AddObserver(sub))
+	go contr.Start()
+
+	send := func(seq string) {
+		incoming <- gerrit.NewEvent(map[string]interface{}{"type": "patchset-created", "seq": seq})
+	}
+	send("1")
+	send("2")
+	send("3")
+	// the first observer holds the three events while the queues are resized
+	contr.Reconfigure(2, 1, time.Millisecond, 5, 1)
+	send("4")
+	close(release)
+
+	assert.Eventually(suite.T(), func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(received) == 4
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(suite.T(), []string{"1", "2", "3", "4"}, received)
+
+	contr.Lock()
+	observer := contr.ObserverMap[id].Value.(*Observer)
+	assert.Equal(suite.T(), 5, cap(observer.eventChan))
+	assert.Equal(suite.T(), 2*time.Second, observer.Timeout)
+	contr.Unlock()
+	maxAttempts, retryInterval := contr.retryPolicy()
+	assert.Equal(suite.T(), 1, maxAttempts)
+	assert.Equal(suite.T(), time.Millisecond, retryInterval)
+	close(incoming)
+	contr.Shutdown(5 * time.Second)
+}
+
+func (suite *HistoryTestSuite) TestShutdown() {
+	var (
+		lock     sync.Mutex
+		received []string
+	)
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the body is read so the server notices the client going away
+		ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	defer hanging.Close()
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&data)
+		lock.Lock()
+		received = append(received, data["seq"].(string))
+		lock.Unlock()
+	}))
+	defer hook.Close()
+
+	detail := redis.SubscribeDetail{Filter: map[string]interface{}{"type": "patchset-created"}, HookURL: hanging.URL}
+	id, err := store.Subscriptions.Save("loki", detail, "", nil)
+	assert.Nil(suite.T(), err)
+	sub, err := store.Subscriptions.Get(id)
+	assert.Nil(suite.T(), err)
+
+	// the hook hangs, so the deliveries are cut short by the deadline
+	incoming := make(chan *gerrit.Event, 10)
+	contr := NewObserverContr(incoming, 10)
+	assert.Nil(suite.T(), contr.AddObserver(sub))
+	for _, seq := range []string{"1", "2", "3"} {
+		incoming <- gerrit.NewEvent(map[string]interface{}{"type": "patchset-created", "seq": seq})
+	}
+	close(incoming)
+	go contr.Start()
+	begin := time.Now()
+	contr.Shutdown(200 * time.Millisecond)
+	assert.True(suite.T(), time.Since(begin) < 5*time.Second)
+	stats, err := store.Subscriptions.GetStats(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(0), stats.Failed)
+
+	// the persisted events are delivered, in order, once observed again
+	sub.Detail.HookURL = hook.URL
+	incoming = make(chan *gerrit.Event)
+	contr = NewObserverContr(incoming, 10)
+	assert.Nil(suite.T(), contr.AddObserver(sub))
+	go contr.Start()
+	close(incoming)
+	contr.Shutdown(5 * time.Second)
+	assert.Equal(suite.T(), []string{"1", "2", "3"}, received)
+	pending, err := store.Subscriptions.TakePending(id)
+	assert.Nil(suite.T(), err)
+	assert.Empty(suite.T(), pending)
+	stats, err = store.Subscriptions.GetStats(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(3), stats.Delivered)
+}
+
+func (suite *HistoryTestSuite) TestPauseResume() {
+	var (
+		lock     sync.Mutex
+		received []string
+	)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&data)
+		lock.Lock()
+		received = append(received, data["seq"].(string))
+		lock.Unlock()
+	}))
+	defer hook.Close()
+
+	detail := redis.SubscribeDetail{Filter: map[string]interface{}{"type": "patchset-created"}, HookURL: hook.URL}
+	id, err := store.Subscriptions.Save("loki", detail, "", nil)
+	assert.Nil(suite.T(), err)
+	sub, err := store.Subscriptions.SetState(id, redis.StatePaused, redis.PauseQueue, "")
+	assert.Nil(suite.T(), err)
+
+	incoming := make(chan *gerrit.Event)
+	contr := NewObserverContr(incoming, 1)
+	assert.Nil(suite.T(), contr.AddObserver(sub))
+	go contr.Start()
+	send := func(seq string) {
+		incoming <- gerrit.NewEvent(map[string]interface{}{"type": "patchset-created", "seq": seq})
+	}
+	send("1")
+	send("2")
+	assert.Eventually(suite.T(), func() bool {
+		n, _ := store.Subscriptions.BacklogLength(id)
+		return n == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	sub, err = store.Subscriptions.SetState(id, redis.StatePaused, redis.PauseSkip, "")
+	assert.Nil(suite.T(), err)
+	assert.Nil(suite.T(), contr.UpdateObserver(sub))
+	send("3")
+	assert.Eventually(suite.T(), func() bool {
+		stats, _ := store.Subscriptions.GetStats(id)
+		return stats.Skipped == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the backlog is delivered before the events received once resumed
+	sub, err = store.Subscriptions.SetState(id, redis.StateActive, "", "")
+	assert.Nil(suite.T(), err)
+	assert.Nil(suite.T(), contr.ResumeObserver(sub, false))
+	send("4")
+	assert.Eventually(suite.T(), func() bool {
+		stats, _ := store.Subscriptions.GetStats(id)
+		return stats.Delivered == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(suite.T(), []string{"1", "2", "4"}, received)
+	stats, err := store.Subscriptions.GetStats(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), redis.SubscribeStats{Seen: 4, Matched: 4, Delivered: 3, Skipped: 1,
+		LastSuccessTime: stats.LastSuccessTime, LastMatchTime: stats.LastMatchTime}, *stats)
+
+	// a discarded backlog counts as dropped
+	assert.Nil(suite.T(), store.Subscriptions.SaveBacklog(id, gerrit.NewEvent(map[string]interface{}{"type": "patchset-created", "seq": "5"})))
+	assert.Nil(suite.T(), contr.ResumeObserver(sub, true))
+	assert.Eventually(suite.T(), func() bool {
+		stats, _ := store.Subscriptions.GetStats(id)
+		return stats.Dropped == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	n, err := store.Subscriptions.BacklogLength(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 0, n)
+
+	assert.Nil(suite.T(), contr.RemoveObserver(id))
+	sub, err = store.Subscriptions.Get(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), redis.StateArchived, sub.State)
+	close(incoming)
+	contr.Shutdown(5 * time.Second)
+}
+
+func (suite *HistoryTestSuite) TestDisableDeadHook() {
+	hook := httptest.NewServer(http.NotFoundHandler())
+	defer hook.Close()
+	notices := make(chan *notify.Notice, 1)
+	notifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notify.Notice
+		json.NewDecoder(r.Body).Decode(&n)
+		notices <- &n
+	}))
+	defer notifier.Close()
+	notify.Init(notifier.URL)
+	defer notify.Init("")
+
+	detail := redis.SubscribeDetail{Filter: map[string]interface{}{"type": "patchset-created"}, HookURL: hook.URL}
+	id, err := store.Subscriptions.Save("loki", detail, "", nil)
+	assert.Nil(suite.T(), err)
+	sub, err := store.Subscriptions.Get(id)
+	assert.Nil(suite.T(), err)
+
+	incoming := make(chan *gerrit.Event)
+	contr := NewObserverContr(incoming, 1)
+	contr.MaxAttempts = 1
+	contr.SetDisablePolicy(2, 0)
+	assert.Nil(suite.T(), contr.AddObserver(sub))
+	go contr.Start()
+	for i := 0; i < 2; i++ {
+		incoming <- gerrit.NewEvent(map[string]interface{}{"type": "patchset-created"})
+	}
+
+	select {
+	case n := <-notices:
+		assert.Equal(suite.T(), notify.EventDisabled, n.Event)
+		assert.Equal(suite.T(), id, n.SubscribeID)
+		assert.Equal(suite.T(), "loki", n.Owner)
+		assert.Equal(suite.T(), "disabled after 2 consecutive failed deliveries", n.Reason)
+	case <-time.After(5 * time.Second):
+		suite.T().Fatal("owner not notified")
+	}
+	sub, err = store.Subscriptions.Get(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), redis.StatePaused, sub.State)
+	assert.Equal(suite.T(), redis.PauseSkip, sub.PauseMode)
+
+	// the paused observer only counts the events it matches
+	incoming <- gerrit.NewEvent(map[string]interface{}{"type": "patchset-created"})
+	assert.Eventually(suite.T(), func() bool {
+		stats, _ := store.Subscriptions.GetStats(id)
+		return stats.Skipped == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	stats, err := store.Subscriptions.GetStats(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(2), stats.Failed)
+	close(incoming)
+	contr.Shutdown(5 * time.Second)
+	notify.Wait()
+}
+
+func (suite *HistoryTestSuite) TestExpireSubscribes() {
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	incoming := make(chan *gerrit.Event)
+	contr := NewObserverContr(incoming, 1)
+	ids := make([]int, 0, 2)
+	for _, expiresAt := range []*time.Time{&past, &future} {
+		detail := redis.SubscribeDetail{Filter: map[string]interface{}{"type": "patchset-created"}, HookURL: "http://127.0.0.1/hook", ExpiresAt: expiresAt}
+		id, err := store.Subscriptions.Save("loki", detail, "", nil)
+		assert.Nil(suite.T(), err)
+		sub, err := store.Subscriptions.Get(id)
+		assert.Nil(suite.T(), err)
+		assert.Nil(suite.T(), contr.AddObserver(sub))
+		ids = append(ids, id)
+	}
+
+	assert.Equal(suite.T(), []int{ids[0]}, contr.ExpireSubscribes(time.Now()))
+	sub, err := store.Subscriptions.Get(ids[0])
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), redis.StateArchived, sub.State)
+	assert.Equal(suite.T(), "expired at "+past.Format(time.RFC3339), sub.StateReason)
+	_, observed := contr.ObserverMap[ids[0]]
+	assert.False(suite.T(), observed)
+	_, observed = contr.ObserverMap[ids[1]]
+	assert.True(suite.T(), observed)
+	assert.Empty(suite.T(), contr.ExpireSubscribes(time.Now()))
+	close(incoming)
+	go contr.Start()
+	contr.Shutdown(5 * time.Second)
+}
+
+func (suite *HistoryTestSuite) TestBreakerFailFast() {
+	var calls int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer hook.Close()
+
+	detail := redis.SubscribeDetail{Filter: map[string]interface{}{"type": "patchset-created"}, HookURL: hook.URL}
+	id, err := store.Subscriptions.Save("loki", detail, "", nil)
+	assert.Nil(suite.T(), err)
+	sub, err := store.Subscriptions.Get(id)
+	assert.Nil(suite.T(), err)
+
+	incoming := make(chan *gerrit.Event)
+	contr := NewObserverContr(incoming, 1)
+	contr.RetryInterval = time.Millisecond
+	contr.SetBreakerPolicy(2, time.Hour, BreakerFail)
+	assert.Nil(suite.T(), contr.AddObserver(sub))
+	go contr.Start()
+	for i := 0; i < 3; i++ {
+		incoming <- gerrit.NewEvent(map[string]interface{}{"type": "patchset-created"})
+	}
+	assert.Eventually(suite.T(), func() bool {
+		stats, _ := store.Subscriptions.GetStats(id)
+		return stats.Failed == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the breaker opened on the second attempt of the first event and kept
+	// the others from the hook
+	assert.Equal(suite.T(), int32(2), atomic.LoadInt32(&calls))
+	statuses := contr.BreakerStatuses()
+	assert.Len(suite.T(), statuses, 1)
+	assert.Equal(suite.T(), BreakerOpen, statuses[0].State)
+	assert.Equal(suite.T(), int64(2), statuses[0].Rejected)
+	assert.NotNil(suite.T(), statuses[0].OpenedAt)
+
+	// the breaker survives the observer being replaced
+	assert.Nil(suite.T(), contr.UpdateObserver(sub))
+	assert.Equal(suite.T(), BreakerOpen, contr.BreakerStatuses()[0].State)
+	close(incoming)
+	contr.Shutdown(5 * time.Second)
+}
+
+func (suite *HistoryTestSuite) TestBreakerQueue() {
+	var (
+		lock     sync.Mutex
+		healthy  bool
+		received []string
+	)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&data)
+		lock.Lock()
+		defer lock.Unlock()
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received = append(received, data["seq"].(string))
+	}))
+	defer hook.Close()
+
+	detail := redis.SubscribeDetail{Filter: map[string]interface{}{"type": "patchset-created"}, HookURL: hook.URL}
+	id, err := store.Subscriptions.Save("loki", detail, "", nil)
+	assert.Nil(suite.T(), err)
+	sub, err := store.Subscriptions.Get(id)
+	assert.Nil(suite.T(), err)
+
+	incoming := make(chan *gerrit.Event)
+	contr := NewObserverContr(incoming, 1)
+	contr.MaxAttempts = 1
+	contr.SetBreakerPolicy(2, 300*time.Millisecond, BreakerQueue)
+	assert.Nil(suite.T(), contr.AddObserver(sub))
+	go contr.Start()
+	send := func(seq string) {
+		incoming <- gerrit.NewEvent(map[string]interface{}{"type": "patchset-created", "seq": seq})
+	}
+	send("1")
+	send("2")
+	send("3")
+	assert.Eventually(suite.T(), func() bool {
+		n, _ := store.Subscriptions.BacklogLength(id)
+		return n == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	lock.Lock()
+	healthy = true
+	lock.Unlock()
+
+	// the probe delivers the queued events before the new ones
+	send("4")
+	assert.Eventually(suite.T(), func() bool {
+		stats, _ := store.Subscriptions.GetStats(id)
+		return stats.Delivered == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(suite.T(), []string{"2", "3", "4"}, received)
+	assert.Equal(suite.T(), BreakerClosed, contr.BreakerStatuses()[0].State)
+	stats, err := store.Subscriptions.GetStats(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(1), stats.Failed)
+	assert.Equal(suite.T(), int64(3), stats.Delivered)
+	close(incoming)
+	contr.Shutdown(5 * time.Second)
+}
+
+// changeEvent returns a patchset-created event of change number, seq tells
+// the events apart
+func changeEvent(number string, seq string) *gerrit.Event {
+	return gerrit.NewEvent(map[string]interface{}{
+		"type":   "patchset-created",
+		"seq":    seq,
+		"change": map[string]interface{}{"project": "loki", "number": number},
+	})
+}
+
+func (suite *HistoryTestSuite) TestConcurrentLanes() {
+	var (
+		lock     sync.Mutex
+		received []string
+	)
+	release := make(chan struct{})
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&data)
+		seq := data["seq"].(string)
+		if seq == "1a" {
+			<-release
+		}
+		lock.Lock()
+		received = append(received, seq)
+		lock.Unlock()
+	}))
+	defer hook.Close()
+
+	detail := redis.SubscribeDetail{Filter: map[string]interface{}{"type": "patchset-created"}, HookURL: hook.URL, Concurrency: 4}
+	id, err := store.Subscriptions.Save("loki", detail, "", nil)
+	assert.Nil(suite.T(), err)
+	sub, err := store.Subscriptions.Get(id)
+	assert.Nil(suite.T(), err)
+
+	incoming := make(chan *gerrit.Event)
+	contr := NewObserverContr(incoming, 5)
+	assert.Nil(suite.T(), contr.AddObserver(sub))
+	go contr.Start()
+	// changes 1 and 2 go through different lanes
+	incoming <- changeEvent("1", "1a")
+	incoming <- changeEvent("1", "1b")
+	incoming <- changeEvent("2", "2a")
+
+	// the hook holding the first event of change 1 does not delay change 2
+	assert.Eventually(suite.T(), func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(received) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(suite.T(), []string{"2a"}, received)
+	close(release)
+
+	close(incoming)
+	contr.Shutdown(5 * time.Second)
+	assert.Equal(suite.T(), []string{"2a", "1a", "1b"}, received)
+	stats, err := store.Subscriptions.GetStats(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(3), stats.Delivered)
+}
+
+func (suite *HistoryTestSuite) TestMaxConnections() {
+	var inFlight, peak int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&peak)
+			if n <= max || atomic.CompareAndSwapInt32(&peak, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer hook.Close()
+
+	detail := redis.SubscribeDetail{Filter: map[string]interface{}{"type": "patchset-created"}, HookURL: hook.URL}
+	id, err := store.Subscriptions.Save("loki", detail, "", nil)
+	assert.Nil(suite.T(), err)
+	sub, err := store.Subscriptions.Get(id)
+	assert.Nil(suite.T(), err)
+
+	incoming := make(chan *gerrit.Event, 10)
+	contr := NewObserverContr(incoming, 5)
+	contr.Concurrency = 4
+	contr.SetMaxConnections(2)
+	assert.Nil(suite.T(), contr.AddObserver(sub))
+	for _, number := range []string{"1", "2", "3", "4", "5", "6"} {
+		incoming <- changeEvent(number, number)
+	}
+	close(incoming)
+	go contr.Start()
+	contr.Shutdown(5 * time.Second)
+
+	assert.True(suite.T(), atomic.LoadInt32(&peak) <= 2)
+	inUse, limit := contr.Connections()
+	assert.Equal(suite.T(), 0, inUse)
+	assert.Equal(suite.T(), 2, limit)
+	stats, err := store.Subscriptions.GetStats(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(6), stats.Delivered)
+}
+
+func (suite *HistoryTestSuite) TestOverflow() {
+	detail := redis.SubscribeDetail{Filter: map[string]interface{}{"type": "patchset-created"}, HookURL: "http://127.0.0.1:1"}
+	id, err := store.Subscriptions.Save("loki", detail, "", nil)
+	assert.Nil(suite.T(), err)
+	sub, err := store.Subscriptions.Get(id)
+	assert.Nil(suite.T(), err)
+
+	contr := NewObserverContr(make(chan *gerrit.Event), 1)
+	contr.SetOverflowPolicy(OverflowDropNewest, 10*time.Millisecond)
+	// the observers are not started, their queue only fills up
+	observe := func(policy string, size int) *Observer {
+		sub.Detail.Overflow = policy
+		obs, err := NewObserver(sub, make(EventChan, size), contr)
+		assert.Nil(suite.T(), err)
+		return obs
+	}
+	queued := func(obs *Observer) []string {
+		seqs := make([]string, 0)
+		for len(obs.eventChan) > 0 {
+			seqs = append(seqs, (<-obs.eventChan).Data["seq"].(string))
+		}
+		return seqs
+	}
+	push := func(obs *Observer, msg *gerrit.Event) int {
+		n, full := contr.push(obs, msg)
+		if full {
+			n += contr.block(obs, msg)
+		}
+		return n
+	}
+	dropped := func() map[string]string {
+		drops, err := store.Subscriptions.GetDrops(id)
+		assert.Nil(suite.T(), err)
+		reasons := make(map[string]string, len(drops))
+		for _, d := range drops {
+			reasons[d.EventID] = d.Reason
+		}
+		return reasons
+	}
+
+	obs := observe("", 1)
+	first, second := changeEvent("1", "1"), changeEvent("2", "2")
+	assert.Equal(suite.T(), 0, push(obs, first))
+	assert.Equal(suite.T(), 1, push(obs, second))
+	assert.Equal(suite.T(), []string{"1"}, queued(obs))
+	assert.Equal(suite.T(), map[string]string{second.ID: DropQueueFull}, dropped())
+
+	obs = observe(OverflowDropOldest, 1)
+	first, second = changeEvent("1", "1"), changeEvent("2", "2")
+	push(obs, first)
+	assert.Equal(suite.T(), 1, push(obs, second))
+	assert.Equal(suite.T(), []string{"2"}, queued(obs))
+	assert.Equal(suite.T(), DropEvicted, dropped()[first.ID])
+
+	obs = observe(OverflowBlock, 1)
+	first, second = changeEvent("1", "1"), changeEvent("2", "2")
+	push(obs, first)
+	assert.Equal(suite.T(), 1, push(obs, second))
+	assert.Equal(suite.T(), DropBlockTimeout, dropped()[second.ID])
+
+	// a later event of the same type and change supersedes the queued one
+	obs = observe(OverflowCoalesce, 2)
+	first, second = changeEvent("1", "1a"), changeEvent("2", "2a")
+	push(obs, first)
+	push(obs, second)
+	assert.Equal(suite.T(), 1, push(obs, changeEvent("1", "1b")))
+	assert.Equal(suite.T(), []string{"2a", "1b"}, queued(obs))
+	assert.Equal(suite.T(), DropCoalesced, dropped()[first.ID])
+
+	// once spilling, the events follow the spilled one even with room
+	obs = observe(OverflowSpill, 1)
+	push(obs, changeEvent("1", "1"))
+	assert.Equal(suite.T(), 0, push(obs, changeEvent("2", "2")))
+	assert.Equal(suite.T(), []string{"1"}, queued(obs))
+	assert.Equal(suite.T(), 0, push(obs, changeEvent("3", "3")))
+	assert.Empty(suite.T(), queued(obs))
+	spilled, err := store.Subscriptions.SpilledLength(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 2, spilled)
+	assert.Len(suite.T(), obs.spillDue, 1)
+
+	stats, err := store.Subscriptions.GetStats(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(4), stats.Dropped)
+}
+
+// gatedHook records the seq of the events posted to it once release is
+// closed, posted counts the POSTs waiting or done
+type gatedHook struct {
+	*httptest.Server
+	lock     sync.Mutex
+	release  chan struct{}
+	posted   int32
+	received []string
+}
+
+func newGatedHook() *gatedHook {
+	hook := &gatedHook{release: make(chan struct{})}
+	hook.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&data)
+		atomic.AddInt32(&hook.posted, 1)
+		<-hook.release
+		hook.lock.Lock()
+		hook.received = append(hook.received, data["seq"].(string))
+		hook.lock.Unlock()
+	}))
+	return hook
+}
+
+func (hook *gatedHook) delivered() []string {
+	hook.lock.Lock()
+	defer hook.lock.Unlock()
+	return append([]string(nil), hook.received...)
+}
+
+// observeGated starts a controller observing a subscribe posting to hook
+// with detail, the observer queue takes a single event
+func (suite *HistoryTestSuite) observeGated(hook *gatedHook, detail redis.SubscribeDetail) (int, chan *gerrit.Event, *ObserverContr) {
+	detail.Filter = map[string]interface{}{"type": "patchset-created"}
+	detail.HookURL = hook.URL
+	id, err := store.Subscriptions.Save("loki", detail, "", nil)
+	assert.Nil(suite.T(), err)
+	sub, err := store.Subscriptions.Get(id)
+	assert.Nil(suite.T(), err)
+
+	incoming := make(chan *gerrit.Event)
+	contr := NewObserverContr(incoming, 5)
+	contr.QueueSize = 1
+	assert.Nil(suite.T(), contr.AddObserver(sub))
+	go contr.Start()
+	return id, incoming, contr
+}
+
+func (suite *HistoryTestSuite) TestSpill() {
+	hook := newGatedHook()
+	defer hook.Close()
+	id, incoming, contr := suite.observeGated(hook, redis.SubscribeDetail{Overflow: OverflowSpill})
+
+	// the first event is posted or queued, the others follow the first
+	// one the full queue spilled
+	for _, seq := range []string{"1", "2", "3", "4"} {
+		incoming <- gerrit.NewEvent(map[string]interface{}{"type": "patchset-created", "seq": seq})
+	}
+	assert.Eventually(suite.T(), func() bool {
+		n, _ := store.Subscriptions.SpilledLength(id)
+		return n >= 2
+	}, 5*time.Second, 10*time.Millisecond)
+	close(hook.release)
+	assert.Eventually(suite.T(), func() bool { return len(hook.delivered()) == 4 }, 5*time.Second, 10*time.Millisecond)
+	// the queue takes the new events again once caught up
+	incoming <- gerrit.NewEvent(map[string]interface{}{"type": "patchset-created", "seq": "5"})
+	close(incoming)
+	contr.Shutdown(5 * time.Second)
+
+	assert.Equal(suite.T(), []string{"1", "2", "3", "4", "5"}, hook.delivered())
+	spilled, err := store.Subscriptions.SpilledLength(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 0, spilled)
+	stats, err := store.Subscriptions.GetStats(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(0), stats.Dropped)
+}
+
+func (suite *HistoryTestSuite) TestBlock() {
+	hook := newGatedHook()
+	defer hook.Close()
+	id, incoming, contr := suite.observeGated(hook, redis.SubscribeDetail{Overflow: OverflowBlock})
+	contr.SetOverflowPolicy("", 5*time.Second)
+
+	// the first event is posted, the second queued and the third waits for
+	// room, which the deliveries make without the lock of the controller
+	incoming <- gerrit.NewEvent(map[string]interface{}{"type": "patchset-created", "seq": "1"})
+	assert.Eventually(suite.T(), func() bool { return atomic.LoadInt32(&hook.posted) == 1 }, 5*time.Second, time.Millisecond)
+	incoming <- gerrit.NewEvent(map[string]interface{}{"type": "patchset-created", "seq": "2"})
+	incoming <- gerrit.NewEvent(map[string]interface{}{"type": "patchset-created", "seq": "3"})
+	close(hook.release)
+	assert.Eventually(suite.T(), func() bool { return len(hook.delivered()) == 3 }, 2*time.Second, 10*time.Millisecond)
+	close(incoming)
+	contr.Shutdown(5 * time.Second)
+
+	assert.Equal(suite.T(), []string{"1", "2", "3"}, hook.delivered())
+	stats, err := store.Subscriptions.GetStats(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(0), stats.Dropped)
+}
+
+func (suite *HistoryTestSuite) TestRedrive() {
+	hook := newGatedHook()
+	defer hook.Close()
+	id, incoming, contr := suite.observeGated(hook, redis.SubscribeDetail{})
+
+	var events []*gerrit.Event
+	for _, seq := range []string{"1", "2", "3"} {
+		msg := gerrit.NewEvent(map[string]interface{}{"type": "patchset-created", "seq": seq})
+		events = append(events, msg)
+		incoming <- msg
+		// the first event is posted, the second queued and the third dropped
+		assert.Eventually(suite.T(), func() bool { return atomic.LoadInt32(&hook.posted) == 1 }, 5*time.Second, time.Millisecond)
+	}
+	var drops []*redis.Drop
+	assert.Eventually(suite.T(), func() bool {
+		drops, _ = store.Subscriptions.GetDrops(id)
+		return len(drops) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	if assert.Len(suite.T(), drops, 1) {
+		assert.Equal(suite.T(), redis.Drop{EventID: events[2].ID, EventType: "patchset-created", Reason: DropQueueFull, Time: drops[0].Time}, *drops[0])
+	}
+	close(hook.release)
+	assert.Eventually(suite.T(), func() bool { return len(hook.delivered()) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	redriven, missing, err := contr.Redrive(id, []string{events[2].ID, "unknown"})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{events[2].ID}, redriven)
+	assert.Equal(suite.T(), []string{"unknown"}, missing)
+	assert.Eventually(suite.T(), func() bool { return len(hook.delivered()) == 3 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(suite.T(), []string{"1", "2", "3"}, hook.delivered())
+	drops, err = store.Subscriptions.GetDrops(id)
+	assert.Nil(suite.T(), err)
+	assert.Empty(suite.T(), drops)
+
+	// a drop log left as it was fails the redrive
+	store.Subscriptions = dropsKept{store.Subscriptions}
+	_, _, err = contr.Redrive(id, nil)
+	assert.EqualError(suite.T(), err, "drop log not updated")
+
+	close(incoming)
+	contr.Shutdown(5 * time.Second)
+	_, _, err = contr.Redrive(id, nil)
+	assert.Equal(suite.T(), ErrNotObserved, err)
+}
+
+// dropsKept is a store whose drop log can not be updated
+type dropsKept struct {
+	store.SubscriptionStore
+}
+
+func (dropsKept) RemoveDrops(id int, eventIDs []string) error {
+	return errors.New("drop log not updated")
+}
+
+// recordingHook records the data of the events posted to it
+type recordingHook struct {
+	*httptest.Server
+	lock     sync.Mutex
+	received []map[string]interface{}
+}
+
+func newRecordingHook() *recordingHook {
+	hook := &recordingHook{}
+	hook.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&data)
+		hook.lock.Lock()
+		hook.received = append(hook.received, data)
+		hook.lock.Unlock()
+	}))
+	return hook
+}
+
+func (hook *recordingHook) events() []map[string]interface{} {
+	hook.lock.Lock()
+	defer hook.lock.Unlock()
+	return append([]map[string]interface{}(nil), hook.received...)
+}
+
+// observeRecording starts a controller observing a subscribe posting the
+// patchset-created events to hook with detail
+func (suite *HistoryTestSuite) observeRecording(hook *recordingHook, detail redis.SubscribeDetail) (int, chan *gerrit.Event, *ObserverContr) {
+	detail.Filter = map[string]interface{}{"type": "patchset-created"}
+	detail.HookURL = hook.URL
+	id, err := store.Subscriptions.Save("loki", detail, "", nil)
+	assert.Nil(suite.T(), err)
+	sub, err := store.Subscriptions.Get(id)
+	assert.Nil(suite.T(), err)
+
+	incoming := make(chan *gerrit.Event)
+	contr := NewObserverContr(incoming, 5)
+	assert.Nil(suite.T(), contr.AddObserver(sub))
+	go contr.Start()
+	return id, incoming, contr
+}
+
+func (suite *HistoryTestSuite) TestDebounce() {
+	hook := newRecordingHook()
+	defer hook.Close()
+	id, incoming, contr := suite.observeRecording(hook, redis.SubscribeDetail{
+		Debounce: &redis.Debounce{Key: DebounceChange, Window: 1},
+	})
+	for _, msg := range []*gerrit.Event{changeEvent("1", "1a"), changeEvent("1", "1b"), changeEvent("2", "2a"), changeEvent("1", "1c")} {
+		incoming <- msg
+	}
+	var stats *redis.SubscribeStats
+	assert.Eventually(suite.T(), func() bool {
+		stats, _ = store.Subscriptions.GetStats(id)
+		return stats != nil && stats.Delivered == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	close(incoming)
+	contr.Shutdown(5 * time.Second)
+
+	var seqs []string
+	for _, data := range hook.events() {
+		seqs = append(seqs, data["seq"].(string))
+		assert.NotContains(suite.T(), data, "batch")
+	}
+	// only the latest event of change 1 is delivered, its window opened first
+	assert.Equal(suite.T(), []string{"1c", "2a"}, seqs)
+	assert.Equal(suite.T(), int64(4), stats.Matched)
+	assert.Equal(suite.T(), int64(2), stats.Debounced)
+}
+
+func (suite *HistoryTestSuite) TestDebounceBatch() {
+	hook := newRecordingHook()
+	defer hook.Close()
+	id, incoming, contr := suite.observeRecording(hook, redis.SubscribeDetail{
+		Debounce: &redis.Debounce{Key: DebounceChange, Window: MaxDebounceWindow, Batch: true},
+	})
+	incoming <- changeEvent("1", "1a")
+	incoming <- changeEvent("1", "1b")
+	// the windows of a stopped observer close at once
+	close(incoming)
+	contr.Shutdown(5 * time.Second)
+
+	data := hook.events()
+	if assert.Len(suite.T(), data, 1) {
+		assert.Equal(suite.T(), "1b", data[0]["seq"])
+		batch := data[0]["batch"].([]interface{})
+		if assert.Len(suite.T(), batch, 2) {
+			assert.Equal(suite.T(), "1a", batch[0].(map[string]interface{})["seq"])
+			assert.Equal(suite.T(), "1b", batch[1].(map[string]interface{})["seq"])
+		}
+	}
+	stats, err := store.Subscriptions.GetStats(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(2), stats.Matched)
+	assert.Equal(suite.T(), int64(1), stats.Delivered)
+	assert.Equal(suite.T(), int64(1), stats.Debounced)
+}
+
+func TestHistoryTestSuite(t *testing.T) {
+	suite.Run(t, new(HistoryTestSuite))
+}
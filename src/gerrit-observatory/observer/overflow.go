@@ -0,0 +1,408 @@
+package observer
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"gerrit-observatory/gerrit"
+	"gerrit-observatory/log"
+	"gerrit-observatory/metrics"
+	"gerrit-observatory/redis"
+	"gerrit-observatory/store"
+)
+
+// overflow policies, what happens to an event the full queue of an
+// observer can not take
+const (
+	// OverflowBlock waits for room until the block timeout, holding the
+	// other observers back meanwhile
+	OverflowBlock = "block"
+	// OverflowSpill keeps the event in redis, the events after it follow
+	// until the observer caught up
+	OverflowSpill = "spill"
+	// OverflowDropOldest drops the oldest queued event to make room
+	OverflowDropOldest = "drop_oldest"
+	// OverflowDropNewest drops the event
+	OverflowDropNewest = "drop_newest"
+	// OverflowCoalesce drops the queued events superseded by a later one of
+	// the same type and ordering key
+	OverflowCoalesce = "coalesce"
+)
+
+// reasons an event is dropped for, recorded in the drop log
+const (
+	DropQueueFull    = "queue_full"
+	DropEvicted      = "evicted"
+	DropCoalesced    = "coalesced"
+	DropBlockTimeout = "block_timeout"
+	DropSpillFailed  = "spill_failed"
+	DropBacklog      = "backlog_failed"
+	DropDiscarded    = "discarded"
+)
+
+var (
+	// ErrNotObserved is returned when redriving events to a subscribe
+	// without a running observer
+	ErrNotObserved = errors.New("subscribe not observed")
+)
+
+// ValidOverflow tells whether policy is an overflow policy, empty stands
+// for the default one
+func ValidOverflow(policy string) bool {
+	switch policy {
+	case "", OverflowBlock, OverflowSpill, OverflowDropOldest, OverflowDropNewest, OverflowCoalesce:
+		return true
+	}
+	return false
+}
+
+// SetOverflowPolicy sets the overflow policy of the observers whose
+// subscribe has none, blockTimeout bounds the wait of the block policy
+func (contr *ObserverContr) SetOverflowPolicy(policy string, blockTimeout time.Duration) {
+	contr.Lock()
+	defer contr.Unlock()
+	contr.Overflow = policy
+	contr.BlockTimeout = blockTimeout
+}
+
+// push hands msg to the queue of obs, applying the overflow policy when
+// it is full. It returns the number of events dropped and whether msg is to
+// wait for room with block once contr is unlocked, contr is locked
+func (contr *ObserverContr) push(obs *Observer, msg *gerrit.Event) (int, bool) {
+	// once spilling, the events follow those spilled
+	if obs.spill(msg, false) {
+		return 0, false
+	}
+	select {
+	case obs.eventChan <- msg:
+		return 0, false
+	default:
+	}
+
+	policy := obs.subscribe.Detail.Overflow
+	if policy == "" {
+		policy = contr.Overflow
+	}
+	switch policy {
+	case OverflowBlock:
+		return 0, true
+	case OverflowSpill:
+		if obs.spill(msg, true) {
+			return 0, false
+		}
+		obs.dropQueued(msg, DropSpillFailed)
+		return 1, false
+	case OverflowDropOldest:
+		dropped := 0
+		select {
+		case oldest := <-obs.eventChan:
+			obs.dropQueued(oldest, DropEvicted)
+			dropped++
+		default:
+		}
+		select {
+		case obs.eventChan <- msg:
+		default:
+			obs.dropQueued(msg, DropQueueFull)
+			dropped++
+		}
+		return dropped, false
+	case OverflowCoalesce:
+		return obs.coalesce(msg), false
+	}
+	obs.dropQueued(msg, DropQueueFull)
+	return 1, false
+}
+
+// block waits until the block timeout for room in the queue of obs, with
+// contr unlocked since the deliveries of obs need it to drain the queue. msg
+// goes to the observer replacing obs meanwhile, if any. It returns the number
+// of events dropped
+func (contr *ObserverContr) block(obs *Observer, msg *gerrit.Event) int {
+	contr.Lock()
+	timeout := contr.BlockTimeout
+	contr.Unlock()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		sent, detached := obs.wait(msg, timer.C)
+		if sent {
+			return 0
+		}
+		if !detached {
+			obs.dropQueued(msg, DropBlockTimeout)
+			return 1
+		}
+		contr.Lock()
+		element, ok := contr.ObserverMap[obs.subscribe.ID]
+		if !ok {
+			contr.Unlock()
+			return 0
+		}
+		obs = element.Value.(*Observer)
+		dropped, full := contr.push(obs, msg)
+		contr.Unlock()
+		if !full {
+			return dropped
+		}
+	}
+}
+
+// wait queues msg once the queue of obs has room, unless timeout fires or
+// obs is detached first
+func (obs *Observer) wait(msg *gerrit.Event, timeout <-chan time.Time) (sent bool, detached bool) {
+	obs.sending.RLock()
+	defer obs.sending.RUnlock()
+
+	select {
+	case <-obs.detached:
+		return false, true
+	default:
+	}
+	select {
+	case obs.eventChan <- msg:
+		return true, false
+	case <-obs.detached:
+		return false, true
+	case <-timeout:
+		return false, false
+	}
+}
+
+// coalesceKey groups the events superseding each other: those of a type
+// and an ordering key
+func coalesceKey(msg *gerrit.Event) string {
+	return msg.Type() + " " + orderingKey(msg)
+}
+
+// coalesce makes room for msg in the full queue of obs by dropping the
+// queued events a later one supersedes, msg is dropped when none is
+func (obs *Observer) coalesce(msg *gerrit.Event) int {
+	queued := make([]*gerrit.Event, 0, cap(obs.eventChan)+1)
+	for len(queued) < cap(obs.eventChan) {
+		select {
+		case e := <-obs.eventChan:
+			queued = append(queued, e)
+			continue
+		default:
+		}
+		break
+	}
+	queued = append(queued, msg)
+
+	latest := make(map[string]int, len(queued))
+	for i, e := range queued {
+		latest[coalesceKey(e)] = i
+	}
+	dropped := 0
+	for i, e := range queued {
+		if latest[coalesceKey(e)] != i {
+			obs.dropQueued(e, DropCoalesced)
+			dropped++
+			continue
+		}
+		select {
+		case obs.eventChan <- e:
+		default:
+			obs.dropQueued(e, DropQueueFull)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// dropQueued counts msg, which never reached obs, as dropped for reason
+func (obs *Observer) dropQueued(msg *gerrit.Event, reason string) {
+	obs.logger(msg).Warningf("event dropped, %s", reason)
+	obs.logDrop(msg, reason)
+	if err := store.Subscriptions.AddStats(obs.subscribe.ID, redis.StatsDelta{Dropped: 1}); err != nil {
+		obs.logger(msg).Warningf("stats not updated, err: %v", err)
+	}
+}
+
+// logDrop records that obs dropped msg for reason, so that it may be
+// redriven. The caller counts it in the statistics
+func (obs *Observer) logDrop(msg *gerrit.Event, reason string) {
+	metrics.EventsDropped.Inc(strconv.Itoa(obs.subscribe.ID), reason)
+	drop := &redis.Drop{EventID: msg.ID, EventType: msg.Type(), Reason: reason, Time: time.Now()}
+	if err := store.Subscriptions.LogDrop(obs.subscribe.ID, drop); err != nil {
+		obs.logger(msg).Warningf("drop not logged, err: %v", err)
+	}
+}
+
+// spill keeps msg in redis while obs is spilling, or starts doing so when
+// force is set. It tells whether msg was kept
+func (obs *Observer) spill(msg *gerrit.Event, force bool) bool {
+	obs.spillMu.Lock()
+	defer obs.spillMu.Unlock()
+
+	if !obs.spilling && !force {
+		return false
+	}
+	if err := store.Subscriptions.SaveSpilled(obs.subscribe.ID, msg); err != nil {
+		obs.logger(msg).Errorf("event not spilled, err: %v", err)
+		return false
+	}
+	obs.startSpilling()
+	return true
+}
+
+// startSpilling makes obs deliver the spilled events, it must be called with
+// obs.spillMu locked
+func (obs *Observer) startSpilling() {
+	if obs.spilling {
+		return
+	}
+	obs.spilling = true
+	select {
+	case obs.spillDue <- struct{}{}:
+	default:
+	}
+}
+
+// followSpilled makes the new events of obs follow the spilled ones, those
+// of previous when obs replaces it or else those a shutdown left
+func (obs *Observer) followSpilled(previous *Observer) {
+	spilling := false
+	if previous != nil {
+		previous.spillMu.Lock()
+		spilling = previous.spilling
+		previous.spillMu.Unlock()
+	} else if n, err := store.Subscriptions.SpilledLength(obs.subscribe.ID); err == nil {
+		spilling = n > 0
+	}
+	if spilling {
+		obs.spilling = true
+		obs.spillDue <- struct{}{}
+	}
+}
+
+// catchUp handles the events queued before obs started spilling, then the
+// spilled ones. It tells whether the queue of obs is still open
+func (obs *Observer) catchUp() bool {
+	for {
+		select {
+		case msg, ok := <-obs.eventChan:
+			if !ok {
+				return false
+			}
+			obs.process(msg)
+			continue
+		default:
+		}
+		break
+	}
+	obs.drainSpilled()
+	return true
+}
+
+// drainSpilled handles the events spilled by obs, oldest first, until none
+// is left or a shutdown aborts. Those left stay spilled
+func (obs *Observer) drainSpilled() {
+	for !obs.contr.aborted() {
+		msg, err := obs.popSpilled()
+		if err != nil {
+			log.Logger.With(log.Fields{log.FieldObserverID: obs.subscribe.ID}).Errorf("spilled event not loaded, err: %v", err)
+			return
+		}
+		if msg == nil {
+			return
+		}
+		obs.process(msg)
+	}
+}
+
+// popSpilled takes the oldest event spilled by obs, the queue of obs takes
+// the new events again once none is left
+func (obs *Observer) popSpilled() (*gerrit.Event, error) {
+	obs.spillMu.Lock()
+	defer obs.spillMu.Unlock()
+
+	msg, err := store.Subscriptions.PopSpilled(obs.subscribe.ID)
+	if err == nil && msg == nil {
+		obs.spilling = false
+	}
+	return msg, err
+}
+
+// Redrive hands the dropped events eventIDs back to the observer of id,
+// every dropped event when eventIDs is empty. They are handled after the
+// queued ones and removed from the drop log. It returns the ids redriven
+// and those not dropped or no longer in the history
+func (contr *ObserverContr) Redrive(id int, eventIDs []string) (redriven []string, missing []string, err error) {
+	observer, ok := contr.observer(id)
+	if !ok {
+		return nil, nil, ErrNotObserved
+	}
+	drops, err := store.Subscriptions.GetDrops(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	wanted := make(map[string]bool, len(eventIDs))
+	for _, eventID := range eventIDs {
+		wanted[eventID] = true
+	}
+
+	redriven, missing = make([]string, 0), make([]string, 0)
+	seen := make(map[string]bool, len(drops))
+	// the drop log is newest first
+	for i := len(drops) - 1; i >= 0; i-- {
+		eventID := drops[i].EventID
+		if seen[eventID] || len(wanted) > 0 && !wanted[eventID] {
+			continue
+		}
+		seen[eventID] = true
+		msg, err := store.Subscriptions.GetEvent(eventID)
+		if err == redis.ErrEventNotFound {
+			missing = append(missing, eventID)
+			continue
+		}
+		if err != nil {
+			return redriven, missing, contr.redriven(id, observer, redriven, err)
+		}
+		if !observer.spill(msg, true) {
+			return redriven, missing, contr.redriven(id, observer, redriven, errors.New("events not spilled"))
+		}
+		redriven = append(redriven, eventID)
+	}
+	for _, eventID := range eventIDs {
+		if !seen[eventID] {
+			missing = append(missing, eventID)
+		}
+	}
+	return redriven, missing, contr.redriven(id, observer, redriven, nil)
+}
+
+// redriven completes a redrive of events to observer, which ends with err:
+// the drops of the events spilled are forgotten so they are not redriven
+// twice, and the observer which replaced observer meanwhile delivers them
+func (contr *ObserverContr) redriven(id int, observer *Observer, eventIDs []string, err error) error {
+	if len(eventIDs) > 0 {
+		if current, ok := contr.observer(id); ok && current != observer {
+			current.spillMu.Lock()
+			current.startSpilling()
+			current.spillMu.Unlock()
+		}
+	}
+	if removeErr := store.Subscriptions.RemoveDrops(id, eventIDs); removeErr != nil {
+		if err == nil {
+			return removeErr
+		}
+		log.Logger.With(log.Fields{log.FieldObserverID: id}).Errorf("redriven events not removed from the drop log, err: %v", removeErr)
+	}
+	return err
+}
+
+// observer returns the running observer of id
+func (contr *ObserverContr) observer(id int) (*Observer, bool) {
+	contr.Lock()
+	defer contr.Unlock()
+
+	element, ok := contr.ObserverMap[id]
+	if !ok {
+		return nil, false
+	}
+	return element.Value.(*Observer), true
+}
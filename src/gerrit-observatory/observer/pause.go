@@ -0,0 +1,101 @@
+package observer
+
+import (
+	"gerrit-observatory/gerrit"
+	"gerrit-observatory/log"
+	"gerrit-observatory/redis"
+	"gerrit-observatory/store"
+	"gerrit-observatory/trace"
+)
+
+// ResumeObserver replaces the paused observer of sub.ID with one built from
+// the resumed sub. The events held while paused are delivered before the
+// new ones, or dropped when discard is set
+func (contr *ObserverContr) ResumeObserver(sub *redis.Subscribe, discard bool) error {
+	contr.Lock()
+	defer contr.Unlock()
+
+	observer, err := NewObserver(sub, make(EventChan, contr.QueueSize), contr)
+	if err != nil {
+		return err
+	}
+	observer.discardBacklog = discard
+	contr.swap(sub.ID, observer)
+	return nil
+}
+
+// hold keeps msg, matched while obs is paused, in the backlog of its
+// subscribe, or only counts it when the pause skips deliveries
+func (obs *Observer) hold(msg *gerrit.Event, delta redis.StatsDelta, span *trace.Span) redis.StatsDelta {
+	span.SetAttribute("paused", obs.subscribe.PauseMode)
+	if obs.subscribe.PauseMode == redis.PauseSkip {
+		delta.Skipped = 1
+		return delta
+	}
+	if err := store.Subscriptions.SaveBacklog(obs.subscribe.ID, msg); err != nil {
+		obs.logger(msg).Errorf("event not kept in backlog, err: %v", err)
+		obs.logDrop(msg, DropBacklog)
+		delta.Dropped = 1
+	}
+	return delta
+}
+
+// replayBacklog delivers the events obs held while paused, they were
+// counted as seen and matched when held. Those left when the disable policy
+// pauses the subscribe again, or when the breaker opens in queue mode, go
+// back to the backlog
+func (obs *Observer) replayBacklog() {
+	id := obs.subscribe.ID
+	logger := log.Logger.With(log.Fields{log.FieldObserverID: id})
+	events, err := store.Subscriptions.TakeBacklog(id)
+	if err != nil {
+		logger.Errorf("backlog not loaded, err: %v", err)
+		return
+	}
+	if len(events) == 0 {
+		return
+	}
+	if obs.discardBacklog {
+		logger.Infof("%d backlog events discarded", len(events))
+		for _, msg := range events {
+			obs.logDrop(msg, DropDiscarded)
+		}
+		if err = store.Subscriptions.AddStats(id, redis.StatsDelta{Dropped: int64(len(events))}); err != nil {
+			logger.Warningf("stats not updated, err: %v", err)
+		}
+		return
+	}
+
+	logger.Infof("delivering %d backlog events", len(events))
+	requeue := func(events ...*gerrit.Event) {
+		if err := store.Subscriptions.SaveBacklog(id, events...); err != nil {
+			logger.Errorf("%d backlog events lost, err: %v", len(events), err)
+		}
+	}
+	for i, msg := range events {
+		if obs.contr.aborted() {
+			requeue(events[i:]...)
+			return
+		}
+		if obs.queuesWhileOpen() {
+			requeue(events[i:]...)
+			obs.armProbe()
+			return
+		}
+		span := trace.StartSpan(msg.Trace, "observer.backlog", trace.KindInternal)
+		span.SetAttribute("event.id", msg.ID)
+		span.SetAttribute("observer.id", id)
+		delta := obs.deliverMatched(msg, redis.StatsDelta{}, span, requeue)
+		span.End()
+		if err = store.Subscriptions.AddStats(id, delta); err != nil {
+			obs.logger(msg).Warningf("stats not updated, err: %v", err)
+		}
+		if delta.Failed > 0 {
+			obs.afterFailure()
+		}
+		if obs.isDisabled() {
+			requeue(events[i+1:]...)
+			return
+		}
+	}
+}
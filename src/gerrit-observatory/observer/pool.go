@@ -0,0 +1,194 @@
+package observer
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+
+	"gerrit-observatory/gerrit"
+	"gerrit-observatory/metrics"
+	"gerrit-observatory/redis"
+	"gerrit-observatory/trace"
+)
+
+// MaxConcurrency bounds the deliveries a subscribe may ask to make at once
+const MaxConcurrency = 32
+
+// limiter bounds the POSTs in flight across the observers. Its limit may
+// change while slots are taken, those still count against the new limit
+// so no more POSTs than it are made once they are released
+type limiter struct {
+	sync.Mutex
+	room  *sync.Cond
+	taken int
+	limit int
+}
+
+func newLimiter(n int) *limiter {
+	l := &limiter{limit: n}
+	l.room = sync.NewCond(&l.Mutex)
+	return l
+}
+
+// acquire waits for a slot, it returns the func releasing it or the error
+// of ctx when ctx is done first
+func (l *limiter) acquire(ctx context.Context) (func(), error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.taken >= l.limit {
+		// the waiters are woken up when ctx is done
+		waited := make(chan struct{})
+		defer close(waited)
+		go func() {
+			select {
+			case <-ctx.Done():
+				l.Lock()
+				l.room.Broadcast()
+				l.Unlock()
+			case <-waited:
+			}
+		}()
+	}
+	for l.taken >= l.limit {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		l.room.Wait()
+	}
+	l.taken++
+	return l.release, nil
+}
+
+func (l *limiter) release() {
+	l.Lock()
+	defer l.Unlock()
+	l.taken--
+	l.room.Broadcast()
+}
+
+func (l *limiter) resize(n int) {
+	l.Lock()
+	defer l.Unlock()
+	l.limit = n
+	l.room.Broadcast()
+}
+
+// usage returns the slots taken and the limit
+func (l *limiter) usage() (int, int) {
+	l.Lock()
+	defer l.Unlock()
+	return l.taken, l.limit
+}
+
+// SetMaxConnections bounds the POSTs in flight across the observers
+func (contr *ObserverContr) SetMaxConnections(n int) {
+	contr.connections.resize(n)
+}
+
+// Connections returns the POSTs in flight across the observers and their
+// limit
+func (contr *ObserverContr) Connections() (inFlight int, limit int) {
+	return contr.connections.usage()
+}
+
+func (contr *ObserverContr) collectConnections() {
+	inFlight, _ := contr.Connections()
+	metrics.DeliveriesInFlight.Set(float64(inFlight))
+}
+
+// concurrency returns the deliveries sub makes at once, its own setting or
+// else the default of the controller
+func concurrency(sub *redis.Subscribe, byDefault int) int {
+	if sub.Detail.Concurrency > 0 {
+		return sub.Detail.Concurrency
+	}
+	return byDefault
+}
+
+// orderingKey groups the events delivered in order: those of a change, of
+// a ref, or else of a project
+func orderingKey(msg *gerrit.Event) string {
+	if change, ok := msg.Data["change"].(map[string]interface{}); ok {
+		if number, ok := change["number"]; ok {
+			return fmt.Sprintf("change:%v:%v", change["project"], number)
+		}
+		if id, ok := change["id"]; ok {
+			return fmt.Sprintf("change:%v", id)
+		}
+	}
+	if ref, ok := msg.Data["refUpdate"].(map[string]interface{}); ok {
+		return fmt.Sprintf("ref:%v:%v", ref["project"], ref["refName"])
+	}
+	return "project:" + msg.Project()
+}
+
+// laneItem is a matched event waiting for a lane, along with what was
+// counted of it so far
+type laneItem struct {
+	msg   *gerrit.Event
+	delta redis.StatsDelta
+	span  *trace.Span
+}
+
+// startLanes runs a goroutine per lane of obs, matched events are then
+// delivered by the lanes rather than in line
+func (obs *Observer) startLanes() {
+	for _, lane := range obs.lanes {
+		obs.lanesDone.Add(1)
+		go obs.runLane(lane)
+	}
+	obs.lanesStarted = len(obs.lanes) > 0
+}
+
+// stopLanes waits for the lanes of obs to deliver their events, or to
+// persist them when a shutdown aborted
+func (obs *Observer) stopLanes() {
+	if !obs.lanesStarted {
+		return
+	}
+	obs.lanesStarted = false
+	for _, lane := range obs.lanes {
+		close(lane)
+	}
+	obs.lanesDone.Wait()
+}
+
+// dispatch hands item to the lane of its ordering key, it waits while the
+// lane is full
+func (obs *Observer) dispatch(item *laneItem) {
+	h := fnv.New32a()
+	h.Write([]byte(orderingKey(item.msg)))
+	lane := h.Sum32() % uint32(len(obs.lanes))
+	item.span.SetAttribute("lane", strconv.Itoa(int(lane)))
+	obs.inflight.Add(1)
+	obs.lanes[lane] <- item
+}
+
+func (obs *Observer) runLane(lane chan *laneItem) {
+	defer obs.lanesDone.Done()
+	for item := range lane {
+		if obs.contr.aborted() {
+			// matched again once replayed, nothing is counted yet
+			item.span.SetError("shutdown")
+			item.span.End()
+			obs.persist(item.msg)
+		} else {
+			delta := obs.deliverMatched(item.msg, item.delta, item.span, obs.persist)
+			item.span.End()
+			obs.record(item.msg, delta)
+		}
+		obs.inflight.Done()
+	}
+}
+
+// lanesDepth returns the number of events waiting in the lanes of obs
+func (obs *Observer) lanesDepth() int {
+	depth := 0
+	for _, lane := range obs.lanes {
+		depth += len(lane)
+	}
+	return depth
+}
@@ -0,0 +1,99 @@
+package observer
+
+import (
+	"context"
+	"time"
+
+	"gerrit-observatory/gerrit"
+	"gerrit-observatory/log"
+	"gerrit-observatory/store"
+)
+
+// Shutdown stops the observers once the incoming queue is closed and
+// drained, they deliver their pending events for at most timeout. Then the
+// deliveries in progress are cancelled and the events left are persisted to
+// be delivered when the observers start again. Observers detached earlier
+// are waited for as well
+func (contr *ObserverContr) Shutdown(timeout time.Duration) {
+	deadline, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	select {
+	case <-contr.stopped:
+	case <-deadline.Done():
+		log.Logger.Warningf("incoming queue not drained in %s", timeout)
+	}
+
+	contr.Lock()
+	for id := range contr.ObserverMap {
+		contr.detach(id)
+	}
+	contr.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		contr.running.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-deadline.Done():
+		log.Logger.Warningf("deliveries not finished in %s, persisting the pending events", timeout)
+	}
+	contr.abort()
+	<-finished
+}
+
+func (contr *ObserverContr) aborted() bool {
+	return contr.ctx.Err() != nil
+}
+
+// persist stores events to be delivered to obs after a restart
+func (obs *Observer) persist(events ...*gerrit.Event) {
+	if len(events) == 0 {
+		return
+	}
+	logger := log.Logger.With(log.Fields{log.FieldObserverID: obs.subscribe.ID})
+	if err := store.Subscriptions.SavePending(obs.subscribe.ID, events...); err != nil {
+		logger.Errorf("%d pending events lost, err: %v", len(events), err)
+		return
+	}
+	logger.Infof("%d pending events persisted", len(events))
+}
+
+// persistQueue persists the events left in the queue of obs
+func (obs *Observer) persistQueue() {
+	events := make([]*gerrit.Event, 0, len(obs.eventChan))
+	for {
+		select {
+		case msg, ok := <-obs.eventChan:
+			if ok {
+				events = append(events, msg)
+				continue
+			}
+		default:
+		}
+		break
+	}
+	obs.persist(events...)
+}
+
+// replayPending handles the events persisted for obs on the last shutdown
+func (obs *Observer) replayPending() {
+	logger := log.Logger.With(log.Fields{log.FieldObserverID: obs.subscribe.ID})
+	events, err := store.Subscriptions.TakePending(obs.subscribe.ID)
+	if err != nil {
+		logger.Errorf("pending events not loaded, err: %v", err)
+		return
+	}
+	if len(events) > 0 {
+		logger.Infof("replaying %d pending events", len(events))
+	}
+	for i, msg := range events {
+		if obs.contr.aborted() {
+			obs.persist(events[i:]...)
+			return
+		}
+		obs.process(msg)
+	}
+}
@@ -0,0 +1,143 @@
+package redis
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+var (
+	deliveryLogKeyPrefix = "delivery_log:"
+	deliveryRetention    = 7 * 24 * time.Hour
+	deliveryMaxEntries   = 1000
+	deliveryMaxBody      = 1024
+)
+
+// Delivery records one attempt to POST an event to the hook of a subscribe
+type Delivery struct {
+	EventID      string    `json:"event_id"`
+	EventType    string    `json:"event_type"`
+	MatchedTime  time.Time `json:"matched_time"`
+	Time         time.Time `json:"time"`
+	Attempt      int       `json:"attempt"`
+	StatusCode   int       `json:"status_code"`
+	LatencyMs    float64   `json:"latency_ms"`
+	Error        string    `json:"error,omitempty"`
+	ResponseBody string    `json:"response_body"`
+}
+
+// Succeeded tells whether the hook accepted the event on this attempt
+func (d *Delivery) Succeeded() bool {
+	return d.Error == ""
+}
+
+// DeliveryQuery filters and paginates a delivery log, zero values match all
+type DeliveryQuery struct {
+	EventID string
+	// Outcome is "success", "failure" or empty
+	Outcome string
+	Since   time.Time
+	Offset  int
+	Limit   int
+}
+
+// Match tells whether d passes the filters of q
+func (q *DeliveryQuery) Match(d *Delivery) bool {
+	if q.EventID != "" && d.EventID != q.EventID {
+		return false
+	}
+	if q.Outcome == "success" && !d.Succeeded() || q.Outcome == "failure" && d.Succeeded() {
+		return false
+	}
+	return q.Since.IsZero() || !d.Time.Before(q.Since)
+}
+
+// InitDeliveryLog keeps at most maxEntries deliveries per subscribe and
+// drops those older than retention
+func InitDeliveryLog(retention time.Duration, maxEntries int) {
+	deliveryRetention = retention
+	deliveryMaxEntries = maxEntries
+}
+
+// DeliveryLogRetention returns how long deliveries are kept
+func DeliveryLogRetention() time.Duration {
+	return deliveryRetention
+}
+
+// DeliveryLogMaxEntries returns how many deliveries are kept per subscribe
+func DeliveryLogMaxEntries() int {
+	return deliveryMaxEntries
+}
+
+// TrimBody cuts the response body of d to the size kept in delivery logs
+func (d *Delivery) TrimBody() {
+	if len(d.ResponseBody) > deliveryMaxBody {
+		d.ResponseBody = d.ResponseBody[:deliveryMaxBody]
+	}
+}
+
+// LogDelivery appends d to the delivery log of subscribe id and trims the log
+func LogDelivery(id int, d *Delivery) error {
+	d.TrimBody()
+	raw, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	key := getDeliveryLogKey(id)
+	redisConn.Send("MULTI")
+	redisConn.Send("ZADD", key, unixMilli(d.Time), raw)
+	redisConn.Send("ZREMRANGEBYSCORE", key, "-inf", "("+formatScore(d.Time.Add(-deliveryRetention)))
+	redisConn.Send("ZREMRANGEBYRANK", key, 0, -deliveryMaxEntries-1)
+	redisConn.Send("EXPIRE", key, int(deliveryRetention/time.Second))
+	_, err = redisConn.Do("EXEC")
+	return err
+}
+
+// GetDeliveries returns the deliveries of subscribe id matching q, newest
+// first, along with the number of matching deliveries before pagination
+func GetDeliveries(id int, q DeliveryQuery) ([]*Delivery, int, error) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	since := time.Now().Add(-deliveryRetention)
+	raws, err := redis.ByteSlices(redisConn.Do("ZREVRANGEBYSCORE", getDeliveryLogKey(id), "+inf", formatScore(since)))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	logged := make([]*Delivery, 0, len(raws))
+	for _, raw := range raws {
+		var d Delivery
+		if err = json.Unmarshal(raw, &d); err != nil {
+			return nil, 0, err
+		}
+		logged = append(logged, &d)
+	}
+	deliveries, total := FilterDeliveries(logged, q)
+	return deliveries, total, nil
+}
+
+// FilterDeliveries returns the page of logged deliveries, newest first,
+// matching q along with the number of matching deliveries before pagination
+func FilterDeliveries(logged []*Delivery, q DeliveryQuery) ([]*Delivery, int) {
+	deliveries := make([]*Delivery, 0)
+	total := 0
+	for _, d := range logged {
+		if !q.Match(d) {
+			continue
+		}
+		total++
+		if total > q.Offset && (q.Limit <= 0 || len(deliveries) < q.Limit) {
+			deliveries = append(deliveries, d)
+		}
+	}
+	return deliveries, total
+}
+
+func getDeliveryLogKey(id int) string {
+	return fmt.Sprintf("%s%s%d", keyPrefix, deliveryLogKeyPrefix, id)
+}
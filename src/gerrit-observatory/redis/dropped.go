@@ -0,0 +1,96 @@
+package redis
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+var dropLogKeyPrefix = "drop_log:"
+
+// Drop records an event a subscribe lost along with why, the event is
+// found again in the history by its id to be redriven
+type Drop struct {
+	EventID   string    `json:"event_id"`
+	EventType string    `json:"event_type"`
+	Reason    string    `json:"reason"`
+	Time      time.Time `json:"time"`
+}
+
+// LogDrop appends d to the drop log of subscribe id, the log is bounded as
+// the delivery log is
+func LogDrop(id int, d *Drop) error {
+	raw, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	key := getDropLogKey(id)
+	redisConn.Send("MULTI")
+	redisConn.Send("ZADD", key, unixMilli(d.Time), raw)
+	redisConn.Send("ZREMRANGEBYSCORE", key, "-inf", "("+formatScore(d.Time.Add(-deliveryRetention)))
+	redisConn.Send("ZREMRANGEBYRANK", key, 0, -deliveryMaxEntries-1)
+	redisConn.Send("EXPIRE", key, int(deliveryRetention/time.Second))
+	_, err = redisConn.Do("EXEC")
+	return err
+}
+
+// GetDrops returns the drop log of subscribe id, newest first
+func GetDrops(id int) ([]*Drop, error) {
+	drops, _, err := getDrops(id)
+	return drops, err
+}
+
+// RemoveDrops removes the drops of the events eventIDs from the drop log of
+// subscribe id
+func RemoveDrops(id int, eventIDs []string) error {
+	drops, raws, err := getDrops(id)
+	if err != nil {
+		return err
+	}
+	removed := make(map[string]bool, len(eventIDs))
+	for _, eventID := range eventIDs {
+		removed[eventID] = true
+	}
+	args := redis.Args{}.Add(getDropLogKey(id))
+	for i, d := range drops {
+		if removed[d.EventID] {
+			args = args.Add(raws[i])
+		}
+	}
+	if len(args) == 1 {
+		return nil
+	}
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	_, err = redisConn.Do("ZREM", args...)
+	return err
+}
+
+func getDrops(id int) ([]*Drop, [][]byte, error) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	since := time.Now().Add(-deliveryRetention)
+	raws, err := redis.ByteSlices(redisConn.Do("ZREVRANGEBYSCORE", getDropLogKey(id), "+inf", formatScore(since)))
+	if err != nil {
+		return nil, nil, err
+	}
+	drops := make([]*Drop, 0, len(raws))
+	for _, raw := range raws {
+		var d Drop
+		if err = json.Unmarshal(raw, &d); err != nil {
+			return nil, nil, err
+		}
+		drops = append(drops, &d)
+	}
+	return drops, raws, nil
+}
+
+func getDropLogKey(id int) string {
+	return fmt.Sprintf("%s%s%d", keyPrefix, dropLogKeyPrefix, id)
+}
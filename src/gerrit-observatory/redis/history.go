@@ -0,0 +1,163 @@
+package redis
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"time"
+
+	"gerrit-observatory/gerrit"
+)
+
+var (
+	historyKey       = "event_history"
+	eventKeyPrefix   = "event:"
+	historyRetention = 7 * 24 * time.Hour
+	historyMaxEvents = 100000
+
+	// ErrEventNotFound is returned when an event is unknown or fell out of the history
+	ErrEventNotFound = errors.New("event not found")
+)
+
+// InitHistory bounds the event history to the events received during the
+// last retention and to at most maxEvents of them
+func InitHistory(retention time.Duration, maxEvents int) {
+	historyRetention = retention
+	historyMaxEvents = maxEvents
+}
+
+// HistoryRetention returns how long events are kept in the history
+func HistoryRetention() time.Duration {
+	return historyRetention
+}
+
+// HistoryMaxEvents returns how many events the history keeps at most
+func HistoryMaxEvents() int {
+	return historyMaxEvents
+}
+
+// RecordEvent adds e to the history and trims the events out of its bounds.
+// The history is a sorted set of event ids scored by reception time, payloads
+// are stored aside and expire with the retention
+func RecordEvent(e *gerrit.Event) error {
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	cutoff := e.ReceivedAt.Add(-historyRetention)
+	redisConn.Send("MULTI")
+	redisConn.Send("SET", getEventKey(e.ID), raw, "EX", int(historyRetention/time.Second))
+	redisConn.Send("ZADD", keyPrefix+historyKey, unixMilli(e.ReceivedAt), e.ID)
+	redisConn.Send("ZREMRANGEBYSCORE", keyPrefix+historyKey, "-inf", "("+formatScore(cutoff))
+	redisConn.Send("ZREMRANGEBYRANK", keyPrefix+historyKey, 0, -historyMaxEvents-1)
+	_, err = redisConn.Do("EXEC")
+	return err
+}
+
+// GetEvent returns the event of id if it is still in the history
+func GetEvent(id string) (*gerrit.Event, error) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	raw, err := redis.Bytes(redisConn.Do("GET", getEventKey(id)))
+	if err == redis.ErrNil {
+		return nil, ErrEventNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeEvent(raw)
+}
+
+// GetEvents returns up to limit events received since since, newest first.
+// A zero since covers the whole retention and a limit <= 0 returns them all
+func GetEvents(since time.Time, limit int) ([]*gerrit.Event, error) {
+	if oldest := time.Now().Add(-historyRetention); since.Before(oldest) {
+		since = oldest
+	}
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	args := redis.Args{}.Add(keyPrefix+historyKey, "+inf", formatScore(since))
+	if limit > 0 {
+		args = args.Add("LIMIT", 0, limit)
+	}
+	events, _, err := getEventRange(redisConn, args)
+	return events, err
+}
+
+// GetEventsPage returns, newest first, the count events received between
+// since and until that follow the first offset ones, and whether more
+// follow them. Fixing until keeps the pages stable while events arrive
+func GetEventsPage(since time.Time, until time.Time, offset int, count int) ([]*gerrit.Event, bool, error) {
+	if oldest := time.Now().Add(-historyRetention); since.Before(oldest) {
+		since = oldest
+	}
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	events, n, err := getEventRange(redisConn, redis.Args{}.Add(keyPrefix+historyKey,
+		formatScore(until), formatScore(since), "LIMIT", offset, count))
+	return events, n > 0 && n == count, err
+}
+
+// getEventRange loads the events of the history range args selects with
+// ZREVRANGEBYSCORE, along with the number of ids it selected. Those whose
+// payload expired are left out
+func getEventRange(redisConn redis.Conn, args redis.Args) ([]*gerrit.Event, int, error) {
+	ids, err := redis.Strings(redisConn.Do("ZREVRANGEBYSCORE", args...))
+	if err != nil {
+		return nil, 0, err
+	}
+	events := make([]*gerrit.Event, 0, len(ids))
+	if len(ids) == 0 {
+		return events, 0, nil
+	}
+
+	keys := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, getEventKey(id))
+	}
+	raws, err := redis.ByteSlices(redisConn.Do("MGET", keys...))
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, raw := range raws {
+		if raw == nil {
+			continue
+		}
+		e, err := decodeEvent(raw)
+		if err != nil {
+			return nil, 0, err
+		}
+		events = append(events, e)
+	}
+	return events, len(ids), nil
+}
+
+func getEventKey(id string) string {
+	return keyPrefix + eventKeyPrefix + id
+}
+
+func decodeEvent(raw []byte) (*gerrit.Event, error) {
+	var e gerrit.Event
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func formatScore(t time.Time) string {
+	return strconv.FormatInt(unixMilli(t), 10)
+}
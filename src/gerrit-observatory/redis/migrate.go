@@ -0,0 +1,267 @@
+package redis
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var schemaVersionKey = "schema_version"
+
+// migration upgrades the keys of a namespace to version. Run reports the
+// changes it makes, or would make when dryRun is set
+type migration struct {
+	version     int
+	description string
+	run         func(redisConn redis.Conn, dryRun bool) ([]string, error)
+}
+
+// migrations are applied in order, the last one sets the current version
+var migrations = []migration{
+	{1, "index subscribes in a sorted set", indexSubscribes},
+	{2, "move activation counters to the subscribe statistics", moveActivationCounters},
+	{3, "replace the valid flag by a lifecycle state", replaceValidFlag},
+}
+
+// SchemaVersion is the version of the keys written by this release
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// MigrationStep is one migration and the changes it made
+type MigrationStep struct {
+	Version     int      `json:"version"`
+	Description string   `json:"description"`
+	Changes     []string `json:"changes"`
+}
+
+// MigrationReport tells how a store was, or would be when DryRun is set,
+// upgraded From a schema version To another
+type MigrationReport struct {
+	From   int              `json:"from"`
+	To     int              `json:"to"`
+	DryRun bool             `json:"dry_run"`
+	Steps  []*MigrationStep `json:"steps"`
+}
+
+// UpToDate tells whether no migration was needed
+func (r *MigrationReport) UpToDate() bool {
+	return r.From == r.To
+}
+
+func (r *MigrationReport) String() string {
+	var buf bytes.Buffer
+	if r.UpToDate() {
+		fmt.Fprintf(&buf, "schema version %d is up to date\n", r.To)
+		return buf.String()
+	}
+	verb := "migrated"
+	if r.DryRun {
+		verb = "would be migrated"
+	}
+	fmt.Fprintf(&buf, "schema %s from version %d to %d\n", verb, r.From, r.To)
+	for _, step := range r.Steps {
+		fmt.Fprintf(&buf, "  %d: %s, %d change(s)\n", step.Version, step.Description, len(step.Changes))
+		for _, change := range step.Changes {
+			fmt.Fprintf(&buf, "    - %s\n", change)
+		}
+	}
+	return buf.String()
+}
+
+// Migrate upgrades the keys written by older releases, the version reached
+// is recorded after every migration so an interrupted run resumes where it
+// stopped. Nothing is written when dryRun is set
+func Migrate(dryRun bool) (*MigrationReport, error) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	from, err := redis.Int(redisConn.Do("GET", keyPrefix+schemaVersionKey))
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	if from > SchemaVersion() {
+		return nil, fmt.Errorf("schema version %d is newer than %d, written by a later release", from, SchemaVersion())
+	}
+	report := &MigrationReport{From: from, To: SchemaVersion(), DryRun: dryRun, Steps: make([]*MigrationStep, 0)}
+	for _, m := range migrations {
+		if m.version <= from {
+			continue
+		}
+		changes, err := m.run(redisConn, dryRun)
+		if err != nil {
+			return report, fmt.Errorf("migration %d, %s: %v", m.version, m.description, err)
+		}
+		report.Steps = append(report.Steps, &MigrationStep{Version: m.version, Description: m.description, Changes: changes})
+		if dryRun {
+			continue
+		}
+		if _, err = redisConn.Do("SET", keyPrefix+schemaVersionKey, m.version); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// indexSubscribes adds to the index the subscribes stored before it existed,
+// walking the keyspace with SCAN. Keys whose suffix is not an id are skipped
+func indexSubscribes(redisConn redis.Conn, dryRun bool) ([]string, error) {
+	ids, err := scanSubscribeIDs(redisConn)
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]string, 0)
+	for _, id := range ids {
+		indexed, err := redis.Int(redisConn.Do("ZSCORE", keyPrefix+subscribeIndexKey, id))
+		if err == nil && indexed == id {
+			continue
+		}
+		if err != nil && err != redis.ErrNil {
+			return changes, err
+		}
+		changes = append(changes, fmt.Sprintf("subscribe %d indexed", id))
+		if dryRun {
+			continue
+		}
+		if _, err = redisConn.Do("ZADD", keyPrefix+subscribeIndexKey, id, id); err != nil {
+			return changes, err
+		}
+	}
+	return changes, nil
+}
+
+// legacy activation fields, they drifted between releases
+var activationCountFields = []string{"active_count", "activate_count"}
+var activationTimeFields = []string{"last_active_time", "last_activate_time"}
+
+// moveActivationCounters folds the activation counters of the subscribe
+// hashes into the statistics: every activation was a matched event posted
+// to the hook, the last activation is the last success unless one is known
+func moveActivationCounters(redisConn redis.Conn, dryRun bool) ([]string, error) {
+	ids, err := redis.Ints(redisConn.Do("ZRANGE", keyPrefix+subscribeIndexKey, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	legacy := append(append([]string{}, activationCountFields...), activationTimeFields...)
+	changes := make([]string, 0)
+	for _, id := range ids {
+		values, err := redis.Values(redisConn.Do("HMGET", redis.Args{}.Add(getKey(id)).AddFlat(legacy)...))
+		if err != nil {
+			return changes, err
+		}
+		present := make([]string, 0, len(legacy))
+		count := int64(0)
+		lastActive := ""
+		for i, field := range legacy {
+			if values[i] == nil {
+				continue
+			}
+			present = append(present, field)
+			value, _ := redis.String(values[i], nil)
+			if i < len(activationCountFields) {
+				n, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					return changes, fmt.Errorf("subscribe %d %s: %v", id, field, err)
+				}
+				count += n
+			} else if lastActive == "" {
+				lastActive = value
+			}
+		}
+		if len(present) == 0 {
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("subscribe %d: %d activation(s) added to matched, %s removed",
+			id, count, strings.Join(present, ", ")))
+		if dryRun {
+			continue
+		}
+		redisConn.Send("MULTI")
+		if count > 0 {
+			redisConn.Send("HINCRBY", getStatsKey(id), "matched", count)
+		}
+		if lastActive != "" {
+			redisConn.Send("HSETNX", getStatsKey(id), "last_success_time", lastActive)
+		}
+		redisConn.Send("HDEL", redis.Args{}.Add(getKey(id)).AddFlat(present)...)
+		if _, err = redisConn.Do("EXEC"); err != nil {
+			return changes, err
+		}
+	}
+	return changes, nil
+}
+
+// replaceValidFlag gives every subscribe a state, those invalidated by
+// older releases are archived
+func replaceValidFlag(redisConn redis.Conn, dryRun bool) ([]string, error) {
+	ids, err := redis.Ints(redisConn.Do("ZRANGE", keyPrefix+subscribeIndexKey, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]string, 0)
+	for _, id := range ids {
+		values, err := redis.Strings(redisConn.Do("HMGET", getKey(id), "state", "valid"))
+		if err != nil {
+			return changes, err
+		}
+		state, rawValid := values[0], values[1]
+		if state != "" && rawValid == "" {
+			continue
+		}
+		if state == "" {
+			state = StateActive
+			if valid, err := strconv.ParseBool(rawValid); err == nil && !valid {
+				state = StateArchived
+			}
+		}
+		changes = append(changes, fmt.Sprintf("subscribe %d: valid=%q replaced by state %s", id, rawValid, state))
+		if dryRun {
+			continue
+		}
+		redisConn.Send("MULTI")
+		redisConn.Send("HSET", getKey(id), "state", state)
+		redisConn.Send("HDEL", getKey(id), "valid")
+		if _, err = redisConn.Do("EXEC"); err != nil {
+			return changes, err
+		}
+	}
+	return changes, nil
+}
+
+// scanSubscribeIDs returns the sorted ids of the subscribe hashes found with
+// SCAN
+func scanSubscribeIDs(redisConn redis.Conn) ([]int, error) {
+	prefix := keyPrefix + subscribeKeyPrefix
+	seen := make(map[int]bool)
+	cursor := 0
+	for {
+		reply, err := redis.Values(redisConn.Do("SCAN", cursor, "MATCH", prefix+"*", "COUNT", 100))
+		if err != nil {
+			return nil, err
+		}
+		var keys []string
+		if _, err = redis.Scan(reply, &cursor, &keys); err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			id, err := strconv.Atoi(strings.TrimPrefix(key, prefix))
+			if err != nil || id <= 0 {
+				continue
+			}
+			seen[id] = true
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	// SCAN may return a key more than once
+	ids := make([]int, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
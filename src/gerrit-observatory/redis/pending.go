@@ -0,0 +1,132 @@
+package redis
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+
+	"gerrit-observatory/gerrit"
+)
+
+var (
+	pendingKeyPrefix = "pending_events:"
+	backlogKeyPrefix = "backlog_events:"
+	spilledKeyPrefix = "spilled_events:"
+)
+
+// SavePending appends events to the queue of subscribe id, they are the
+// events left undelivered on shutdown
+func SavePending(id int, events ...*gerrit.Event) error {
+	return pushEvents(getPendingKey(id), events)
+}
+
+// TakePending removes and returns the queued events of subscribe id, oldest first
+func TakePending(id int) ([]*gerrit.Event, error) {
+	return takeEvents(getPendingKey(id))
+}
+
+// SaveBacklog appends events to the backlog of subscribe id, they are the
+// events it matched while paused, delivered once resumed
+func SaveBacklog(id int, events ...*gerrit.Event) error {
+	return pushEvents(getBacklogKey(id), events)
+}
+
+// TakeBacklog removes and returns the backlog of subscribe id, oldest first
+func TakeBacklog(id int) ([]*gerrit.Event, error) {
+	return takeEvents(getBacklogKey(id))
+}
+
+// BacklogLength returns the number of events in the backlog of subscribe id
+func BacklogLength(id int) (int, error) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	return redis.Int(redisConn.Do("LLEN", getBacklogKey(id)))
+}
+
+// SaveSpilled appends events to those spilled by subscribe id, they are the
+// events its full queue could not take, matched once taken back
+func SaveSpilled(id int, events ...*gerrit.Event) error {
+	return pushEvents(getSpilledKey(id), events)
+}
+
+// PopSpilled removes and returns the oldest event spilled by subscribe id,
+// nil when none is left
+func PopSpilled(id int) (*gerrit.Event, error) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	raw, err := redis.Bytes(redisConn.Do("LPOP", getSpilledKey(id)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeEvent(raw)
+}
+
+// SpilledLength returns the number of events spilled by subscribe id
+func SpilledLength(id int) (int, error) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	return redis.Int(redisConn.Do("LLEN", getSpilledKey(id)))
+}
+
+func pushEvents(key string, events []*gerrit.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	args := redis.Args{}.Add(key)
+	for _, e := range events {
+		raw, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		args = args.Add(raw)
+	}
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	_, err := redisConn.Do("RPUSH", args...)
+	return err
+}
+
+func takeEvents(key string) ([]*gerrit.Event, error) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	redisConn.Send("MULTI")
+	redisConn.Send("LRANGE", key, 0, -1)
+	redisConn.Send("DEL", key)
+	reply, err := redis.Values(redisConn.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+	raws, err := redis.ByteSlices(reply[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]*gerrit.Event, 0, len(raws))
+	for _, raw := range raws {
+		e, err := decodeEvent(raw)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+func getPendingKey(id int) string {
+	return fmt.Sprintf("%s%s%d", keyPrefix, pendingKeyPrefix, id)
+}
+
+func getBacklogKey(id int) string {
+	return fmt.Sprintf("%s%s%d", keyPrefix, backlogKeyPrefix, id)
+}
+
+func getSpilledKey(id int) string {
+	return fmt.Sprintf("%s%s%d", keyPrefix, spilledKeyPrefix, id)
+}
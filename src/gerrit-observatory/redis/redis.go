@@ -2,203 +2,385 @@ package redis
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
 	"strconv"
 	"strings"
 	"time"
+
+	"gerrit-observatory/metrics"
 )
 
 var (
 	redisPool          *redis.Pool
+	keyPrefix          = ""
 	subscribeKeyPrefix = "subscribe:"
+	subscribeIndexKey  = "subscribe_index"
 	idKey              = "subscribe_id_index"
 	redisMaxIdle       = 3
 	redisIdleTimeout   = 240 * time.Second
+
+	// ErrSubscribeNotFound is returned when no subscribe is stored under the requested id
+	ErrSubscribeNotFound = errors.New("subscribe not found")
+)
+
+// lifecycle states of a subscribe: active ones are delivered events, paused
+// ones still match events but hold or skip their deliveries, archived ones
+// are no longer observed and only kept for audit until purged
+const (
+	StateActive   = "active"
+	StatePaused   = "paused"
+	StateArchived = "archived"
+)
+
+// what a paused subscribe does with the events it matches: queue keeps them
+// in its backlog until resumed, skip only counts them
+const (
+	PauseQueue = "queue"
+	PauseSkip  = "skip"
 )
 
 // Subscribe ...
 type Subscribe struct {
 	ID               int
+	Owner            string
 	Detail           SubscribeDetail
+	GerritUser       string
+	VisibleProjects  []string
 	CreatedTime      string
-	LastActivateTime string
-	ActivateCount    int
-	Valid            bool
+	Stats            SubscribeStats
+	State            string
+	PauseMode        string `json:",omitempty"`
+	StateChangedTime string `json:",omitempty"`
+	// StateReason tells who or what moved the subscribe to its state
+	StateReason string `json:",omitempty"`
 }
 
-func (sub *Subscribe) Activate() (err error) {
-	key := fmt.Sprintf("%s%d", subscribeKeyPrefix, sub.ID)
-
-	redisConn := redisPool.Get()
-	defer redisConn.Close()
-
-	exist, err := redis.Bool(redisConn.Do("EXISTS", key))
-	if err != nil {
-		return
-	}
-	if !exist {
-		return fmt.Errorf("subscribe %s not existed", key)
-	}
-	now := time.Now().Format(time.UnixDate)
-	_, err = redisConn.Do("HSET", key, "last_active_time", now)
-	if err != nil {
-		return
-	}
-	_, err = redisConn.Do("HINCRBY", key, "active_count", 1)
-	if err != nil {
-		return
-	}
-	sub.LastActivateTime = now
-	sub.ActivateCount++
-	return
+// Observed tells whether sub should have a running observer
+func (sub *Subscribe) Observed() bool {
+	return sub.State != StateArchived
 }
 
-func (sub *Subscribe) Invalid() (err error) {
-	redisConn := redisPool.Get()
-	defer redisConn.Close()
-
-	key := fmt.Sprintf("%s%d", subscribeKeyPrefix, sub.ID)
-	_, err = redisConn.Do("HSET", key, "valid", false)
-	if err != nil {
-		return
-	}
-	sub.Valid = false
-	return
+// Expired tells whether the subscribe reached its expiry time at now
+func (sub *Subscribe) Expired(now time.Time) bool {
+	return sub.Detail.ExpiresAt != nil && !now.Before(*sub.Detail.ExpiresAt)
 }
 
 // SubscribeDetail ...
+// Name is chosen by the owner and unique among its subscribes, manifests
+// refer to subscribes by name. A subscribe is archived once ExpiresAt is
+// reached, it never expires when nil. Concurrency is the number of events
+// delivered at once and Overflow what happens to the events its full queue
+// can not take, the defaults of the observatory when empty
 type SubscribeDetail struct {
-	Filter  map[string]interface{} `json:"filter"`
-	HookURL string                 `json:"hook_url"`
-	Comment string                 `json:"comment"`
+	Name        string                 `json:"name,omitempty"`
+	Filter      map[string]interface{} `json:"filter"`
+	HookURL     string                 `json:"hook_url"`
+	Comment     string                 `json:"comment"`
+	ExpiresAt   *time.Time             `json:"expires_at,omitempty"`
+	Concurrency int                    `json:"concurrency,omitempty"`
+	Overflow    string                 `json:"overflow,omitempty"`
+	Debounce    *Debounce              `json:"debounce,omitempty"`
+}
+
+// Debounce holds back the matched events of a subscribe sharing a key for
+// a window of seconds, only the latest of them is delivered, or a batch of
+// them all
+type Debounce struct {
+	Key    string `json:"key"`
+	Window int    `json:"window_seconds"`
+	Batch  bool   `json:"batch,omitempty"`
+}
+
+// Save stores subd as a new unrestricted subscribe belonging to owner
+func (subd *SubscribeDetail) Save(owner string) (id int, err error) {
+	return subd.SaveVisible(owner, "", nil)
 }
 
-func (subd *SubscribeDetail) Save() (id int, err error) {
+// SaveVisible stores subd as a new subscribe belonging to owner, bound to
+// the projects gerritUser can read unless gerritUser is empty. The
+// subscribe, its bound and its index entry are written in a single
+// transaction
+func (subd *SubscribeDetail) SaveVisible(owner string, gerritUser string, projects []string) (id int, err error) {
 	redisConn := redisPool.Get()
 	defer redisConn.Close()
 
-	id, err = redis.Int(redisConn.Do("INCR", idKey))
+	id, err = redis.Int(redisConn.Do("INCR", keyPrefix+idKey))
 	if err != nil {
 		return
 	}
-	key := fmt.Sprintf("%s%d", subscribeKeyPrefix, id)
 	createdTime := time.Now().Format(time.UnixDate)
 	rawDetail, err := json.Marshal(*subd)
 	if err != nil {
 		return
 	}
-	ok, err := redis.String(
-		redisConn.Do("HMSET", key,
-			"detail", rawDetail,
-			"created_time", createdTime,
-			"activate_count", 0,
-			"last_activate_time", "",
-			"valid", true))
-	if err != nil {
-		return
-	}
-	if ok != "OK" {
-		err = fmt.Errorf("hmset failed, %s", ok)
-		return
+	args := redis.Args{getKey(id),
+		"owner", owner,
+		"detail", rawDetail,
+		"created_time", createdTime,
+		"state", StateActive}
+	if gerritUser != "" {
+		rawProjects, err := json.Marshal(VisibleTo(gerritUser, projects))
+		if err != nil {
+			return 0, err
+		}
+		args = args.Add("gerrit_user", gerritUser, "visible_projects", rawProjects)
 	}
+	redisConn.Send("MULTI")
+	redisConn.Send("HMSET", args...)
+	redisConn.Send("ZADD", keyPrefix+subscribeIndexKey, id, id)
+	_, err = redisConn.Do("EXEC")
 	return
 }
 
+// GetSubscribes lists the indexed subscribes by id, their hashes and
+// statistics are fetched in a single round trip
 func GetSubscribes() ([]*Subscribe, error) {
-	subscribes := make([]*Subscribe, 0, 10)
-
 	redisConn := redisPool.Get()
 	defer redisConn.Close()
 
-	keys, err := redis.ByteSlices(redisConn.Do("KEYS", subscribeKeyPrefix+"*"))
+	ids, err := redis.Ints(redisConn.Do("ZRANGE", keyPrefix+subscribeIndexKey, 0, -1))
 	if err != nil {
 		return nil, err
 	}
+	for _, id := range ids {
+		redisConn.Send("HGETALL", getKey(id))
+		redisConn.Send("HGETALL", getStatsKey(id))
+	}
+	if err = redisConn.Flush(); err != nil {
+		return nil, err
+	}
 
-	for _, key := range keys {
-		subscribe, err := getSubscribeByKey(string(key))
+	subscribes := make([]*Subscribe, 0, len(ids))
+	for _, id := range ids {
+		hash, err := redis.StringMap(redisConn.Receive())
 		if err != nil {
 			return nil, err
 		}
+		stats, err := redis.StringMap(redisConn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		// the index may outlive a subscribe removed by hand
+		if len(hash) == 0 {
+			continue
+		}
+		subscribe, err := parseSubscribe(id, hash, stats)
+		if err != nil {
+			return nil, fmt.Errorf("subscribe %d: %v", id, err)
+		}
 		subscribes = append(subscribes, subscribe)
 	}
 	return subscribes, nil
 }
 
 func GetSubscribe(id int) (*Subscribe, error) {
-	key := getKey(id)
-	return getSubscribeByKey(key)
-}
-
-func getSubscribeByKey(key string) (*Subscribe, error) {
-	var (
-		detail           SubscribeDetail
-		createdTime      string
-		lastActivateTime string
-		activateCount    int
-		valid            bool
-	)
-
 	redisConn := redisPool.Get()
 	defer redisConn.Close()
 
-	reply, err := redis.Values(redisConn.Do("HMGET", key, "created_time", "last_active_time", "active_count", "valid"))
+	return getSubscribe(redisConn, id)
+}
+
+func getSubscribe(redisConn redis.Conn, id int) (*Subscribe, error) {
+	hash, err := redis.StringMap(redisConn.Do("HGETALL", getKey(id)))
 	if err != nil {
 		return nil, err
 	}
-
-	_, err = redis.Scan(reply, &createdTime, &lastActivateTime, &activateCount, &valid)
+	if len(hash) == 0 {
+		return nil, ErrSubscribeNotFound
+	}
+	stats, err := redis.StringMap(redisConn.Do("HGETALL", getStatsKey(id)))
 	if err != nil {
 		return nil, err
 	}
+	return parseSubscribe(id, hash, stats)
+}
 
-	detailRaw, err := redis.Bytes(redisConn.Do("HGET", key, "detail"))
-	if err != nil {
+// parseSubscribe builds subscribe id from the fields of its hash and of its
+// statistics hash
+func parseSubscribe(id int, hash map[string]string, stats map[string]string) (*Subscribe, error) {
+	subscribe := &Subscribe{
+		ID:          id,
+		Owner:       hash["owner"],
+		GerritUser:  hash["gerrit_user"],
+		CreatedTime: hash["created_time"],
+	}
+	if err := json.Unmarshal([]byte(hash["detail"]), &subscribe.Detail); err != nil {
 		return nil, err
 	}
+	if raw := hash["visible_projects"]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), &subscribe.VisibleProjects); err != nil {
+			return nil, err
+		}
+	}
+	subscribe.VisibleProjects = VisibleTo(subscribe.GerritUser, subscribe.VisibleProjects)
+	subscribe.State = hash["state"]
+	if subscribe.State == "" {
+		// written before the migration to version 3
+		subscribe.State = StateActive
+		if valid, err := strconv.ParseBool(hash["valid"]); err == nil && !valid {
+			subscribe.State = StateArchived
+		}
+	}
+	if subscribe.State == StatePaused {
+		subscribe.PauseMode = hash["pause_mode"]
+	}
+	subscribe.StateChangedTime = hash["state_changed_time"]
+	subscribe.StateReason = hash["state_reason"]
+	if err := parseStats(stats, &subscribe.Stats); err != nil {
+		return nil, err
+	}
+	return subscribe, nil
+}
 
-	err = json.Unmarshal(detailRaw, &detail)
+// UpdateSubscribe replaces the detail of an existing subscribe, keeping its
+// creation time, statistics and state
+func UpdateSubscribe(id int, detail SubscribeDetail) (*Subscribe, error) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	rawDetail, err := json.Marshal(detail)
 	if err != nil {
 		return nil, err
 	}
+	err = updateExisting(redisConn, id, func() {
+		redisConn.Send("HSET", getKey(id), "detail", rawDetail)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return getSubscribe(redisConn, id)
+}
 
-	id, err := strconv.Atoi(strings.TrimPrefix(key, subscribeKeyPrefix))
+// SetState moves subscribe id to state for reason, pauseMode only applies
+// to the paused state
+func SetState(id int, state string, pauseMode string, reason string) (*Subscribe, error) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	if state != StatePaused {
+		pauseMode = ""
+	}
+	err := updateExisting(redisConn, id, func() {
+		redisConn.Send("HMSET", getKey(id),
+			"state", state,
+			"pause_mode", pauseMode,
+			"state_reason", reason,
+			"state_changed_time", time.Now().Format(time.UnixDate))
+	})
 	if err != nil {
 		return nil, err
 	}
+	return getSubscribe(redisConn, id)
+}
 
-	return &Subscribe{
-		ID:               id,
-		Detail:           detail,
-		CreatedTime:      createdTime,
-		LastActivateTime: lastActivateTime,
-		ActivateCount:    activateCount,
-		Valid:            valid,
-	}, nil
+// updateExisting runs the commands queued by write in a transaction that
+// only commits while the hash of subscribe id exists, so that a concurrent
+// delete never leaves a partial hash behind. The check is made again when
+// the hash changed in between
+func updateExisting(redisConn redis.Conn, id int, write func()) error {
+	key := getKey(id)
+	for {
+		if _, err := redisConn.Do("WATCH", key); err != nil {
+			return err
+		}
+		exist, err := redis.Bool(redisConn.Do("EXISTS", key))
+		if err != nil || !exist {
+			redisConn.Do("UNWATCH")
+			if err == nil {
+				err = ErrSubscribeNotFound
+			}
+			return err
+		}
+		redisConn.Send("MULTI")
+		write()
+		reply, err := redisConn.Do("EXEC")
+		if err != nil {
+			return err
+		}
+		if reply != nil {
+			return nil
+		}
+	}
 }
 
-func DeleteSubscribe(id int) (bool, error) {
+// SetVisibleProjects records the projects gerritUser may read as the only
+// ones subscribe id is delivered events of, an empty gerritUser lifts the
+// restriction
+func SetVisibleProjects(id int, gerritUser string, projects []string) error {
 	key := getKey(id)
-	return deleteSubscribeByKey(key)
+
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	if gerritUser == "" {
+		return updateExisting(redisConn, id, func() {
+			redisConn.Send("HDEL", key, "gerrit_user", "visible_projects")
+		})
+	}
+	raw, err := json.Marshal(VisibleTo(gerritUser, projects))
+	if err != nil {
+		return err
+	}
+	return updateExisting(redisConn, id, func() {
+		redisConn.Send("HMSET", key, "gerrit_user", gerritUser, "visible_projects", raw)
+	})
 }
 
-func deleteSubscribeByKey(key string) (bool, error) {
+// VisibleTo returns the projects a subscribe bound to gerritUser is
+// delivered events of: every project, nil, when it is bound to no user and
+// none when the projects of its user are not known. Subscribes fail closed
+func VisibleTo(gerritUser string, projects []string) []string {
+	if gerritUser == "" {
+		return nil
+	}
+	if projects == nil {
+		return []string{}
+	}
+	return projects
+}
+
+// DeleteSubscribe removes subscribe id and its index entry along with its
+// statistics, delivery and drop logs, pending, held and spilled events
+func DeleteSubscribe(id int) (bool, error) {
 	redisConn := redisPool.Get()
 	defer redisConn.Close()
 
-	b, err := redis.Bool(redisConn.Do("DEL", key))
+	redisConn.Send("MULTI")
+	redisConn.Send("DEL", getKey(id))
+	redisConn.Send("ZREM", keyPrefix+subscribeIndexKey, id)
+	redisConn.Send("DEL", getStatsKey(id))
+	redisConn.Send("DEL", getDeliveryLogKey(id))
+	redisConn.Send("DEL", getPendingKey(id))
+	redisConn.Send("DEL", getBacklogKey(id))
+	redisConn.Send("DEL", getDropLogKey(id))
+	redisConn.Send("DEL", getSpilledKey(id))
+	reply, err := redis.Values(redisConn.Do("EXEC"))
 	if err != nil {
 		return false, err
-	} else {
-		return b, nil
 	}
+	return redis.Bool(reply[0], nil)
+}
+
+// SetKeyPrefix namespaces every key, so that the observatory can share a
+// redis database with other applications
+func SetKeyPrefix(prefix string) {
+	keyPrefix = prefix
 }
 
 func getKey(id int) string {
-	return fmt.Sprintf("%s%d", subscribeKeyPrefix, id)
+	return fmt.Sprintf("%s%s%d", keyPrefix, subscribeKeyPrefix, id)
 }
 
+// Ping tells whether redis answers
+func Ping() error {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	_, err := redisConn.Do("PING")
+	return err
+}
 
 func InitRedis(host string, port int, db int) {
 	addr := fmt.Sprintf("%s:%d", host, port)
@@ -210,6 +392,22 @@ func DestroyRedis() {
 	redisPool.Close()
 }
 
+// instrumentedConn counts the failed commands of a connection
+type instrumentedConn struct {
+	redis.Conn
+}
+
+func (c *instrumentedConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(commandName, args...)
+	if err != nil && err != redis.ErrNil {
+		if commandName == "" {
+			commandName = "FLUSH"
+		}
+		metrics.RedisErrors.Inc(strings.ToUpper(commandName))
+	}
+	return reply, err
+}
+
 func newRedisPool(addr string, options ...redis.DialOption) *redis.Pool {
 	return &redis.Pool{
 		MaxIdle:     redisMaxIdle,
@@ -217,9 +415,10 @@ func newRedisPool(addr string, options ...redis.DialOption) *redis.Pool {
 		Dial: func() (redis.Conn, error) {
 			c, err := redis.Dial("tcp", addr, options...)
 			if err != nil {
+				metrics.RedisErrors.Inc("DIAL")
 				return nil, err
 			}
-			return c, err
+			return &instrumentedConn{c}, err
 		},
 		TestOnBorrow: func(c redis.Conn, t time.Time) error {
 			_, err := c.Do("PING")
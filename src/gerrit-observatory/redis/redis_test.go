@@ -2,10 +2,15 @@ package redis
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/garyburd/redigo/redis"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"strings"
 	"testing"
+	"time"
+
+	"gerrit-observatory/gerrit"
 )
 
 var (
@@ -50,31 +55,42 @@ func (suite *RedisTestSuite) TearDownTest() {
 	suite.redisConn = nil
 }
 
-func (suite *RedisTestSuite) TestSubscribeDetailSaveGetActivate() {
+func (suite *RedisTestSuite) TestSubscribeDetailSaveGetStats() {
 	detail := SubscribeDetail{}
 	err := json.Unmarshal([]byte(DetailRaw), &detail)
 	assert.Nil(suite.T(), err)
-	id, err := detail.Save()
+	id, err := detail.Save("loki")
 	assert.Nil(suite.T(), err)
 	assert.NotEqual(suite.T(), id, 0, "id should not be zero")
 	subscribe, err := GetSubscribe(id)
 	assert.Nil(suite.T(), err)
-	assert.Equal(suite.T(), subscribe.ActivateCount, 0, "ActiveCount should be 0")
-	assert.Equal(suite.T(), subscribe.LastActivateTime, "", "lastactiveTime should be empty")
-	subscribe.Activate()
-	assert.Equal(suite.T(), subscribe.ActivateCount, 1, "ActiveCount should be 1")
-	assert.NotEqual(suite.T(), subscribe.LastActivateTime, "", "lastactiveTime should not be empty")
+	assert.Equal(suite.T(), subscribe.Owner, "loki")
+	assert.Equal(suite.T(), subscribe.Stats, SubscribeStats{}, "stats should be empty")
+	err = AddStats(id, StatsDelta{Seen: 2, Matched: 2, Delivered: 1, Failed: 1, Retried: 3})
+	assert.Nil(suite.T(), err)
+	err = AddStats(id, StatsDelta{Dropped: 1})
+	assert.Nil(suite.T(), err)
 	newSubscirbe, err := GetSubscribe(id)
 	assert.Nil(suite.T(), err)
-	assert.Equal(suite.T(), subscribe.ActivateCount, newSubscirbe.ActivateCount, "fail update redis activeCount")
-	assert.Equal(suite.T(), subscribe.LastActivateTime, newSubscirbe.LastActivateTime, "fail update redis lastActivateTime")
+	stats := newSubscirbe.Stats
+	assert.Equal(suite.T(), stats.Seen, int64(2))
+	assert.Equal(suite.T(), stats.Matched, int64(2))
+	assert.Equal(suite.T(), stats.Delivered, int64(1))
+	assert.Equal(suite.T(), stats.Failed, int64(1))
+	assert.Equal(suite.T(), stats.Retried, int64(3))
+	assert.Equal(suite.T(), stats.Dropped, int64(1))
+	assert.NotEqual(suite.T(), stats.LastSuccessTime, "", "last success time should not be empty")
+	assert.NotEqual(suite.T(), stats.LastFailureTime, "", "last failure time should not be empty")
+	fetched, err := GetStats(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), *fetched, stats)
 }
 
 func (suite *RedisTestSuite) TestGetSubscribes() {
 	detail := SubscribeDetail{}
 	err := json.Unmarshal([]byte(DetailRaw), &detail)
 	assert.Nil(suite.T(), err)
-	id, err := detail.Save()
+	id, err := detail.Save("loki")
 	assert.Nil(suite.T(), err)
 	subscribes, err := GetSubscribes()
 	assert.Nil(suite.T(), err)
@@ -82,18 +98,404 @@ func (suite *RedisTestSuite) TestGetSubscribes() {
 	assert.Equal(suite.T(), subscribes[0].ID, id, "id not meet")
 }
 
-func (suite *RedisTestSuite) TestSubscribeInvalid() {
+func (suite *RedisTestSuite) TestSubscribeIndex() {
 	detail := SubscribeDetail{}
 	err := json.Unmarshal([]byte(DetailRaw), &detail)
 	assert.Nil(suite.T(), err)
-	id, err := detail.Save()
+	first, err := detail.Save("loki")
 	assert.Nil(suite.T(), err)
-	subscribe, err := GetSubscribe(id)
-	err = subscribe.Invalid()
+	second, err := detail.Save("crawler")
+	assert.Nil(suite.T(), err)
+	// keys of other applications are not listed
+	suite.redisConn.Do("SET", "subscribe:legacy", "x")
+	err = AddStats(second, StatsDelta{Seen: 4})
+	assert.Nil(suite.T(), err)
+
+	subscribes, err := GetSubscribes()
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), subscribes, 2)
+	assert.Equal(suite.T(), first, subscribes[0].ID)
+	assert.Equal(suite.T(), "crawler", subscribes[1].Owner)
+	assert.Equal(suite.T(), int64(4), subscribes[1].Stats.Seen)
+	assert.Equal(suite.T(), StateActive, subscribes[1].State)
+
+	_, err = DeleteSubscribe(first)
+	assert.Nil(suite.T(), err)
+	subscribes, err = GetSubscribes()
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), subscribes, 1)
+
+	// subscribes stored before the index are indexed by the first migration
+	suite.redisConn.Do("DEL", subscribeIndexKey)
+	report, err := Migrate(false)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{fmt.Sprintf("subscribe %d indexed", second)}, report.Steps[0].Changes)
+	subscribes, err = GetSubscribes()
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), subscribes, 1)
+	assert.Equal(suite.T(), second, subscribes[0].ID)
+}
+
+func (suite *RedisTestSuite) TestMigrate() {
+	// a subscribe as stored by the first releases, not indexed
+	suite.redisConn.Do("HMSET", "subscribe:7",
+		"owner", "loki",
+		"detail", DetailRaw,
+		"created_time", "Mon Jan  2 15:04:05 MST 2006",
+		"valid", false,
+		"activate_count", 0,
+		"last_activate_time", "",
+		"active_count", 12,
+		"last_active_time", "Tue Jan  3 15:04:05 MST 2006")
+
+	report, err := Migrate(true)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 0, report.From)
+	assert.Equal(suite.T(), SchemaVersion(), report.To)
+	assert.Len(suite.T(), report.Steps, 3)
+	assert.Equal(suite.T(), []string{"subscribe 7 indexed"}, report.Steps[0].Changes)
+	// the dry run changed nothing, so the second step does not see the subscribe yet
+	assert.Empty(suite.T(), report.Steps[1].Changes)
+	subscribes, err := GetSubscribes()
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), subscribes, 0)
+
+	report, err = Migrate(false)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{"subscribe 7: 12 activation(s) added to matched, active_count, activate_count, last_active_time, last_activate_time removed"},
+		report.Steps[1].Changes)
+	subscribe, err := GetSubscribe(7)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(12), subscribe.Stats.Matched)
+	assert.Equal(suite.T(), "Tue Jan  3 15:04:05 MST 2006", subscribe.Stats.LastSuccessTime)
+	exist, err := redis.Bool(suite.redisConn.Do("HEXISTS", "subscribe:7", "active_count"))
+	assert.Nil(suite.T(), err)
+	assert.False(suite.T(), exist)
+	assert.Equal(suite.T(), []string{`subscribe 7: valid="0" replaced by state archived`}, report.Steps[2].Changes)
+	assert.Equal(suite.T(), StateArchived, subscribe.State)
+
+	report, err = Migrate(false)
+	assert.Nil(suite.T(), err)
+	assert.True(suite.T(), report.UpToDate())
+	assert.Contains(suite.T(), report.String(), "is up to date")
+}
+
+func (suite *RedisTestSuite) TestKeyPrefix() {
+	SetKeyPrefix("observatory:")
+	defer SetKeyPrefix("")
+
+	detail := SubscribeDetail{}
+	err := json.Unmarshal([]byte(DetailRaw), &detail)
+	assert.Nil(suite.T(), err)
+	id, err := detail.Save("loki")
+	assert.Nil(suite.T(), err)
+	exist, err := redis.Bool(suite.redisConn.Do("EXISTS", "observatory:subscribe:1"))
+	assert.Nil(suite.T(), err)
+	assert.True(suite.T(), exist)
+	_, err = GetSubscribe(id)
 	assert.Nil(suite.T(), err)
+
+	SetKeyPrefix("")
+	subscribes, err := GetSubscribes()
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), subscribes, 0)
+}
+
+func (suite *RedisTestSuite) TestSubscribeState() {
+	detail := SubscribeDetail{}
+	err := json.Unmarshal([]byte(DetailRaw), &detail)
+	assert.Nil(suite.T(), err)
+	id, err := detail.Save("loki")
+	assert.Nil(suite.T(), err)
+	subscribe, err := SetState(id, StatePaused, PauseSkip, "paused by loki")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), StatePaused, subscribe.State)
+	assert.Equal(suite.T(), PauseSkip, subscribe.PauseMode)
+	assert.Equal(suite.T(), "paused by loki", subscribe.StateReason)
+	assert.NotEmpty(suite.T(), subscribe.StateChangedTime)
+
+	subscribe, err = SetState(id, StateArchived, PauseSkip, "")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), StateArchived, subscribe.State)
+	assert.Empty(suite.T(), subscribe.PauseMode)
+	assert.False(suite.T(), subscribe.Observed())
+
+	_, err = SetState(404, StateActive, "", "")
+	assert.Equal(suite.T(), ErrSubscribeNotFound, err)
+}
+
+func (suite *RedisTestSuite) TestUpdateSubscribe() {
+	detail := SubscribeDetail{}
+	err := json.Unmarshal([]byte(DetailRaw), &detail)
+	assert.Nil(suite.T(), err)
+	id, err := detail.Save("loki")
+	assert.Nil(suite.T(), err)
+	detail.HookURL = "http://loki.wandoulabs.com/webhook?from_gerrit_v2"
+	subscribe, err := UpdateSubscribe(id, detail)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), subscribe.Detail.HookURL, detail.HookURL)
+	assert.Equal(suite.T(), subscribe.State, StateActive)
 	newSubscirbe, err := GetSubscribe(id)
-	assert.Equal(suite.T(), subscribe.Valid, newSubscirbe.Valid, "fail update redis validity")
-	assert.Equal(suite.T(), newSubscirbe.Valid, false)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), newSubscirbe.Detail.HookURL, detail.HookURL)
+	assert.Equal(suite.T(), newSubscirbe.CreatedTime, subscribe.CreatedTime)
+}
+
+func (suite *RedisTestSuite) TestUpdateDeletedSubscribe() {
+	detail := SubscribeDetail{}
+	assert.Nil(suite.T(), json.Unmarshal([]byte(DetailRaw), &detail))
+	id, err := detail.Save("loki")
+	assert.Nil(suite.T(), err)
+
+	// a delete landing between the check and the write aborts the write
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+	err = updateExisting(redisConn, id, func() {
+		DeleteSubscribe(id)
+		redisConn.Send("HSET", getKey(id), "detail", "{}")
+	})
+	assert.Equal(suite.T(), ErrSubscribeNotFound, err)
+	exist, err := redis.Bool(suite.redisConn.Do("EXISTS", getKey(id)))
+	assert.Nil(suite.T(), err)
+	assert.False(suite.T(), exist)
+	_, err = SetState(id, StatePaused, PauseQueue, "")
+	assert.Equal(suite.T(), ErrSubscribeNotFound, err)
+}
+
+func (suite *RedisTestSuite) TestSubscribeNotFound() {
+	_, err := GetSubscribe(404)
+	assert.Equal(suite.T(), err, ErrSubscribeNotFound)
+	_, err = UpdateSubscribe(404, SubscribeDetail{})
+	assert.Equal(suite.T(), err, ErrSubscribeNotFound)
+	deleted, err := DeleteSubscribe(404)
+	assert.Nil(suite.T(), err)
+	assert.False(suite.T(), deleted)
+}
+
+func (suite *RedisTestSuite) TestVisibleProjects() {
+	detail := SubscribeDetail{}
+	err := json.Unmarshal([]byte(DetailRaw), &detail)
+	assert.Nil(suite.T(), err)
+	id, err := detail.Save("loki")
+	assert.Nil(suite.T(), err)
+	subscribe, err := GetSubscribe(id)
+	assert.Nil(suite.T(), err)
+	assert.Nil(suite.T(), subscribe.VisibleProjects)
+	err = SetVisibleProjects(id, "zengyaopeng", []string{"loki", "orion/crawler"})
+	assert.Nil(suite.T(), err)
+	subscribe, err = GetSubscribe(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), subscribe.GerritUser, "zengyaopeng")
+	assert.Equal(suite.T(), subscribe.VisibleProjects, []string{"loki", "orion/crawler"})
+	err = SetVisibleProjects(id, "", nil)
+	assert.Nil(suite.T(), err)
+	subscribe, err = GetSubscribe(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), subscribe.GerritUser, "")
+	assert.Nil(suite.T(), subscribe.VisibleProjects)
+
+	// the bound is written along with the subscribe
+	id, err = detail.SaveVisible("loki", "zengyaopeng", []string{"loki"})
+	assert.Nil(suite.T(), err)
+	subscribe, err = GetSubscribe(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "zengyaopeng", subscribe.GerritUser)
+	assert.Equal(suite.T(), []string{"loki"}, subscribe.VisibleProjects)
+	// a gerrit user without recorded projects sees none
+	_, err = suite.redisConn.Do("HDEL", getKey(id), "visible_projects")
+	assert.Nil(suite.T(), err)
+	subscribe, err = GetSubscribe(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{}, subscribe.VisibleProjects)
+	assert.Nil(suite.T(), SetVisibleProjects(id, "zengyaopeng", nil))
+	subscribe, err = GetSubscribe(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{}, subscribe.VisibleProjects)
+	assert.Equal(suite.T(), ErrSubscribeNotFound, SetVisibleProjects(404, "zengyaopeng", nil))
+}
+
+func (suite *RedisTestSuite) TestToken() {
+	token := &Token{Owner: "loki", GerritUser: "zengyaopeng", Comment: "ci"}
+	raw, err := NewRawToken()
+	assert.Nil(suite.T(), err)
+	assert.Nil(suite.T(), SaveToken(raw, token))
+	assert.NotEqual(suite.T(), raw, token.ID, "token should be stored hashed")
+	authed, err := Authenticate(raw)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), authed.Owner, "loki")
+	assert.Equal(suite.T(), authed.GerritUser, "zengyaopeng")
+	assert.False(suite.T(), authed.Admin)
+	_, err = Authenticate("not-a-token")
+	assert.Equal(suite.T(), err, ErrTokenNotFound)
+
+	err = SaveToken("root-secret", &Token{Owner: "ops", Admin: true})
+	assert.Nil(suite.T(), err)
+	tokens, err := GetTokens()
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), tokens, 2)
+
+	deleted, err := DeleteToken(token.ID)
+	assert.Nil(suite.T(), err)
+	assert.True(suite.T(), deleted)
+	_, err = Authenticate(raw)
+	assert.Equal(suite.T(), err, ErrTokenNotFound)
+}
+
+func (suite *RedisTestSuite) TestEventHistory() {
+	now := time.Now()
+	old := gerrit.NewEvent(map[string]interface{}{"type": "ref-updated"})
+	old.ReceivedAt = now.Add(-2 * time.Hour)
+	recent := gerrit.NewEvent(map[string]interface{}{"type": "patchset-created", "size": json.Number("3")})
+	recent.ReceivedAt = now
+	assert.Nil(suite.T(), RecordEvent(old))
+	assert.Nil(suite.T(), RecordEvent(recent))
+
+	events, err := GetEvents(time.Time{}, 0)
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), events, 2)
+	assert.Equal(suite.T(), events[0].ID, recent.ID)
+	assert.Equal(suite.T(), events[0].Data["size"], json.Number("3"))
+
+	events, err = GetEvents(now.Add(-time.Hour), 0)
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), events, 1)
+
+	event, err := GetEvent(old.ID)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), event.Type(), "ref-updated")
+	_, err = GetEvent("missing")
+	assert.Equal(suite.T(), err, ErrEventNotFound)
+
+	InitHistory(time.Hour, 1)
+	defer InitHistory(7*24*time.Hour, 100000)
+	// received after recent, which shares its millisecond otherwise
+	latest := gerrit.NewEvent(map[string]interface{}{"type": "draft-published"})
+	latest.ReceivedAt = now.Add(time.Second)
+	assert.Nil(suite.T(), RecordEvent(latest))
+	events, err = GetEvents(time.Time{}, 0)
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), events, 1)
+	assert.Equal(suite.T(), events[0].Type(), "draft-published")
+}
+
+func (suite *RedisTestSuite) TestDeliveryLog() {
+	now := time.Now()
+	for i, d := range []*Delivery{
+		{EventID: "e1", Attempt: 1, StatusCode: 500, Error: "unexpected status code 500", Time: now.Add(-3 * time.Second)},
+		{EventID: "e1", Attempt: 2, StatusCode: 200, Time: now.Add(-2 * time.Second), ResponseBody: strings.Repeat("x", 2048)},
+		{EventID: "e2", Attempt: 1, StatusCode: 200, Time: now.Add(-time.Second)},
+		{EventID: "e0", Attempt: 1, StatusCode: 200, Time: now.Add(-30 * 24 * time.Hour)},
+	} {
+		assert.Nil(suite.T(), LogDelivery(7, d), "delivery %d", i)
+	}
+
+	deliveries, total, err := GetDeliveries(7, DeliveryQuery{})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), total, 3)
+	assert.Equal(suite.T(), deliveries[0].EventID, "e2")
+	assert.Len(suite.T(), deliveries[1].ResponseBody, 1024)
+
+	deliveries, total, err = GetDeliveries(7, DeliveryQuery{Outcome: "failure"})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), total, 1)
+	assert.Equal(suite.T(), deliveries[0].Attempt, 1)
+
+	deliveries, total, err = GetDeliveries(7, DeliveryQuery{EventID: "e1", Offset: 1, Limit: 1})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), total, 2)
+	assert.Len(suite.T(), deliveries, 1)
+	assert.Equal(suite.T(), deliveries[0].Attempt, 1)
+
+	InitDeliveryLog(7*24*time.Hour, 2)
+	defer InitDeliveryLog(7*24*time.Hour, 1000)
+	assert.Nil(suite.T(), LogDelivery(7, &Delivery{EventID: "e3", Attempt: 1, Time: now}))
+	_, total, err = GetDeliveries(7, DeliveryQuery{})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), total, 2)
+
+	detail := SubscribeDetail{}
+	assert.Nil(suite.T(), json.Unmarshal([]byte(DetailRaw), &detail))
+	id, err := detail.Save("loki")
+	assert.Nil(suite.T(), err)
+	assert.Nil(suite.T(), LogDelivery(id, &Delivery{EventID: "e4", Attempt: 1, Time: now}))
+	deleted, err := DeleteSubscribe(id)
+	assert.Nil(suite.T(), err)
+	assert.True(suite.T(), deleted)
+	_, total, err = GetDeliveries(id, DeliveryQuery{})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), total, 0)
+}
+
+func (suite *RedisTestSuite) TestPending() {
+	first := gerrit.NewEvent(map[string]interface{}{"type": "patchset-created"})
+	second := gerrit.NewEvent(map[string]interface{}{"type": "ref-updated"})
+	assert.Nil(suite.T(), SavePending(3, first))
+	assert.Nil(suite.T(), SavePending(3, second))
+	assert.Nil(suite.T(), SavePending(3))
+
+	events, err := TakePending(3)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 2, len(events))
+	assert.Equal(suite.T(), first.ID, events[0].ID)
+	assert.Equal(suite.T(), "ref-updated", events[1].Type())
+	events, err = TakePending(3)
+	assert.Nil(suite.T(), err)
+	assert.Empty(suite.T(), events)
+
+	detail := SubscribeDetail{}
+	assert.Nil(suite.T(), json.Unmarshal([]byte(DetailRaw), &detail))
+	id, err := detail.Save("loki")
+	assert.Nil(suite.T(), err)
+	assert.Nil(suite.T(), SavePending(id, first))
+	_, err = DeleteSubscribe(id)
+	assert.Nil(suite.T(), err)
+	events, err = TakePending(id)
+	assert.Nil(suite.T(), err)
+	assert.Empty(suite.T(), events)
+
+	assert.Nil(suite.T(), SaveBacklog(3, first, second))
+	n, err := BacklogLength(3)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 2, n)
+	events, err = TakeBacklog(3)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 2, len(events))
+	assert.Equal(suite.T(), second.ID, events[1].ID)
+	events, err = TakePending(3)
+	assert.Nil(suite.T(), err)
+	assert.Empty(suite.T(), events)
+
+	assert.Nil(suite.T(), SaveSpilled(3, first, second))
+	n, err = SpilledLength(3)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 2, n)
+	for _, want := range []*gerrit.Event{first, second} {
+		e, err := PopSpilled(3)
+		assert.Nil(suite.T(), err)
+		assert.Equal(suite.T(), want.ID, e.ID)
+	}
+	e, err := PopSpilled(3)
+	assert.Nil(suite.T(), err)
+	assert.Nil(suite.T(), e)
+}
+
+func (suite *RedisTestSuite) TestDropLog() {
+	now := time.Now()
+	assert.Nil(suite.T(), LogDrop(3, &Drop{EventID: "a", EventType: "patchset-created", Reason: "queue_full", Time: now.Add(-time.Minute)}))
+	assert.Nil(suite.T(), LogDrop(3, &Drop{EventID: "b", EventType: "ref-updated", Reason: "evicted", Time: now}))
+
+	drops, err := GetDrops(3)
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), drops, 2)
+	assert.Equal(suite.T(), "b", drops[0].EventID)
+	assert.Equal(suite.T(), "queue_full", drops[1].Reason)
+
+	assert.Nil(suite.T(), RemoveDrops(3, []string{"b", "unknown"}))
+	assert.Nil(suite.T(), RemoveDrops(3, nil))
+	drops, err = GetDrops(3)
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), drops, 1)
+	assert.Equal(suite.T(), "a", drops[0].EventID)
 }
 
 func TestRedisTestSuite(t *testing.T) {
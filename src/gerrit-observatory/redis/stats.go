@@ -0,0 +1,165 @@
+package redis
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"time"
+)
+
+var (
+	statsKeyPrefix = "subscribe_stats:"
+)
+
+// SubscribeStats counts what happened to the events a subscribe observed.
+// Seen events were handed to its observer, Matched ones passed the filter,
+// Delivered and Failed are the matched events the hook finally accepted or
+// not, Retried counts the extra attempts and Dropped the events lost before
+// reaching the observer or discarded from its backlog. Skipped are the
+// matched events not delivered because the subscribe was paused and
+// Debounced those a later one stood for once their debounce window closed.
+// ConsecutiveFailures and FailingSince describe the failures since the last
+// delivery, they are reset once an event is delivered
+type SubscribeStats struct {
+	Seen      int64 `json:"seen"`
+	Matched   int64 `json:"matched"`
+	Delivered int64 `json:"delivered"`
+	Failed    int64 `json:"failed"`
+	Retried   int64 `json:"retried"`
+	Dropped   int64 `json:"dropped"`
+	Skipped   int64 `json:"skipped"`
+	Debounced int64 `json:"debounced"`
+	// Backlog is the number of events queued while paused and Spilled
+	// those the full queue of the observer could not take, they are not
+	// stored with the counters
+	Backlog             int64  `json:"backlog,omitempty"`
+	Spilled             int64  `json:"spilled,omitempty"`
+	LastSuccessTime     string `json:"last_success_time"`
+	LastFailureTime     string `json:"last_failure_time"`
+	LastMatchTime       string `json:"last_match_time"`
+	ConsecutiveFailures int64  `json:"consecutive_failures"`
+	FailingSince        string `json:"failing_since,omitempty"`
+}
+
+// FailingFor returns for how long the deliveries of the subscribe have been
+// failing at now, zero when the last one succeeded
+func (stats *SubscribeStats) FailingFor(now time.Time) time.Duration {
+	since, err := time.Parse(time.UnixDate, stats.FailingSince)
+	if err != nil {
+		return 0
+	}
+	return now.Sub(since)
+}
+
+// StatsDelta is added at once to the statistics of a subscribe
+type StatsDelta struct {
+	Seen      int64
+	Matched   int64
+	Delivered int64
+	Failed    int64
+	Retried   int64
+	Dropped   int64
+	Skipped   int64
+	Debounced int64
+}
+
+// AddStats applies delta to the statistics of subscribe id in a single
+// transaction, the last success, failure and match times follow Delivered,
+// Failed and Matched. A delivery ends the current streak of failures
+func AddStats(id int, delta StatsDelta) error {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	key := getStatsKey(id)
+	now := time.Now().Format(time.UnixDate)
+	redisConn.Send("MULTI")
+	for _, counter := range []struct {
+		field string
+		value int64
+	}{
+		{"seen", delta.Seen},
+		{"matched", delta.Matched},
+		{"delivered", delta.Delivered},
+		{"failed", delta.Failed},
+		{"retried", delta.Retried},
+		{"dropped", delta.Dropped},
+		{"skipped", delta.Skipped},
+		{"debounced", delta.Debounced},
+	} {
+		if counter.value != 0 {
+			redisConn.Send("HINCRBY", key, counter.field, counter.value)
+		}
+	}
+	if delta.Matched > 0 {
+		redisConn.Send("HSET", key, "last_match_time", now)
+	}
+	if delta.Delivered > 0 {
+		redisConn.Send("HSET", key, "last_success_time", now)
+		redisConn.Send("HDEL", key, "consecutive_failures", "failing_since")
+	}
+	if delta.Failed > 0 {
+		redisConn.Send("HSET", key, "last_failure_time", now)
+		redisConn.Send("HINCRBY", key, "consecutive_failures", delta.Failed)
+		redisConn.Send("HSETNX", key, "failing_since", now)
+	}
+	_, err := redisConn.Do("EXEC")
+	return err
+}
+
+// GetStats returns the statistics of subscribe id
+func GetStats(id int) (*SubscribeStats, error) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	return getStats(redisConn, id)
+}
+
+func getStats(redisConn redis.Conn, id int) (*SubscribeStats, error) {
+	hash, err := redis.StringMap(redisConn.Do("HGETALL", getStatsKey(id)))
+	if err != nil {
+		return nil, err
+	}
+	stats := &SubscribeStats{}
+	if err = parseStats(hash, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// parseStats fills stats from the fields of a statistics hash, missing
+// counters are zero
+func parseStats(hash map[string]string, stats *SubscribeStats) error {
+	for _, counter := range []struct {
+		field string
+		value *int64
+	}{
+		{"seen", &stats.Seen},
+		{"matched", &stats.Matched},
+		{"delivered", &stats.Delivered},
+		{"failed", &stats.Failed},
+		{"retried", &stats.Retried},
+		{"dropped", &stats.Dropped},
+		{"skipped", &stats.Skipped},
+		{"debounced", &stats.Debounced},
+		{"consecutive_failures", &stats.ConsecutiveFailures},
+	} {
+		raw, ok := hash[counter.field]
+		if !ok {
+			continue
+		}
+		value, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("stats %s: %v", counter.field, err)
+		}
+		*counter.value = value
+	}
+	stats.LastSuccessTime = hash["last_success_time"]
+	stats.LastFailureTime = hash["last_failure_time"]
+	stats.LastMatchTime = hash["last_match_time"]
+	stats.FailingSince = hash["failing_since"]
+	return nil
+}
+
+func getStatsKey(id int) string {
+	return fmt.Sprintf("%s%s%d", keyPrefix, statsKeyPrefix, id)
+}
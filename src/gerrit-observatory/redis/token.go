@@ -0,0 +1,139 @@
+package redis
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+var (
+	tokenKeyPrefix = "token:"
+	tokenIndexKey  = "token_index"
+	tokenBytes     = 24
+
+	// ErrTokenNotFound is returned when a token is unknown or has been revoked
+	ErrTokenNotFound = errors.New("token not found")
+)
+
+// Token grants API access on behalf of Owner, only its sha256 sum is stored.
+// GerritUser is the gerrit account whose read permissions bound the
+// subscribes created with the token
+type Token struct {
+	ID          string `json:"id"`
+	Owner       string `json:"owner"`
+	GerritUser  string `json:"gerrit_user"`
+	Admin       bool   `json:"admin"`
+	Comment     string `json:"comment"`
+	CreatedTime string `json:"created_time"`
+}
+
+// HashToken returns the id under which raw is stored
+func HashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewRawToken returns a random token in clear
+func NewRawToken() (string, error) {
+	buf := make([]byte, tokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// SaveToken stores the hash of raw, replacing any token with the same value.
+// The ID and CreatedTime of token are filled in
+func SaveToken(raw string, token *Token) error {
+	if token.Owner == "" {
+		return fmt.Errorf("token owner is required")
+	}
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	token.ID = HashToken(raw)
+	token.CreatedTime = time.Now().Format(time.UnixDate)
+	redisConn.Send("MULTI")
+	redisConn.Send("HMSET", getTokenKey(token.ID),
+		"owner", token.Owner,
+		"gerrit_user", token.GerritUser,
+		"admin", token.Admin,
+		"comment", token.Comment,
+		"created_time", token.CreatedTime)
+	redisConn.Send("SADD", keyPrefix+tokenIndexKey, token.ID)
+	_, err := redisConn.Do("EXEC")
+	return err
+}
+
+// Authenticate resolves a clear token to its stored Token
+func Authenticate(raw string) (*Token, error) {
+	if raw == "" {
+		return nil, ErrTokenNotFound
+	}
+	return GetToken(HashToken(raw))
+}
+
+// GetToken returns the token stored under id
+func GetToken(id string) (*Token, error) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	reply, err := redis.Values(redisConn.Do("HMGET", getTokenKey(id), "owner", "gerrit_user", "admin", "comment", "created_time"))
+	if err != nil {
+		return nil, err
+	}
+	if reply[0] == nil {
+		return nil, ErrTokenNotFound
+	}
+	token := &Token{ID: id}
+	if _, err = redis.Scan(reply, &token.Owner, &token.GerritUser, &token.Admin, &token.Comment, &token.CreatedTime); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// GetTokens lists every stored token
+func GetTokens() ([]*Token, error) {
+	redisConn := redisPool.Get()
+	ids, err := redis.Strings(redisConn.Do("SMEMBERS", keyPrefix+tokenIndexKey))
+	redisConn.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]*Token, 0, len(ids))
+	for _, id := range ids {
+		token, err := GetToken(id)
+		if err == ErrTokenNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// DeleteToken revokes the token stored under id
+func DeleteToken(id string) (bool, error) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	redisConn.Send("MULTI")
+	redisConn.Send("DEL", getTokenKey(id))
+	redisConn.Send("SREM", keyPrefix+tokenIndexKey, id)
+	reply, err := redis.Values(redisConn.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+	return redis.Bool(reply[0], nil)
+}
+
+func getTokenKey(id string) string {
+	return keyPrefix + tokenKeyPrefix + id
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"gerrit-observatory/config"
+	"gerrit-observatory/gerrit"
+	"gerrit-observatory/log"
+	"gerrit-observatory/notify"
+	"gerrit-observatory/observer"
+	"gerrit-observatory/redis"
+	"gerrit-observatory/store"
+	"gerrit-observatory/trace"
+)
+
+// reloader reads the configuration again and applies it to the running
+// services, settings that can not change live are reported
+type reloader struct {
+	sync.Mutex
+	args      []string
+	current   *config.Config
+	keyDigest [sha256.Size]byte
+	stream    *gerrit.EventStream
+	client    *gerrit.Client
+	contr     *observer.ObserverContr
+}
+
+func newReloader(args []string, conf *config.Config, stream *gerrit.EventStream, client *gerrit.Client, contr *observer.ObserverContr) *reloader {
+	digest, _ := keyDigest(conf.PrivateKey)
+	return &reloader{
+		args:      args,
+		current:   conf,
+		keyDigest: digest,
+		stream:    stream,
+		client:    client,
+		contr:     contr,
+	}
+}
+
+// Current returns the configuration in effect
+func (r *reloader) Current() *config.Config {
+	r.Lock()
+	defer r.Unlock()
+	return r.current
+}
+
+// Reload applies the configuration read from the same file, environment
+// and flags as on start, nothing is applied when it is invalid
+func (r *reloader) Reload() (*config.ReloadReport, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	loaded, err := config.Load(r.args, os.Environ())
+	if err != nil {
+		return nil, err
+	}
+	live := config.Live(r.current, loaded)
+	digest, err := keyDigest(live.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	old := r.current
+	if gerritChanged(old, live) || digest != r.keyDigest {
+		// reconnecting loses the events gerrit sends meanwhile, so it is
+		// only done when the server or the credentials changed
+		creds, err := gerrit.LoadCredentials(live.GerritPort, live.GerritUser, live.GerritHost, live.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		r.client.Configure(creds)
+		r.stream.Configure(creds)
+	}
+
+	applyLogging(live)
+	if old.TracingEndpoint != live.TracingEndpoint || old.TracingServiceName != live.TracingServiceName {
+		trace.Init(live.TracingEndpoint, live.TracingServiceName)
+	}
+	if old.HistoryRetentionHours != live.HistoryRetentionHours || old.HistoryMaxEvents != live.HistoryMaxEvents {
+		redis.InitHistory(time.Duration(live.HistoryRetentionHours)*time.Hour, live.HistoryMaxEvents)
+	}
+	if old.DeliveryLogRetentionHours != live.DeliveryLogRetentionHours || old.DeliveryLogMaxEntries != live.DeliveryLogMaxEntries {
+		redis.InitDeliveryLog(time.Duration(live.DeliveryLogRetentionHours)*time.Hour, live.DeliveryLogMaxEntries)
+	}
+	r.contr.Reconfigure(live.PostTimeout, live.DeliveryAttempts, time.Duration(live.DeliveryRetryInterval)*time.Second, live.DeliveryQueueSize, live.DeliveryConcurrency)
+	r.contr.SetMaxConnections(live.DeliveryMaxConnections)
+	r.contr.SetOverflowPolicy(live.Overflow, time.Duration(live.OverflowBlockTimeoutMs)*time.Millisecond)
+	r.contr.SetDisablePolicy(live.DisableAfterFailures, time.Duration(live.DisableAfterHours)*time.Hour)
+	r.contr.SetBreakerPolicy(live.BreakerFailures, time.Duration(live.BreakerOpenSeconds)*time.Second, live.BreakerMode)
+	notify.Init(live.NotifyWebhookURL)
+	if live.AdminToken != "" && (old.AdminToken != live.AdminToken || old.AdminOwner != live.AdminOwner) {
+		if err = saveAdminToken(live); err != nil {
+			log.Logger.Errorf("admin token not saved, err: %v", err)
+		}
+	}
+
+	report := config.NewReloadReport(config.Diff(old, loaded))
+	r.current = live
+	r.keyDigest = digest
+	log.Logger.Infof("configuration reloaded, applied: %v, restart required: %v", report.Applied, report.RestartRequired)
+	return report, nil
+}
+
+func gerritChanged(old *config.Config, new *config.Config) bool {
+	return old.GerritHost != new.GerritHost ||
+		old.GerritPort != new.GerritPort ||
+		old.GerritUser != new.GerritUser ||
+		old.PrivateKey != new.PrivateKey
+}
+
+// keyDigest tells apart the versions of a private key rotated in place
+func keyDigest(path string) ([sha256.Size]byte, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(raw), nil
+}
+
+func applyLogging(conf *config.Config) {
+	level, _ := log.ParseLevel(conf.LogLevel)
+	log.Logger.SetLevel(level)
+	log.Logger.SetJSON(conf.LogJSON)
+	log.Logger.SetRedact(conf.LogRedact)
+}
+
+func saveAdminToken(conf *config.Config) error {
+	token := &redis.Token{Owner: conf.AdminOwner, Admin: true, Comment: "bootstrap admin token"}
+	return store.Subscriptions.SaveToken(conf.AdminToken, token)
+}
@@ -2,4 +2,4 @@
 
 chmod 400 .id_rsa
 test -d ./logs || mkdir ./logs
-nohup ./gerrit-observatory > ./logs/gerrit-observatory.log 2>&1 &
+nohup ./gerrit-observatory $(test -f observatory.toml && echo -config observatory.toml) > ./logs/gerrit-observatory.log 2>&1 &
@@ -2,5 +2,10 @@
 
 if ps -ef | grep -v python | grep -v make | grep gerrit-observatory | grep -v grep
 then
+	# SIGTERM, pending deliveries get shutdown.timeout to complete
 	killall gerrit-observatory
+	while killall -0 gerrit-observatory 2>/dev/null
+	do
+		sleep 1
+	done
 fi
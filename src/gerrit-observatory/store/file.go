@@ -0,0 +1,977 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"gerrit-observatory/gerrit"
+	"gerrit-observatory/log"
+	"gerrit-observatory/redis"
+)
+
+// buckets of the file store. The delivery and drop logs and the queues of a
+// subscribe are nested in their bucket under the id of the subscribe,
+// events maps the id of the events of the history to their key
+var (
+	metaBucket        = []byte("meta")
+	subscribesBucket  = []byte("subscribes")
+	statsBucket       = []byte("stats")
+	deliveriesBucket  = []byte("deliveries")
+	dropsBucket       = []byte("drops")
+	pendingBucket     = []byte("pending")
+	backlogBucket     = []byte("backlog")
+	spilledBucket     = []byte("spilled")
+	historyBucket     = []byte("history")
+	eventsBucket      = []byte("events")
+	tokensBucket      = []byte("tokens")
+	invalidatedBucket = []byte("invalidated")
+
+	schemaVersionKey = []byte("schema_version")
+	historyLenKey    = []byte("history_len")
+)
+
+// perSubscribe are the buckets nesting a bucket for every subscribe
+var perSubscribe = [][]byte{deliveriesBucket, dropsBucket, pendingBucket, backlogBucket, spilledBucket}
+
+// fileStore keeps the subscribes in a bbolt database for single node
+// installs, one record per key. Every change is committed to disk before
+// the call making it returns
+type fileStore struct {
+	db *bolt.DB
+}
+
+// OpenFileStore opens the database at path, it is created empty when the
+// file does not exist yet. A JSON snapshot written by an older release is
+// converted first
+func OpenFileStore(path string) (SubscriptionStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("file store requires a path")
+	}
+	legacy, err := isSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		if err = convertSnapshot(path); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := createBuckets(tx); err != nil {
+			return err
+		}
+		meta := tx.Bucket(metaBucket)
+		if meta.Get(schemaVersionKey) != nil {
+			return nil
+		}
+		return meta.Put(schemaVersionKey, []byte(strconv.Itoa(schemaVersion)))
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &fileStore{db: db}, nil
+}
+
+func createBuckets(tx *bolt.Tx) error {
+	for _, name := range [][]byte{metaBucket, subscribesBucket, statsBucket, deliveriesBucket, dropsBucket,
+		pendingBucket, backlogBucket, spilledBucket, historyBucket, eventsBucket, tokensBucket} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isSnapshot tells whether path holds a JSON snapshot rather than a
+// database
+func isSnapshot(path string) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := f.Read(head)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return bytes.HasPrefix(bytes.TrimSpace(head[:n]), []byte("{")), nil
+}
+
+// invalidatedSubscribes returns the subscribes a version 1 snapshot flagged
+// as no longer valid
+func invalidatedSubscribes(raw []byte) (map[int]bool, error) {
+	var legacy struct {
+		Subscribes map[int]struct {
+			Valid *bool
+		} `json:"subscribes"`
+	}
+	if err := json.Unmarshal(raw, &legacy); err != nil {
+		return nil, err
+	}
+	invalidated := make(map[int]bool)
+	for id, sub := range legacy.Subscribes {
+		if sub.Valid != nil && !*sub.Valid {
+			invalidated[id] = true
+		}
+	}
+	return invalidated, nil
+}
+
+// convertSnapshot replaces the JSON snapshot at path by a database holding
+// its records, at the schema version of the snapshot so it is migrated as
+// usual. The snapshot is kept with a .snapshot suffix
+func convertSnapshot(path string) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	data := newSnapshot()
+	if err = json.Unmarshal(raw, data); err != nil {
+		return err
+	}
+	invalidated := make(map[int]bool)
+	if data.SchemaVersion < 2 {
+		if invalidated, err = invalidatedSubscribes(raw); err != nil {
+			return err
+		}
+	}
+
+	converted := path + ".converting"
+	if err = os.Remove(converted); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	db, err := bolt.Open(converted, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return writeSnapshot(tx, data, invalidated)
+	})
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path, path+".snapshot")
+	}
+	if err == nil {
+		err = os.Rename(converted, path)
+	}
+	if err != nil {
+		os.Remove(converted)
+		return err
+	}
+	log.Logger.Infof("snapshot %s converted to a database, the snapshot is kept as %s.snapshot", path, path)
+	return nil
+}
+
+// writeSnapshot stores the records of data in tx
+func writeSnapshot(tx *bolt.Tx, data *snapshot, invalidated map[int]bool) error {
+	if err := createBuckets(tx); err != nil {
+		return err
+	}
+	if err := tx.Bucket(metaBucket).Put(schemaVersionKey, []byte(strconv.Itoa(data.SchemaVersion))); err != nil {
+		return err
+	}
+	subscribes := tx.Bucket(subscribesBucket)
+	if err := subscribes.SetSequence(uint64(data.LastID)); err != nil {
+		return err
+	}
+	for id, sub := range data.Subscribes {
+		if err := putJSON(subscribes, itob(id), sub); err != nil {
+			return err
+		}
+	}
+	for id, stats := range data.Stats {
+		if err := putJSON(tx.Bucket(statsBucket), itob(id), stats); err != nil {
+			return err
+		}
+	}
+	for id, deliveries := range data.Deliveries {
+		for _, d := range deliveries {
+			if err := putLogged(tx, deliveriesBucket, id, d.Time, d); err != nil {
+				return err
+			}
+		}
+	}
+	for id, drops := range data.Drops {
+		for _, d := range drops {
+			if err := putLogged(tx, dropsBucket, id, d.Time, d); err != nil {
+				return err
+			}
+		}
+	}
+	for name, queues := range map[string]map[int][]*gerrit.Event{
+		string(pendingBucket): data.Pending, string(backlogBucket): data.Backlog, string(spilledBucket): data.Spilled,
+	} {
+		for id, events := range queues {
+			if err := pushEvents(tx, []byte(name), id, events); err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(data.History) - 1; i >= 0; i-- {
+		if err := recordEvent(tx, data.History[i]); err != nil {
+			return err
+		}
+	}
+	for id, token := range data.Tokens {
+		if err := putJSON(tx.Bucket(tokensBucket), []byte(id), token); err != nil {
+			return err
+		}
+	}
+	if len(invalidated) == 0 {
+		return nil
+	}
+	b, err := tx.CreateBucketIfNotExists(invalidatedBucket)
+	if err != nil {
+		return err
+	}
+	for id := range invalidated {
+		if err = b.Put(itob(id), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileStore) Save(owner string, detail redis.SubscribeDetail, gerritUser string, projects []string) (int, error) {
+	var id int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(subscribesBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		id = int(seq)
+		return putJSON(b, itob(id), &redis.Subscribe{
+			ID:              id,
+			Owner:           owner,
+			Detail:          detail,
+			GerritUser:      gerritUser,
+			VisibleProjects: redis.VisibleTo(gerritUser, projects),
+			CreatedTime:     time.Now().Format(time.UnixDate),
+			State:           redis.StateActive,
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (s *fileStore) Get(id int) (subscribe *redis.Subscribe, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		subscribe, err = getSubscribe(tx, id)
+		return err
+	})
+	return
+}
+
+// loadSubscribe decodes the record of subscribe id, without its statistics
+func loadSubscribe(tx *bolt.Tx, id int) (*redis.Subscribe, error) {
+	raw := tx.Bucket(subscribesBucket).Get(itob(id))
+	if raw == nil {
+		return nil, redis.ErrSubscribeNotFound
+	}
+	var subscribe redis.Subscribe
+	if err := json.Unmarshal(raw, &subscribe); err != nil {
+		return nil, err
+	}
+	return &subscribe, nil
+}
+
+func getSubscribe(tx *bolt.Tx, id int) (*redis.Subscribe, error) {
+	subscribe, err := loadSubscribe(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	subscribe.VisibleProjects = redis.VisibleTo(subscribe.GerritUser, subscribe.VisibleProjects)
+	stats, err := getStats(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	subscribe.Stats = *stats
+	return subscribe, nil
+}
+
+func (s *fileStore) List() ([]*redis.Subscribe, error) {
+	subscribes := make([]*redis.Subscribe, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(subscribesBucket).ForEach(func(k, _ []byte) error {
+			subscribe, err := getSubscribe(tx, btoi(k))
+			if err != nil {
+				return err
+			}
+			subscribes = append(subscribes, subscribe)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subscribes, nil
+}
+
+// updateSubscribe applies change to the record of subscribe id and returns
+// the subscribe changed
+func (s *fileStore) updateSubscribe(id int, change func(*redis.Subscribe)) (subscribe *redis.Subscribe, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		stored, err := loadSubscribe(tx, id)
+		if err != nil {
+			return err
+		}
+		change(stored)
+		if err = putJSON(tx.Bucket(subscribesBucket), itob(id), stored); err != nil {
+			return err
+		}
+		subscribe, err = getSubscribe(tx, id)
+		return err
+	})
+	return
+}
+
+func (s *fileStore) Update(id int, detail redis.SubscribeDetail) (*redis.Subscribe, error) {
+	return s.updateSubscribe(id, func(stored *redis.Subscribe) {
+		stored.Detail = detail
+	})
+}
+
+func (s *fileStore) SetVisibleProjects(id int, gerritUser string, projects []string) error {
+	_, err := s.updateSubscribe(id, func(stored *redis.Subscribe) {
+		stored.GerritUser = gerritUser
+		stored.VisibleProjects = redis.VisibleTo(gerritUser, projects)
+	})
+	return err
+}
+
+func (s *fileStore) SetState(id int, state string, pauseMode string, reason string) (*redis.Subscribe, error) {
+	if state != redis.StatePaused {
+		pauseMode = ""
+	}
+	return s.updateSubscribe(id, func(stored *redis.Subscribe) {
+		stored.State = state
+		stored.PauseMode = pauseMode
+		stored.StateReason = reason
+		stored.StateChangedTime = time.Now().Format(time.UnixDate)
+	})
+}
+
+func (s *fileStore) Delete(id int) (existed bool, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		key := itob(id)
+		subscribes := tx.Bucket(subscribesBucket)
+		existed = subscribes.Get(key) != nil
+		if err := subscribes.Delete(key); err != nil {
+			return err
+		}
+		if err := tx.Bucket(statsBucket).Delete(key); err != nil {
+			return err
+		}
+		for _, name := range perSubscribe {
+			if err := tx.Bucket(name).DeleteBucket(key); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (s *fileStore) AddStats(id int, delta redis.StatsDelta) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		stats, err := getStats(tx, id)
+		if err != nil {
+			return err
+		}
+		addStats(stats, delta)
+		return putJSON(tx.Bucket(statsBucket), itob(id), stats)
+	})
+}
+
+func (s *fileStore) GetStats(id int) (stats *redis.SubscribeStats, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		stats, err = getStats(tx, id)
+		return err
+	})
+	return
+}
+
+func getStats(tx *bolt.Tx, id int) (*redis.SubscribeStats, error) {
+	stats := &redis.SubscribeStats{}
+	raw := tx.Bucket(statsBucket).Get(itob(id))
+	if raw == nil {
+		return stats, nil
+	}
+	return stats, json.Unmarshal(raw, stats)
+}
+
+// LogDelivery keeps the log of subscribe id within the bounds set by
+// redis.InitDeliveryLog
+func (s *fileStore) LogDelivery(id int, d *redis.Delivery) error {
+	d.TrimBody()
+	logged := *d
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		return putLogged(tx, deliveriesBucket, id, logged.Time, &logged)
+	})
+}
+
+func (s *fileStore) GetDeliveries(id int, q redis.DeliveryQuery) ([]*redis.Delivery, int, error) {
+	logged := make([]*redis.Delivery, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return eachLogged(tx, deliveriesBucket, id, func(raw []byte) error {
+			var d redis.Delivery
+			if err := json.Unmarshal(raw, &d); err != nil {
+				return err
+			}
+			logged = append(logged, &d)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	deliveries, total := redis.FilterDeliveries(trimDeliveries(logged), q)
+	return deliveries, total, nil
+}
+
+// LogDrop keeps the drop log of subscribe id within the bounds of the
+// delivery log
+func (s *fileStore) LogDrop(id int, d *redis.Drop) error {
+	logged := *d
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		return putLogged(tx, dropsBucket, id, logged.Time, &logged)
+	})
+}
+
+func (s *fileStore) GetDrops(id int) ([]*redis.Drop, error) {
+	drops := make([]*redis.Drop, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return eachLogged(tx, dropsBucket, id, func(raw []byte) error {
+			var d redis.Drop
+			if err := json.Unmarshal(raw, &d); err != nil {
+				return err
+			}
+			drops = append(drops, &d)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return trimDrops(drops), nil
+}
+
+func (s *fileStore) RemoveDrops(id int, eventIDs []string) error {
+	removed := make(map[string]bool, len(eventIDs))
+	for _, eventID := range eventIDs {
+		removed[eventID] = true
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(dropsBucket).Bucket(itob(id))
+		if b == nil {
+			return nil
+		}
+		var keys [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var d redis.Drop
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			if removed[d.EventID] {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err = b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// putLogged adds v to the log of subscribe id in the bucket name, ordered
+// by t. The entries beyond the bounds of the delivery log are dropped
+func putLogged(tx *bolt.Tx, name []byte, id int, t time.Time, v interface{}) error {
+	b, err := tx.Bucket(name).CreateBucketIfNotExists(itob(id))
+	if err != nil {
+		return err
+	}
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	if err = putJSON(b, timeKey(t, seq), v); err != nil {
+		return err
+	}
+	n := count(b)
+	cutoff := time.Now().Add(-redis.DeliveryLogRetention())
+	var stale [][]byte
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if n-len(stale) <= redis.DeliveryLogMaxEntries() && !keyTime(k).Before(cutoff) {
+			break
+		}
+		stale = append(stale, append([]byte(nil), k...))
+	}
+	for _, k := range stale {
+		if err = b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eachLogged calls fn with the entries of the log of subscribe id in the
+// bucket name, newest first
+func eachLogged(tx *bolt.Tx, name []byte, id int, fn func(raw []byte) error) error {
+	b := tx.Bucket(name).Bucket(itob(id))
+	if b == nil {
+		return nil
+	}
+	c := b.Cursor()
+	for k, v := c.Last(); k != nil; k, v = c.Prev() {
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileStore) SavePending(id int, events ...*gerrit.Event) error {
+	return s.saveEvents(pendingBucket, id, events)
+}
+
+func (s *fileStore) TakePending(id int) ([]*gerrit.Event, error) {
+	return s.takeEvents(pendingBucket, id)
+}
+
+func (s *fileStore) SaveBacklog(id int, events ...*gerrit.Event) error {
+	return s.saveEvents(backlogBucket, id, events)
+}
+
+func (s *fileStore) TakeBacklog(id int) ([]*gerrit.Event, error) {
+	return s.takeEvents(backlogBucket, id)
+}
+
+func (s *fileStore) BacklogLength(id int) (int, error) {
+	return s.queueLength(backlogBucket, id)
+}
+
+func (s *fileStore) SaveSpilled(id int, events ...*gerrit.Event) error {
+	return s.saveEvents(spilledBucket, id, events)
+}
+
+func (s *fileStore) PopSpilled(id int) (e *gerrit.Event, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(spilledBucket).Bucket(itob(id))
+		if b == nil {
+			return nil
+		}
+		k, v := b.Cursor().First()
+		if k == nil {
+			return tx.Bucket(spilledBucket).DeleteBucket(itob(id))
+		}
+		if e, err = decodeEvent(v); err != nil {
+			return err
+		}
+		return b.Delete(k)
+	})
+	return
+}
+
+func (s *fileStore) SpilledLength(id int) (int, error) {
+	return s.queueLength(spilledBucket, id)
+}
+
+func (s *fileStore) saveEvents(name []byte, id int, events []*gerrit.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		return pushEvents(tx, name, id, events)
+	})
+}
+
+// pushEvents appends events to the queue of subscribe id in the bucket name
+func pushEvents(tx *bolt.Tx, name []byte, id int, events []*gerrit.Event) error {
+	b, err := tx.Bucket(name).CreateBucketIfNotExists(itob(id))
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err = putJSON(b, itob(int(seq)), e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// takeEvents removes and returns the queue of subscribe id in the bucket
+// name, oldest first
+func (s *fileStore) takeEvents(name []byte, id int) ([]*gerrit.Event, error) {
+	var events []*gerrit.Event
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		events = make([]*gerrit.Event, 0)
+		b := tx.Bucket(name).Bucket(itob(id))
+		if b == nil {
+			return nil
+		}
+		err := b.ForEach(func(_, v []byte) error {
+			e, err := decodeEvent(v)
+			if err != nil {
+				return err
+			}
+			events = append(events, e)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(name).DeleteBucket(itob(id))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (s *fileStore) queueLength(name []byte, id int) (n int, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(name).Bucket(itob(id)); b != nil {
+			n = count(b)
+		}
+		return nil
+	})
+	return
+}
+
+// RecordEvent keeps the history within the bounds set by redis.InitHistory
+func (s *fileStore) RecordEvent(e *gerrit.Event) error {
+	recorded, err := copyEvent(e)
+	if err != nil {
+		return err
+	}
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		return recordEvent(tx, recorded)
+	})
+}
+
+// recordEvent adds e to the history, replacing an event of the same id,
+// and drops the events out of the retention or beyond the maximum number
+func recordEvent(tx *bolt.Tx, e *gerrit.Event) error {
+	history, index, meta := tx.Bucket(historyBucket), tx.Bucket(eventsBucket), tx.Bucket(metaBucket)
+	n, _ := strconv.Atoi(string(meta.Get(historyLenKey)))
+	if old := index.Get([]byte(e.ID)); old != nil {
+		if err := history.Delete(append([]byte(nil), old...)); err != nil {
+			return err
+		}
+		n--
+	}
+	seq, err := history.NextSequence()
+	if err != nil {
+		return err
+	}
+	key := timeKey(e.ReceivedAt, seq)
+	if err = putJSON(history, key, e); err != nil {
+		return err
+	}
+	if err = index.Put([]byte(e.ID), key); err != nil {
+		return err
+	}
+	n++
+
+	cutoff := e.ReceivedAt.Add(-redis.HistoryRetention())
+	var stale [][]byte
+	var staleIDs []string
+	c := history.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if n-len(stale) <= redis.HistoryMaxEvents() && !keyTime(k).Before(cutoff) {
+			break
+		}
+		var recorded struct {
+			ID string `json:"id"`
+		}
+		if err = json.Unmarshal(v, &recorded); err != nil {
+			return err
+		}
+		stale = append(stale, append([]byte(nil), k...))
+		staleIDs = append(staleIDs, recorded.ID)
+	}
+	for i, k := range stale {
+		if err = history.Delete(k); err != nil {
+			return err
+		}
+		if err = index.Delete([]byte(staleIDs[i])); err != nil {
+			return err
+		}
+	}
+	return meta.Put(historyLenKey, []byte(strconv.Itoa(n-len(stale))))
+}
+
+func (s *fileStore) GetEvent(id string) (e *gerrit.Event, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		key := tx.Bucket(eventsBucket).Get([]byte(id))
+		if key == nil || keyTime(key).Before(time.Now().Add(-redis.HistoryRetention())) {
+			return redis.ErrEventNotFound
+		}
+		e, err = decodeEvent(tx.Bucket(historyBucket).Get(key))
+		return err
+	})
+	return
+}
+
+func (s *fileStore) GetEvents(since time.Time, limit int) ([]*gerrit.Event, error) {
+	events, _, err := s.eventRange(since, time.Time{}, 0, limit)
+	return events, err
+}
+
+func (s *fileStore) GetEventsPage(since time.Time, until time.Time, offset int, count int) ([]*gerrit.Event, bool, error) {
+	events, n, err := s.eventRange(since, until, offset, count)
+	return events, n > 0 && n == count, err
+}
+
+// eventRange returns, newest first, the count events received between
+// since and until, a zero until having no bound, that follow the first
+// offset ones, along with how many it found. A count <= 0 returns them all
+func (s *fileStore) eventRange(since time.Time, until time.Time, offset int, count int) ([]*gerrit.Event, int, error) {
+	if oldest := time.Now().Add(-redis.HistoryRetention()); since.Before(oldest) {
+		since = oldest
+	}
+	events := make([]*gerrit.Event, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(historyBucket).Cursor()
+		k, v := c.Last()
+		if !until.IsZero() {
+			if k, v = c.Seek(timeKey(until.Add(time.Nanosecond), 0)); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+		for skipped := 0; k != nil; k, v = c.Prev() {
+			if keyTime(k).Before(since) {
+				break
+			}
+			if skipped < offset {
+				skipped++
+				continue
+			}
+			e, err := decodeEvent(v)
+			if err != nil {
+				return err
+			}
+			events = append(events, e)
+			if count > 0 && len(events) == count {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return events, len(events), nil
+}
+
+func (s *fileStore) SaveToken(raw string, token *redis.Token) error {
+	if token.Owner == "" {
+		return fmt.Errorf("token owner is required")
+	}
+	token.ID = redis.HashToken(raw)
+	token.CreatedTime = time.Now().Format(time.UnixDate)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(tokensBucket), []byte(token.ID), token)
+	})
+}
+
+func (s *fileStore) Authenticate(raw string) (*redis.Token, error) {
+	if raw == "" {
+		return nil, redis.ErrTokenNotFound
+	}
+	var token *redis.Token
+	err := s.db.View(func(tx *bolt.Tx) error {
+		stored := tx.Bucket(tokensBucket).Get([]byte(redis.HashToken(raw)))
+		if stored == nil {
+			return redis.ErrTokenNotFound
+		}
+		token = &redis.Token{}
+		return json.Unmarshal(stored, token)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (s *fileStore) GetTokens() ([]*redis.Token, error) {
+	tokens := make([]*redis.Token, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokensBucket).ForEach(func(_, v []byte) error {
+			var token redis.Token
+			if err := json.Unmarshal(v, &token); err != nil {
+				return err
+			}
+			tokens = append(tokens, &token)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (s *fileStore) DeleteToken(id string) (existed bool, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(tokensBucket)
+		existed = b.Get([]byte(id)) != nil
+		return b.Delete([]byte(id))
+	})
+	return
+}
+
+func (s *fileStore) Ping() error {
+	return s.db.View(func(*bolt.Tx) error { return nil })
+}
+
+// Migrate upgrades a database converted from a snapshot of an older
+// release
+func (s *fileStore) Migrate(dryRun bool) (*redis.MigrationReport, error) {
+	var report *redis.MigrationReport
+	run := s.db.Update
+	if dryRun {
+		run = s.db.View
+	}
+	err := run(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		from, err := strconv.Atoi(string(meta.Get(schemaVersionKey)))
+		if err != nil {
+			return fmt.Errorf("invalid schema version %q", meta.Get(schemaVersionKey))
+		}
+		report = &redis.MigrationReport{From: from, To: schemaVersion, DryRun: dryRun, Steps: make([]*redis.MigrationStep, 0)}
+		if report.From > report.To {
+			return fmt.Errorf("schema version %d is newer than %d, written by a later release", report.From, report.To)
+		}
+		if report.From < 2 {
+			step := &redis.MigrationStep{Version: 2, Description: "replace the valid flag by a lifecycle state", Changes: make([]string, 0)}
+			invalidated := tx.Bucket(invalidatedBucket)
+			ids := make([]int, 0)
+			tx.Bucket(subscribesBucket).ForEach(func(k, _ []byte) error {
+				ids = append(ids, btoi(k))
+				return nil
+			})
+			sort.Ints(ids)
+			for _, id := range ids {
+				state := redis.StateActive
+				if invalidated != nil && invalidated.Get(itob(id)) != nil {
+					state = redis.StateArchived
+				}
+				step.Changes = append(step.Changes, fmt.Sprintf("subscribe %d: state %s", id, state))
+				if dryRun {
+					continue
+				}
+				stored, err := loadSubscribe(tx, id)
+				if err != nil {
+					return err
+				}
+				stored.State = state
+				if err = putJSON(tx.Bucket(subscribesBucket), itob(id), stored); err != nil {
+					return err
+				}
+			}
+			report.Steps = append(report.Steps, step)
+		}
+		if report.UpToDate() || dryRun {
+			return nil
+		}
+		if invalidated := tx.Bucket(invalidatedBucket); invalidated != nil {
+			if err = tx.DeleteBucket(invalidatedBucket); err != nil {
+				return err
+			}
+		}
+		return meta.Put(schemaVersionKey, []byte(strconv.Itoa(schemaVersion)))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (s *fileStore) Close() error {
+	return s.db.Close()
+}
+
+// count returns the number of keys of b, unlike b.Stats it sees the changes
+// of the current transaction
+func count(b *bolt.Bucket) int {
+	n := 0
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n++
+	}
+	return n
+}
+
+func putJSON(b *bolt.Bucket, key []byte, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, raw)
+}
+
+// itob is the key of id, ordered as the ids
+func itob(id int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+func btoi(key []byte) int {
+	return int(binary.BigEndian.Uint64(key))
+}
+
+// timeKey orders the entries of a log or the history by t, seq tells apart
+// those of the same time
+func timeKey(t time.Time, seq uint64) []byte {
+	nanos := t.UnixNano()
+	if nanos < 0 {
+		nanos = 0
+	}
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(nanos))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+func keyTime(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key)))
+}
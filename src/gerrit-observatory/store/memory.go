@@ -0,0 +1,637 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"gerrit-observatory/gerrit"
+	"gerrit-observatory/redis"
+)
+
+// schemaVersion is the schema version of what this release stores
+const schemaVersion = 2
+
+// memoryStore keeps the subscribes in memory, they are lost on exit. Values
+// are copied in and out so callers never share them with the store
+type memoryStore struct {
+	sync.Mutex
+	data *snapshot
+}
+
+// snapshot is the whole content of a memory store, as the file store of
+// older releases wrote it
+type snapshot struct {
+	SchemaVersion int                           `json:"schema_version"`
+	LastID        int                           `json:"last_id"`
+	Subscribes    map[int]*redis.Subscribe      `json:"subscribes"`
+	Stats         map[int]*redis.SubscribeStats `json:"stats"`
+	Deliveries    map[int][]*redis.Delivery     `json:"deliveries"`
+	Drops         map[int][]*redis.Drop         `json:"drops"`
+	Pending       map[int][]*gerrit.Event       `json:"pending"`
+	Backlog       map[int][]*gerrit.Event       `json:"backlog"`
+	Spilled       map[int][]*gerrit.Event       `json:"spilled"`
+	// History holds the received events newest first
+	History []*gerrit.Event         `json:"history"`
+	Tokens  map[string]*redis.Token `json:"tokens"`
+}
+
+func newSnapshot() *snapshot {
+	return &snapshot{
+		SchemaVersion: schemaVersion,
+		Subscribes:    make(map[int]*redis.Subscribe),
+		Stats:         make(map[int]*redis.SubscribeStats),
+		Deliveries:    make(map[int][]*redis.Delivery),
+		Drops:         make(map[int][]*redis.Drop),
+		Pending:       make(map[int][]*gerrit.Event),
+		Backlog:       make(map[int][]*gerrit.Event),
+		Spilled:       make(map[int][]*gerrit.Event),
+		Tokens:        make(map[string]*redis.Token),
+	}
+}
+
+// NewMemoryStore returns an empty store living in memory
+func NewMemoryStore() SubscriptionStore {
+	return &memoryStore{data: newSnapshot()}
+}
+
+func (s *memoryStore) Save(owner string, detail redis.SubscribeDetail, gerritUser string, projects []string) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	detail, err := copyDetail(detail)
+	if err != nil {
+		return 0, err
+	}
+	s.data.LastID++
+	id := s.data.LastID
+	s.data.Subscribes[id] = &redis.Subscribe{
+		ID:              id,
+		Owner:           owner,
+		Detail:          detail,
+		GerritUser:      gerritUser,
+		VisibleProjects: redis.VisibleTo(gerritUser, append([]string(nil), projects...)),
+		CreatedTime:     time.Now().Format(time.UnixDate),
+		State:           redis.StateActive,
+	}
+	return id, nil
+}
+
+func (s *memoryStore) Get(id int) (*redis.Subscribe, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.get(id)
+}
+
+func (s *memoryStore) get(id int) (*redis.Subscribe, error) {
+	stored, ok := s.data.Subscribes[id]
+	if !ok {
+		return nil, redis.ErrSubscribeNotFound
+	}
+	subscribe, err := copySubscribe(stored)
+	if err != nil {
+		return nil, err
+	}
+	subscribe.VisibleProjects = redis.VisibleTo(subscribe.GerritUser, subscribe.VisibleProjects)
+	subscribe.Stats = s.stats(id)
+	return subscribe, nil
+}
+
+func (s *memoryStore) List() ([]*redis.Subscribe, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	ids := make([]int, 0, len(s.data.Subscribes))
+	for id := range s.data.Subscribes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	subscribes := make([]*redis.Subscribe, 0, len(ids))
+	for _, id := range ids {
+		subscribe, err := s.get(id)
+		if err != nil {
+			return nil, err
+		}
+		subscribes = append(subscribes, subscribe)
+	}
+	return subscribes, nil
+}
+
+func (s *memoryStore) Update(id int, detail redis.SubscribeDetail) (*redis.Subscribe, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	stored, ok := s.data.Subscribes[id]
+	if !ok {
+		return nil, redis.ErrSubscribeNotFound
+	}
+	detail, err := copyDetail(detail)
+	if err != nil {
+		return nil, err
+	}
+	stored.Detail = detail
+	return s.get(id)
+}
+
+func (s *memoryStore) SetVisibleProjects(id int, gerritUser string, projects []string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	stored, ok := s.data.Subscribes[id]
+	if !ok {
+		return redis.ErrSubscribeNotFound
+	}
+	stored.GerritUser = gerritUser
+	stored.VisibleProjects = redis.VisibleTo(gerritUser, append([]string(nil), projects...))
+	return nil
+}
+
+func (s *memoryStore) SetState(id int, state string, pauseMode string, reason string) (*redis.Subscribe, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	stored, ok := s.data.Subscribes[id]
+	if !ok {
+		return nil, redis.ErrSubscribeNotFound
+	}
+	if state != redis.StatePaused {
+		pauseMode = ""
+	}
+	stored.State = state
+	stored.PauseMode = pauseMode
+	stored.StateReason = reason
+	stored.StateChangedTime = time.Now().Format(time.UnixDate)
+	return s.get(id)
+}
+
+func (s *memoryStore) Delete(id int) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	_, ok := s.data.Subscribes[id]
+	delete(s.data.Subscribes, id)
+	delete(s.data.Stats, id)
+	delete(s.data.Deliveries, id)
+	delete(s.data.Drops, id)
+	delete(s.data.Pending, id)
+	delete(s.data.Backlog, id)
+	delete(s.data.Spilled, id)
+	return ok, nil
+}
+
+func (s *memoryStore) AddStats(id int, delta redis.StatsDelta) error {
+	s.Lock()
+	defer s.Unlock()
+
+	stats, ok := s.data.Stats[id]
+	if !ok {
+		stats = &redis.SubscribeStats{}
+		s.data.Stats[id] = stats
+	}
+	addStats(stats, delta)
+	return nil
+}
+
+// addStats adds delta to stats, stamping the times of what it counts
+func addStats(stats *redis.SubscribeStats, delta redis.StatsDelta) {
+	stats.Seen += delta.Seen
+	stats.Matched += delta.Matched
+	stats.Delivered += delta.Delivered
+	stats.Failed += delta.Failed
+	stats.Retried += delta.Retried
+	stats.Dropped += delta.Dropped
+	stats.Skipped += delta.Skipped
+	stats.Debounced += delta.Debounced
+	now := time.Now().Format(time.UnixDate)
+	if delta.Matched > 0 {
+		stats.LastMatchTime = now
+	}
+	if delta.Delivered > 0 {
+		stats.LastSuccessTime = now
+		stats.ConsecutiveFailures, stats.FailingSince = 0, ""
+	}
+	if delta.Failed > 0 {
+		stats.LastFailureTime = now
+		stats.ConsecutiveFailures += delta.Failed
+		if stats.FailingSince == "" {
+			stats.FailingSince = now
+		}
+	}
+}
+
+func (s *memoryStore) GetStats(id int) (*redis.SubscribeStats, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	stats := s.stats(id)
+	return &stats, nil
+}
+
+func (s *memoryStore) stats(id int) redis.SubscribeStats {
+	if stats, ok := s.data.Stats[id]; ok {
+		return *stats
+	}
+	return redis.SubscribeStats{}
+}
+
+// LogDelivery keeps the log of subscribe id sorted newest first within the
+// bounds set by redis.InitDeliveryLog
+func (s *memoryStore) LogDelivery(id int, d *redis.Delivery) error {
+	s.Lock()
+	defer s.Unlock()
+
+	d.TrimBody()
+	logged := *d
+	deliveries := s.data.Deliveries[id]
+	i := sort.Search(len(deliveries), func(i int) bool {
+		return deliveries[i].Time.Before(logged.Time)
+	})
+	deliveries = append(deliveries, nil)
+	copy(deliveries[i+1:], deliveries[i:])
+	deliveries[i] = &logged
+	s.data.Deliveries[id] = trimDeliveries(deliveries)
+	return nil
+}
+
+func (s *memoryStore) GetDeliveries(id int, q redis.DeliveryQuery) ([]*redis.Delivery, int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	logged := trimDeliveries(s.data.Deliveries[id])
+	page, total := redis.FilterDeliveries(logged, q)
+	deliveries := make([]*redis.Delivery, 0, len(page))
+	for _, d := range page {
+		copied := *d
+		deliveries = append(deliveries, &copied)
+	}
+	return deliveries, total, nil
+}
+
+// Migrate has nothing to upgrade, a memory store starts empty
+func (s *memoryStore) Migrate(dryRun bool) (*redis.MigrationReport, error) {
+	return &redis.MigrationReport{From: schemaVersion, To: schemaVersion, DryRun: dryRun, Steps: make([]*redis.MigrationStep, 0)}, nil
+}
+
+// LogDrop keeps the drop log of subscribe id sorted newest first within the
+// bounds of the delivery log
+func (s *memoryStore) LogDrop(id int, d *redis.Drop) error {
+	s.Lock()
+	defer s.Unlock()
+
+	logged := *d
+	drops := s.data.Drops[id]
+	i := sort.Search(len(drops), func(i int) bool {
+		return drops[i].Time.Before(logged.Time)
+	})
+	drops = append(drops, nil)
+	copy(drops[i+1:], drops[i:])
+	drops[i] = &logged
+	s.data.Drops[id] = trimDrops(drops)
+	return nil
+}
+
+func (s *memoryStore) GetDrops(id int) ([]*redis.Drop, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	logged := trimDrops(s.data.Drops[id])
+	drops := make([]*redis.Drop, 0, len(logged))
+	for _, d := range logged {
+		copied := *d
+		drops = append(drops, &copied)
+	}
+	return drops, nil
+}
+
+func (s *memoryStore) RemoveDrops(id int, eventIDs []string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	removed := make(map[string]bool, len(eventIDs))
+	for _, eventID := range eventIDs {
+		removed[eventID] = true
+	}
+	kept := s.data.Drops[id][:0]
+	for _, d := range s.data.Drops[id] {
+		if !removed[d.EventID] {
+			kept = append(kept, d)
+		}
+	}
+	s.data.Drops[id] = kept
+	return nil
+}
+
+func (s *memoryStore) SavePending(id int, events ...*gerrit.Event) error {
+	return s.pushEvents(s.data.Pending, id, events)
+}
+
+func (s *memoryStore) TakePending(id int) ([]*gerrit.Event, error) {
+	return s.takeEvents(s.data.Pending, id)
+}
+
+func (s *memoryStore) SaveBacklog(id int, events ...*gerrit.Event) error {
+	return s.pushEvents(s.data.Backlog, id, events)
+}
+
+func (s *memoryStore) TakeBacklog(id int) ([]*gerrit.Event, error) {
+	return s.takeEvents(s.data.Backlog, id)
+}
+
+func (s *memoryStore) BacklogLength(id int) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.data.Backlog[id]), nil
+}
+
+func (s *memoryStore) SaveSpilled(id int, events ...*gerrit.Event) error {
+	return s.pushEvents(s.data.Spilled, id, events)
+}
+
+func (s *memoryStore) PopSpilled(id int) (*gerrit.Event, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	spilled := s.data.Spilled[id]
+	if len(spilled) == 0 {
+		return nil, nil
+	}
+	e := spilled[0]
+	if len(spilled) == 1 {
+		delete(s.data.Spilled, id)
+	} else {
+		s.data.Spilled[id] = spilled[1:]
+	}
+	return copyEvent(e)
+}
+
+func (s *memoryStore) SpilledLength(id int) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.data.Spilled[id]), nil
+}
+
+// pushEvents appends a copy of events to the queue of subscribe id in queues
+func (s *memoryStore) pushEvents(queues map[int][]*gerrit.Event, id int, events []*gerrit.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	for _, e := range events {
+		copied, err := copyEvent(e)
+		if err != nil {
+			return err
+		}
+		queues[id] = append(queues[id], copied)
+	}
+	return nil
+}
+
+// takeEvents removes and returns the queue of subscribe id in queues
+func (s *memoryStore) takeEvents(queues map[int][]*gerrit.Event, id int) ([]*gerrit.Event, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	queued := queues[id]
+	delete(queues, id)
+	events := make([]*gerrit.Event, 0, len(queued))
+	for _, e := range queued {
+		copied, err := copyEvent(e)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, copied)
+	}
+	return events, nil
+}
+
+// RecordEvent keeps the history sorted newest first within the bounds set by
+// redis.InitHistory
+func (s *memoryStore) RecordEvent(e *gerrit.Event) error {
+	copied, err := copyEvent(e)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	history := s.data.History
+	i := sort.Search(len(history), func(i int) bool {
+		return history[i].ReceivedAt.Before(copied.ReceivedAt)
+	})
+	history = append(history, nil)
+	copy(history[i+1:], history[i:])
+	history[i] = copied
+	cutoff := copied.ReceivedAt.Add(-redis.HistoryRetention())
+	for len(history) > 0 && history[len(history)-1].ReceivedAt.Before(cutoff) {
+		history = history[:len(history)-1]
+	}
+	if max := redis.HistoryMaxEvents(); len(history) > max {
+		history = history[:max]
+	}
+	s.data.History = history
+	return nil
+}
+
+func (s *memoryStore) GetEvent(id string) (*gerrit.Event, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	cutoff := time.Now().Add(-redis.HistoryRetention())
+	for _, e := range s.data.History {
+		if e.ID == id && !e.ReceivedAt.Before(cutoff) {
+			return copyEvent(e)
+		}
+	}
+	return nil, redis.ErrEventNotFound
+}
+
+func (s *memoryStore) GetEvents(since time.Time, limit int) ([]*gerrit.Event, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	events, _ := s.eventRange(since, time.Time{}, 0, limit)
+	return events, nil
+}
+
+func (s *memoryStore) GetEventsPage(since time.Time, until time.Time, offset int, count int) ([]*gerrit.Event, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	events, n := s.eventRange(since, until, offset, count)
+	return events, n > 0 && n == count, nil
+}
+
+// eventRange copies, newest first, the count events received between since
+// and until, a zero until having no bound, that follow the first offset
+// ones, along with how many it found. A count <= 0 copies them all
+func (s *memoryStore) eventRange(since time.Time, until time.Time, offset int, count int) ([]*gerrit.Event, int) {
+	if oldest := time.Now().Add(-redis.HistoryRetention()); since.Before(oldest) {
+		since = oldest
+	}
+	events := make([]*gerrit.Event, 0)
+	skipped := 0
+	for _, e := range s.data.History {
+		if e.ReceivedAt.Before(since) {
+			break
+		}
+		if !until.IsZero() && e.ReceivedAt.After(until) {
+			continue
+		}
+		if skipped < offset {
+			skipped++
+			continue
+		}
+		if copied, err := copyEvent(e); err == nil {
+			events = append(events, copied)
+		}
+		if count > 0 && len(events) == count {
+			break
+		}
+	}
+	return events, len(events)
+}
+
+func (s *memoryStore) SaveToken(raw string, token *redis.Token) error {
+	if token.Owner == "" {
+		return fmt.Errorf("token owner is required")
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	token.ID = redis.HashToken(raw)
+	token.CreatedTime = time.Now().Format(time.UnixDate)
+	stored := *token
+	s.data.Tokens[token.ID] = &stored
+	return nil
+}
+
+func (s *memoryStore) Authenticate(raw string) (*redis.Token, error) {
+	if raw == "" {
+		return nil, redis.ErrTokenNotFound
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	stored, ok := s.data.Tokens[redis.HashToken(raw)]
+	if !ok {
+		return nil, redis.ErrTokenNotFound
+	}
+	token := *stored
+	return &token, nil
+}
+
+func (s *memoryStore) GetTokens() ([]*redis.Token, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	ids := make([]string, 0, len(s.data.Tokens))
+	for id := range s.data.Tokens {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	tokens := make([]*redis.Token, 0, len(ids))
+	for _, id := range ids {
+		token := *s.data.Tokens[id]
+		tokens = append(tokens, &token)
+	}
+	return tokens, nil
+}
+
+func (s *memoryStore) DeleteToken(id string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	_, ok := s.data.Tokens[id]
+	if !ok {
+		return false, nil
+	}
+	delete(s.data.Tokens, id)
+	return true, nil
+}
+
+func (s *memoryStore) Ping() error {
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// trimDeliveries drops from a log sorted newest first the deliveries out of
+// the retention or beyond the maximum number of entries
+func trimDeliveries(deliveries []*redis.Delivery) []*redis.Delivery {
+	if max := redis.DeliveryLogMaxEntries(); len(deliveries) > max {
+		deliveries = deliveries[:max]
+	}
+	cutoff := time.Now().Add(-redis.DeliveryLogRetention())
+	for len(deliveries) > 0 && deliveries[len(deliveries)-1].Time.Before(cutoff) {
+		deliveries = deliveries[:len(deliveries)-1]
+	}
+	return deliveries
+}
+
+// trimDrops bounds a drop log sorted newest first as trimDeliveries bounds
+// the delivery log
+func trimDrops(drops []*redis.Drop) []*redis.Drop {
+	if max := redis.DeliveryLogMaxEntries(); len(drops) > max {
+		drops = drops[:max]
+	}
+	cutoff := time.Now().Add(-redis.DeliveryLogRetention())
+	for len(drops) > 0 && drops[len(drops)-1].Time.Before(cutoff) {
+		drops = drops[:len(drops)-1]
+	}
+	return drops
+}
+
+// copyEvent deep copies e the way it would go through redis, numbers are
+// decoded as json.Number and the trace is left behind
+func copyEvent(e *gerrit.Event) (*gerrit.Event, error) {
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return decodeEvent(raw)
+}
+
+// decodeEvent reads an event as redis returns it, numbers as json.Number
+func decodeEvent(raw []byte) (*gerrit.Event, error) {
+	var e gerrit.Event
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// copySubscribe deep copies sub the way it would go through redis, so the
+// filter holds the same types whatever the backend
+func copySubscribe(sub *redis.Subscribe) (*redis.Subscribe, error) {
+	raw, err := json.Marshal(sub)
+	if err != nil {
+		return nil, err
+	}
+	var copied redis.Subscribe
+	if err = json.Unmarshal(raw, &copied); err != nil {
+		return nil, err
+	}
+	return &copied, nil
+}
+
+func copyDetail(detail redis.SubscribeDetail) (redis.SubscribeDetail, error) {
+	var copied redis.SubscribeDetail
+	raw, err := json.Marshal(detail)
+	if err != nil {
+		return copied, err
+	}
+	err = json.Unmarshal(raw, &copied)
+	return copied, err
+}
@@ -0,0 +1,149 @@
+package store
+
+import (
+	"time"
+
+	"gerrit-observatory/gerrit"
+	"gerrit-observatory/redis"
+)
+
+// redisStore keeps the subscribes in the redis database set up by
+// redis.InitRedis
+type redisStore struct{}
+
+// NewRedisStore returns the store backed by redis
+func NewRedisStore() SubscriptionStore {
+	return redisStore{}
+}
+
+func (redisStore) Save(owner string, detail redis.SubscribeDetail, gerritUser string, projects []string) (int, error) {
+	return detail.SaveVisible(owner, gerritUser, projects)
+}
+
+func (redisStore) Get(id int) (*redis.Subscribe, error) {
+	return redis.GetSubscribe(id)
+}
+
+func (redisStore) List() ([]*redis.Subscribe, error) {
+	return redis.GetSubscribes()
+}
+
+func (redisStore) Update(id int, detail redis.SubscribeDetail) (*redis.Subscribe, error) {
+	return redis.UpdateSubscribe(id, detail)
+}
+
+func (redisStore) SetVisibleProjects(id int, gerritUser string, projects []string) error {
+	return redis.SetVisibleProjects(id, gerritUser, projects)
+}
+
+func (redisStore) SetState(id int, state string, pauseMode string, reason string) (*redis.Subscribe, error) {
+	return redis.SetState(id, state, pauseMode, reason)
+}
+
+func (redisStore) Delete(id int) (bool, error) {
+	return redis.DeleteSubscribe(id)
+}
+
+func (redisStore) AddStats(id int, delta redis.StatsDelta) error {
+	return redis.AddStats(id, delta)
+}
+
+func (redisStore) GetStats(id int) (*redis.SubscribeStats, error) {
+	return redis.GetStats(id)
+}
+
+func (redisStore) LogDelivery(id int, d *redis.Delivery) error {
+	return redis.LogDelivery(id, d)
+}
+
+func (redisStore) GetDeliveries(id int, q redis.DeliveryQuery) ([]*redis.Delivery, int, error) {
+	return redis.GetDeliveries(id, q)
+}
+
+func (redisStore) Migrate(dryRun bool) (*redis.MigrationReport, error) {
+	return redis.Migrate(dryRun)
+}
+
+func (redisStore) LogDrop(id int, d *redis.Drop) error {
+	return redis.LogDrop(id, d)
+}
+
+func (redisStore) GetDrops(id int) ([]*redis.Drop, error) {
+	return redis.GetDrops(id)
+}
+
+func (redisStore) RemoveDrops(id int, eventIDs []string) error {
+	return redis.RemoveDrops(id, eventIDs)
+}
+
+func (redisStore) SavePending(id int, events ...*gerrit.Event) error {
+	return redis.SavePending(id, events...)
+}
+
+func (redisStore) TakePending(id int) ([]*gerrit.Event, error) {
+	return redis.TakePending(id)
+}
+
+func (redisStore) SaveBacklog(id int, events ...*gerrit.Event) error {
+	return redis.SaveBacklog(id, events...)
+}
+
+func (redisStore) TakeBacklog(id int) ([]*gerrit.Event, error) {
+	return redis.TakeBacklog(id)
+}
+
+func (redisStore) BacklogLength(id int) (int, error) {
+	return redis.BacklogLength(id)
+}
+
+func (redisStore) SaveSpilled(id int, events ...*gerrit.Event) error {
+	return redis.SaveSpilled(id, events...)
+}
+
+func (redisStore) PopSpilled(id int) (*gerrit.Event, error) {
+	return redis.PopSpilled(id)
+}
+
+func (redisStore) SpilledLength(id int) (int, error) {
+	return redis.SpilledLength(id)
+}
+
+func (redisStore) RecordEvent(e *gerrit.Event) error {
+	return redis.RecordEvent(e)
+}
+
+func (redisStore) GetEvent(id string) (*gerrit.Event, error) {
+	return redis.GetEvent(id)
+}
+
+func (redisStore) GetEvents(since time.Time, limit int) ([]*gerrit.Event, error) {
+	return redis.GetEvents(since, limit)
+}
+
+func (redisStore) GetEventsPage(since time.Time, until time.Time, offset int, count int) ([]*gerrit.Event, bool, error) {
+	return redis.GetEventsPage(since, until, offset, count)
+}
+
+func (redisStore) SaveToken(raw string, token *redis.Token) error {
+	return redis.SaveToken(raw, token)
+}
+
+func (redisStore) Authenticate(raw string) (*redis.Token, error) {
+	return redis.Authenticate(raw)
+}
+
+func (redisStore) GetTokens() ([]*redis.Token, error) {
+	return redis.GetTokens()
+}
+
+func (redisStore) DeleteToken(id string) (bool, error) {
+	return redis.DeleteToken(id)
+}
+
+func (redisStore) Ping() error {
+	return redis.Ping()
+}
+
+func (redisStore) Close() error {
+	return nil
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"gerrit-observatory/gerrit"
+	"gerrit-observatory/redis"
+)
+
+// backends selectable with the storage.backend setting
+const (
+	BackendRedis  = "redis"
+	BackendFile   = "file"
+	BackendMemory = "memory"
+)
+
+// Subscriptions is the store used by the API and the observers, redis until
+// main opens the configured backend
+var Subscriptions SubscriptionStore = NewRedisStore()
+
+// SubscriptionStore keeps the subscribes along with their statistics and
+// delivery logs. Stores return redis.ErrSubscribeNotFound for unknown ids
+type SubscriptionStore interface {
+	// Save stores detail as a new subscribe of owner, bound to the projects
+	// gerritUser can read unless gerritUser is empty, and returns its id
+	Save(owner string, detail redis.SubscribeDetail, gerritUser string, projects []string) (int, error)
+	Get(id int) (*redis.Subscribe, error)
+	// List returns every subscribe ordered by id
+	List() ([]*redis.Subscribe, error)
+	// Update replaces the detail of subscribe id
+	Update(id int, detail redis.SubscribeDetail) (*redis.Subscribe, error)
+	// SetVisibleProjects bounds the events of subscribe id to projects, an
+	// empty gerritUser lifts the restriction
+	SetVisibleProjects(id int, gerritUser string, projects []string) error
+	// SetState moves subscribe id to one of the redis.State lifecycle
+	// states for reason, pauseMode only applies to the paused state
+	SetState(id int, state string, pauseMode string, reason string) (*redis.Subscribe, error)
+	// Delete removes subscribe id with its statistics and delivery log, it
+	// tells whether the subscribe existed
+	Delete(id int) (bool, error)
+
+	AddStats(id int, delta redis.StatsDelta) error
+	GetStats(id int) (*redis.SubscribeStats, error)
+
+	LogDelivery(id int, d *redis.Delivery) error
+	// GetDeliveries returns the page of deliveries matching q, newest first,
+	// and the number of matching deliveries
+	GetDeliveries(id int, q redis.DeliveryQuery) ([]*redis.Delivery, int, error)
+
+	// LogDrop records an event subscribe id lost, GetDrops returns its drop
+	// log newest first and RemoveDrops forgets the drops of eventIDs
+	LogDrop(id int, d *redis.Drop) error
+	GetDrops(id int) ([]*redis.Drop, error)
+	RemoveDrops(id int, eventIDs []string) error
+
+	// SavePending keeps the events of subscribe id left undelivered on
+	// shutdown, TakePending removes and returns them oldest first
+	SavePending(id int, events ...*gerrit.Event) error
+	TakePending(id int) ([]*gerrit.Event, error)
+	// SaveBacklog keeps the events subscribe id matched while paused or
+	// while its breaker was open, TakeBacklog removes and returns them
+	// oldest first
+	SaveBacklog(id int, events ...*gerrit.Event) error
+	TakeBacklog(id int) ([]*gerrit.Event, error)
+	BacklogLength(id int) (int, error)
+	// SaveSpilled keeps the events the full queue of subscribe id could not
+	// take, PopSpilled removes the oldest one and returns nil once none is
+	// left
+	SaveSpilled(id int, events ...*gerrit.Event) error
+	PopSpilled(id int) (*gerrit.Event, error)
+	SpilledLength(id int) (int, error)
+
+	// RecordEvent adds e to the event history, bounded as set by
+	// redis.InitHistory
+	RecordEvent(e *gerrit.Event) error
+	// GetEvent returns redis.ErrEventNotFound once the event left the history
+	GetEvent(id string) (*gerrit.Event, error)
+	// GetEvents returns up to limit events received since since, newest
+	// first, all of them when limit <= 0
+	GetEvents(since time.Time, limit int) ([]*gerrit.Event, error)
+	// GetEventsPage returns, newest first, the count events received
+	// between since and until following the first offset ones, and whether
+	// more follow them
+	GetEventsPage(since time.Time, until time.Time, offset int, count int) ([]*gerrit.Event, bool, error)
+
+	// SaveToken stores the hash of raw with the attributes of token, filling
+	// its ID and CreatedTime. Authenticate returns redis.ErrTokenNotFound
+	// for unknown tokens
+	SaveToken(raw string, token *redis.Token) error
+	Authenticate(raw string) (*redis.Token, error)
+	GetTokens() ([]*redis.Token, error)
+	DeleteToken(id string) (bool, error)
+
+	// Ping tells whether the store answers
+	Ping() error
+
+	// Migrate upgrades what older releases stored, or only reports what
+	// would change when dryRun is set
+	Migrate(dryRun bool) (*redis.MigrationReport, error)
+
+	// Close releases the connections or files the store holds
+	Close() error
+}
+
+// GenerateToken stores in s a random token with the attributes of token and
+// returns it in clear, it can not be recovered afterwards
+func GenerateToken(s SubscriptionStore, token *redis.Token) (string, error) {
+	raw, err := redis.NewRawToken()
+	if err != nil {
+		return "", err
+	}
+	return raw, s.SaveToken(raw, token)
+}
+
+// Open returns the store of backend, path is the file of the file backend.
+// Nothing is migrated until Migrate is called
+func Open(backend string, path string) (SubscriptionStore, error) {
+	switch backend {
+	case BackendRedis:
+		return NewRedisStore(), nil
+	case BackendFile:
+		return OpenFileStore(path)
+	case BackendMemory:
+		return NewMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", backend)
+}
@@ -0,0 +1,392 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+
+	"gerrit-observatory/gerrit"
+	"gerrit-observatory/redis"
+)
+
+var DetailRaw = `{
+  "filter": {
+	"type": "patchset-created",
+	"change": {
+	  "project": "loki"
+	}
+  },
+  "hook_url": "http://loki.wandoulabs.com/webhook?from_gerrit",
+  "comment": "用途说明"
+}`
+
+// StoreTestSuite runs the same checks against every backend, open returns
+// a new empty store
+type StoreTestSuite struct {
+	suite.Suite
+	open  func() SubscriptionStore
+	store SubscriptionStore
+}
+
+func (suite *StoreTestSuite) SetupTest() {
+	suite.store = suite.open()
+}
+
+func (suite *StoreTestSuite) TearDownTest() {
+	assert.Nil(suite.T(), suite.store.Close())
+}
+
+func (suite *StoreTestSuite) detail() redis.SubscribeDetail {
+	var detail redis.SubscribeDetail
+	assert.Nil(suite.T(), json.Unmarshal([]byte(DetailRaw), &detail))
+	return detail
+}
+
+func (suite *StoreTestSuite) TestSubscribes() {
+	first, err := suite.store.Save("loki", suite.detail(), "", nil)
+	assert.Nil(suite.T(), err)
+	second, err := suite.store.Save("crawler", suite.detail(), "zengyaopeng", nil)
+	assert.Nil(suite.T(), err)
+	assert.True(suite.T(), second > first)
+
+	subscribe, err := suite.store.Get(first)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "loki", subscribe.Owner)
+	assert.Equal(suite.T(), "patchset-created", subscribe.Detail.Filter["type"])
+	assert.Equal(suite.T(), redis.StateActive, subscribe.State)
+
+	detail := suite.detail()
+	detail.HookURL = "http://loki.wandoulabs.com/v2"
+	subscribe, err = suite.store.Update(first, detail)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "http://loki.wandoulabs.com/v2", subscribe.Detail.HookURL)
+	_, err = suite.store.Update(100, detail)
+	assert.Equal(suite.T(), redis.ErrSubscribeNotFound, err)
+
+	assert.Nil(suite.T(), suite.store.SetVisibleProjects(first, "zengyaopeng", []string{"loki"}))
+	subscribe, err = suite.store.SetState(second, redis.StatePaused, redis.PauseSkip, "paused by loki")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), redis.PauseSkip, subscribe.PauseMode)
+	assert.Equal(suite.T(), "paused by loki", subscribe.StateReason)
+	_, err = suite.store.SetState(second, redis.StateArchived, redis.PauseSkip, "")
+	assert.Nil(suite.T(), err)
+	_, err = suite.store.SetState(100, redis.StateActive, "", "")
+	assert.Equal(suite.T(), redis.ErrSubscribeNotFound, err)
+	subscribes, err := suite.store.List()
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), subscribes, 2)
+	assert.Equal(suite.T(), []string{"loki"}, subscribes[0].VisibleProjects)
+	assert.Equal(suite.T(), "zengyaopeng", subscribes[0].GerritUser)
+	assert.Equal(suite.T(), redis.StateArchived, subscribes[1].State)
+	// a gerrit user without projects sees none
+	assert.Equal(suite.T(), "zengyaopeng", subscribes[1].GerritUser)
+	assert.Equal(suite.T(), []string{}, subscribes[1].VisibleProjects)
+	assert.Empty(suite.T(), subscribes[1].PauseMode)
+
+	deleted, err := suite.store.Delete(first)
+	assert.Nil(suite.T(), err)
+	assert.True(suite.T(), deleted)
+	deleted, err = suite.store.Delete(first)
+	assert.Nil(suite.T(), err)
+	assert.False(suite.T(), deleted)
+	_, err = suite.store.Get(first)
+	assert.Equal(suite.T(), redis.ErrSubscribeNotFound, err)
+}
+
+func (suite *StoreTestSuite) TestStatsDeliveries() {
+	id, err := suite.store.Save("loki", suite.detail(), "", nil)
+	assert.Nil(suite.T(), err)
+	assert.Nil(suite.T(), suite.store.AddStats(id, redis.StatsDelta{Seen: 2, Matched: 1, Delivered: 1}))
+	assert.Nil(suite.T(), suite.store.AddStats(id, redis.StatsDelta{Seen: 1}))
+	stats, err := suite.store.GetStats(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(3), stats.Seen)
+	assert.Equal(suite.T(), int64(1), stats.Delivered)
+	assert.NotEmpty(suite.T(), stats.LastSuccessTime)
+	subscribe, err := suite.store.Get(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), *stats, subscribe.Stats)
+	assert.NotEmpty(suite.T(), stats.LastMatchTime)
+
+	// failures in a row are counted until the next delivery
+	assert.Nil(suite.T(), suite.store.AddStats(id, redis.StatsDelta{Seen: 1, Matched: 1, Failed: 1}))
+	assert.Nil(suite.T(), suite.store.AddStats(id, redis.StatsDelta{Seen: 1, Matched: 1, Failed: 1}))
+	stats, err = suite.store.GetStats(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(2), stats.ConsecutiveFailures)
+	assert.NotEmpty(suite.T(), stats.FailingSince)
+	assert.Nil(suite.T(), suite.store.AddStats(id, redis.StatsDelta{Seen: 1, Matched: 1, Delivered: 1}))
+	stats, err = suite.store.GetStats(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(0), stats.ConsecutiveFailures)
+	assert.Empty(suite.T(), stats.FailingSince)
+	assert.Equal(suite.T(), int64(2), stats.Failed)
+
+	now := time.Now()
+	assert.Nil(suite.T(), suite.store.LogDelivery(id, &redis.Delivery{EventID: "e1", Attempt: 1, Error: "timeout", Time: now.Add(-time.Minute)}))
+	assert.Nil(suite.T(), suite.store.LogDelivery(id, &redis.Delivery{EventID: "e2", Attempt: 1, StatusCode: 200, Time: now}))
+	deliveries, total, err := suite.store.GetDeliveries(id, redis.DeliveryQuery{})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 2, total)
+	assert.Equal(suite.T(), "e2", deliveries[0].EventID)
+	deliveries, total, err = suite.store.GetDeliveries(id, redis.DeliveryQuery{Outcome: "failure"})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 1, total)
+	assert.Equal(suite.T(), "e1", deliveries[0].EventID)
+}
+
+func (suite *StoreTestSuite) TestQueues() {
+	id, err := suite.store.Save("loki", suite.detail(), "", nil)
+	assert.Nil(suite.T(), err)
+	first := gerrit.NewEvent(map[string]interface{}{"type": "patchset-created", "seq": 1})
+	second := gerrit.NewEvent(map[string]interface{}{"type": "change-merged", "seq": 2})
+
+	assert.Nil(suite.T(), suite.store.SavePending(id, first, second))
+	pending, err := suite.store.TakePending(id)
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), pending, 2)
+	assert.Equal(suite.T(), first.ID, pending[0].ID)
+	// numbers come back as they would from redis
+	assert.Equal(suite.T(), json.Number("1"), pending[0].Data["seq"])
+	pending, err = suite.store.TakePending(id)
+	assert.Nil(suite.T(), err)
+	assert.Empty(suite.T(), pending)
+
+	assert.Nil(suite.T(), suite.store.SaveBacklog(id, first))
+	assert.Nil(suite.T(), suite.store.SaveBacklog(id, second))
+	n, err := suite.store.BacklogLength(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 2, n)
+	backlog, err := suite.store.TakeBacklog(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{first.ID, second.ID}, []string{backlog[0].ID, backlog[1].ID})
+	n, err = suite.store.BacklogLength(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 0, n)
+
+	assert.Nil(suite.T(), suite.store.SaveSpilled(id, first, second))
+	n, err = suite.store.SpilledLength(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 2, n)
+	spilled, err := suite.store.PopSpilled(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), first.ID, spilled.ID)
+
+	now := time.Now()
+	assert.Nil(suite.T(), suite.store.LogDrop(id, &redis.Drop{EventID: first.ID, Reason: "queue_full", Time: now.Add(-time.Minute)}))
+	assert.Nil(suite.T(), suite.store.LogDrop(id, &redis.Drop{EventID: second.ID, Reason: "queue_full", Time: now}))
+	drops, err := suite.store.GetDrops(id)
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), drops, 2)
+	assert.Equal(suite.T(), second.ID, drops[0].EventID)
+	assert.Nil(suite.T(), suite.store.RemoveDrops(id, []string{second.ID}))
+	drops, err = suite.store.GetDrops(id)
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), drops, 1)
+	assert.Equal(suite.T(), first.ID, drops[0].EventID)
+
+	// deleting the subscribe forgets what was kept for it
+	assert.Nil(suite.T(), suite.store.SaveBacklog(id, first))
+	_, err = suite.store.Delete(id)
+	assert.Nil(suite.T(), err)
+	n, err = suite.store.BacklogLength(id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 0, n)
+	spilled, err = suite.store.PopSpilled(id)
+	assert.Nil(suite.T(), err)
+	assert.Nil(suite.T(), spilled)
+	drops, err = suite.store.GetDrops(id)
+	assert.Nil(suite.T(), err)
+	assert.Empty(suite.T(), drops)
+}
+
+func (suite *StoreTestSuite) TestHistory() {
+	now := time.Now()
+	events := make([]*gerrit.Event, 0, 3)
+	for i := 0; i < 3; i++ {
+		e := gerrit.NewEvent(map[string]interface{}{"type": "patchset-created", "seq": i})
+		e.ReceivedAt = now.Add(time.Duration(i-3) * time.Second)
+		events = append(events, e)
+		assert.Nil(suite.T(), suite.store.RecordEvent(e))
+	}
+
+	e, err := suite.store.GetEvent(events[1].ID)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), json.Number("1"), e.Data["seq"])
+	_, err = suite.store.GetEvent("0123456789abcdef")
+	assert.Equal(suite.T(), redis.ErrEventNotFound, err)
+
+	recent, err := suite.store.GetEvents(time.Time{}, 2)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{events[2].ID, events[1].ID}, []string{recent[0].ID, recent[1].ID})
+	recent, err = suite.store.GetEvents(events[1].ReceivedAt, 0)
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), recent, 2)
+
+	page, more, err := suite.store.GetEventsPage(time.Time{}, now, 0, 2)
+	assert.Nil(suite.T(), err)
+	assert.True(suite.T(), more)
+	assert.Equal(suite.T(), events[2].ID, page[0].ID)
+	page, more, err = suite.store.GetEventsPage(time.Time{}, now, 2, 2)
+	assert.Nil(suite.T(), err)
+	assert.False(suite.T(), more)
+	assert.Len(suite.T(), page, 1)
+	assert.Equal(suite.T(), events[0].ID, page[0].ID)
+	// events received after until stay off the pages
+	page, _, err = suite.store.GetEventsPage(time.Time{}, events[1].ReceivedAt, 0, 2)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{events[1].ID, events[0].ID}, []string{page[0].ID, page[1].ID})
+
+	// the oldest events leave the history beyond its maximum
+	redis.InitHistory(time.Hour, 2)
+	defer redis.InitHistory(7*24*time.Hour, 100000)
+	latest := gerrit.NewEvent(map[string]interface{}{"type": "patchset-created", "seq": 3})
+	assert.Nil(suite.T(), suite.store.RecordEvent(latest))
+	recent, err = suite.store.GetEvents(time.Time{}, 0)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{latest.ID, events[2].ID}, []string{recent[0].ID, recent[1].ID})
+}
+
+func (suite *StoreTestSuite) TestTokens() {
+	assert.NotNil(suite.T(), suite.store.SaveToken("secret", &redis.Token{}))
+	token := &redis.Token{Owner: "loki", GerritUser: "zengyaopeng", Comment: "ci"}
+	assert.Nil(suite.T(), suite.store.SaveToken("secret", token))
+	assert.Equal(suite.T(), redis.HashToken("secret"), token.ID)
+	raw, err := GenerateToken(suite.store, &redis.Token{Owner: "ops", Admin: true})
+	assert.Nil(suite.T(), err)
+
+	found, err := suite.store.Authenticate("secret")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "zengyaopeng", found.GerritUser)
+	found, err = suite.store.Authenticate(raw)
+	assert.Nil(suite.T(), err)
+	assert.True(suite.T(), found.Admin)
+	_, err = suite.store.Authenticate("")
+	assert.Equal(suite.T(), redis.ErrTokenNotFound, err)
+	tokens, err := suite.store.GetTokens()
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), tokens, 2)
+
+	deleted, err := suite.store.DeleteToken(token.ID)
+	assert.Nil(suite.T(), err)
+	assert.True(suite.T(), deleted)
+	deleted, err = suite.store.DeleteToken(token.ID)
+	assert.Nil(suite.T(), err)
+	assert.False(suite.T(), deleted)
+	_, err = suite.store.Authenticate("secret")
+	assert.Equal(suite.T(), redis.ErrTokenNotFound, err)
+	assert.Nil(suite.T(), suite.store.Ping())
+}
+
+func TestMemoryStore(t *testing.T) {
+	suite.Run(t, &StoreTestSuite{open: NewMemoryStore})
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	n := 0
+	suite.Run(t, &StoreTestSuite{open: func() SubscriptionStore {
+		n++
+		s, err := OpenFileStore(filepath.Join(dir, fmt.Sprintf("observatory-%d.db", n)))
+		assert.Nil(t, err)
+		return s
+	}})
+}
+
+func TestFileStoreReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "observatory.db")
+
+	s, err := OpenFileStore(path)
+	assert.Nil(t, err)
+	var detail redis.SubscribeDetail
+	assert.Nil(t, json.Unmarshal([]byte(DetailRaw), &detail))
+	id, err := s.Save("loki", detail, "", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, s.AddStats(id, redis.StatsDelta{Seen: 5}))
+	assert.Nil(t, s.SaveToken("secret", &redis.Token{Owner: "loki"}))
+	assert.Nil(t, s.SaveBacklog(id, gerrit.NewEvent(map[string]interface{}{"type": "patchset-created"})))
+
+	// every change is on disk once made, a copy of the file taken before
+	// closing the store holds them as a crash would leave them
+	raw, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Nil(t, s.Close())
+	assert.Nil(t, ioutil.WriteFile(path, raw, 0600))
+
+	s, err = OpenFileStore(path)
+	assert.Nil(t, err)
+	defer s.Close()
+	subscribe, err := s.Get(id)
+	assert.Nil(t, err)
+	assert.Equal(t, "loki", subscribe.Owner)
+	assert.Equal(t, int64(5), subscribe.Stats.Seen)
+	next, err := s.Save("crawler", detail, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, id+1, next)
+	token, err := s.Authenticate("secret")
+	assert.Nil(t, err)
+	assert.Equal(t, "loki", token.Owner)
+	backlog, err := s.TakeBacklog(id)
+	assert.Nil(t, err)
+	assert.Len(t, backlog, 1)
+}
+
+func TestFileStoreMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "observatory.json")
+	// a snapshot written before subscribes had a state
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"schema_version": 1, "last_id": 2, "subscribes": {
+		"1": {"ID": 1, "Owner": "loki", "Detail": {"filter": {}, "hook_url": "http://loki"}, "Valid": true},
+		"2": {"ID": 2, "Owner": "loki", "Detail": {"filter": {}, "hook_url": "http://loki"}, "Valid": false}
+	}}`), 0644))
+
+	s, err := OpenFileStore(path)
+	assert.Nil(t, err)
+	defer s.Close()
+	_, err = os.Stat(path + ".snapshot")
+	assert.Nil(t, err)
+	report, err := s.Migrate(true)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.From)
+	report, err = s.Migrate(false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.From)
+	assert.Equal(t, []string{"subscribe 1: state active", "subscribe 2: state archived"}, report.Steps[0].Changes)
+	subscribe, err := s.Get(2)
+	assert.Nil(t, err)
+	assert.Equal(t, redis.StateArchived, subscribe.State)
+	report, err = s.Migrate(false)
+	assert.Nil(t, err)
+	assert.True(t, report.UpToDate())
+}
+
+func TestRedisStore(t *testing.T) {
+	redis.InitRedis("127.0.0.1", 6379, 4)
+	defer redis.DestroyRedis()
+
+	suite.Run(t, &StoreTestSuite{open: func() SubscriptionStore {
+		conn, err := redigo.Dial("tcp", "127.0.0.1:6379", redigo.DialDatabase(4))
+		assert.Nil(t, err)
+		conn.Do("FLUSHDB")
+		conn.Close()
+		s, err := Open(BackendRedis, "")
+		assert.Nil(t, err)
+		return s
+	}})
+}
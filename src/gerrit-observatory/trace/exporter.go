@@ -0,0 +1,232 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	exporterQueueSize = 2048
+	exporterBatchSize = 512
+	exporterInterval  = 5 * time.Second
+
+	exporterLock sync.Mutex
+	current      *exporter
+)
+
+// exporter ships ended spans in batches to an OTLP/HTTP collector using the
+// JSON encoding, spans are dropped when the collector can not keep up
+type exporter struct {
+	endpoint    string
+	serviceName string
+	client      http.Client
+	queue       chan *Span
+	done        chan struct{}
+	stopped     chan struct{}
+}
+
+// Init enables tracing, spans are exported to the OTLP/HTTP traces endpoint
+// of a collector such as http://127.0.0.1:4318/v1/traces. An empty endpoint
+// disables tracing
+func Init(endpoint string, serviceName string) {
+	Shutdown()
+	if endpoint == "" {
+		return
+	}
+	e := &exporter{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		client:      http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *Span, exporterQueueSize),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go e.run()
+
+	exporterLock.Lock()
+	current = e
+	exporterLock.Unlock()
+}
+
+// Shutdown flushes the pending spans and disables tracing
+func Shutdown() {
+	exporterLock.Lock()
+	e := current
+	current = nil
+	exporterLock.Unlock()
+
+	if e != nil {
+		close(e.done)
+		<-e.stopped
+	}
+}
+
+// Enabled tells whether spans are recorded
+func Enabled() bool {
+	exporterLock.Lock()
+	defer exporterLock.Unlock()
+	return current != nil
+}
+
+func export(s *Span) {
+	exporterLock.Lock()
+	e := current
+	exporterLock.Unlock()
+
+	if e == nil {
+		return
+	}
+	select {
+	case e.queue <- s:
+	default:
+	}
+}
+
+func (e *exporter) run() {
+	defer close(e.stopped)
+	ticker := time.NewTicker(exporterInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, exporterBatchSize)
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= exporterBatchSize {
+				e.send(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			e.send(batch)
+			batch = batch[:0]
+		case <-e.done:
+			for {
+				select {
+				case s := <-e.queue:
+					batch = append(batch, s)
+				default:
+					e.send(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *exporter) send(batch []*Span) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(encodeSpans(e.serviceName, batch))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("otlp collector replied %d", resp.StatusCode)
+	}
+	return nil
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+// encodeSpans builds an OTLP ExportTraceServiceRequest in its JSON mapping
+func encodeSpans(serviceName string, batch []*Span) map[string]interface{} {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.context.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.context.SpanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        encodeAttributes(s.attributes),
+			Status:            otlpStatus{Code: s.status, Message: s.message},
+		}
+		if s.parent.IsValid() {
+			span.ParentSpanID = hex.EncodeToString(s.parent.SpanID[:])
+		}
+		s.Unlock()
+		spans = append(spans, span)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": encodeAttributes(map[string]interface{}{"service.name": serviceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "gerrit-observatory"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func encodeAttributes(attributes map[string]interface{}) []otlpKeyValue {
+	keyValues := make([]otlpKeyValue, 0, len(attributes))
+	for key, value := range attributes {
+		var encoded map[string]interface{}
+		switch v := value.(type) {
+		case string:
+			encoded = map[string]interface{}{"stringValue": v}
+		case bool:
+			encoded = map[string]interface{}{"boolValue": v}
+		case int:
+			encoded = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			encoded = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			encoded = map[string]interface{}{"doubleValue": v}
+		default:
+			encoded = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		keyValues = append(keyValues, otlpKeyValue{Key: key, Value: encoded})
+	}
+	sortKeyValues(keyValues)
+	return keyValues
+}
+
+func sortKeyValues(keyValues []otlpKeyValue) {
+	for i := 1; i < len(keyValues); i++ {
+		for j := i; j > 0 && keyValues[j].Key < keyValues[j-1].Key; j-- {
+			keyValues[j], keyValues[j-1] = keyValues[j-1], keyValues[j]
+		}
+	}
+}
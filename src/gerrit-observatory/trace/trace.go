@@ -0,0 +1,143 @@
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SpanKind follows the OTLP span kinds
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+	KindProducer SpanKind = 4
+	KindConsumer SpanKind = 5
+)
+
+const (
+	statusOK    = 1
+	statusError = 2
+)
+
+// SpanContext identifies a span across process boundaries
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// IsValid tells whether sc refers to a span
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceParent formats sc as a W3C traceparent header value
+func (sc SpanContext) TraceParent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]))
+}
+
+// Span is a timed operation of a trace, a nil Span is a no-op so callers do
+// not have to care whether tracing is enabled
+type Span struct {
+	sync.Mutex
+	context    SpanContext
+	parent     SpanContext
+	name       string
+	kind       SpanKind
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	status     int
+	message    string
+}
+
+// StartSpan starts a span as a child of parent, a root span is started when
+// parent is not valid. It returns nil when tracing is disabled
+func StartSpan(parent SpanContext, name string, kind SpanKind) *Span {
+	return StartSpanAt(parent, name, kind, time.Now())
+}
+
+// StartSpanAt is StartSpan for an operation that began at start
+func StartSpanAt(parent SpanContext, name string, kind SpanKind, start time.Time) *Span {
+	if !Enabled() {
+		return nil
+	}
+	span := &Span{
+		parent:     parent,
+		name:       name,
+		kind:       kind,
+		start:      start,
+		attributes: make(map[string]interface{}),
+	}
+	if parent.IsValid() {
+		span.context.TraceID = parent.TraceID
+	} else {
+		rand.Read(span.context.TraceID[:])
+	}
+	rand.Read(span.context.SpanID[:])
+	return span
+}
+
+// Context returns the SpanContext of s, or an invalid one for a nil span
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// SetAttribute records a string, bool, int, int64 or float64 attribute
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.attributes[key] = value
+}
+
+// SetError marks s as failed
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.status = statusError
+	s.message = message
+}
+
+// SetOK marks s as succeeded
+func (s *Span) SetOK() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.status = statusOK
+}
+
+// Inject sets the traceparent header of the outgoing request so the receiver
+// can continue the trace of s
+func (s *Span) Inject(header http.Header) {
+	if s == nil {
+		return
+	}
+	header.Set("traceparent", s.context.TraceParent())
+}
+
+// End finishes s and hands it to the exporter
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	s.end = time.Now()
+	s.Unlock()
+	export(s)
+}
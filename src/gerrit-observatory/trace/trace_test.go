@@ -0,0 +1,76 @@
+package trace
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDisabled(t *testing.T) {
+	span := StartSpan(SpanContext{}, "noop", KindInternal)
+	assert.Nil(t, span)
+	assert.False(t, span.Context().IsValid())
+
+	header := http.Header{}
+	span.Inject(header)
+	span.SetAttribute("key", "value")
+	span.End()
+	assert.Equal(t, "", header.Get("traceparent"))
+}
+
+func TestExport(t *testing.T) {
+	var requests []map[string]interface{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+		requests = append(requests, body)
+	}))
+	defer collector.Close()
+
+	Init(collector.URL+"/v1/traces", "observatory-test")
+	root := StartSpan(SpanContext{}, "gerrit.decode", KindConsumer)
+	root.SetAttribute("event.id", "abc")
+	child := StartSpan(root.Context(), "hook.post", KindClient)
+	child.SetAttribute("attempt", 2)
+	child.SetError("unexpected status code 500")
+
+	rootContext, childContext := root.Context(), child.Context()
+	header := http.Header{}
+	child.Inject(header)
+	parts := strings.Split(header.Get("traceparent"), "-")
+	assert.Equal(t, 4, len(parts))
+	assert.Equal(t, "00", parts[0])
+	assert.Equal(t, hex.EncodeToString(rootContext.TraceID[:]), parts[1])
+	assert.Equal(t, hex.EncodeToString(childContext.SpanID[:]), parts[2])
+	assert.Equal(t, "01", parts[3])
+
+	child.End()
+	root.End()
+	Shutdown()
+	assert.False(t, Enabled())
+
+	assert.Equal(t, 1, len(requests))
+	resourceSpans := requests[0]["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	resource := resourceSpans["resource"].(map[string]interface{})
+	assert.Equal(t, "service.name", resource["attributes"].([]interface{})[0].(map[string]interface{})["key"])
+	spans := resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	assert.Equal(t, 2, len(spans))
+
+	exported := spans[0].(map[string]interface{})
+	assert.Equal(t, "hook.post", exported["name"])
+	assert.Equal(t, float64(KindClient), exported["kind"])
+	assert.Equal(t, hex.EncodeToString(rootContext.SpanID[:]), exported["parentSpanId"])
+	assert.Equal(t, map[string]interface{}{"code": float64(2), "message": "unexpected status code 500"}, exported["status"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"key": "attempt", "value": map[string]interface{}{"intValue": "2"}},
+	}, exported["attributes"])
+
+	exported = spans[1].(map[string]interface{})
+	assert.Equal(t, "gerrit.decode", exported["name"])
+	_, hasParent := exported["parentSpanId"]
+	assert.False(t, hasParent)
+}